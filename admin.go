@@ -0,0 +1,625 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/database"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/models"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/scheduler"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/webhooks"
+)
+
+// AdminSaleSummaryHandler serves GET /admin/sales/{saleID}/summary with a
+// sale's sold count and revenue. Revenue is in cents. With spike detection
+// on, the sale's current purchase rate is included too.
+func AdminSaleSummaryHandler(db *database.DB, redisClient *redis.Client, spikes *PurchaseSpikes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		saleID, ok := saleIDFromPath(r.URL.Path, "/admin/sales/", "summary")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		sale, err := db.GetSaleByID(saleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load sale", "sale_id", saleID, "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading sale summary")
+			return
+		}
+
+		if sale == nil {
+			WriteJSONError(w, http.StatusNotFound, ErrCodeNotFound, "Sale not found")
+			return
+		}
+
+		revenue, err := db.GetSaleRevenue(saleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load revenue", "sale_id", saleID, "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading sale summary")
+			return
+		}
+
+		// Prefer the live count; the items_sold column only catches up on
+		// reconciliation, and Redis keys expire after the sale
+		itemsSold := sale.ItemsSold
+		if sold, err := redisClient.GetItemsSold(r.Context(), saleID); err == nil {
+			itemsSold = sold
+		}
+
+		summary := map[string]interface{}{
+			"sale_id":       sale.SaleID,
+			"status":        sale.Status,
+			"start_time":    sale.StartTime.Unix(),
+			"end_time":      sale.EndTime.Unix(),
+			"total_items":   sale.TotalItems,
+			"items_sold":    itemsSold,
+			"revenue_cents": revenue,
+		}
+
+		// Like the live sold count, the rate is left out rather than failing
+		// the summary when Redis can't be read
+		if spikes != nil {
+			if rate, spiking, err := spikes.Rate(saleID); err == nil {
+				summary["purchase_rate"] = rate
+				summary["purchase_spike"] = spiking
+			} else {
+				Logger(r.Context()).Error("Failed to load purchase rate", "sale_id", saleID, "error", err)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"sale":    summary,
+		})
+	}
+}
+
+// AdminCreateSaleHandler serves POST /admin/sales, creating a sale on demand
+// instead of waiting for the next window. The optional JSON body
+// {"start_time", "end_time", "items", "checkout_ttl_seconds"} overrides the
+// start (Unix seconds, default now), end (default one sale duration later),
+// item count and checkout TTL. A sale starting beyond the lead time is
+// stored with its items still to be generated. A sale overlapping one that
+// is scheduled or running is refused with 409.
+func AdminCreateSaleHandler(saleScheduler *scheduler.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		var req struct {
+			StartTime   int64 `json:"start_time"`
+			EndTime     int64 `json:"end_time"`
+			Items       int   `json:"items"`
+			CheckoutTTL int   `json:"checkout_ttl_seconds"`
+		}
+		if r.ContentLength != 0 && !decodeJSONBody(w, r, &req) {
+			return
+		}
+
+		opts := scheduler.SaleOptions{
+			ItemsPerSale: req.Items,
+			CheckoutTTL:  time.Duration(req.CheckoutTTL) * time.Second,
+		}
+		if req.StartTime != 0 {
+			opts.StartTime = time.Unix(req.StartTime, 0)
+		}
+		if req.EndTime != 0 {
+			opts.EndTime = time.Unix(req.EndTime, 0)
+		}
+
+		sale, err := saleScheduler.CreateSale(opts)
+		switch {
+		case errors.Is(err, scheduler.ErrInvalidSaleOptions):
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+			return
+		case errors.Is(err, scheduler.ErrSaleOverlaps):
+			WriteJSONError(w, http.StatusConflict, ErrCodeSaleConflict, "Sale would overlap a scheduled or running sale")
+			return
+		case errors.Is(err, scheduler.ErrSaleCreationBusy):
+			WriteJSONError(w, http.StatusConflict, ErrCodeSaleConflict, "Another sale is being created for this window, retry shortly")
+			return
+		case err != nil:
+			Logger(r.Context()).Error("Failed to create sale", "error", err)
+			writeDependencyError(w, err, "Error creating sale")
+			return
+		}
+
+		Logger(r.Context()).Info("Sale created by admin", "sale_id", sale.SaleID, "status", sale.Status)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"sale": map[string]interface{}{
+				"sale_id":              sale.SaleID,
+				"status":               sale.Status,
+				"start_time":           sale.StartTime.Unix(),
+				"end_time":             sale.EndTime.Unix(),
+				"total_items":          sale.TotalItems,
+				"checkout_ttl_seconds": int(sale.CheckoutTTL / time.Second),
+				"items_generated":      sale.PendingItems == 0,
+			},
+		})
+	}
+}
+
+// maxCancelledByLength bounds the audit name stored with a cancellation
+const maxCancelledByLength = 128
+
+// AdminCancelSaleHandler serves POST /admin/sales/{saleID}/cancel, voiding a
+// sale that hasn't completed. The JSON body {"cancelled_by", "flush_inventory"}
+// names who cancelled it, recorded for audit, and optionally deletes its
+// inventory from Redis. Purchases that already took their stock complete;
+// every later one is rejected with 410.
+func AdminCancelSaleHandler(db *database.DB, redisClient *redis.Client, events *webhooks.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		saleID, ok := saleIDFromPath(r.URL.Path, "/admin/sales/", "cancel")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		var req struct {
+			CancelledBy    string `json:"cancelled_by"`
+			FlushInventory bool   `json:"flush_inventory"`
+		}
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+
+		if req.CancelledBy == "" || len(req.CancelledBy) > maxCancelledByLength {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeMissingParameter,
+				fmt.Sprintf("cancelled_by is required and at most %d characters", maxCancelledByLength))
+			return
+		}
+
+		sale, err := db.GetSaleByID(saleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load sale", "sale_id", saleID, "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error cancelling sale")
+			return
+		}
+
+		if sale == nil {
+			WriteJSONError(w, http.StatusNotFound, ErrCodeNotFound, "Sale not found")
+			return
+		}
+
+		if sale.Status == models.SaleStatusCompleted || sale.Status == models.SaleStatusCancelled {
+			WriteJSONError(w, http.StatusConflict, ErrCodeSaleConflict, "Sale has already "+sale.Status)
+			return
+		}
+
+		// Redis goes first: once the flag is set no purchase can take stock,
+		// so nothing slips in between the two writes
+		if err := redisClient.MarkSaleCancelled(saleID, sale.EndTime); err != nil {
+			Logger(r.Context()).Error("Failed to mark sale cancelled", "sale_id", saleID, "error", err)
+			writeDependencyError(w, err, "Error cancelling sale")
+			return
+		}
+
+		cancelled, err := db.CancelSale(saleID, req.CancelledBy)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to cancel sale", "sale_id", saleID, "error", err)
+			writeDependencyError(w, err, "Error cancelling sale")
+			return
+		}
+
+		if !cancelled {
+			WriteJSONError(w, http.StatusConflict, ErrCodeSaleConflict, "Sale completed or was cancelled concurrently")
+			return
+		}
+
+		Logger(r.Context()).Info("Sale cancelled by admin", "sale_id", saleID, "cancelled_by", req.CancelledBy)
+		events.Emit(webhooks.EventSaleCancelled, map[string]interface{}{
+			"sale_id":      saleID,
+			"cancelled_by": req.CancelledBy,
+		})
+
+		flushed := false
+		if req.FlushInventory {
+			itemIDs, err := db.GetItemIDs(saleID)
+			if err == nil {
+				err = redisClient.FlushSaleInventory(saleID, itemIDs)
+			}
+			if err != nil {
+				// The sale is already cancelled; its keys expire on their own
+				Logger(r.Context()).Error("Failed to flush sale inventory", "sale_id", saleID, "error", err)
+			} else {
+				flushed = true
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":           true,
+			"sale_id":           saleID,
+			"status":            models.SaleStatusCancelled,
+			"cancelled_by":      req.CancelledBy,
+			"cancelled_at":      time.Now().Unix(),
+			"inventory_flushed": flushed,
+		})
+	}
+}
+
+// WarmInventoryHandler serves POST /admin/sales/{saleID}/warm, rebuilding a
+// sale's inventory in Redis from the database after Redis lost it. Stock of
+// purchased items is not brought back and keys Redis still has are kept, so
+// it is safe to run against a live sale.
+func WarmInventoryHandler(db *database.DB, redisClient *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		saleID, ok := saleIDFromPath(r.URL.Path, "/admin/sales/", "warm")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		sale, err := db.GetSaleByID(saleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load sale", "sale_id", saleID, "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error warming inventory")
+			return
+		}
+
+		if sale == nil {
+			WriteJSONError(w, http.StatusNotFound, ErrCodeNotFound, "Sale not found")
+			return
+		}
+
+		running := sale.Status == models.SaleStatusScheduled || sale.Status == models.SaleStatusActive ||
+			sale.Status == models.SaleStatusSoldOut
+		if !running || !time.Now().Before(sale.EndTime) {
+			WriteJSONError(w, http.StatusConflict, ErrCodeSaleConflict, "Only a scheduled or running sale can be warmed")
+			return
+		}
+
+		state := redis.SaleState{}
+		state.ItemIDs, err = db.GetItemIDs(saleID)
+		if err == nil {
+			state.PurchasedByItem, err = db.CountPurchasesByItem(state.ItemIDs)
+		}
+		if err == nil {
+			state.PurchasesByUser, err = db.CountPurchasesByUser(saleID)
+		}
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load sale purchases", "sale_id", saleID, "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error warming inventory")
+			return
+		}
+
+		// items_sold only catches up on reconciliation; the purchase rows
+		// never lag
+		soldCount := sale.ItemsSold
+		purchased := 0
+		for _, count := range state.PurchasedByItem {
+			purchased += count
+		}
+		if purchased > soldCount {
+			soldCount = purchased
+		}
+
+		restored, err := redisClient.RehydrateSale(sale, soldCount, state)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to rehydrate sale", "sale_id", saleID, "error", err)
+			writeDependencyError(w, err, "Error warming inventory")
+			return
+		}
+
+		Logger(r.Context()).Info("Sale inventory warmed", "sale_id", saleID, "items_restored", restored, "items_sold", soldCount)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":        true,
+			"sale_id":        saleID,
+			"items_restored": restored,
+			"items_sold":     soldCount,
+		})
+	}
+}
+
+// ReleaseReservationsHandler serves POST
+// /admin/sales/{saleID}/release-reservations, releasing every open checkout
+// in a sale at once rather than waiting for them to expire, e.g. to clean up
+// after an incident. Released codes can no longer be purchased. It is safe to
+// run at any time and more than once.
+func ReleaseReservationsHandler(db *database.DB, redisClient *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		saleID, ok := saleIDFromPath(r.URL.Path, "/admin/sales/", "release-reservations")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		sale, err := db.GetSaleByID(saleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load sale", "sale_id", saleID, "error", err)
+			writeDependencyError(w, err, "Error releasing reservations")
+			return
+		}
+
+		if sale == nil {
+			WriteJSONError(w, http.StatusNotFound, ErrCodeNotFound, "Sale not found")
+			return
+		}
+
+		released, err := redisClient.ReleaseAllReservations(saleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to release reservations", "sale_id", saleID, "released", released, "error", err)
+			writeDependencyError(w, err, "Error releasing reservations")
+			return
+		}
+
+		Logger(r.Context()).Info("Sale reservations released by admin", "sale_id", saleID, "released", released)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"sale_id":  saleID,
+			"released": released,
+		})
+	}
+}
+
+// maxAdjustedByLength bounds the audit name stored with a stock adjustment
+const maxAdjustedByLength = 128
+
+// AdminAdjustStockHandler serves POST /admin/items/{itemID}/stock, restocking
+// or pulling an item during a sale. The JSON body {"delta"} or {"stock"}
+// changes the item's stock by delta or sets it outright, and "adjusted_by"
+// names who did it for the audit trail. The sale's remaining inventory and
+// total_items move with it, a sold out sale that gets stock back is reopened,
+// and stock never goes below zero. Sales that have completed, been cancelled
+// or ended can't be adjusted.
+func AdminAdjustStockHandler(db *database.DB, redisClient *redis.Client, events *webhooks.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, ok := saleIDFromPath(r.URL.Path, "/admin/items/", "stock")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		var req struct {
+			Delta      *int   `json:"delta"`
+			Stock      *int   `json:"stock"`
+			AdjustedBy string `json:"adjusted_by"`
+		}
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+
+		if req.AdjustedBy == "" || len(req.AdjustedBy) > maxAdjustedByLength {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeMissingParameter,
+				fmt.Sprintf("adjusted_by is required and at most %d characters", maxAdjustedByLength))
+			return
+		}
+
+		if (req.Delta == nil) == (req.Stock == nil) {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Exactly one of delta and stock is required")
+			return
+		}
+		if req.Delta != nil && *req.Delta == 0 {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "delta must not be zero")
+			return
+		}
+		if req.Stock != nil && *req.Stock < 0 {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "stock must not be negative")
+			return
+		}
+
+		item, err := db.GetItemContext(r.Context(), itemID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load item", "item_id", itemID, "error", err)
+			writeDependencyError(w, err, "Error adjusting stock")
+			return
+		}
+
+		if item == nil {
+			WriteJSONError(w, http.StatusNotFound, ErrCodeNotFound, "Item not found")
+			return
+		}
+
+		sale, err := db.GetSaleByID(item.SaleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load sale", "sale_id", item.SaleID, "error", err)
+			writeDependencyError(w, err, "Error adjusting stock")
+			return
+		}
+
+		if sale == nil {
+			WriteJSONError(w, http.StatusNotFound, ErrCodeNotFound, "Sale not found")
+			return
+		}
+
+		running := sale.Status == models.SaleStatusScheduled || sale.Status == models.SaleStatusActive ||
+			sale.Status == models.SaleStatusSoldOut
+		if !running || !time.Now().Before(sale.EndTime) {
+			WriteJSONError(w, http.StatusConflict, ErrCodeSaleConflict, "Stock can only be adjusted in a scheduled or running sale")
+			return
+		}
+
+		var before, after int
+		if req.Delta != nil {
+			after, err = redisClient.AdjustItemStock(sale.SaleID, itemID, *req.Delta)
+			before = after - *req.Delta
+		} else {
+			before, err = redisClient.SetItemStock(sale.SaleID, itemID, *req.Stock)
+			after = *req.Stock
+		}
+		if errors.Is(err, redis.ErrNegativeStock) {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Stock cannot go below zero")
+			return
+		}
+		if errors.Is(err, redis.ErrSaleNotInitialized) {
+			WriteJSONError(w, http.StatusConflict, ErrCodeSaleConflict, "Item has no stock in Redis; warm the sale first")
+			return
+		}
+		if err != nil {
+			Logger(r.Context()).Error("Failed to adjust stock", "item_id", itemID, "error", err)
+			writeDependencyError(w, err, "Error adjusting stock")
+			return
+		}
+
+		Logger(r.Context()).Info("Item stock adjusted by admin", "sale_id", sale.SaleID, "item_id", itemID,
+			"stock_before", before, "stock_after", after, "adjusted_by", req.AdjustedBy)
+		// Streams and long-polls waiting on the sale see the new stock now
+		if err := redisClient.PublishInventoryUpdate(r.Context(), sale.SaleID); err != nil {
+			Logger(r.Context()).Error("Failed to publish inventory update", "sale_id", sale.SaleID, "error", err)
+		}
+		recordAudit(r.Context(), db, []*models.AuditEntry{{
+			Action:      models.AuditActionStockAdjustment,
+			SaleID:      sale.SaleID,
+			UserID:      req.AdjustedBy,
+			ItemID:      itemID,
+			StockBefore: before,
+			StockAfter:  after,
+			CreatedAt:   time.Now().UTC(),
+		}})
+
+		// Redis already holds the new stock and is what purchases go by; a
+		// stale total only skews sold out detection until it is fixed
+		delta := after - before
+		if err := db.AdjustSaleTotalItems(sale.SaleID, delta); err != nil {
+			Logger(r.Context()).Error("Failed to adjust sale total items", "sale_id", sale.SaleID, "delta", delta, "error", err)
+		}
+		sale.TotalItems += delta
+
+		if delta > 0 && sale.Status == models.SaleStatusSoldOut {
+			reopened, err := db.UpdateSaleStatus(sale.SaleID, models.SaleStatusSoldOut, models.SaleStatusActive)
+			if err != nil {
+				Logger(r.Context()).Error("Failed to reopen sold out sale", "sale_id", sale.SaleID, "error", err)
+			} else if reopened {
+				Logger(r.Context()).Info("Sold out sale reopened by restock", "sale_id", sale.SaleID)
+			}
+		} else if delta < 0 {
+			markSoldOutIfExhausted(r.Context(), db, redisClient, events, sale)
+		}
+
+		if err := redisClient.PublishInventoryUpdate(r.Context(), sale.SaleID); err != nil {
+			Logger(r.Context()).Error("Failed to publish inventory update", "error", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":      true,
+			"sale_id":      sale.SaleID,
+			"item_id":      itemID,
+			"stock_before": before,
+			"stock":        after,
+			"adjusted_by":  req.AdjustedBy,
+		})
+	}
+}
+
+// maxMaintenanceMessageLength bounds the message shown to buyers during
+// maintenance
+const maxMaintenanceMessageLength = 256
+
+// AdminMaintenanceHandler serves /admin/maintenance. GET reports the
+// maintenance switch; POST with {"enabled", "message"} flips it for every
+// instance. While it is on checkout and purchase answer 503 with message.
+func AdminMaintenanceHandler(redisClient *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req struct {
+				Enabled bool   `json:"enabled"`
+				Message string `json:"message"`
+			}
+			if !decodeJSONBody(w, r, &req) {
+				return
+			}
+
+			if len(req.Message) > maxMaintenanceMessageLength {
+				WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter,
+					fmt.Sprintf("message must be at most %d characters", maxMaintenanceMessageLength))
+				return
+			}
+
+			if err := redisClient.SetMaintenance(req.Enabled, req.Message); err != nil {
+				Logger(r.Context()).Error("Failed to set maintenance mode", "error", err)
+				writeDependencyError(w, err, "Error setting maintenance mode")
+				return
+			}
+			Logger(r.Context()).Info("Maintenance mode changed", "enabled", req.Enabled, "message", req.Message)
+		default:
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		state, err := redisClient.GetMaintenance()
+		if err != nil {
+			Logger(r.Context()).Error("Failed to get maintenance mode", "error", err)
+			writeDependencyError(w, err, "Error loading maintenance mode")
+			return
+		}
+
+		response := map[string]interface{}{
+			"success": true,
+			"enabled": state.Enabled,
+			"message": state.Message,
+		}
+		if state.Enabled {
+			response["since"] = state.Since.Unix()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// AdminSaleResourceHandler routes the admin sub-resources of
+// /admin/sales/{saleID}
+func AdminSaleResourceHandler(db *database.DB, redisClient *redis.Client, events *webhooks.Dispatcher, spikes *PurchaseSpikes) http.HandlerFunc {
+	summary := AdminSaleSummaryHandler(db, redisClient, spikes)
+	cancel := AdminCancelSaleHandler(db, redisClient, events)
+	warm := WarmInventoryHandler(db, redisClient)
+	release := ReleaseReservationsHandler(db, redisClient)
+	export := ExportPurchasesHandler(db)
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		switch {
+		case strings.HasSuffix(path, "/cancel"):
+			cancel(w, r)
+		case strings.HasSuffix(path, "/warm"):
+			warm(w, r)
+		case strings.HasSuffix(path, "/release-reservations"):
+			release(w, r)
+		case strings.HasSuffix(path, "/purchases.csv"):
+			export(w, r)
+		default:
+			summary(w, r)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/handlers"
+)
+
+// AdminMiddleware requires the X-Admin-Key header to match apiKey. It is
+// separate from user authentication so a buyer's token never grants admin
+// access.
+func AdminMiddleware(apiKey string) func(http.Handler) http.Handler {
+	key := []byte(apiKey)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			provided := r.Header.Get("X-Admin-Key")
+			if provided == "" {
+				handlers.WriteJSONError(w, http.StatusUnauthorized, handlers.ErrCodeUnauthorized, "Missing admin key")
+				return
+			}
+
+			if subtle.ConstantTimeCompare([]byte(provided), key) != 1 {
+				handlers.WriteJSONError(w, http.StatusForbidden, handlers.ErrCodeForbidden, "Invalid admin key")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/config"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/models"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/scheduler"
+)
+
+// createTestSale posts a sale to the admin endpoint and returns the response
+func createTestSale(t *testing.T, handler http.HandlerFunc, start, end time.Time) *httptest.ResponseRecorder {
+	t.Helper()
+	body := fmt.Sprintf(`{"start_time": %d, "end_time": %d, "items": 10}`, start.Unix(), end.Unix())
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/admin/sales", strings.NewReader(body)))
+	return rec
+}
+
+func TestAdminCreateSale(t *testing.T) {
+	// A dry run keeps the sale windows it was asked for, so overlaps are
+	// found without a database
+	saleScheduler, err := scheduler.NewScheduler(nil, nil, config.Scheduler{LeadTime: 10 * time.Minute})
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+	saleScheduler.DryRun = true
+	handler := AdminCreateSaleHandler(saleScheduler)
+
+	now := time.Now().Truncate(time.Second)
+	tests := []struct {
+		name       string
+		start, end time.Time
+		wantStatus int
+		wantSale   string
+	}{
+		{"starting now runs at once", now, now.Add(time.Hour), http.StatusCreated, models.SaleStatusActive},
+		{"overlapping the running sale", now.Add(30 * time.Minute), now.Add(90 * time.Minute), http.StatusConflict, ""},
+		{"starting later waits for its start", now.Add(time.Hour + 5*time.Minute), now.Add(2 * time.Hour), http.StatusCreated, models.SaleStatusScheduled},
+		{"overlapping the scheduled sale", now.Add(90 * time.Minute), now.Add(3 * time.Hour), http.StatusConflict, ""},
+		{"right after the scheduled sale", now.Add(2 * time.Hour), now.Add(3 * time.Hour), http.StatusCreated, models.SaleStatusScheduled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := createTestSale(t, handler, tt.start, tt.end)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusConflict {
+				if code := errorCode(t, rec); code != ErrCodeSaleConflict {
+					t.Errorf("error code = %q, want %q", code, ErrCodeSaleConflict)
+				}
+				return
+			}
+
+			var body struct {
+				Sale struct {
+					Status    string `json:"status"`
+					StartTime int64  `json:"start_time"`
+				} `json:"sale"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("decode body: %v", err)
+			}
+			if body.Sale.Status != tt.wantSale {
+				t.Errorf("sale status = %q, want %q", body.Sale.Status, tt.wantSale)
+			}
+			if body.Sale.StartTime != tt.start.Unix() {
+				t.Errorf("sale start = %d, want %d", body.Sale.StartTime, tt.start.Unix())
+			}
+		})
+	}
+}
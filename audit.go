@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/database"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/metrics"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/models"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// newAuditEntry records the inventory change behind purchase, made with
+// checkout code when the item had stockBefore units
+func newAuditEntry(purchase *models.Purchase, code string, stockBefore int) *models.AuditEntry {
+	return &models.AuditEntry{
+		Action:       models.AuditActionPurchase,
+		PurchaseID:   purchase.PurchaseID,
+		SaleID:       purchase.SaleID,
+		UserID:       purchase.UserID,
+		ItemID:       purchase.ItemID,
+		CheckoutCode: code,
+		StockBefore:  stockBefore,
+		StockAfter:   stockBefore - 1,
+		CreatedAt:    purchase.CreatedAt,
+	}
+}
+
+// recordAudit writes the audit entries of inventory changes that were just
+// made. The changes stand either way, so a failure doesn't fail the request; it
+// is logged at error level with the entries themselves, so the trail can be
+// rebuilt from the logs, and counted.
+func recordAudit(ctx context.Context, db *database.DB, entries []*models.AuditEntry) {
+	err := db.CreateAuditEntriesContext(context.WithoutCancel(ctx), entries)
+	if err == nil {
+		return
+	}
+
+	metrics.AuditWriteFailuresTotal.Add(float64(len(entries)))
+	for _, e := range entries {
+		Logger(ctx).Error("Failed to write audit entry", "action", e.Action, "purchase_id", e.PurchaseID, "sale_id", e.SaleID,
+			"user_id", e.UserID, "item_id", e.ItemID, "stock_before", e.StockBefore, "stock_after", e.StockAfter, "error", err)
+	}
+}
+
+// AdminAuditHandler serves GET /admin/audit?user_id=&item_id=, the inventory
+// audit trail of a user, an item or both, newest first. At least one filter
+// is required; limit defaults to 100, at most 1000.
+func AdminAuditHandler(db *database.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		userID := r.URL.Query().Get("user_id")
+		itemID := r.URL.Query().Get("item_id")
+		if userID == "" && itemID == "" {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeMissingParameter, "Missing user_id or item_id")
+			return
+		}
+
+		limit, ok := parseNonNegativeInt(r, "limit", defaultAuditLimit)
+		if !ok {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid limit")
+			return
+		}
+		if limit == 0 {
+			limit = defaultAuditLimit
+		}
+		if limit > maxAuditLimit {
+			limit = maxAuditLimit
+		}
+
+		entries, err := db.GetAuditEntriesContext(r.Context(), userID, itemID, limit)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load audit entries", "user_id", userID, "item_id", itemID, "error", err)
+			writeDependencyError(w, err, "Error loading audit entries")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"entries": entries,
+		})
+	}
+}
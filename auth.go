@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/handlers"
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+// jwtClaims are the registered claims we rely on
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+}
+
+// parseJWT verifies an HS256 JSON Web Token and returns its claims
+func parseJWT(token string, secret []byte) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "HS256" {
+		return nil, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errInvalidToken
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil || claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+
+	now := time.Now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return nil, errInvalidToken
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errInvalidToken
+	}
+	return &claims, nil
+}
+
+// AuthMiddleware requires a valid HS256 bearer JWT and stores its subject as
+// the authenticated user ID, readable with handlers.UserFromContext
+func AuthMiddleware(secret string) func(http.Handler) http.Handler {
+	key := []byte(secret)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" || token == r.Header.Get("Authorization") {
+				handlers.WriteJSONError(w, http.StatusUnauthorized, handlers.ErrCodeUnauthorized, "Missing bearer token")
+				return
+			}
+
+			claims, err := parseJWT(token, key)
+			if err != nil {
+				handlers.WriteJSONError(w, http.StatusUnauthorized, handlers.ErrCodeUnauthorized, "Invalid or expired token")
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(handlers.ContextWithUser(r.Context(), claims.Subject)))
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+const (
+	// availabilityCheckInterval is the most often held requests' stock is
+	// read again while purchases are coming in
+	availabilityCheckInterval = 250 * time.Millisecond
+
+	// availabilityWaitMargin is how long before the client's own timeout a
+	// held request is answered, so the answer arrives before the client
+	// gives up
+	availabilityWaitMargin = time.Second
+
+	// availabilityWriteGrace keeps the connection writable a little past the
+	// hold, so the answer itself can still be sent
+	availabilityWriteGrace = time.Second
+)
+
+// availabilityWait is one held request, told the item's stock once it is no
+// longer known
+type availabilityWait struct {
+	itemID  string
+	known   int
+	changed chan int
+}
+
+// AvailabilityWatch holds availability checks open until an item's stock
+// changes, for clients that can't use the inventory stream. Purchases publish
+// through Redis so every instance hears about them; each instance then reads
+// the stock of every held item in one round-trip, at most four times a
+// second however many requests are held.
+type AvailabilityWatch struct {
+	redis    *redis.Client
+	maxWaits int
+	maxHold  time.Duration
+
+	mu    sync.Mutex
+	waits map[*availabilityWait]struct{}
+
+	// done closes when Run returns so held requests are answered on shutdown
+	done chan struct{}
+}
+
+// NewAvailabilityWatch creates a watch holding up to maxWaits requests for
+// at most maxHold each
+func NewAvailabilityWatch(redisClient *redis.Client, maxWaits int, maxHold time.Duration) *AvailabilityWatch {
+	return &AvailabilityWatch{
+		redis:    redisClient,
+		maxWaits: maxWaits,
+		maxHold:  maxHold,
+		waits:    make(map[*availabilityWait]struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Run listens for inventory changes and answers the requests they concern
+// until ctx is cancelled
+func (aw *AvailabilityWatch) Run(ctx context.Context) {
+	defer close(aw.done)
+
+	updates := aw.redis.SubscribeInventoryUpdates(ctx)
+	ticker := time.NewTicker(availabilityCheckInterval)
+	defer ticker.Stop()
+
+	dirty := false
+	for {
+		select {
+		case _, ok := <-updates:
+			if !ok {
+				return
+			}
+			dirty = true
+
+		case <-ticker.C:
+			if !dirty {
+				continue
+			}
+			if err := aw.check(); err != nil {
+				slog.Error("Failed to load stock for held availability checks", "error", err)
+				continue
+			}
+			dirty = false
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check reads the stock of every held item and answers the requests whose
+// item no longer has the stock they know
+func (aw *AvailabilityWatch) check() error {
+	aw.mu.Lock()
+	seen := make(map[string]bool)
+	var itemIDs []string
+	for wait := range aw.waits {
+		if !seen[wait.itemID] {
+			seen[wait.itemID] = true
+			itemIDs = append(itemIDs, wait.itemID)
+		}
+	}
+	aw.mu.Unlock()
+
+	if len(itemIDs) == 0 {
+		return nil
+	}
+
+	stocks, err := aw.redis.GetItemStocks(itemIDs)
+	if err != nil {
+		return err
+	}
+
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	for wait := range aw.waits {
+		stock, ok := stocks[wait.itemID]
+		if !ok || stock == wait.known {
+			continue
+		}
+		wait.changed <- stock
+		delete(aw.waits, wait)
+	}
+	return nil
+}
+
+func (aw *AvailabilityWatch) register(itemID string, known int) (*availabilityWait, bool) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	if len(aw.waits) >= aw.maxWaits {
+		return nil, false
+	}
+	wait := &availabilityWait{itemID: itemID, known: known, changed: make(chan int, 1)}
+	aw.waits[wait] = struct{}{}
+	return wait, true
+}
+
+func (aw *AvailabilityWatch) unregister(wait *availabilityWait) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	delete(aw.waits, wait)
+}
+
+// WaitForAvailabilityChange serves GET
+// /items/availability/wait?item_id=&stock=&timeout=, a long-poll variant of
+// the availability check. stock is the client's last known stock of the
+// item; the request is answered as soon as the item's stock differs from it,
+// or with "changed": false once the hold runs out. timeout is how many
+// seconds the client waits, and the hold ends a second before it and never
+// lasts longer than the watch's maxHold. Like the batch check, the answer is
+// advisory.
+func (aw *AvailabilityWatch) WaitForAvailabilityChange() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		itemID := r.URL.Query().Get("item_id")
+		if itemID == "" || r.URL.Query().Get("stock") == "" {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeMissingParameter, "Missing item_id or stock")
+			return
+		}
+
+		known, err := strconv.Atoi(r.URL.Query().Get("stock"))
+		if err != nil || known < 0 {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "stock must be a non-negative integer")
+			return
+		}
+
+		hold := aw.maxHold
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			seconds, err := strconv.Atoi(value)
+			clientTimeout := time.Duration(seconds) * time.Second
+			if err != nil || clientTimeout <= availabilityWaitMargin {
+				WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter,
+					fmt.Sprintf("timeout must be more than %d seconds", int(availabilityWaitMargin/time.Second)))
+				return
+			}
+			if clientTimeout-availabilityWaitMargin < hold {
+				hold = clientTimeout - availabilityWaitMargin
+			}
+		}
+
+		// Registered before the first read, so a change landing in between
+		// is seen by one or the other
+		wait, ok := aw.register(itemID, known)
+		if !ok {
+			WriteJSONError(w, http.StatusServiceUnavailable, ErrCodeTooManyStreams, "Too many held availability checks, poll /items/availability instead")
+			return
+		}
+		defer aw.unregister(wait)
+
+		stocks, err := aw.redis.GetItemStocks([]string{itemID})
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load item stock", "item_id", itemID, "error", err)
+			writeDependencyError(w, err, "Error checking availability")
+			return
+		}
+
+		stock := stocks[itemID]
+		if stock == known {
+			// Held requests outlive the server's write timeout
+			if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(hold + availabilityWriteGrace)); err != nil {
+				Logger(r.Context()).Error("Failed to extend write deadline for availability check", "error", err)
+			}
+
+			timer := time.NewTimer(hold)
+			defer timer.Stop()
+
+			select {
+			case stock = <-wait.changed:
+			case <-timer.C:
+			case <-aw.done:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"advisory":  true,
+			"item_id":   itemID,
+			"stock":     stock,
+			"available": stock > 0,
+			"changed":   stock != known,
+		})
+	}
+}
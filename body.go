@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// writeBodyError answers a request whose body could not be read: 413 when it
+// was over the limit set by middleware.BodyLimitMiddleware, 400 otherwise
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		WriteRequestTooLarge(w, tooLarge.Limit)
+		return
+	}
+	WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid request body")
+}
+
+// WriteRequestTooLarge writes the 413 response for a body over limit bytes
+func WriteRequestTooLarge(w http.ResponseWriter, limit int64) {
+	writeJSONError(w, http.StatusRequestEntityTooLarge, ErrCodeRequestTooLarge, "Request body is too large",
+		map[string]interface{}{"max_bytes": limit})
+}
+
+// decodeJSONBody decodes r's body into dst. Unknown fields and trailing data
+// are rejected so a typo'd payload fails instead of being half understood. On
+// failure the error response has been written and false is returned.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(dst); err != nil {
+		writeBodyError(w, err)
+		return false
+	}
+	if err := decoder.Decode(&struct{}{}); err != io.EOF {
+		writeBodyError(w, err)
+		return false
+	}
+	return true
+}
+
+// parseFormBody parses r's form, writing the error response and returning
+// false when the body is unreadable or too large
+func parseFormBody(w http.ResponseWriter, r *http.Request) bool {
+	if err := r.ParseForm(); err != nil {
+		writeBodyError(w, err)
+		return false
+	}
+	return true
+}
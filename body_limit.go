@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/handlers"
+)
+
+// BodyLimitMiddleware caps request bodies at maxBytes. A declared
+// Content-Length over the cap is rejected with 413 straight away; otherwise
+// reading past the cap fails and handlers answer 413 themselves.
+func BodyLimitMiddleware(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				handlers.WriteRequestTooLarge(w, maxBytes)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
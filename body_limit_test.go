@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyLimitMiddlewareRejectsOversizedBody(t *testing.T) {
+	reached := false
+	handler := BodyLimitMiddleware(16)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		if _, err := io.ReadAll(r.Body); err == nil {
+			t.Error("reading past the limit succeeded")
+		}
+	}))
+
+	// A declared length over the limit never reaches the handler
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 17))))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if reached {
+		t.Error("handler reached despite the declared length")
+	}
+
+	// An undeclared one is cut off while the handler reads it
+	r := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader(strings.Repeat("x", 17))))
+	r.ContentLength = -1
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if !reached {
+		t.Error("handler not reached for a body of unknown length")
+	}
+}
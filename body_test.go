@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSONBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"valid", `{"user_id": "user_1"}`, http.StatusOK},
+		{"over the limit", `{"user_id": "` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge},
+		{"malformed", `{"user_id": `, http.StatusBadRequest},
+		{"unknown field", `{"user_id": "user_1", "usr_id": "user_2"}`, http.StatusBadRequest},
+		{"trailing data", `{"user_id": "user_1"} {}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			r.Body = http.MaxBytesReader(rec, r.Body, 48)
+
+			var dst struct {
+				UserID string `json:"user_id"`
+			}
+			ok := decodeJSONBody(rec, r, &dst)
+			if ok != (tt.wantStatus == http.StatusOK) {
+				t.Fatalf("decodeJSONBody = %v, want %v", ok, !ok)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if ok && dst.UserID != "user_1" {
+				t.Errorf("user_id = %q, want user_1", dst.UserID)
+			}
+		})
+	}
+}
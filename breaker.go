@@ -0,0 +1,138 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+
+	"flash-sale-service/internal/errs"
+)
+
+// ErrOpen is returned instead of calling a dependency while its breaker is open
+var ErrOpen = errs.New(errs.ErrUnavailable, "circuit breaker is open")
+
+const (
+	// DefaultFailureThreshold is how many consecutive failures open a breaker
+	DefaultFailureThreshold = 5
+
+	// DefaultCooldown is how long a breaker stays open before probing again
+	DefaultCooldown = 5 * time.Second
+)
+
+// State is the position of a breaker
+type State int
+
+const (
+	// Closed lets every call through
+	Closed State = iota
+	// Open rejects every call until the cooldown passes
+	Open
+	// HalfOpen lets a single probe through to test the dependency
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// Breaker stops calls to a failing dependency so callers fail fast instead of
+// piling up on timeouts. After threshold consecutive failures it opens for the
+// cooldown, then lets one probe through; the probe's result closes or reopens
+// it.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// New creates a closed breaker. Non-positive arguments use the defaults.
+func New(threshold int, cooldown time.Duration) *Breaker {
+	if threshold <= 0 {
+		threshold = DefaultFailureThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+	return &Breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Allow reports whether a call may proceed, returning ErrOpen when it may not.
+// Every allowed call must be followed by Record.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return ErrOpen
+		}
+		b.state = HalfOpen
+		b.probing = true
+		return nil
+	case HalfOpen:
+		if b.probing {
+			return ErrOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Record reports the outcome of an allowed call. A nil err counts as success.
+func (b *Breaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.state = Closed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.state == HalfOpen || b.failures >= b.threshold {
+		b.state = Open
+		b.openedAt = b.now()
+		b.probing = false
+	}
+}
+
+// Abandon reports that an allowed call ended without telling us anything
+// about the dependency, e.g. because its caller went away. A half-open breaker
+// lets the next call probe instead.
+func (b *Breaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// Do runs fn through the breaker
+func (b *Breaker) Do(fn func() error) error {
+	if err := b.Allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.Record(err)
+	return err
+}
+
+// State returns the breaker's current state. An open breaker whose cooldown
+// has passed still reports Open until the next call probes it.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
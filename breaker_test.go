@@ -0,0 +1,116 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("dependency down")
+
+// newTestBreaker returns a breaker on a clock that only moves when told
+func newTestBreaker(threshold int, cooldown time.Duration) (*Breaker, *time.Time) {
+	now := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	b := New(threshold, cooldown)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func fail() error { return errDown }
+
+func succeed() error { return nil }
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b, _ := newTestBreaker(3, time.Second)
+
+	// A success in between starts the count again
+	b.Do(fail)
+	b.Do(fail)
+	b.Do(succeed)
+	for i := 0; i < 2; i++ {
+		if err := b.Do(fail); !errors.Is(err, errDown) {
+			t.Fatalf("failure %d: error = %v, want the call's own", i+1, err)
+		}
+		if state := b.State(); state != Closed {
+			t.Fatalf("after %d failures in a row: state = %v, want closed", i+1, state)
+		}
+	}
+
+	b.Do(fail)
+	if state := b.State(); state != Open {
+		t.Fatalf("after 3 failures in a row: state = %v, want open", state)
+	}
+
+	called := false
+	err := b.Do(func() error { called = true; return nil })
+	if !errors.Is(err, ErrOpen) {
+		t.Errorf("call while open: error = %v, want ErrOpen", err)
+	}
+	if called {
+		t.Error("call while open reached the dependency")
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe func() error
+		want  State
+	}{
+		{"successful probe closes", succeed, Closed},
+		{"failed probe reopens", fail, Open},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, now := newTestBreaker(1, time.Second)
+			b.Do(fail)
+
+			// Still cooling down
+			*now = now.Add(time.Second - time.Millisecond)
+			if err := b.Allow(); !errors.Is(err, ErrOpen) {
+				t.Fatalf("Allow during the cooldown = %v, want ErrOpen", err)
+			}
+
+			*now = now.Add(time.Millisecond)
+			if err := b.Allow(); err != nil {
+				t.Fatalf("Allow after the cooldown = %v, want the probe let through", err)
+			}
+			if state := b.State(); state != HalfOpen {
+				t.Fatalf("state while probing = %v, want half_open", state)
+			}
+			// Only the one probe goes through
+			if err := b.Allow(); !errors.Is(err, ErrOpen) {
+				t.Fatalf("Allow beside the probe = %v, want ErrOpen", err)
+			}
+
+			b.Record(tt.probe())
+			if state := b.State(); state != tt.want {
+				t.Fatalf("state after the probe = %v, want %v", state, tt.want)
+			}
+			if tt.want == Open {
+				// The cooldown starts over from the failed probe
+				if err := b.Allow(); !errors.Is(err, ErrOpen) {
+					t.Errorf("Allow right after a failed probe = %v, want ErrOpen", err)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerAbandonedProbeLetsNextCallProbe(t *testing.T) {
+	b, now := newTestBreaker(1, time.Second)
+	b.Do(fail)
+	*now = now.Add(time.Second)
+
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow after the cooldown = %v, want the probe let through", err)
+	}
+	b.Abandon()
+
+	if err := b.Do(succeed); err != nil {
+		t.Fatalf("next call after an abandoned probe = %v, want it let through", err)
+	}
+	if state := b.State(); state != Closed {
+		t.Errorf("state = %v, want closed", state)
+	}
+}
@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/database"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/errs"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/metrics"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/models"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/notify"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/webhooks"
+)
+
+// maxBulkPurchaseItems caps how many checkout codes one bundle may contain
+const maxBulkPurchaseItems = 10
+
+// Per-item outcomes in a bulk purchase response
+const (
+	bulkItemPurchased   = "purchased"
+	bulkItemAvailable   = "available"
+	bulkItemSoldOut     = "sold_out"
+	bulkItemInvalidCode = "invalid_code"
+	bulkItemDuplicate   = "duplicate"
+)
+
+// bulkItemResult reports what happened to one checkout code in a bundle
+type bulkItemResult struct {
+	CheckoutCode string `json:"checkout_code"`
+	ItemID       string `json:"item_id,omitempty"`
+	PurchaseID   string `json:"purchase_id,omitempty"`
+	Status       string `json:"status"`
+}
+
+// bulkPurchaseFailure gives the failure reason and the buyer's explanation for
+// a bundle decrement that took nothing
+func bulkPurchaseFailure(err error) (string, string) {
+	switch {
+	case errors.Is(err, errs.ErrUserLimitReached):
+		return metrics.ReasonLimitReached,
+			fmt.Sprintf("Bundle would exceed the limit of %d items per user in this sale", models.MaxItemsPerUserPerSale)
+	case errors.Is(err, errs.ErrSaleEnded):
+		return metrics.ReasonNoActiveSale, "The sale these items belong to has been cancelled"
+	case errors.Is(err, errs.ErrCheckoutUsed):
+		return metrics.ReasonInvalidCode, "Bundle contains a checkout code that has already been used"
+	case errors.Is(err, errs.ErrInvalidCheckoutCode):
+		return metrics.ReasonInvalidCode, "Bundle contains a cancelled or expired checkout code"
+	}
+	return metrics.ReasonError, "Error processing purchase"
+}
+
+// BulkPurchaseHandler completes a bundle of checkout codes as one purchase:
+// either every item is bought or none is. The body is
+// {"checkout_codes": [...]} and every code must belong to the same user and
+// sale. The per-user limit applies to the bundle as a whole. The buyer is
+// notified of each item through notifier, and the purchases are written in
+// one turn of writes. A spiking sale holds the bundle once, like a single
+// purchase.
+func BulkPurchaseHandler(db *database.DB, redisClient *redis.Client, codeSecret []byte, events *webhooks.Dispatcher, notifier *notify.Dispatcher, writes *PurchaseWrites, spikes *PurchaseSpikes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		var req struct {
+			CheckoutCodes []string `json:"checkout_codes"`
+		}
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+
+		if len(req.CheckoutCodes) == 0 {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeMissingCheckoutCode, "Missing checkout codes")
+			return
+		}
+
+		if len(req.CheckoutCodes) > maxBulkPurchaseItems {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter,
+				fmt.Sprintf("A bundle may contain at most %d checkout codes", maxBulkPurchaseItems))
+			return
+		}
+
+		// Resolve every code before touching inventory so a bad one fails
+		// the bundle without side effects
+		results := make([]bulkItemResult, len(req.CheckoutCodes))
+		itemIDs := make([]string, len(req.CheckoutCodes))
+		seenItems := make(map[string]bool)
+		userID := ""
+		valid := true
+		for i, code := range req.CheckoutCodes {
+			results[i] = bulkItemResult{CheckoutCode: code, Status: bulkItemInvalidCode}
+
+			if _, err := parseCheckoutCode(codeSecret, code); err != nil {
+				valid = false
+				continue
+			}
+
+			codeUserID, itemID, err := redis.GetCheckoutSession(r.Context(), redisClient, code)
+			if err != nil || (userID != "" && codeUserID != userID) {
+				valid = false
+				continue
+			}
+			userID = codeUserID
+			itemIDs[i] = itemID
+			results[i].ItemID = itemID
+
+			if seenItems[itemID] {
+				results[i].Status = bulkItemDuplicate
+				valid = false
+				continue
+			}
+			seenItems[itemID] = true
+			results[i].Status = bulkItemAvailable
+		}
+
+		if !valid {
+			metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonInvalidCode).Inc()
+			writeJSONError(w, http.StatusBadRequest, ErrCodeInvalidCheckoutCode,
+				"Bundle contains invalid, expired, duplicate or mismatched checkout codes",
+				map[string]interface{}{"items": results})
+			return
+		}
+
+		// The caller must be the user who made the checkouts
+		if authUserID, ok := UserFromContext(r.Context()); ok && authUserID != userID {
+			metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonInvalidCode).Inc()
+			WriteJSONError(w, http.StatusForbidden, ErrCodeForbidden, "Checkout codes belong to another user")
+			return
+		}
+
+		// A bundle is decremented against a single sale's limits, so every
+		// item must come from the same one
+		saleID := ""
+		for _, itemID := range itemIDs {
+			item, err := db.GetItemContext(r.Context(), itemID)
+			if err != nil {
+				Logger(r.Context()).Error("Failed to load item", "item_id", itemID, "error", err)
+				metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonError).Inc()
+				writeDependencyError(w, err, "Error processing purchase")
+				return
+			}
+
+			if item == nil {
+				metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonInvalidCode).Inc()
+				writeError(w, errs.ErrInvalidCheckoutCode, "Bundle contains invalid, expired, duplicate or mismatched checkout codes")
+				return
+			}
+
+			if saleID != "" && item.SaleID != saleID {
+				metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonInvalidCode).Inc()
+				WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Every item in a bundle must belong to the same sale")
+				return
+			}
+			saleID = item.SaleID
+		}
+
+		sale, err := db.GetActiveSaleByIDContext(r.Context(), saleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load bundle's sale", "sale_id", saleID, "error", err)
+			metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonError).Inc()
+			writeDependencyError(w, err, "Error processing purchase")
+			return
+		}
+
+		if sale == nil {
+			metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonNoActiveSale).Inc()
+			writeError(w, errs.ErrSaleEnded, "The sale these items belong to is no longer active")
+			return
+		}
+
+		if !spikes.admit(r.Context(), sale.SaleID) {
+			return
+		}
+
+		// Once sent, the decrement may take stock whether or not the client
+		// is still waiting, so it and the commands after it outlive the
+		// request
+		ctx := context.WithoutCancel(r.Context())
+		taken, stocks, err := redisClient.DecrementInventoryBulk(ctx, sale.SaleID, userID, itemIDs, req.CheckoutCodes, models.MaxItemsPerUserPerSale)
+		if err != nil {
+			reason, message := bulkPurchaseFailure(err)
+			if reason == metrics.ReasonError {
+				Logger(r.Context()).Error("Failed to decrement bundle", "user_id", userID, "error", err)
+			}
+			metrics.PurchaseFailuresTotal.WithLabelValues(reason).Inc()
+			writeError(w, err, message)
+			return
+		}
+
+		if !taken {
+			for i := range results {
+				if stocks[i] == 0 {
+					results[i].Status = bulkItemSoldOut
+				}
+			}
+			metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonSoldOut).Inc()
+			status, code := errs.ToHTTP(errs.ErrSoldOut)
+			writeJSONError(w, status, code, "Some items in the bundle are sold out",
+				map[string]interface{}{"items": results})
+			return
+		}
+
+		if !writes.acquire() {
+			rejectPurchaseWrite(w, r, redisClient, sale.SaleID, userID, itemIDs, req.CheckoutCodes)
+			return
+		}
+		defer writes.release()
+
+		if err := redisClient.PublishInventoryUpdate(ctx, sale.SaleID); err != nil {
+			Logger(r.Context()).Error("Failed to publish inventory update", "error", err)
+		}
+
+		now := time.Now().UTC()
+		purchases := make([]*models.Purchase, len(itemIDs))
+		for i, itemID := range itemIDs {
+			purchaseID, err := generatePurchaseID()
+			if err != nil {
+				restorePurchase(r.Context(), redisClient, sale.SaleID, userID, itemIDs, req.CheckoutCodes)
+				metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonError).Inc()
+				WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error recording purchase")
+				return
+			}
+			purchases[i] = &models.Purchase{
+				PurchaseID: purchaseID,
+				SaleID:     sale.SaleID,
+				UserID:     userID,
+				ItemID:     itemID,
+				CreatedAt:  now,
+			}
+		}
+
+		// Inventory is already taken, so the records are written even if the
+		// client has gone away. Records that can't be written give the
+		// inventory back.
+		err = db.CreatePurchasesContext(context.WithoutCancel(r.Context()), purchases)
+		if err != nil {
+			restorePurchase(r.Context(), redisClient, sale.SaleID, userID, itemIDs, req.CheckoutCodes)
+		}
+
+		if errors.Is(err, database.ErrDuplicatePurchase) {
+			metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonLimitReached).Inc()
+			writeError(w, errs.ErrUserLimitReached, "User has already purchased an item in this sale")
+			return
+		}
+
+		if err != nil {
+			Logger(r.Context()).Error("Failed to record bundle", "user_id", userID, "error", err)
+			metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonError).Inc()
+			writeDependencyError(w, err, "Error recording purchase")
+			return
+		}
+
+		// Only written purchases may end the sale
+		markSoldOutIfExhausted(r.Context(), db, redisClient, events, sale)
+
+		audit := make([]*models.AuditEntry, len(purchases))
+		for i, p := range purchases {
+			audit[i] = newAuditEntry(p, req.CheckoutCodes[i], stocks[i])
+		}
+		recordAudit(r.Context(), db, audit)
+
+		for i := range results {
+			results[i].Status = bulkItemPurchased
+			results[i].PurchaseID = purchases[i].PurchaseID
+			events.Emit(webhooks.EventPurchaseCompleted, map[string]interface{}{
+				"purchase_id": purchases[i].PurchaseID,
+				"sale_id":     sale.SaleID,
+				"user_id":     userID,
+				"item_id":     purchases[i].ItemID,
+			})
+			notifier.Purchase(userID, purchases[i].ItemID, purchases[i].PurchaseID)
+		}
+		metrics.PurchasesTotal.Add(float64(len(purchases)))
+		if err := redisClient.RecordPurchases(ctx, sale.SaleID, len(purchases)); err != nil {
+			Logger(r.Context()).Error("Failed to record purchase rate", "error", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"items":   results,
+			"message": "Bundle purchased successfully",
+		})
+	}
+}
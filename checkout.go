@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/database"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/errs"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/metrics"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/models"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+// CheckoutHandler reserves an item in the active sale and returns a checkout
+// code, signed with codeSecret, that can be exchanged for the item through
+// PurchaseHandler. A queued item is reserved in arrival order instead: the
+// caller joins its queue and is reserved the item straight away only if their
+// turn has already come.
+func CheckoutHandler(db *database.DB, redisClient *redis.Client, codeSecret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		userID, item, sale, ok := checkoutTarget(w, r, db)
+		if !ok {
+			return
+		}
+
+		if item.Queued {
+			claimQueuedCheckout(w, r, redisClient, codeSecret, sale, userID, item.ItemID, true)
+			return
+		}
+
+		expiresAt := time.Now().Add(sale.ReservationTTL())
+		checkoutCode, err := generateCheckoutCode(codeSecret, userID, item.ItemID, expiresAt)
+		if err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error processing checkout")
+			return
+		}
+
+		// Soft reservation only; inventory is decremented on purchase
+		reserved, err := redisClient.ReserveItem(r.Context(), checkoutCode, sale.SaleID, userID, item.ItemID, expiresAt)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to reserve item", "item_id", item.ItemID, "error", err)
+			writeDependencyError(w, err, "Error processing checkout")
+			return
+		}
+
+		if !reserved {
+			WriteJSONError(w, http.StatusConflict, ErrCodeItemUnavailable, "Item is already reserved or sold out")
+			return
+		}
+
+		writeCheckout(w, checkoutCode, expiresAt)
+	}
+}
+
+// checkoutTarget reads the user and item of a checkout request and loads the
+// item and its running sale, answering the request itself when it can't go
+// ahead
+func checkoutTarget(w http.ResponseWriter, r *http.Request, db *database.DB) (string, *models.Item, *models.Sale, bool) {
+	if !parseFormBody(w, r) {
+		return "", nil, nil, false
+	}
+
+	// Prefer the authenticated user; user_id is only trusted without auth
+	userID := r.FormValue("user_id")
+	if authUserID, ok := UserFromContext(r.Context()); ok {
+		if userID != "" && userID != authUserID {
+			WriteJSONError(w, http.StatusForbidden, ErrCodeForbidden, "user_id does not match the authenticated user")
+			return "", nil, nil, false
+		}
+		userID = authUserID
+	}
+
+	itemID := r.FormValue("item_id")
+	if itemID == "" {
+		itemID = r.FormValue("id")
+	}
+
+	if userID == "" || itemID == "" {
+		WriteJSONError(w, http.StatusBadRequest, ErrCodeMissingParameter, "Missing user_id or item_id")
+		return "", nil, nil, false
+	}
+
+	item, err := db.GetItemContext(r.Context(), itemID)
+	if err != nil {
+		Logger(r.Context()).Error("Failed to load item", "item_id", itemID, "error", err)
+		writeDependencyError(w, err, "Error processing checkout")
+		return "", nil, nil, false
+	}
+
+	if item == nil {
+		WriteJSONError(w, http.StatusBadRequest, ErrCodeItemNotInSale, "Item is not part of an active sale")
+		return "", nil, nil, false
+	}
+
+	// Several sales may run at once, so the item's own sale must be the
+	// one running right now
+	sale, err := db.GetActiveSaleByIDContext(r.Context(), item.SaleID)
+	if err != nil {
+		Logger(r.Context()).Error("Failed to load item's sale", "sale_id", item.SaleID, "error", err)
+		writeDependencyError(w, err, "Error processing checkout")
+		return "", nil, nil, false
+	}
+
+	if sale == nil {
+		WriteJSONError(w, http.StatusBadRequest, ErrCodeItemNotInSale, "Item is not part of an active sale")
+		return "", nil, nil, false
+	}
+
+	if sale.Status == models.SaleStatusSoldOut {
+		writeError(w, errs.ErrSoldOut, "Sale is sold out")
+		return "", nil, nil, false
+	}
+
+	return userID, item, sale, true
+}
+
+// writeCheckout answers a request that reserved an item under checkoutCode
+func writeCheckout(w http.ResponseWriter, checkoutCode string, expiresAt time.Time) {
+	metrics.CheckoutReservationsTotal.Inc()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"checkout_code": checkoutCode,
+		"expires_at":    expiresAt.Unix(),
+		"message":       "Checkout session created successfully",
+	})
+}
+
+// CancelCheckoutHandler releases a checkout's reservation before it expires so
+// the item can be reserved by someone else. It accepts POST or DELETE with the
+// checkout code as ?code= and only the user who made the checkout may cancel
+// it.
+func CancelCheckoutHandler(redisClient *redis.Client, codeSecret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeMissingCheckoutCode, "Missing checkout code")
+			return
+		}
+
+		if _, err := parseCheckoutCode(codeSecret, code); err != nil {
+			writeError(w, errs.ErrInvalidCheckoutCode, "Invalid or expired checkout code")
+			return
+		}
+
+		if !parseFormBody(w, r) {
+			return
+		}
+
+		// Prefer the authenticated user; user_id is only trusted without auth
+		userID, ok := UserFromContext(r.Context())
+		if !ok {
+			userID = r.FormValue("user_id")
+		}
+		if userID == "" {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeMissingParameter, "Missing user_id")
+			return
+		}
+
+		err := redisClient.CancelCheckout(r.Context(), code, userID)
+		if errors.Is(err, redis.ErrCheckoutNotFound) {
+			writeError(w, errs.ErrInvalidCheckoutCode, "Checkout not found, expired or already purchased")
+			return
+		}
+
+		if errors.Is(err, redis.ErrCheckoutNotOwned) {
+			WriteJSONError(w, http.StatusForbidden, ErrCodeForbidden, "Checkout code belongs to another user")
+			return
+		}
+
+		if err != nil {
+			Logger(r.Context()).Error("Failed to cancel checkout", "error", err)
+			writeDependencyError(w, err, "Error cancelling checkout")
+			return
+		}
+
+		metrics.CheckoutReservationsCancelledTotal.Inc()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": "Checkout cancelled, the item has been released",
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidCheckoutCode = errors.New("invalid checkout code")
+	errExpiredCheckoutCode = errors.New("checkout code expired")
+)
+
+const (
+	// maxCheckoutCodeLength is far longer than any code generateCheckoutCode
+	// builds for realistic user and item IDs
+	maxCheckoutCodeLength = 1024
+
+	// checkoutNonceLength is the length of a hex encoded generateNonce
+	checkoutNonceLength = 32
+)
+
+// checkoutSignatureLength is the length of an encoded signCheckoutCode
+var checkoutSignatureLength = base64.RawURLEncoding.EncodedLen(sha256.Size)
+
+// validationProblem is one thing wrong with a request parameter
+type validationProblem struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError lists everything wrong with a request's parameters, so a
+// client can fix them all at once
+type validationError struct {
+	Problems []validationProblem
+}
+
+func (e *validationError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		messages[i] = problem.Field + ": " + problem.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// validateCheckoutCode checks that code is shaped like one generateCheckoutCode
+// builds, without checking its signature or expiry, so garbage is turned away
+// with an explanation before any lookup. It returns a *validationError.
+func validateCheckoutCode(code string) error {
+	invalid := &validationError{}
+	problem := func(format string, args ...interface{}) {
+		invalid.Problems = append(invalid.Problems, validationProblem{Field: "code", Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(code) > maxCheckoutCodeLength {
+		problem("must be at most %d characters", maxCheckoutCodeLength)
+		return invalid
+	}
+
+	parts := strings.Split(code, ".")
+	if len(parts) != 5 {
+		problem("must have 5 dot-separated segments, got %d", len(parts))
+		return invalid
+	}
+
+	if _, err := hex.DecodeString(parts[0]); err != nil || len(parts[0]) != checkoutNonceLength {
+		problem("nonce must be %d hex characters", checkoutNonceLength)
+	}
+	if expiry, err := strconv.ParseInt(parts[1], 10, 64); err != nil || expiry <= 0 {
+		problem("expiry must be a Unix timestamp")
+	}
+	if userID, err := base64.RawURLEncoding.DecodeString(parts[2]); err != nil || len(userID) == 0 {
+		problem("user must be a non-empty base64url value")
+	}
+	if itemID, err := base64.RawURLEncoding.DecodeString(parts[3]); err != nil || len(itemID) == 0 {
+		problem("item must be a non-empty base64url value")
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(parts[4]); err != nil || len(parts[4]) != checkoutSignatureLength {
+		problem("signature must be %d base64url characters", checkoutSignatureLength)
+	}
+
+	if len(invalid.Problems) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+// generateNonce generates a random hex string
+func generateNonce() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// checkoutClaims is what a checkout code vouches for
+type checkoutClaims struct {
+	UserID    string
+	ItemID    string
+	ExpiresAt time.Time
+}
+
+func signCheckoutCode(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// generateCheckoutCode builds a checkout code of the form
+// nonce.expiry.user.item.signature, where user and item are base64url encoded
+// and the signature is an HMAC over everything before it. Codes can be checked
+// without a Redis lookup and can't be forged or altered without the secret.
+func generateCheckoutCode(secret []byte, userID, itemID string, expiresAt time.Time) (string, error) {
+	nonce, err := generateNonce()
+	if err != nil {
+		return "", err
+	}
+
+	payload := fmt.Sprintf("%s.%d.%s.%s", nonce, expiresAt.Unix(),
+		base64.RawURLEncoding.EncodeToString([]byte(userID)),
+		base64.RawURLEncoding.EncodeToString([]byte(itemID)))
+	return payload + "." + signCheckoutCode(secret, payload), nil
+}
+
+// parseCheckoutCode verifies a checkout code's signature and expiry and
+// returns its claims
+func parseCheckoutCode(secret []byte, code string) (*checkoutClaims, error) {
+	i := strings.LastIndex(code, ".")
+	if i < 0 {
+		return nil, errInvalidCheckoutCode
+	}
+	payload, signature := code[:i], code[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(signCheckoutCode(secret, payload))) {
+		return nil, errInvalidCheckoutCode
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 4 {
+		return nil, errInvalidCheckoutCode
+	}
+
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errInvalidCheckoutCode
+	}
+	userID, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidCheckoutCode
+	}
+	itemID, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, errInvalidCheckoutCode
+	}
+
+	claims := &checkoutClaims{
+		UserID:    string(userID),
+		ItemID:    string(itemID),
+		ExpiresAt: time.Unix(expiry, 0),
+	}
+	if !time.Now().Before(claims.ExpiresAt) {
+		return nil, errExpiredCheckoutCode
+	}
+	return claims, nil
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateCheckoutCode(t *testing.T) {
+	valid, err := generateCheckoutCode(testCodeSecret, "user_1", "item_1", time.Now().Add(5*time.Minute))
+	if err != nil {
+		t.Fatalf("generateCheckoutCode: %v", err)
+	}
+	parts := strings.Split(valid, ".")
+	with := func(i int, segment string) string {
+		changed := append([]string(nil), parts...)
+		changed[i] = segment
+		return strings.Join(changed, ".")
+	}
+
+	tests := []struct {
+		name string
+		code string
+		// want holds a fragment of each expected problem; none means valid
+		want []string
+	}{
+		{"generated code", valid, nil},
+		{"expired but well formed", with(1, "1"), nil},
+		{"too long", strings.Repeat("a", maxCheckoutCodeLength+1), []string{"at most"}},
+		{"no segments", "garbage", []string{"5 dot-separated segments, got 1"}},
+		{"signature missing", strings.Join(parts[:4], "."), []string{"got 4"}},
+		{"extra segment", valid + ".x", []string{"got 6"}},
+		{"nonce not hex", with(0, strings.Repeat("z", len(parts[0]))), []string{"nonce"}},
+		{"nonce too short", with(0, parts[0][:8]), []string{"nonce"}},
+		{"expiry not a number", with(1, "soon"), []string{"expiry"}},
+		{"expiry zero", with(1, "0"), []string{"expiry"}},
+		{"user empty", with(2, ""), []string{"user"}},
+		{"item not base64url", with(3, "a+b/"), []string{"item"}},
+		{"signature truncated", with(4, parts[4][:10]), []string{"signature"}},
+		{"every field wrong", "n.x.!.!.s", []string{"nonce", "expiry", "user", "item", "signature"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCheckoutCode(tt.code)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("validateCheckoutCode = %v, want nil", err)
+				}
+				return
+			}
+
+			var invalid *validationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("validateCheckoutCode = %v, want a *validationError", err)
+			}
+			if len(invalid.Problems) != len(tt.want) {
+				t.Fatalf("problems = %+v, want %d", invalid.Problems, len(tt.want))
+			}
+			for i, fragment := range tt.want {
+				problem := invalid.Problems[i]
+				if problem.Field != "code" || !strings.Contains(problem.Message, fragment) {
+					t.Errorf("problem %d = %+v, want one about %q", i, problem, fragment)
+				}
+			}
+		})
+	}
+}
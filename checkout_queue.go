@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/database"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/errs"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/models"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+const (
+	// itemQueueLease is how long a place in a hot item's queue is kept
+	// without the user asking after it. A client that disconnects or gives
+	// up simply stops asking, and the users behind move up once it runs out.
+	itemQueueLease = 10 * time.Second
+
+	// itemQueuePollAfter is how often a waiting client is told to ask again
+	itemQueuePollAfter = time.Second
+)
+
+// claimQueuedCheckout asks for userID's turn at a queued item, joining the
+// back of its queue first if join is set. The caller is answered with a
+// checkout, exactly as an unqueued item's, once fewer users are ahead of them
+// than there are free units; until then with 202 Accepted and their position.
+func claimQueuedCheckout(w http.ResponseWriter, r *http.Request, redisClient *redis.Client, codeSecret []byte, sale *models.Sale, userID, itemID string, join bool) {
+	now := time.Now()
+	expiresAt := now.Add(sale.ReservationTTL())
+	checkoutCode, err := generateCheckoutCode(codeSecret, userID, itemID, expiresAt)
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error processing checkout")
+		return
+	}
+
+	reserved, ahead, err := redisClient.ClaimQueuedItem(r.Context(), checkoutCode, sale.SaleID, userID, itemID, expiresAt, now.Add(itemQueueLease), join)
+	if errors.Is(err, redis.ErrSoldOut) {
+		writeError(w, errs.ErrSoldOut, "Item is sold out")
+		return
+	}
+
+	if errors.Is(err, redis.ErrNotQueued) {
+		WriteJSONError(w, http.StatusNotFound, ErrCodeNotQueued, "Not waiting for this item, or the place lapsed; check out again to rejoin")
+		return
+	}
+
+	if err != nil {
+		Logger(r.Context()).Error("Failed to claim queued item", "item_id", itemID, "error", err)
+		writeDependencyError(w, err, "Error processing checkout")
+		return
+	}
+
+	if reserved {
+		writeCheckout(w, checkoutCode, expiresAt)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(itemQueuePollAfter/time.Second)))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"queued":        true,
+		"item_id":       itemID,
+		"position":      ahead + 1,
+		"poll_after_ms": itemQueuePollAfter.Milliseconds(),
+		"lease_seconds": int(itemQueueLease / time.Second),
+		"message":       "Waiting for your turn at this item",
+	})
+}
+
+// CheckoutQueueHandler serves /checkout/queue?item_id= for queued items. GET
+// reports the caller's position and, once their turn has come and a unit is
+// free, reserves the item and returns the checkout code; each GET also keeps
+// the caller's place for another itemQueueLease. DELETE leaves the queue.
+// Only the user themselves is served, as for checkout.
+func CheckoutQueueHandler(db *database.DB, redisClient *redis.Client, codeSecret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		userID, item, sale, ok := checkoutTarget(w, r, db)
+		if !ok {
+			return
+		}
+
+		if !item.Queued {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Item has no queue; check it out directly")
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			claimQueuedCheckout(w, r, redisClient, codeSecret, sale, userID, item.ItemID, false)
+			return
+		}
+
+		if err := redisClient.LeaveItemQueue(r.Context(), userID, item.ItemID); err != nil {
+			Logger(r.Context()).Error("Failed to leave item queue", "item_id", item.ItemID, "error", err)
+			writeDependencyError(w, err, "Error leaving queue")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": "Left the queue",
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/models"
+)
+
+func TestCheckoutOfScheduledSaleWaitsForStart(t *testing.T) {
+	redisClient := newTestRedis(t)
+	endTime := time.Now().Add(time.Hour)
+	// Generated LeadTime early, the sale's items are already in Redis
+	seedTestSale(t, redisClient, "sale_1", endTime, 5, "item_1")
+
+	db, mock := newTestDB(t)
+	handler := CheckoutHandler(db, redisClient, testCodeSecret)
+	checkout := func() *httptest.ResponseRecorder {
+		form := url.Values{"user_id": {"user_1"}, "item_id": {"item_1"}}
+		r := httptest.NewRequest(http.MethodPost, "/checkout", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec
+	}
+
+	// Before its start the sale is still scheduled, which the running sale
+	// lookup leaves out along with anything not yet started
+	expectItem(mock, "item_1", "sale_1")
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE status IN ($1, $2) AND start_time <= NOW() AND end_time > NOW()")).
+		WithArgs(models.SaleStatusActive, models.SaleStatusSoldOut, "sale_1").
+		WillReturnRows(sqlmock.NewRows([]string{"sale_id"}))
+	rec := checkout()
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("checkout before the start: status = %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+	}
+	if code := errorCode(t, rec); code != ErrCodeItemNotInSale {
+		t.Errorf("checkout before the start: error code = %q, want %q", code, ErrCodeItemNotInSale)
+	}
+
+	// From its start the activated sale is found and the item reserved
+	expectItem(mock, "item_1", "sale_1")
+	expectActiveSale(mock, "sale_1", endTime, 5)
+	if rec := checkout(); rec.Code != http.StatusOK {
+		t.Fatalf("checkout at the start: status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
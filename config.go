@@ -0,0 +1,610 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"flash-sale-service/internal/breaker"
+	"flash-sale-service/internal/database"
+	"flash-sale-service/internal/models"
+	"flash-sale-service/internal/redis"
+)
+
+// Defaults for settings that aren't given in the environment
+const (
+	DefaultPort                   = 8080
+	DefaultLeadTime               = 5 * time.Minute
+	DefaultCleanupInterval        = 15 * time.Minute
+	DefaultQueueAdmitPerSecond    = 100
+	DefaultMaxInventoryStreams    = 1000
+	DefaultMaxAvailabilityWaits   = 1000
+	DefaultAvailabilityWaitHold   = 25 * time.Second
+	DefaultHealthLatencyThreshold = 250 * time.Millisecond
+	DefaultHealthCacheTTL         = 2 * time.Second
+	DefaultRedisHealthInterval    = time.Second
+	DefaultDBQueryTimeout         = 2 * time.Second
+	DefaultDBSlowQueryThreshold   = 200 * time.Millisecond
+	DefaultMaxPurchaseWrites      = 40
+	DefaultPurchaseWriteWait      = 500 * time.Millisecond
+	DefaultPurchaseSpikeRate      = 100
+	DefaultPurchaseSpikeWindow    = 10 * time.Second
+	DefaultPurchaseSpikeDelay     = time.Second
+	DefaultRateLimitIdle          = 10 * time.Minute
+	DefaultRateLimitStore         = RateLimitStoreRedis
+	DefaultReadTimeout            = 15 * time.Second
+	DefaultWriteTimeout           = 15 * time.Second
+	DefaultIdleTimeout            = 60 * time.Second
+	DefaultShutdownTimeout        = 30 * time.Second
+	DefaultRequestTimeout         = 10 * time.Second
+	DefaultAdminRequestTimeout    = 60 * time.Second
+	DefaultMaxBodyBytes           = 4 << 10
+)
+
+// Where rate limit buckets are kept. In Redis they are shared by every
+// instance, so a client's limit holds however many instances serve it; in
+// memory each instance limits on its own, for running without Redis locally.
+const (
+	RateLimitStoreRedis  = "redis"
+	RateLimitStoreMemory = "memory"
+)
+
+// RateLimitedRoutes are the routes that can be given a rate limit. Health and
+// metrics are never limited so probes and scrapes always get through.
+var RateLimitedRoutes = []string{"checkout", "purchase", "sales", "items"}
+
+// TimeoutRoutes are the routes that can be given their own request timeout;
+// every other route uses RequestTimeout. The inventory stream has none.
+var TimeoutRoutes = []string{"checkout", "purchase", "sales", "items", "admin"}
+
+// Config holds application configuration
+type Config struct {
+	Server    Server
+	Database  database.Config
+	Redis     redis.Config
+	Scheduler Scheduler
+
+	// CheckoutSecret signs checkout codes
+	CheckoutSecret string
+
+	// JWTSecret verifies bearer tokens; checkout and purchase require
+	// authentication when it is set
+	JWTSecret string
+
+	// AdminAPIKey guards the /admin endpoints; they are disabled when empty
+	AdminAPIKey string
+
+	// WebhookURL receives sale and purchase events; webhooks are off when empty
+	WebhookURL string
+
+	// WebhookSecret signs webhook bodies
+	WebhookSecret string
+
+	// PurchaseNotifyURL receives a POST for each completed purchase so the
+	// buyer can be notified; nothing is sent when empty
+	PurchaseNotifyURL string
+
+	// FallbackImageURL is served with every item for the storefront to show
+	// when the item's own image fails to load; none is served when empty
+	FallbackImageURL string
+
+	// ImageHealthChecks probes image hosts in the background and serves the
+	// fallback as the image of items on a host that doesn't answer
+	ImageHealthChecks bool
+
+	// QueueSecret signs waiting room tokens; the waiting room is off when empty
+	QueueSecret string
+
+	// QueueAdmitPerSecond is how many queued users are admitted each second
+	QueueAdmitPerSecond int
+
+	// MaxInventoryStreams caps concurrent inventory SSE connections
+	MaxInventoryStreams int
+
+	// MaxAvailabilityWaits caps concurrent long-poll availability checks
+	MaxAvailabilityWaits int
+
+	// AvailabilityWaitHold is the longest a long-poll availability check is
+	// held open
+	AvailabilityWaitHold time.Duration
+
+	// RateLimits holds the per-client limit for each of RateLimitedRoutes
+	RateLimits map[string]RouteRateLimit
+
+	// RateLimitStore is where the buckets are kept, RateLimitStoreRedis or
+	// RateLimitStoreMemory
+	RateLimitStore string
+
+	// RateLimitIdle is how long a client's bucket is kept after its last
+	// request, for buckets kept in memory
+	RateLimitIdle time.Duration
+
+	// RequestTimeout bounds how long a request may take before the client
+	// gets a 503
+	RequestTimeout time.Duration
+
+	// RouteTimeouts overrides RequestTimeout for each of TimeoutRoutes
+	RouteTimeouts map[string]time.Duration
+
+	// TrustedProxies are the proxy IPs or CIDRs whose X-Forwarded-For is
+	// believed when rate limiting by client IP
+	TrustedProxies []string
+
+	// CORSAllowedOrigins are the browser origins allowed to call the API;
+	// "*" allows any
+	CORSAllowedOrigins []string
+
+	// HealthLatencyThreshold marks a dependency degraded when pings are slower
+	HealthLatencyThreshold time.Duration
+
+	// HealthCacheTTL is how long readiness checks reuse the last dependency
+	// pings; zero pings on every check
+	HealthCacheTTL time.Duration
+
+	// RedisHealthInterval is how often Redis is pinged while it is healthy
+	RedisHealthInterval time.Duration
+
+	RedisBreaker Breaker
+	DBBreaker    Breaker
+
+	// DBQueryTimeout bounds each database query made on behalf of a request
+	DBQueryTimeout time.Duration
+
+	// DBQueryMetrics records per-query latency histograms
+	DBQueryMetrics bool
+
+	// DBSlowQueryThreshold logs queries at least this slow; zero logs none
+	DBSlowQueryThreshold time.Duration
+
+	DBPool database.PoolConfig
+
+	// MaxPurchaseWrites caps purchases being written to the database at once
+	MaxPurchaseWrites int
+
+	// PurchaseWriteWait is how long a purchase waits for its turn to be
+	// written before it is turned away
+	PurchaseWriteWait time.Duration
+
+	// PurchaseSpikes turns on purchase spike detection
+	PurchaseSpikes bool
+
+	// PurchaseSpikeRate is how many purchases per second in one sale count
+	// as a spike
+	PurchaseSpikeRate int
+
+	// PurchaseSpikeWindow is how long the purchase rate is measured over
+	PurchaseSpikeWindow time.Duration
+
+	// PurchaseSpikeDelay is the most a purchase is held while its sale is
+	// spiking
+	PurchaseSpikeDelay time.Duration
+}
+
+// Server holds the HTTP server settings
+type Server struct {
+	Port         int
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// ShutdownTimeout bounds how long in-flight requests get to finish
+	ShutdownTimeout time.Duration
+
+	// MaxBodyBytes caps the size of request bodies
+	MaxBodyBytes int
+}
+
+// Scheduler holds the sale scheduling settings
+type Scheduler struct {
+	// ItemsPerSale is the number of items generated for each sale
+	ItemsPerSale int
+
+	// SalesPerWindow is how many sales are generated for each window
+	SalesPerWindow int
+
+	// SaleDuration is how long each scheduled sale runs
+	SaleDuration time.Duration
+
+	// SaleOffset shifts sale boundaries off the multiples of SaleDuration,
+	// e.g. 15 minutes starts hourly sales at quarter past
+	SaleOffset time.Duration
+
+	// LeadTime is how long before its start each sale is generated
+	LeadTime time.Duration
+
+	// CleanupInterval is how often expired checkouts are released and sold
+	// counts reconciled
+	CleanupInterval time.Duration
+
+	// CleanupJitter spreads each cleanup pass randomly up to this much either
+	// side of CleanupInterval, so a fleet doesn't clean up in lockstep
+	CleanupJitter time.Duration
+
+	// GenerationJitter delays each window's sale generation by a random
+	// amount up to this, after LeadTime before the start
+	GenerationJitter time.Duration
+
+	// ImageURLTemplate builds generated items' image URLs, with {itemID}
+	// replaced by the item ID; empty uses picsum.photos placeholders
+	ImageURLTemplate string
+
+	// UniqueItemNames keeps generated item names from repeating within a
+	// sale
+	UniqueItemNames bool
+
+	// ItemTiers is the share of generated items in each rarity tier; empty
+	// makes every item common
+	ItemTiers []models.TierShare
+
+	// QueuedTiers lists the tiers whose generated items are checked out in
+	// arrival order through a reservation queue
+	QueuedTiers []string
+
+	// GenerationWorkers is how many goroutines generate a sale's items; zero
+	// uses one per CPU
+	GenerationWorkers int
+
+	// CheckoutTTL is how long a checkout in each new sale holds an item
+	CheckoutTTL time.Duration
+
+	// DryRun generates sales as usual but only logs their writes, and skips
+	// activation and cleanup, for benchmarking generation against a live
+	// deployment's settings
+	DryRun bool
+}
+
+// RouteRateLimit is the token bucket applied to one route; a zero Rate leaves
+// the route unlimited
+type RouteRateLimit struct {
+	Rate  int
+	Burst int
+}
+
+// Breaker holds the settings of a circuit breaker: Threshold consecutive
+// failures open it for Cooldown
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// env reads typed values from the environment, collecting every malformed one
+// so they can all be reported at once
+type env struct {
+	errs []error
+}
+
+// getString returns the variable's value or def
+func (e *env) getString(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// getInt returns the variable as an integer or def
+func (e *env) getInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be an integer, got %q", key, value))
+		return def
+	}
+	return n
+}
+
+// getBool returns the variable as a boolean or def
+func (e *env) getBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be true or false, got %q", key, value))
+		return def
+	}
+	return b
+}
+
+// getDuration returns the variable, an integer count of unit, as a duration or
+// def
+func (e *env) getDuration(key string, def, unit time.Duration) time.Duration {
+	return time.Duration(e.getInt(key, int(def/unit))) * unit
+}
+
+// getList returns a comma-separated variable as a list
+func (e *env) getList(key string) []string {
+	var list []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// getTierShares returns a list of tier:percent pairs such as
+// legendary:5,rare:20,common:75
+func (e *env) getTierShares(key string) []models.TierShare {
+	var shares []models.TierShare
+	for _, pair := range e.getList(key) {
+		tier, percent, ok := strings.Cut(pair, ":")
+		n, err := strconv.Atoi(strings.TrimSpace(percent))
+		if !ok || err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s entries must be tier:percent, got %q", key, pair))
+			continue
+		}
+		shares = append(shares, models.TierShare{Tier: strings.TrimSpace(tier), Percent: n})
+	}
+	return shares
+}
+
+// getBreaker reads <prefix>_BREAKER_THRESHOLD and <prefix>_BREAKER_COOLDOWN_MS
+func (e *env) getBreaker(prefix string) Breaker {
+	return Breaker{
+		Threshold: e.getInt(prefix+"_BREAKER_THRESHOLD", breaker.DefaultFailureThreshold),
+		Cooldown:  e.getDuration(prefix+"_BREAKER_COOLDOWN_MS", breaker.DefaultCooldown, time.Millisecond),
+	}
+}
+
+// getRateLimits reads RATE_LIMIT_<ROUTE>_RPS and RATE_LIMIT_<ROUTE>_BURST for
+// each rate limited route. The burst defaults to the rate.
+func (e *env) getRateLimits() map[string]RouteRateLimit {
+	limits := make(map[string]RouteRateLimit, len(RateLimitedRoutes))
+	for _, route := range RateLimitedRoutes {
+		prefix := "RATE_LIMIT_" + strings.ToUpper(route)
+		rate := e.getInt(prefix+"_RPS", 0)
+		limits[route] = RouteRateLimit{Rate: rate, Burst: e.getInt(prefix+"_BURST", rate)}
+	}
+	return limits
+}
+
+// getRouteTimeouts reads the timeout of each of TimeoutRoutes, defaulting to
+// def; admin operations such as creating or warming a sale default to
+// DefaultAdminRequestTimeout
+func (e *env) getRouteTimeouts(def time.Duration) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration, len(TimeoutRoutes))
+	for _, route := range TimeoutRoutes {
+		routeDef := def
+		if route == "admin" {
+			routeDef = DefaultAdminRequestTimeout
+		}
+		timeouts[route] = e.getDuration("REQUEST_TIMEOUT_"+strings.ToUpper(route)+"_MS", routeDef, time.Millisecond)
+	}
+	return timeouts
+}
+
+// Load reads the configuration from environment variables and validates it.
+// The error lists every problem found, not just the first.
+func Load() (*Config, error) {
+	e := &env{}
+	cfg := &Config{
+		Server: Server{
+			Port:            e.getInt("PORT", DefaultPort),
+			ReadTimeout:     e.getDuration("READ_TIMEOUT_SECONDS", DefaultReadTimeout, time.Second),
+			WriteTimeout:    e.getDuration("WRITE_TIMEOUT_SECONDS", DefaultWriteTimeout, time.Second),
+			IdleTimeout:     e.getDuration("IDLE_TIMEOUT_SECONDS", DefaultIdleTimeout, time.Second),
+			ShutdownTimeout: e.getDuration("SHUTDOWN_TIMEOUT_SECONDS", DefaultShutdownTimeout, time.Second),
+			MaxBodyBytes:    e.getInt("MAX_BODY_BYTES", DefaultMaxBodyBytes),
+		},
+		Database: database.Config{
+			Host:     e.getString("DB_HOST", "localhost"),
+			Port:     e.getInt("DB_PORT", 5432),
+			User:     e.getString("DB_USER", "postgres"),
+			Password: e.getString("DB_PASSWORD", "password"),
+			DBName:   e.getString("DB_NAME", "flashsale"),
+			SSLMode:  e.getString("DB_SSLMODE", "disable"),
+		},
+		Redis: redis.Config{
+			Addr:     e.getString("REDIS_ADDR", "localhost:6379"),
+			Password: e.getString("REDIS_PASSWORD", ""),
+			DB:       e.getInt("REDIS_DB", 0),
+		},
+		Scheduler: Scheduler{
+			ItemsPerSale:      e.getInt("ITEMS_PER_SALE", models.ItemsPerSale),
+			SalesPerWindow:    e.getInt("SALES_PER_WINDOW", models.SalesPerWindow),
+			SaleDuration:      e.getDuration("SALE_DURATION_SECONDS", models.SaleDuration, time.Second),
+			SaleOffset:        e.getDuration("SALE_OFFSET_SECONDS", 0, time.Second),
+			LeadTime:          e.getDuration("SALE_LEAD_TIME_SECONDS", DefaultLeadTime, time.Second),
+			CleanupInterval:   e.getDuration("CLEANUP_INTERVAL_SECONDS", DefaultCleanupInterval, time.Second),
+			CleanupJitter:     e.getDuration("CLEANUP_JITTER_SECONDS", 0, time.Second),
+			GenerationJitter:  e.getDuration("SALE_GENERATION_JITTER_SECONDS", 0, time.Second),
+			ImageURLTemplate:  e.getString("ITEM_IMAGE_URL_TEMPLATE", ""),
+			UniqueItemNames:   e.getBool("UNIQUE_ITEM_NAMES", false),
+			ItemTiers:         e.getTierShares("ITEM_TIERS"),
+			QueuedTiers:       e.getList("QUEUED_ITEM_TIERS"),
+			GenerationWorkers: e.getInt("ITEM_GENERATION_WORKERS", 0),
+			CheckoutTTL:       e.getDuration("CHECKOUT_TTL_SECONDS", models.CheckoutReservationTTL, time.Second),
+			DryRun:            e.getBool("SCHEDULER_DRY_RUN", false),
+		},
+		CheckoutSecret:         e.getString("CHECKOUT_SECRET", ""),
+		JWTSecret:              e.getString("JWT_SECRET", ""),
+		AdminAPIKey:            e.getString("ADMIN_API_KEY", ""),
+		WebhookURL:             e.getString("WEBHOOK_URL", ""),
+		WebhookSecret:          e.getString("WEBHOOK_SECRET", ""),
+		PurchaseNotifyURL:      e.getString("PURCHASE_NOTIFY_URL", ""),
+		FallbackImageURL:       e.getString("ITEM_FALLBACK_IMAGE_URL", ""),
+		ImageHealthChecks:      e.getBool("ITEM_IMAGE_HEALTH_CHECKS", false),
+		QueueSecret:            e.getString("QUEUE_SECRET", ""),
+		QueueAdmitPerSecond:    e.getInt("QUEUE_ADMIT_PER_SECOND", DefaultQueueAdmitPerSecond),
+		MaxInventoryStreams:    e.getInt("MAX_INVENTORY_STREAMS", DefaultMaxInventoryStreams),
+		MaxAvailabilityWaits:   e.getInt("MAX_AVAILABILITY_WAITS", DefaultMaxAvailabilityWaits),
+		AvailabilityWaitHold:   e.getDuration("AVAILABILITY_WAIT_SECONDS", DefaultAvailabilityWaitHold, time.Second),
+		RateLimits:             e.getRateLimits(),
+		RateLimitStore:         e.getString("RATE_LIMIT_STORE", DefaultRateLimitStore),
+		RateLimitIdle:          e.getDuration("RATE_LIMIT_IDLE_SECONDS", DefaultRateLimitIdle, time.Second),
+		RequestTimeout:         e.getDuration("REQUEST_TIMEOUT_MS", DefaultRequestTimeout, time.Millisecond),
+		TrustedProxies:         e.getList("TRUSTED_PROXIES"),
+		CORSAllowedOrigins:     e.getList("CORS_ALLOWED_ORIGINS"),
+		HealthLatencyThreshold: e.getDuration("HEALTH_LATENCY_THRESHOLD_MS", DefaultHealthLatencyThreshold, time.Millisecond),
+		HealthCacheTTL:         e.getDuration("HEALTH_CACHE_MS", DefaultHealthCacheTTL, time.Millisecond),
+		RedisHealthInterval:    e.getDuration("REDIS_HEALTH_CHECK_INTERVAL_MS", DefaultRedisHealthInterval, time.Millisecond),
+		RedisBreaker:           e.getBreaker("REDIS"),
+		DBBreaker:              e.getBreaker("DB"),
+		DBQueryTimeout:         e.getDuration("DB_QUERY_TIMEOUT_MS", DefaultDBQueryTimeout, time.Millisecond),
+		DBQueryMetrics:         e.getBool("DB_QUERY_METRICS", true),
+		DBSlowQueryThreshold:   e.getDuration("DB_SLOW_QUERY_MS", DefaultDBSlowQueryThreshold, time.Millisecond),
+		DBPool: database.PoolConfig{
+			MaxOpenConns:    e.getInt("DB_MAX_OPEN_CONNS", database.DefaultMaxOpenConns),
+			MaxIdleConns:    e.getInt("DB_MAX_IDLE_CONNS", database.DefaultMaxIdleConns),
+			ConnMaxLifetime: e.getDuration("DB_CONN_MAX_LIFETIME_SECONDS", database.DefaultConnMaxLifetime, time.Second),
+			ConnMaxIdleTime: e.getDuration("DB_CONN_MAX_IDLE_TIME_SECONDS", database.DefaultConnMaxIdleTime, time.Second),
+		},
+		MaxPurchaseWrites: e.getInt("MAX_PURCHASE_WRITES", DefaultMaxPurchaseWrites),
+		PurchaseWriteWait: e.getDuration("PURCHASE_WRITE_WAIT_MS", DefaultPurchaseWriteWait, time.Millisecond),
+
+		PurchaseSpikes:      e.getBool("PURCHASE_SPIKE_DETECTION", false),
+		PurchaseSpikeRate:   e.getInt("PURCHASE_SPIKE_RATE", DefaultPurchaseSpikeRate),
+		PurchaseSpikeWindow: e.getDuration("PURCHASE_SPIKE_WINDOW_SECONDS", DefaultPurchaseSpikeWindow, time.Second),
+		PurchaseSpikeDelay:  e.getDuration("PURCHASE_SPIKE_DELAY_MS", DefaultPurchaseSpikeDelay, time.Millisecond),
+	}
+	cfg.RouteTimeouts = e.getRouteTimeouts(cfg.RequestTimeout)
+
+	errs := append(e.errs, cfg.Validate()...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return cfg, nil
+}
+
+// Validate returns every setting that is out of range or inconsistent
+func (c *Config) Validate() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port <= 65535, "PORT must be between 1 and 65535, got %d", c.Server.Port)
+	check(c.Server.ReadTimeout > 0, "READ_TIMEOUT_SECONDS must be positive")
+	check(c.Server.WriteTimeout > 0, "WRITE_TIMEOUT_SECONDS must be positive")
+	check(c.Server.IdleTimeout > 0, "IDLE_TIMEOUT_SECONDS must be positive")
+	check(c.Server.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT_SECONDS must be positive")
+	check(c.Server.MaxBodyBytes > 0, "MAX_BODY_BYTES must be positive, got %d", c.Server.MaxBodyBytes)
+
+	check(c.Scheduler.ItemsPerSale > 0 && c.Scheduler.ItemsPerSale <= models.MaxItemsPerSale,
+		"ITEMS_PER_SALE must be between 1 and %d, got %d", models.MaxItemsPerSale, c.Scheduler.ItemsPerSale)
+	check(c.Scheduler.SalesPerWindow > 0 && c.Scheduler.SalesPerWindow <= models.MaxSalesPerWindow,
+		"SALES_PER_WINDOW must be between 1 and %d, got %d", models.MaxSalesPerWindow, c.Scheduler.SalesPerWindow)
+	saleSeconds := int(c.Scheduler.SaleDuration / time.Second)
+	check(c.Scheduler.SaleDuration > 0 && c.Scheduler.SaleDuration <= models.MaxSaleDuration,
+		"SALE_DURATION_SECONDS must be between 1 and %d, got %d", int(models.MaxSaleDuration/time.Second), saleSeconds)
+	check(c.Scheduler.SaleOffset >= 0 && c.Scheduler.SaleOffset < c.Scheduler.SaleDuration,
+		"SALE_OFFSET_SECONDS must be between 0 and %d, got %d", saleSeconds-1, int(c.Scheduler.SaleOffset/time.Second))
+	check(c.Scheduler.LeadTime >= 0 && c.Scheduler.LeadTime < c.Scheduler.SaleDuration,
+		"SALE_LEAD_TIME_SECONDS must be between 0 and %d, got %d",
+		saleSeconds-1, int(c.Scheduler.LeadTime/time.Second))
+	check(c.Scheduler.CleanupInterval > 0 && c.Scheduler.CleanupInterval < c.Scheduler.SaleDuration,
+		"CLEANUP_INTERVAL_SECONDS must be between 1 and %d, got %d",
+		saleSeconds-1, int(c.Scheduler.CleanupInterval/time.Second))
+	check(c.Scheduler.CleanupJitter >= 0 && c.Scheduler.CleanupJitter < c.Scheduler.CleanupInterval,
+		"CLEANUP_JITTER_SECONDS must be between 0 and %d, got %d",
+		int(c.Scheduler.CleanupInterval/time.Second)-1, int(c.Scheduler.CleanupJitter/time.Second))
+	check(c.Scheduler.GenerationJitter == 0 || (c.Scheduler.GenerationJitter > 0 && c.Scheduler.GenerationJitter < c.Scheduler.LeadTime),
+		"SALE_GENERATION_JITTER_SECONDS must be 0 or under SALE_LEAD_TIME_SECONDS (%d), got %d",
+		int(c.Scheduler.LeadTime/time.Second), int(c.Scheduler.GenerationJitter/time.Second))
+	check(c.Scheduler.GenerationWorkers >= 0,
+		"ITEM_GENERATION_WORKERS must not be negative, got %d", c.Scheduler.GenerationWorkers)
+	check(c.Scheduler.CheckoutTTL >= models.MinCheckoutTTL && c.Scheduler.CheckoutTTL <= models.MaxCheckoutTTL,
+		"CHECKOUT_TTL_SECONDS must be between %d and %d, got %d",
+		int(models.MinCheckoutTTL/time.Second), int(models.MaxCheckoutTTL/time.Second), int(c.Scheduler.CheckoutTTL/time.Second))
+	check(c.Scheduler.ImageURLTemplate == "" || validImageURLTemplate(c.Scheduler.ImageURLTemplate),
+		"ITEM_IMAGE_URL_TEMPLATE must be an http(s) URL containing {itemID}, got %q", c.Scheduler.ImageURLTemplate)
+	tierErr := models.ValidateTierShares(c.Scheduler.ItemTiers)
+	check(tierErr == nil, "ITEM_TIERS is invalid: %v", tierErr)
+	for _, tier := range c.Scheduler.QueuedTiers {
+		check(models.IsTier(tier), "QUEUED_ITEM_TIERS must list tiers out of %v, got %q", models.Tiers, tier)
+	}
+
+	check(c.FallbackImageURL == "" || validHTTPURL(c.FallbackImageURL),
+		"ITEM_FALLBACK_IMAGE_URL must be an http(s) URL, got %q", c.FallbackImageURL)
+	check(!c.ImageHealthChecks || c.FallbackImageURL != "",
+		"ITEM_FALLBACK_IMAGE_URL must be set when ITEM_IMAGE_HEALTH_CHECKS is")
+
+	check(c.CheckoutSecret != "", "CHECKOUT_SECRET must be set")
+	check(c.WebhookURL == "" || c.WebhookSecret != "", "WEBHOOK_SECRET must be set when WEBHOOK_URL is")
+	check(c.QueueSecret == "" || c.QueueAdmitPerSecond > 0,
+		"QUEUE_ADMIT_PER_SECOND must be positive, got %d", c.QueueAdmitPerSecond)
+	check(c.MaxInventoryStreams > 0, "MAX_INVENTORY_STREAMS must be positive, got %d", c.MaxInventoryStreams)
+	check(c.MaxAvailabilityWaits > 0, "MAX_AVAILABILITY_WAITS must be positive, got %d", c.MaxAvailabilityWaits)
+	check(c.AvailabilityWaitHold > 0 && c.AvailabilityWaitHold <= 5*time.Minute,
+		"AVAILABILITY_WAIT_SECONDS must be between 1 and 300, got %d", int(c.AvailabilityWaitHold/time.Second))
+
+	for _, route := range RateLimitedRoutes {
+		limit := c.RateLimits[route]
+		name := "RATE_LIMIT_" + strings.ToUpper(route)
+		check(limit.Rate >= 0, "%s_RPS must not be negative, got %d", name, limit.Rate)
+		check(limit.Rate == 0 || limit.Burst > 0, "%s_BURST must be positive when %s_RPS is set, got %d", name, name, limit.Burst)
+	}
+	check(c.RateLimitStore == RateLimitStoreRedis || c.RateLimitStore == RateLimitStoreMemory,
+		"RATE_LIMIT_STORE must be %q or %q, got %q", RateLimitStoreRedis, RateLimitStoreMemory, c.RateLimitStore)
+	check(c.RateLimitIdle > 0, "RATE_LIMIT_IDLE_SECONDS must be positive")
+
+	check(c.RequestTimeout > 0, "REQUEST_TIMEOUT_MS must be positive")
+	for _, route := range TimeoutRoutes {
+		check(c.RouteTimeouts[route] > 0, "REQUEST_TIMEOUT_%s_MS must be positive", strings.ToUpper(route))
+	}
+
+	for _, origin := range c.CORSAllowedOrigins {
+		check(validOrigin(origin), "CORS_ALLOWED_ORIGINS entry %q must be \"*\" or scheme://host[:port]", origin)
+	}
+
+	check(c.HealthLatencyThreshold > 0, "HEALTH_LATENCY_THRESHOLD_MS must be positive")
+	check(c.HealthCacheTTL >= 0, "HEALTH_CACHE_MS must not be negative")
+	check(c.RedisHealthInterval > 0, "REDIS_HEALTH_CHECK_INTERVAL_MS must be positive")
+	check(c.RedisBreaker.Threshold > 0, "REDIS_BREAKER_THRESHOLD must be positive, got %d", c.RedisBreaker.Threshold)
+	check(c.RedisBreaker.Cooldown > 0, "REDIS_BREAKER_COOLDOWN_MS must be positive")
+	check(c.DBBreaker.Threshold > 0, "DB_BREAKER_THRESHOLD must be positive, got %d", c.DBBreaker.Threshold)
+	check(c.DBBreaker.Cooldown > 0, "DB_BREAKER_COOLDOWN_MS must be positive")
+	check(c.DBQueryTimeout > 0, "DB_QUERY_TIMEOUT_MS must be positive")
+	check(c.DBSlowQueryThreshold >= 0, "DB_SLOW_QUERY_MS must not be negative")
+	check(c.DBPool.MaxOpenConns > 0, "DB_MAX_OPEN_CONNS must be positive, got %d", c.DBPool.MaxOpenConns)
+	check(c.DBPool.MaxIdleConns >= 0 && c.DBPool.MaxIdleConns <= c.DBPool.MaxOpenConns,
+		"DB_MAX_IDLE_CONNS must be between 0 and DB_MAX_OPEN_CONNS, got %d", c.DBPool.MaxIdleConns)
+	check(c.DBPool.ConnMaxLifetime > 0, "DB_CONN_MAX_LIFETIME_SECONDS must be positive")
+	check(c.DBPool.ConnMaxIdleTime > 0, "DB_CONN_MAX_IDLE_TIME_SECONDS must be positive")
+	check(c.MaxPurchaseWrites > 0, "MAX_PURCHASE_WRITES must be positive, got %d", c.MaxPurchaseWrites)
+	check(c.PurchaseWriteWait >= 0, "PURCHASE_WRITE_WAIT_MS must not be negative")
+	check(c.PurchaseSpikeRate > 0, "PURCHASE_SPIKE_RATE must be positive, got %d", c.PurchaseSpikeRate)
+	check(c.PurchaseSpikeWindow >= time.Second && c.PurchaseSpikeWindow <= redis.MaxSalePurchaseWindow,
+		"PURCHASE_SPIKE_WINDOW_SECONDS must be between 1 and %d, got %d",
+		int(redis.MaxSalePurchaseWindow/time.Second), int(c.PurchaseSpikeWindow/time.Second))
+	check(c.PurchaseSpikeDelay >= 0, "PURCHASE_SPIKE_DELAY_MS must not be negative")
+
+	return errs
+}
+
+// validImageURLTemplate accepts an absolute http(s) URL with an {itemID}
+// placeholder
+func validImageURLTemplate(template string) bool {
+	return strings.Contains(template, "{itemID}") && validHTTPURL(template)
+}
+
+// validHTTPURL accepts absolute http and https URLs
+func validHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validOrigin accepts "*" or a bare origin such as https://shop.example.com
+func validOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		(u.Path == "" || u.Path == "/") && u.RawQuery == "" && u.Fragment == "" && u.User == nil
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+)
+
+type contextKey string
+
+const (
+	userIDContextKey    contextKey = "user_id"
+	requestIDContextKey contextKey = "request_id"
+)
+
+// RequestIDHeader carries the request ID in requests and responses
+const RequestIDHeader = "X-Request-ID"
+
+// ContextWithUser returns a copy of ctx carrying the authenticated user ID
+func ContextWithUser(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDContextKey, userID)
+}
+
+// UserFromContext returns the authenticated user ID stored in ctx, if any
+func UserFromContext(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(userIDContextKey).(string)
+	return userID, ok && userID != ""
+}
+
+// ContextWithRequestID returns a copy of ctx carrying the request ID
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, requestID)
+}
+
+// RequestIDFromContext returns the request ID stored in ctx, if any
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(requestIDContextKey).(string)
+	return requestID, ok && requestID != ""
+}
+
+// Logger returns the default structured logger tagged with the request ID and
+// authenticated user from ctx, so every line can be traced to its request
+func Logger(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if requestID, ok := RequestIDFromContext(ctx); ok {
+		logger = logger.With("request_id", requestID)
+	}
+	if userID, ok := UserFromContext(ctx); ok {
+		logger = logger.With("auth_user_id", userID)
+	}
+	return logger
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/handlers"
+)
+
+const (
+	corsAllowMethods  = "GET, POST, DELETE, OPTIONS"
+	corsAllowHeaders  = "Content-Type, Authorization, Idempotency-Key, X-Queue-Token, " + handlers.RequestIDHeader
+	corsExposeHeaders = handlers.RequestIDHeader + ", Retry-After, ETag"
+
+	// corsMaxAge is how long browsers may cache a preflight result
+	corsMaxAge = 10 * time.Minute
+)
+
+// CORSMiddleware lets browser frontends on allowedOrigins call the API. A
+// request carrying any other Origin is rejected with 403 instead of being
+// served, preflight or not. Requests without an Origin header, i.e. from
+// anything but a browser, pass through untouched. The single origin "*"
+// allows every origin and is meant for development only.
+func CORSMiddleware(allowedOrigins []string) func(http.Handler) http.Handler {
+	allowAll := false
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		if origin == "*" {
+			allowAll = true
+		}
+		allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The answer depends on Origin, so caches must not share it
+			w.Header().Add("Vary", "Origin")
+			if !allowAll && !allowed[strings.ToLower(origin)] {
+				handlers.WriteJSONError(w, http.StatusForbidden, handlers.ErrCodeForbidden, "Origin not allowed")
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge/time.Second)))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,1146 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"flash-sale-service/internal/breaker"
+	"flash-sale-service/internal/errs"
+	"flash-sale-service/internal/metrics"
+	"flash-sale-service/internal/models"
+)
+
+var (
+	// ErrDuplicatePurchase is returned when a user already has a purchase in a sale
+	ErrDuplicatePurchase = errs.New(errs.ErrUserLimitReached, "user already purchased in this sale")
+
+	// ErrStaleItemsSold is returned when the items sold count changed since
+	// the caller read it. Callers re-read the recorded count to retry.
+	ErrStaleItemsSold = errors.New("items sold update is stale")
+)
+
+// uniqueViolation is the PostgreSQL error code for a unique constraint failure
+const uniqueViolation = "23505"
+
+// IsTransient reports whether err may pass if the statement is tried again:
+// the breaker is open, the connection failed or timed out, or PostgreSQL
+// refused it for a passing reason such as a serialization failure, too many
+// connections or a server shutting down. Constraint violations and bad SQL
+// are permanent.
+func IsTransient(err error) bool {
+	if errors.Is(err, breaker.ErrOpen) || errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Connection exception, transaction rollback, insufficient resources
+		// and operator intervention
+		switch pqErr.Code.Class() {
+		case "08", "40", "53", "57":
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// itemInsertBatchSize is the number of rows written per INSERT statement.
+// Nine parameters per row keeps a batch well under PostgreSQL's 65535 limit.
+const itemInsertBatchSize = 500
+
+// DB wraps the PostgreSQL connection pool
+type DB struct {
+	*sql.DB
+
+	// Breaker, when set, guards the hot-path queries behind checkout and
+	// purchase so they fail fast with breaker.ErrOpen while PostgreSQL is
+	// struggling instead of queueing for connections
+	Breaker *breaker.Breaker
+
+	// QueryTimeout bounds each query made through a Context method, on top of
+	// the caller's own deadline; zero adds none
+	QueryTimeout time.Duration
+
+	// QueryMetrics records every query's duration in
+	// metrics.DBQueryDuration, labelled by query name
+	QueryMetrics bool
+
+	// SlowQueryThreshold logs queries that take at least this long; zero logs
+	// none
+	SlowQueryThreshold time.Duration
+}
+
+// Config holds the PostgreSQL connection settings
+type Config struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	DBName   string
+	SSLMode  string
+}
+
+// dsn renders cfg as a lib/pq connection string
+func (cfg Config) dsn() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.DBName, cfg.SSLMode)
+}
+
+// ConnectDB opens the connection pool described by cfg and checks that the
+// server answers
+func ConnectDB(cfg Config) (*DB, error) {
+	sqlDB, err := sql.Open("postgres", cfg.dsn())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to reach database at %s:%d: %w", cfg.Host, cfg.Port, err)
+	}
+
+	return &DB{DB: sqlDB}, nil
+}
+
+// Connection pool defaults, sized for the top-of-hour burst: every connection
+// is kept idle and ready rather than dialled while buyers wait
+const (
+	DefaultMaxOpenConns    = 50
+	DefaultMaxIdleConns    = 50
+	DefaultConnMaxLifetime = 30 * time.Minute
+	DefaultConnMaxIdleTime = 5 * time.Minute
+)
+
+// PoolConfig sizes the connection pool
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// ConfigurePool applies cfg to the connection pool
+func (db *DB) ConfigurePool(cfg PoolConfig) {
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+}
+
+// withTimeout derives the context for one query from ctx
+func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, db.QueryTimeout)
+}
+
+// observe records how long the named query took since start. It is
+// deferred at the top of every query method; with metrics and slow query
+// logging both off it returns straight away.
+func (db *DB) observe(query string, start time.Time) {
+	if !db.QueryMetrics && db.SlowQueryThreshold <= 0 {
+		return
+	}
+
+	elapsed := time.Since(start)
+	if db.QueryMetrics {
+		metrics.DBQueryDuration.WithLabelValues(query).Observe(elapsed.Seconds())
+	}
+	if db.SlowQueryThreshold > 0 && elapsed >= db.SlowQueryThreshold {
+		slog.Warn("Slow query", "query", query, "duration", elapsed)
+	}
+}
+
+// guard runs fn through the breaker, if there is one. A missing row or a
+// duplicate purchase is an answer from a healthy database, not a failure, and
+// a caller that went away says nothing either way. Timeouts do count.
+func (db *DB) guard(fn func() error) error {
+	if db.Breaker == nil {
+		return fn()
+	}
+	if err := db.Breaker.Allow(); err != nil {
+		return err
+	}
+
+	err := fn()
+	switch {
+	case errors.Is(err, context.Canceled):
+		db.Breaker.Abandon()
+	case err == sql.ErrNoRows || errors.Is(err, ErrDuplicatePurchase):
+		db.Breaker.Record(nil)
+	default:
+		db.Breaker.Record(err)
+	}
+	return err
+}
+
+// CreateSale inserts a sale record
+func (db *DB) CreateSale(sale *models.Sale) error {
+	return db.CreateSaleContext(context.Background(), sale)
+}
+
+// CreateSaleContext is CreateSale bounded by ctx
+func (db *DB) CreateSaleContext(ctx context.Context, sale *models.Sale) error {
+	defer db.observe("create_sale", time.Now())
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO sales (sale_id, start_time, end_time, total_items, items_sold, status, checkout_ttl_seconds, pending_items)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, sale.SaleID, sale.StartTime.UTC(), sale.EndTime.UTC(), sale.TotalItems, sale.ItemsSold, sale.Status,
+		int(sale.ReservationTTL()/time.Second), sale.PendingItems)
+	if err != nil {
+		return fmt.Errorf("failed to create sale %s: %w", sale.SaleID, err)
+	}
+	return nil
+}
+
+// activeSalesQuery selects the sales that are currently running: a sale that
+// sold out before its end time is still included; a scheduled sale is not,
+// even once its start time has passed, until the scheduler activates it.
+const activeSalesQuery = `
+	SELECT sale_id, start_time, end_time, total_items, items_sold, status, checkout_ttl_seconds
+	FROM sales
+	WHERE status IN ($1, $2) AND start_time <= NOW() AND end_time > NOW()
+`
+
+// GetActiveSales returns every sale that is currently running, most recently
+// started first
+func (db *DB) GetActiveSales() ([]models.Sale, error) {
+	return db.GetActiveSalesContext(context.Background())
+}
+
+// GetActiveSalesContext is GetActiveSales bounded by ctx
+func (db *DB) GetActiveSalesContext(ctx context.Context) ([]models.Sale, error) {
+	defer db.observe("get_active_sales", time.Now())
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var sales []models.Sale
+	err := db.guard(func() error {
+		rows, err := db.QueryContext(ctx, activeSalesQuery+`
+			ORDER BY start_time DESC, sale_id
+		`, models.SaleStatusActive, models.SaleStatusSoldOut)
+		if err != nil {
+			return err
+		}
+		sales, err = scanSales(rows)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query active sales: %w", err)
+	}
+	return sales, nil
+}
+
+// GetActiveSale returns one sale that is currently running, or nil if none is.
+// It is the most recently started of GetActiveSales, for callers that only
+// deal with a single sale.
+func (db *DB) GetActiveSale() (*models.Sale, error) {
+	return db.GetActiveSaleContext(context.Background())
+}
+
+// GetActiveSaleContext is GetActiveSale bounded by ctx
+func (db *DB) GetActiveSaleContext(ctx context.Context) (*models.Sale, error) {
+	defer db.observe("get_active_sale", time.Now())
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	sale := &models.Sale{}
+	var ttlSeconds int
+	err := db.guard(func() error {
+		return db.QueryRowContext(ctx, activeSalesQuery+`
+			ORDER BY start_time DESC, sale_id
+			LIMIT 1
+		`, models.SaleStatusActive, models.SaleStatusSoldOut).Scan(
+			&sale.SaleID, &sale.StartTime, &sale.EndTime,
+			&sale.TotalItems, &sale.ItemsSold, &sale.Status, &ttlSeconds,
+		)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query active sale: %w", err)
+	}
+	fillSale(sale, ttlSeconds)
+	return sale, nil
+}
+
+// GetActiveSaleByIDContext returns the sale with the given ID if it is
+// currently running, or nil if it is not. Checkout and purchase use it to
+// resolve the sale an item belongs to.
+func (db *DB) GetActiveSaleByIDContext(ctx context.Context, saleID string) (*models.Sale, error) {
+	defer db.observe("get_active_sale_by_id", time.Now())
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	sale := &models.Sale{}
+	var ttlSeconds int
+	err := db.guard(func() error {
+		return db.QueryRowContext(ctx, activeSalesQuery+`
+			AND sale_id = $3
+		`, models.SaleStatusActive, models.SaleStatusSoldOut, saleID).Scan(
+			&sale.SaleID, &sale.StartTime, &sale.EndTime,
+			&sale.TotalItems, &sale.ItemsSold, &sale.Status, &ttlSeconds,
+		)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query active sale %s: %w", saleID, err)
+	}
+	fillSale(sale, ttlSeconds)
+	return sale, nil
+}
+
+// GetSaleByID returns the sale with the given ID, or nil if it does not exist
+func (db *DB) GetSaleByID(saleID string) (*models.Sale, error) {
+	defer db.observe("get_sale_by_id", time.Now())
+
+	sale := &models.Sale{}
+	var ttlSeconds int
+	err := db.QueryRow(`
+		SELECT sale_id, start_time, end_time, total_items, items_sold, status, checkout_ttl_seconds
+		FROM sales
+		WHERE sale_id = $1
+	`, saleID).Scan(
+		&sale.SaleID, &sale.StartTime, &sale.EndTime,
+		&sale.TotalItems, &sale.ItemsSold, &sale.Status, &ttlSeconds,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sale %s: %w", saleID, err)
+	}
+	fillSale(sale, ttlSeconds)
+	return sale, nil
+}
+
+// GetUpcomingSales returns up to limit sales that have not started yet,
+// soonest first
+func (db *DB) GetUpcomingSales(limit int) ([]models.Sale, error) {
+	defer db.observe("get_upcoming_sales", time.Now())
+
+	rows, err := db.Query(`
+		SELECT sale_id, start_time, end_time, total_items, items_sold, status, checkout_ttl_seconds
+		FROM sales
+		WHERE start_time > NOW()
+		ORDER BY start_time
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upcoming sales: %w", err)
+	}
+	return scanSales(rows)
+}
+
+// CountSalesForStart returns how many sales starting at startTime already exist
+func (db *DB) CountSalesForStart(startTime time.Time) (int, error) {
+	defer db.observe("count_sales_for_start", time.Now())
+
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sales WHERE start_time = $1`, startTime).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count sales for start time: %w", err)
+	}
+	return count, nil
+}
+
+// SaleOverlaps reports whether a sale that is scheduled or running overlaps
+// the window from start to end
+func (db *DB) SaleOverlaps(start, end time.Time) (bool, error) {
+	defer db.observe("sale_overlaps", time.Now())
+
+	var overlaps bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM sales
+			WHERE status IN ($1, $2, $3) AND start_time < $5 AND end_time > $4
+		)
+	`, models.SaleStatusScheduled, models.SaleStatusActive, models.SaleStatusSoldOut, start, end).Scan(&overlaps)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for overlapping sales: %w", err)
+	}
+	return overlaps, nil
+}
+
+// fillSale finishes a scanned sale: its times are put in UTC, whatever zone
+// the database session reports them in, and its checkout TTL is set
+func fillSale(sale *models.Sale, ttlSeconds int) {
+	sale.StartTime = sale.StartTime.UTC()
+	sale.EndTime = sale.EndTime.UTC()
+	sale.CheckoutTTL = time.Duration(ttlSeconds) * time.Second
+}
+
+// scanSales reads every row of a sales query and closes rows
+func scanSales(rows *sql.Rows) ([]models.Sale, error) {
+	defer rows.Close()
+
+	sales := []models.Sale{}
+	for rows.Next() {
+		var sale models.Sale
+		var ttlSeconds int
+		if err := rows.Scan(&sale.SaleID, &sale.StartTime, &sale.EndTime, &sale.TotalItems, &sale.ItemsSold, &sale.Status, &ttlSeconds); err != nil {
+			return nil, fmt.Errorf("failed to scan sale: %w", err)
+		}
+		fillSale(&sale, ttlSeconds)
+		sales = append(sales, sale)
+	}
+	return sales, rows.Err()
+}
+
+// GetDueScheduledSales returns scheduled sales whose start time is at or
+// before now and that have not ended yet. Sales whose items are still to be
+// generated are left out until they are.
+func (db *DB) GetDueScheduledSales(now time.Time) ([]models.Sale, error) {
+	defer db.observe("get_due_scheduled_sales", time.Now())
+
+	rows, err := db.Query(`
+		SELECT sale_id, start_time, end_time, total_items, items_sold, status, checkout_ttl_seconds
+		FROM sales
+		WHERE status = $1 AND start_time <= $2 AND end_time > $2 AND pending_items = 0
+		ORDER BY start_time
+	`, models.SaleStatusScheduled, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query due scheduled sales: %w", err)
+	}
+	return scanSales(rows)
+}
+
+// GetSalesAwaitingItems returns scheduled sales starting at or before before
+// whose items are still to be generated, soonest first
+func (db *DB) GetSalesAwaitingItems(before time.Time) ([]models.Sale, error) {
+	defer db.observe("get_sales_awaiting_items", time.Now())
+
+	rows, err := db.Query(`
+		SELECT sale_id, start_time, end_time, total_items, items_sold, status, checkout_ttl_seconds, pending_items
+		FROM sales
+		WHERE status = $1 AND pending_items > 0 AND start_time <= $2 AND end_time > NOW()
+		ORDER BY start_time
+	`, models.SaleStatusScheduled, before)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sales awaiting items: %w", err)
+	}
+	defer rows.Close()
+
+	sales := []models.Sale{}
+	for rows.Next() {
+		var sale models.Sale
+		var ttlSeconds int
+		if err := rows.Scan(&sale.SaleID, &sale.StartTime, &sale.EndTime, &sale.TotalItems, &sale.ItemsSold, &sale.Status, &ttlSeconds, &sale.PendingItems); err != nil {
+			return nil, fmt.Errorf("failed to scan sale: %w", err)
+		}
+		fillSale(&sale, ttlSeconds)
+		sales = append(sales, sale)
+	}
+	return sales, rows.Err()
+}
+
+// ClearPendingItems records that a sale's items have been generated
+func (db *DB) ClearPendingItems(saleID string) error {
+	defer db.observe("clear_pending_items", time.Now())
+
+	if _, err := db.Exec(`UPDATE sales SET pending_items = 0 WHERE sale_id = $1`, saleID); err != nil {
+		return fmt.Errorf("failed to clear pending items of sale %s: %w", saleID, err)
+	}
+	return nil
+}
+
+// GetExpiredActiveSales returns sales that have not been completed yet but
+// whose end time is at or before now
+func (db *DB) GetExpiredActiveSales(now time.Time) ([]models.Sale, error) {
+	defer db.observe("get_expired_active_sales", time.Now())
+
+	rows, err := db.Query(`
+		SELECT sale_id, start_time, end_time, total_items, items_sold, status, checkout_ttl_seconds
+		FROM sales
+		WHERE status IN ($1, $2, $3) AND end_time <= $4
+		ORDER BY end_time
+	`, models.SaleStatusScheduled, models.SaleStatusActive, models.SaleStatusSoldOut, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expired sales: %w", err)
+	}
+	return scanSales(rows)
+}
+
+// UpdateSaleStatus moves a sale from one status to another. It reports false
+// without error when the sale is no longer in the from status, so concurrent
+// callers can race on a transition and only one of them wins.
+func (db *DB) UpdateSaleStatus(saleID, from, to string) (bool, error) {
+	defer db.observe("update_sale_status", time.Now())
+
+	result, err := db.Exec(`UPDATE sales SET status = $1 WHERE sale_id = $2 AND status = $3`, to, saleID, from)
+	if err != nil {
+		return false, fmt.Errorf("failed to update status for sale %s: %w", saleID, err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to update status for sale %s: %w", saleID, err)
+	}
+	return updated > 0, nil
+}
+
+// AdjustSaleTotalItems moves a sale's total_items by delta after its stock was
+// changed by hand, so sold out detection and sell-through follow the new
+// total
+func (db *DB) AdjustSaleTotalItems(saleID string, delta int) error {
+	defer db.observe("adjust_sale_total_items", time.Now())
+
+	return db.guard(func() error {
+		if _, err := db.Exec(`UPDATE sales SET total_items = total_items + $1 WHERE sale_id = $2`, delta, saleID); err != nil {
+			return fmt.Errorf("failed to adjust total items for sale %s: %w", saleID, err)
+		}
+		return nil
+	})
+}
+
+// CancelSale voids a sale that has not completed, recording who cancelled it
+// and when. It reports false without error when the sale had already
+// completed or been cancelled.
+func (db *DB) CancelSale(saleID, cancelledBy string) (bool, error) {
+	defer db.observe("cancel_sale", time.Now())
+
+	result, err := db.Exec(`
+		UPDATE sales
+		SET status = $1, cancelled_by = $2, cancelled_at = NOW()
+		WHERE sale_id = $3 AND status IN ($4, $5, $6)
+	`, models.SaleStatusCancelled, cancelledBy, saleID,
+		models.SaleStatusScheduled, models.SaleStatusActive, models.SaleStatusSoldOut)
+	if err != nil {
+		return false, fmt.Errorf("failed to cancel sale %s: %w", saleID, err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to cancel sale %s: %w", saleID, err)
+	}
+	return updated > 0, nil
+}
+
+// GetItem returns the item with the given ID, or nil if it does not exist
+func (db *DB) GetItem(itemID string) (*models.Item, error) {
+	return db.GetItemContext(context.Background(), itemID)
+}
+
+// GetItemContext is GetItem bounded by ctx
+func (db *DB) GetItemContext(ctx context.Context, itemID string) (*models.Item, error) {
+	defer db.observe("get_item", time.Now())
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	item := &models.Item{}
+	err := db.guard(func() error {
+		return db.QueryRowContext(ctx, `
+			SELECT item_id, sale_id, name, category, image_url, tier, price_cents, discount_price_cents, queued
+			FROM items
+			WHERE item_id = $1
+		`, itemID).Scan(&item.ItemID, &item.SaleID, &item.Name, &item.Category, &item.ImageURL, &item.Tier, &item.Price, &item.DiscountPrice, &item.Queued)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query item %s: %w", itemID, err)
+	}
+	return item, nil
+}
+
+// GetItemIDs returns the IDs of every item in a sale
+func (db *DB) GetItemIDs(saleID string) ([]string, error) {
+	defer db.observe("get_item_ids", time.Now())
+
+	rows, err := db.Query(`SELECT item_id FROM items WHERE sale_id = $1`, saleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list item IDs for sale %s: %w", saleID, err)
+	}
+	defer rows.Close()
+
+	itemIDs := []string{}
+	for rows.Next() {
+		var itemID string
+		if err := rows.Scan(&itemID); err != nil {
+			return nil, fmt.Errorf("failed to scan item ID: %w", err)
+		}
+		itemIDs = append(itemIDs, itemID)
+	}
+	return itemIDs, rows.Err()
+}
+
+// ListItems returns a page of a sale's items ordered by item ID
+func (db *DB) ListItems(saleID string, limit, offset int) ([]models.Item, error) {
+	return db.ListItemsByCategory(saleID, "", limit, offset)
+}
+
+// ListItemsByCategory returns a page of a sale's items in one category ordered
+// by item ID. An empty category matches every item.
+func (db *DB) ListItemsByCategory(saleID, category string, limit, offset int) ([]models.Item, error) {
+	defer db.observe("list_items_by_category", time.Now())
+
+	rows, err := db.Query(`
+		SELECT item_id, sale_id, name, category, image_url, tier, price_cents, discount_price_cents, queued
+		FROM items
+		WHERE sale_id = $1 AND ($2 = '' OR category = $2)
+		ORDER BY item_id
+		LIMIT $3 OFFSET $4
+	`, saleID, category, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list items for sale %s: %w", saleID, err)
+	}
+	defer rows.Close()
+
+	items := []models.Item{}
+	for rows.Next() {
+		var item models.Item
+		if err := rows.Scan(&item.ItemID, &item.SaleID, &item.Name, &item.Category, &item.ImageURL, &item.Tier, &item.Price, &item.DiscountPrice, &item.Queued); err != nil {
+			return nil, fmt.Errorf("failed to scan item: %w", err)
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// SearchItems returns up to limit of a sale's items whose name contains
+// query, ignoring case. Exact matches rank first, then names starting with
+// query, then the rest by trigram similarity to it. The match is backed by
+// the idx_items_name_trgm index.
+func (db *DB) SearchItems(saleID, query string, limit int) ([]models.Item, error) {
+	defer db.observe("search_items", time.Now())
+
+	rows, err := db.Query(`
+		SELECT item_id, sale_id, name, category, image_url, tier, price_cents, discount_price_cents, queued
+		FROM items
+		WHERE sale_id = $1 AND name ILIKE '%' || $2 || '%'
+		ORDER BY
+			CASE WHEN lower(name) = lower($3) THEN 0 WHEN name ILIKE $2 || '%' THEN 1 ELSE 2 END,
+			similarity(name, $3) DESC,
+			item_id
+		LIMIT $4
+	`, saleID, escapeLike(query), query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search items for sale %s: %w", saleID, err)
+	}
+	defer rows.Close()
+
+	items := []models.Item{}
+	for rows.Next() {
+		var item models.Item
+		if err := rows.Scan(&item.ItemID, &item.SaleID, &item.Name, &item.Category, &item.ImageURL, &item.Tier, &item.Price, &item.DiscountPrice, &item.Queued); err != nil {
+			return nil, fmt.Errorf("failed to scan item: %w", err)
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// CountItems returns the number of items in a sale
+func (db *DB) CountItems(saleID string) (int, error) {
+	return db.CountItemsByCategory(saleID, "")
+}
+
+// CountItemsByCategory returns the number of items of one category in a sale.
+// An empty category counts every item.
+func (db *DB) CountItemsByCategory(saleID, category string) (int, error) {
+	defer db.observe("count_items_by_category", time.Now())
+
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM items WHERE sale_id = $1 AND ($2 = '' OR category = $2)`, saleID, category).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count items for sale %s: %w", saleID, err)
+	}
+	return count, nil
+}
+
+// GetCategoryCounts returns the categories present in a sale with their item
+// counts, ordered by category
+func (db *DB) GetCategoryCounts(saleID string) ([]models.CategoryCount, error) {
+	defer db.observe("get_category_counts", time.Now())
+
+	rows, err := db.Query(`
+		SELECT category, COUNT(*)
+		FROM items
+		WHERE sale_id = $1
+		GROUP BY category
+		ORDER BY category
+	`, saleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count categories for sale %s: %w", saleID, err)
+	}
+	defer rows.Close()
+
+	counts := []models.CategoryCount{}
+	for rows.Next() {
+		var c models.CategoryCount
+		if err := rows.Scan(&c.Category, &c.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan category count: %w", err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// UpdateItemsSold replaces the recorded sold count of a sale, read as previous,
+// with sold. Redis is authoritative, so the count may go down as well as up;
+// the update only applies while the row still holds previous, and a writer
+// that raced another gets ErrStaleItemsSold instead of overwriting it. An
+// unknown sale is reported the same way.
+func (db *DB) UpdateItemsSold(saleID string, previous, sold int) error {
+	defer db.observe("update_items_sold", time.Now())
+
+	result, err := db.Exec(`UPDATE sales SET items_sold = $1 WHERE sale_id = $2 AND items_sold = $3`, sold, saleID, previous)
+	if err != nil {
+		return fmt.Errorf("failed to update items sold for sale %s: %w", saleID, err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update items sold for sale %s: %w", saleID, err)
+	}
+	if updated == 0 {
+		return ErrStaleItemsSold
+	}
+	return nil
+}
+
+// CreatePurchase inserts a purchase record
+func (db *DB) CreatePurchase(purchase *models.Purchase) error {
+	return db.CreatePurchaseContext(context.Background(), purchase)
+}
+
+// CreatePurchaseContext is CreatePurchase bounded by ctx
+func (db *DB) CreatePurchaseContext(ctx context.Context, purchase *models.Purchase) error {
+	defer db.observe("create_purchase", time.Now())
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	return db.guard(func() error {
+		_, err := db.ExecContext(ctx, `
+			INSERT INTO purchases (purchase_id, sale_id, user_id, item_id, created_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, purchase.PurchaseID, purchase.SaleID, purchase.UserID, purchase.ItemID, purchase.CreatedAt.UTC())
+
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+			return ErrDuplicatePurchase
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create purchase: %w", err)
+		}
+		return nil
+	})
+}
+
+// CreatePurchases inserts several purchase records in one transaction, so
+// either all of them are recorded or none are
+func (db *DB) CreatePurchases(purchases []*models.Purchase) error {
+	return db.CreatePurchasesContext(context.Background(), purchases)
+}
+
+// CreatePurchasesContext is CreatePurchases bounded by ctx
+func (db *DB) CreatePurchasesContext(ctx context.Context, purchases []*models.Purchase) error {
+	defer db.observe("create_purchases", time.Now())
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	return db.guard(func() error {
+		return db.createPurchases(ctx, purchases)
+	})
+}
+
+func (db *DB) createPurchases(ctx context.Context, purchases []*models.Purchase) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, purchase := range purchases {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO purchases (purchase_id, sale_id, user_id, item_id, created_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, purchase.PurchaseID, purchase.SaleID, purchase.UserID, purchase.ItemID, purchase.CreatedAt.UTC())
+
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+			return ErrDuplicatePurchase
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create purchase: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit purchases: %w", err)
+	}
+	return nil
+}
+
+// GetSaleRevenue returns the total, in cents, paid for the items purchased in
+// a sale
+func (db *DB) GetSaleRevenue(saleID string) (int64, error) {
+	defer db.observe("get_sale_revenue", time.Now())
+
+	var revenue int64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN i.discount_price_cents > 0 THEN i.discount_price_cents ELSE i.price_cents END), 0)
+		FROM purchases p
+		JOIN items i ON i.item_id = p.item_id
+		WHERE p.sale_id = $1
+	`, saleID).Scan(&revenue)
+	if err != nil {
+		return 0, fmt.Errorf("failed to sum revenue for sale %s: %w", saleID, err)
+	}
+	return revenue, nil
+}
+
+// GetLastPurchaseTime returns when the most recent purchase in a sale was
+// made, or the zero time if it has none
+func (db *DB) GetLastPurchaseTime(saleID string) (time.Time, error) {
+	defer db.observe("get_last_purchase_time", time.Now())
+
+	var last sql.NullTime
+	if err := db.QueryRow(`SELECT MAX(created_at) FROM purchases WHERE sale_id = $1`, saleID).Scan(&last); err != nil {
+		return time.Time{}, fmt.Errorf("failed to query last purchase for sale %s: %w", saleID, err)
+	}
+	return last.Time.UTC(), nil
+}
+
+// GetPurchasesPerMinute returns how many purchases a sale had in each minute
+// since start, keyed by minute offset. Minutes without purchases are absent.
+func (db *DB) GetPurchasesPerMinute(saleID string, start time.Time) (map[int]int, error) {
+	defer db.observe("get_purchases_per_minute", time.Now())
+
+	rows, err := db.Query(`
+		SELECT FLOOR(EXTRACT(EPOCH FROM created_at - $2) / 60)::int AS minute, COUNT(*)
+		FROM purchases
+		WHERE sale_id = $1
+		GROUP BY minute
+	`, saleID, start)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count purchases per minute for sale %s: %w", saleID, err)
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int)
+	for rows.Next() {
+		var minute, count int
+		if err := rows.Scan(&minute, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan purchase count: %w", err)
+		}
+		counts[minute] = count
+	}
+	return counts, rows.Err()
+}
+
+// GetTopCategoriesSold returns up to limit categories of a sale by units
+// purchased, best selling first
+func (db *DB) GetTopCategoriesSold(saleID string, limit int) ([]models.CategoryCount, error) {
+	defer db.observe("get_top_categories_sold", time.Now())
+
+	rows, err := db.Query(`
+		SELECT i.category, COUNT(*) AS sold
+		FROM purchases p
+		JOIN items i ON i.item_id = p.item_id
+		WHERE p.sale_id = $1
+		GROUP BY i.category
+		ORDER BY sold DESC, i.category
+		LIMIT $2
+	`, saleID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query top categories for sale %s: %w", saleID, err)
+	}
+	defer rows.Close()
+
+	categories := []models.CategoryCount{}
+	for rows.Next() {
+		var c models.CategoryCount
+		if err := rows.Scan(&c.Category, &c.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan category count: %w", err)
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// GetPurchasesByUser returns a user's purchases newest first, optionally
+// restricted to one sale when saleID is not empty
+func (db *DB) GetPurchasesByUser(userID, saleID string) ([]models.Purchase, error) {
+	defer db.observe("get_purchases_by_user", time.Now())
+
+	rows, err := db.Query(`
+		SELECT p.purchase_id, p.sale_id, p.user_id, p.item_id, p.created_at, i.name, i.image_url
+		FROM purchases p
+		JOIN items i ON i.item_id = p.item_id
+		WHERE p.user_id = $1 AND ($2 = '' OR p.sale_id = $2)
+		ORDER BY p.created_at DESC
+	`, userID, saleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query purchases for user %s: %w", userID, err)
+	}
+	defer rows.Close()
+
+	purchases := []models.Purchase{}
+	for rows.Next() {
+		var p models.Purchase
+		if err := rows.Scan(&p.PurchaseID, &p.SaleID, &p.UserID, &p.ItemID, &p.CreatedAt, &p.ItemName, &p.ImageURL); err != nil {
+			return nil, fmt.Errorf("failed to scan purchase: %w", err)
+		}
+		p.CreatedAt = p.CreatedAt.UTC()
+		purchases = append(purchases, p)
+	}
+	return purchases, rows.Err()
+}
+
+// ExportPurchasesContext calls fn with each purchase in a sale, oldest first,
+// together with the item's name and the price paid. Zero from or to leave
+// that end of the range open. Rows are read one at a time so an export of a
+// whole sale is never held in memory; the query is bounded only by ctx, not
+// the per-query timeout, since it runs for as long as the caller streams.
+func (db *DB) ExportPurchasesContext(ctx context.Context, saleID string, from, to time.Time, fn func(*models.Purchase) error) error {
+	defer db.observe("export_purchases", time.Now())
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.purchase_id, p.sale_id, p.user_id, p.item_id, p.created_at, i.name,
+			CASE WHEN i.discount_price_cents > 0 THEN i.discount_price_cents ELSE i.price_cents END
+		FROM purchases p
+		JOIN items i ON i.item_id = p.item_id
+		WHERE p.sale_id = $1
+			AND ($2::timestamptz IS NULL OR p.created_at >= $2)
+			AND ($3::timestamptz IS NULL OR p.created_at < $3)
+		ORDER BY p.created_at, p.purchase_id
+	`, saleID, sql.NullTime{Time: from, Valid: !from.IsZero()}, sql.NullTime{Time: to, Valid: !to.IsZero()})
+	if err != nil {
+		return fmt.Errorf("failed to query purchases for sale %s: %w", saleID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.Purchase
+		if err := rows.Scan(&p.PurchaseID, &p.SaleID, &p.UserID, &p.ItemID, &p.CreatedAt, &p.ItemName, &p.Price); err != nil {
+			return fmt.Errorf("failed to scan purchase: %w", err)
+		}
+		p.CreatedAt = p.CreatedAt.UTC()
+		if err := fn(&p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// CreateAuditEntriesContext appends audit entries in one statement
+func (db *DB) CreateAuditEntriesContext(ctx context.Context, entries []*models.AuditEntry) error {
+	defer db.observe("create_audit_entries", time.Now())
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	placeholders := make([]string, len(entries))
+	args := make([]interface{}, 0, len(entries)*9)
+	for i, e := range entries {
+		n := i * 9
+		placeholders[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9)
+		args = append(args, e.Action, e.PurchaseID, e.SaleID, e.UserID, e.ItemID, e.CheckoutCode, e.StockBefore, e.StockAfter, e.CreatedAt.UTC())
+	}
+
+	return db.guard(func() error {
+		query := "INSERT INTO audit (action, purchase_id, sale_id, user_id, item_id, checkout_code, stock_before, stock_after, created_at) VALUES " + strings.Join(placeholders, ", ")
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to create audit entries: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetAuditEntriesContext returns up to limit audit entries for a user, an
+// item or both, newest first. Empty filters match everything.
+func (db *DB) GetAuditEntriesContext(ctx context.Context, userID, itemID string, limit int) ([]models.AuditEntry, error) {
+	defer db.observe("get_audit_entries", time.Now())
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT audit_id, action, purchase_id, sale_id, user_id, item_id, checkout_code, stock_before, stock_after, created_at
+		FROM audit
+		WHERE ($1 = '' OR user_id = $1) AND ($2 = '' OR item_id = $2)
+		ORDER BY created_at DESC, audit_id DESC
+		LIMIT $3
+	`, userID, itemID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		var e models.AuditEntry
+		if err := rows.Scan(&e.AuditID, &e.Action, &e.PurchaseID, &e.SaleID, &e.UserID, &e.ItemID, &e.CheckoutCode, &e.StockBefore, &e.StockAfter, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		e.CreatedAt = e.CreatedAt.UTC()
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// CountPurchasesByItem returns how many units of each of the given items have
+// been purchased. Items without purchases are absent from the map.
+func (db *DB) CountPurchasesByItem(itemIDs []string) (map[string]int, error) {
+	defer db.observe("count_purchases_by_item", time.Now())
+
+	counts := make(map[string]int, len(itemIDs))
+	if len(itemIDs) == 0 {
+		return counts, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT item_id, COUNT(*)
+		FROM purchases
+		WHERE item_id = ANY($1)
+		GROUP BY item_id
+	`, pq.Array(itemIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count purchases by item: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var itemID string
+		var count int
+		if err := rows.Scan(&itemID, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan purchase count: %w", err)
+		}
+		counts[itemID] = count
+	}
+	return counts, rows.Err()
+}
+
+// CountPurchasesByUser returns how many items each buyer in a sale has
+// purchased. Users without purchases are absent from the map.
+func (db *DB) CountPurchasesByUser(saleID string) (map[string]int, error) {
+	defer db.observe("count_purchases_by_user", time.Now())
+
+	rows, err := db.Query(`
+		SELECT user_id, COUNT(*)
+		FROM purchases
+		WHERE sale_id = $1
+		GROUP BY user_id
+	`, saleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count purchases by user for sale %s: %w", saleID, err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var userID string
+		var count int
+		if err := rows.Scan(&userID, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan purchase count: %w", err)
+		}
+		counts[userID] = count
+	}
+	return counts, rows.Err()
+}
+
+// DeleteSale removes a sale and its items. It is only for undoing a sale whose
+// creation failed part way, before anything could be bought from it; the
+// purchases foreign key refuses it for a sale that has sales.
+func (db *DB) DeleteSale(saleID string) error {
+	defer db.observe("delete_sale", time.Now())
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM items WHERE sale_id = $1`, saleID); err != nil {
+		return fmt.Errorf("failed to delete items of sale %s: %w", saleID, err)
+	}
+	if _, err := tx.Exec(`DELETE FROM sales WHERE sale_id = $1`, saleID); err != nil {
+		return fmt.Errorf("failed to delete sale %s: %w", saleID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit sale deletion: %w", err)
+	}
+	return nil
+}
+
+// CreateItems inserts a sale's items using multi-row INSERTs inside a single
+// transaction, so a failure never leaves a sale half-populated
+func (db *DB) CreateItems(items []models.Item) error {
+	defer db.observe("create_items", time.Now())
+	return db.createItems(items, itemInsertBatchSize)
+}
+
+// createItems inserts items batchSize rows per statement in one transaction
+func (db *DB) createItems(items []models.Item, batchSize int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for start := 0; start < len(items); start += batchSize {
+		end := start + batchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		batch := items[start:end]
+
+		placeholders := make([]string, len(batch))
+		args := make([]interface{}, 0, len(batch)*9)
+		for i, item := range batch {
+			n := i * 9
+			placeholders[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9)
+			args = append(args, item.ItemID, item.SaleID, item.Name, item.Category, item.ImageURL, item.Tier, item.Price, item.DiscountPrice, item.Queued)
+		}
+
+		query := "INSERT INTO items (item_id, sale_id, name, category, image_url, tier, price_cents, discount_price_cents, queued) VALUES " + strings.Join(placeholders, ", ")
+		if _, err := tx.Exec(query, args...); err != nil {
+			return fmt.Errorf("failed to insert items %d-%d: %w", start, end, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit items: %w", err)
+	}
+	return nil
+}
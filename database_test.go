@@ -0,0 +1,239 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+
+	"flash-sale-service/internal/breaker"
+	"flash-sale-service/internal/models"
+)
+
+// newTestDB returns a DB on a mocked connection
+func newTestDB(t *testing.T) (*DB, sqlmock.Sqlmock) {
+	t.Helper()
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return &DB{DB: sqlDB}, mock
+}
+
+func testPurchase(purchaseID, userID, itemID string) *models.Purchase {
+	return &models.Purchase{
+		PurchaseID: purchaseID,
+		SaleID:     "sale_1",
+		UserID:     userID,
+		ItemID:     itemID,
+		CreatedAt:  time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestCreatePurchaseReportsDuplicateBuyer(t *testing.T) {
+	db, mock := newTestDB(t)
+	first := testPurchase("purchase_1", "user_1", "item_1")
+	second := testPurchase("purchase_2", "user_1", "item_2")
+
+	mock.ExpectExec("INSERT INTO purchases").
+		WithArgs(first.PurchaseID, first.SaleID, first.UserID, first.ItemID, first.CreatedAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// The (sale_id, user_id) constraint turns the second purchase away
+	mock.ExpectExec("INSERT INTO purchases").
+		WithArgs(second.PurchaseID, second.SaleID, second.UserID, second.ItemID, second.CreatedAt).
+		WillReturnError(&pq.Error{Code: uniqueViolation})
+
+	if err := db.CreatePurchase(first); err != nil {
+		t.Fatalf("first CreatePurchase: %v", err)
+	}
+	if err := db.CreatePurchase(second); !errors.Is(err, ErrDuplicatePurchase) {
+		t.Fatalf("second CreatePurchase error = %v, want ErrDuplicatePurchase", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreatePurchasesRollsBackOnDuplicate(t *testing.T) {
+	db, mock := newTestDB(t)
+	purchases := []*models.Purchase{
+		testPurchase("purchase_1", "user_1", "item_1"),
+		testPurchase("purchase_2", "user_1", "item_2"),
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO purchases").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO purchases").WillReturnError(&pq.Error{Code: uniqueViolation})
+	// The first row must not stay behind
+	mock.ExpectRollback()
+
+	if err := db.CreatePurchases(purchases); !errors.Is(err, ErrDuplicatePurchase) {
+		t.Fatalf("CreatePurchases error = %v, want ErrDuplicatePurchase", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBreakerFailsHotPathFastWhileOpen(t *testing.T) {
+	db, mock := newTestDB(t)
+	db.Breaker = breaker.New(2, time.Hour)
+	purchase := testPurchase("purchase_1", "user_1", "item_1")
+
+	// A duplicate buyer is an answer, not a failure
+	mock.ExpectExec("INSERT INTO purchases").WillReturnError(&pq.Error{Code: uniqueViolation})
+	mock.ExpectExec("INSERT INTO purchases").WillReturnError(errors.New("connection refused"))
+	mock.ExpectExec("INSERT INTO purchases").WillReturnError(errors.New("connection refused"))
+	for i := 0; i < 3; i++ {
+		db.CreatePurchase(purchase)
+	}
+	if state := db.Breaker.State(); state != breaker.Open {
+		t.Fatalf("breaker state = %v, want open", state)
+	}
+
+	// No query is expected: the open breaker answers for the database
+	if err := db.CreatePurchase(purchase); !errors.Is(err, breaker.ErrOpen) {
+		t.Fatalf("CreatePurchase while open: error = %v, want breaker.ErrOpen", err)
+	}
+	if !IsTransient(breaker.ErrOpen) {
+		t.Error("breaker.ErrOpen is not transient")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestContextQueriesStopPromptly(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		cancel  bool
+	}{
+		{"caller cancels", 0, true},
+		{"query timeout", 20 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newTestDB(t)
+			db.QueryTimeout = tt.timeout
+			// The database never answers in time
+			mock.ExpectQuery("FROM sales").WillDelayFor(time.Hour).
+				WillReturnRows(sqlmock.NewRows([]string{"sale_id"}))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(20*time.Millisecond, cancel)
+			}
+
+			start := time.Now()
+			sale, err := db.GetActiveSaleContext(ctx)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("GetActiveSaleContext returned after %v, want promptly", elapsed)
+			}
+			if err == nil || sale != nil {
+				t.Errorf("GetActiveSaleContext = %v, %v; want an error", sale, err)
+			}
+		})
+	}
+}
+
+func TestUpdateItemsSoldRejectsStaleConcurrentWrite(t *testing.T) {
+	db, mock := newTestDB(t)
+	mock.MatchExpectationsInOrder(false)
+
+	// Two writers both read 7 sold. Redis came back at 5 after a restore, so
+	// a lower count is accepted; the database applies whichever arrives first
+	// and the other no longer finds the 7 it read.
+	update := regexp.QuoteMeta(`UPDATE sales SET items_sold = $1 WHERE sale_id = $2 AND items_sold = $3`)
+	mock.ExpectExec(update).WithArgs(5, "sale_1", 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(update).WithArgs(6, "sale_1", 7).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	var wg sync.WaitGroup
+	errs := make(map[int]error)
+	var mu sync.Mutex
+	for _, sold := range []int{5, 6} {
+		wg.Add(1)
+		go func(sold int) {
+			defer wg.Done()
+			err := db.UpdateItemsSold("sale_1", 7, sold)
+			mu.Lock()
+			errs[sold] = err
+			mu.Unlock()
+		}(sold)
+	}
+	wg.Wait()
+
+	if err := errs[5]; err != nil {
+		t.Errorf("UpdateItemsSold(7 -> 5) = %v, want nil", err)
+	}
+	if err := errs[6]; !errors.Is(err, ErrStaleItemsSold) {
+		t.Errorf("UpdateItemsSold(7 -> 6) = %v, want ErrStaleItemsSold", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// benchRoundTrip stands in for the network round-trip of each statement, which
+// is what batching saves
+const benchRoundTrip = 100 * time.Microsecond
+
+// roundTripConn is a connection that answers every statement after
+// benchRoundTrip, as a database on the network would at best. It spins rather
+// than sleeps, since timer granularity is coarser than the round-trip.
+type roundTripConn struct{}
+
+func (roundTripConn) Connect(context.Context) (driver.Conn, error) { return roundTripConn{}, nil }
+func (roundTripConn) Driver() driver.Driver                        { return nil }
+func (roundTripConn) Close() error                                 { return nil }
+func (roundTripConn) Begin() (driver.Tx, error)                    { return roundTripConn{}, nil }
+func (roundTripConn) Commit() error                                { return nil }
+func (roundTripConn) Rollback() error                              { return nil }
+
+func (roundTripConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements not supported")
+}
+
+func (roundTripConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	for start := time.Now(); time.Since(start) < benchRoundTrip; {
+	}
+	return driver.RowsAffected(len(args) / 9), nil
+}
+
+func BenchmarkCreateItems(b *testing.B) {
+	const count = 10000
+	items := make([]models.Item, count)
+	for i := range items {
+		items[i] = models.Item{
+			ItemID:   fmt.Sprintf("item_%d", i),
+			SaleID:   "sale_1",
+			Name:     "Item",
+			Category: "general",
+			Tier:     models.TierCommon,
+			Price:    1000,
+		}
+	}
+	sqlDB := sql.OpenDB(roundTripConn{})
+	defer sqlDB.Close()
+	db := &DB{DB: sqlDB}
+
+	for _, batchSize := range []int{1, itemInsertBatchSize} {
+		b.Run(fmt.Sprintf("rows_per_insert=%d", batchSize), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := db.createItems(items, batchSize); err != nil {
+					b.Fatalf("createItems: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package scheduler
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"flash-sale-service/internal/database"
+	"flash-sale-service/internal/models"
+	redisClient "flash-sale-service/internal/redis"
+)
+
+// saleStore is everything sale creation, and the generation of scheduled
+// sales' items, reads from and writes to the database and Redis
+type saleStore interface {
+	AcquireLock(name string, ttl time.Duration) (string, error)
+	ReleaseLock(name, token string) error
+	CountSalesForStart(startTime time.Time) (int, error)
+	SaleOverlaps(start, end time.Time) (bool, error)
+	CreateSale(sale *models.Sale) error
+	CreateItems(items []models.Item) error
+	DeleteSale(saleID string) error
+	InitializeSale(saleID string, startTime, endTime time.Time, items []models.Item, stockPerItem int) error
+	GetSalesAwaitingItems(before time.Time) ([]models.Sale, error)
+	GetItemIDs(saleID string) ([]string, error)
+	ClearPendingItems(saleID string) error
+}
+
+// liveStore sends sale creation to the real database and Redis
+type liveStore struct {
+	db    *database.DB
+	redis *redisClient.Client
+}
+
+func (l liveStore) AcquireLock(name string, ttl time.Duration) (string, error) {
+	return l.redis.AcquireLock(name, ttl)
+}
+
+func (l liveStore) ReleaseLock(name, token string) error {
+	return l.redis.ReleaseLock(name, token)
+}
+
+func (l liveStore) CountSalesForStart(startTime time.Time) (int, error) {
+	return l.db.CountSalesForStart(startTime)
+}
+
+func (l liveStore) SaleOverlaps(start, end time.Time) (bool, error) {
+	return l.db.SaleOverlaps(start, end)
+}
+
+func (l liveStore) CreateSale(sale *models.Sale) error {
+	return l.db.CreateSale(sale)
+}
+
+func (l liveStore) CreateItems(items []models.Item) error {
+	return l.db.CreateItems(items)
+}
+
+func (l liveStore) DeleteSale(saleID string) error {
+	return l.db.DeleteSale(saleID)
+}
+
+func (l liveStore) InitializeSale(saleID string, startTime, endTime time.Time, items []models.Item, stockPerItem int) error {
+	return l.redis.InitializeSale(saleID, startTime, endTime, items, stockPerItem)
+}
+
+func (l liveStore) GetSalesAwaitingItems(before time.Time) ([]models.Sale, error) {
+	return l.db.GetSalesAwaitingItems(before)
+}
+
+func (l liveStore) GetItemIDs(saleID string) ([]string, error) {
+	return l.db.GetItemIDs(saleID)
+}
+
+func (l liveStore) ClearPendingItems(saleID string) error {
+	return l.db.ClearPendingItems(saleID)
+}
+
+// dryRunStore stands in for the database and Redis while DryRun is set. It
+// logs each write instead of making it and keeps only the locks, sale windows
+// and pending item counts that are read back, so repeated runs for a window
+// skip or overlap, and a scheduled sale's items are generated once, exactly as
+// they would be for real.
+type dryRunStore struct {
+	mu        sync.Mutex
+	locks     map[string]string
+	sales     []models.Sale
+	lockCount int
+}
+
+func newDryRunStore() *dryRunStore {
+	return &dryRunStore{locks: make(map[string]string)}
+}
+
+func (d *dryRunStore) AcquireLock(name string, ttl time.Duration) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, held := d.locks[name]; held {
+		return "", nil
+	}
+	d.lockCount++
+	token := fmt.Sprintf("dry-run-%d", d.lockCount)
+	d.locks[name] = token
+	return token, nil
+}
+
+func (d *dryRunStore) ReleaseLock(name, token string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.locks[name] == token {
+		delete(d.locks, name)
+	}
+	return nil
+}
+
+func (d *dryRunStore) CountSalesForStart(startTime time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	count := 0
+	for _, sale := range d.sales {
+		if sale.StartTime.Equal(startTime) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (d *dryRunStore) SaleOverlaps(start, end time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, sale := range d.sales {
+		if sale.StartTime.Before(end) && start.Before(sale.EndTime) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (d *dryRunStore) CreateSale(sale *models.Sale) error {
+	d.mu.Lock()
+	d.sales = append(d.sales, *sale)
+	d.mu.Unlock()
+
+	slog.Info("Dry run: would insert sale", "sale_id", sale.SaleID, "start_time", sale.StartTime,
+		"end_time", sale.EndTime, "status", sale.Status, "total_items", sale.TotalItems, "pending_items", sale.PendingItems)
+	return nil
+}
+
+func (d *dryRunStore) CreateItems(items []models.Item) error {
+	slog.Info("Dry run: would insert items", "items", len(items))
+	return nil
+}
+
+func (d *dryRunStore) DeleteSale(saleID string) error {
+	d.mu.Lock()
+	for i, sale := range d.sales {
+		if sale.SaleID == saleID {
+			d.sales = append(d.sales[:i], d.sales[i+1:]...)
+			break
+		}
+	}
+	d.mu.Unlock()
+
+	slog.Info("Dry run: would delete sale", "sale_id", saleID)
+	return nil
+}
+
+func (d *dryRunStore) InitializeSale(saleID string, startTime, endTime time.Time, items []models.Item, stockPerItem int) error {
+	slog.Info("Dry run: would load sale into Redis", "sale_id", saleID, "items", len(items),
+		"stock_per_item", stockPerItem, "expires", endTime)
+	return nil
+}
+
+func (d *dryRunStore) GetSalesAwaitingItems(before time.Time) ([]models.Sale, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	var sales []models.Sale
+	for _, sale := range d.sales {
+		if sale.Status == models.SaleStatusScheduled && sale.PendingItems > 0 &&
+			!sale.StartTime.After(before) && sale.EndTime.After(now) {
+			sales = append(sales, sale)
+		}
+	}
+	sort.Slice(sales, func(i, j int) bool { return sales[i].StartTime.Before(sales[j].StartTime) })
+	return sales, nil
+}
+
+// GetItemIDs finds no items, since none were written
+func (d *dryRunStore) GetItemIDs(saleID string) ([]string, error) {
+	return nil, nil
+}
+
+func (d *dryRunStore) ClearPendingItems(saleID string) error {
+	d.mu.Lock()
+	for i := range d.sales {
+		if d.sales[i].SaleID == saleID {
+			d.sales[i].PendingItems = 0
+		}
+	}
+	d.mu.Unlock()
+
+	slog.Info("Dry run: would mark items generated", "sale_id", saleID)
+	return nil
+}
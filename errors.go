@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/errs"
+)
+
+// Machine-readable error codes returned in error responses. These are part of
+// the API contract and must not change once published.
+const (
+	ErrCodeMethodNotAllowed       = "METHOD_NOT_ALLOWED"
+	ErrCodeNotFound               = "NOT_FOUND"
+	ErrCodeInvalidParameter       = "INVALID_PARAMETER"
+	ErrCodeMissingParameter       = "MISSING_PARAMETER"
+	ErrCodeMissingCheckoutCode    = "MISSING_CHECKOUT_CODE"
+	ErrCodeInvalidCheckoutCode    = errs.CodeInvalidCheckoutCode
+	ErrCodeCheckoutUsed           = errs.CodeCheckoutUsed
+	ErrCodeNoActiveSale           = "NO_ACTIVE_SALE"
+	ErrCodeSaleEnded              = errs.CodeSaleEnded
+	ErrCodeItemNotInSale          = "ITEM_NOT_IN_SALE"
+	ErrCodeItemUnavailable        = "ITEM_UNAVAILABLE"
+	ErrCodeSoldOut                = errs.CodeSoldOut
+	ErrCodePurchaseLimitReached   = errs.CodeUserLimitReached
+	ErrCodeRateLimited            = errs.CodeRateLimited
+	ErrCodeIdempotencyKeyInvalid  = "INVALID_IDEMPOTENCY_KEY"
+	ErrCodeIdempotencyKeyReused   = "IDEMPOTENCY_KEY_REUSED"
+	ErrCodeIdempotencyKeyInFlight = "IDEMPOTENCY_KEY_IN_PROGRESS"
+	ErrCodeQueueTokenRequired     = "QUEUE_TOKEN_REQUIRED"
+	ErrCodeQueueTokenInvalid      = "QUEUE_TOKEN_INVALID"
+	ErrCodeQueueTokenUsed         = "QUEUE_TOKEN_USED"
+	ErrCodeNotAdmitted            = "NOT_ADMITTED"
+	ErrCodeNotQueued              = "NOT_QUEUED"
+	ErrCodeUnauthorized           = "UNAUTHORIZED"
+	ErrCodeForbidden              = "FORBIDDEN"
+	ErrCodeTooManyStreams         = "TOO_MANY_STREAMS"
+	ErrCodeSaleNotFinished        = "SALE_NOT_FINISHED"
+	ErrCodeSaleConflict           = "SALE_CONFLICT"
+	ErrCodeRequestTooLarge        = "REQUEST_TOO_LARGE"
+	ErrCodeMaintenance            = "MAINTENANCE"
+	ErrCodeRequestTimeout         = "REQUEST_TIMEOUT"
+	ErrCodeServiceUnavailable     = errs.CodeUnavailable
+	ErrCodeInternal               = errs.CodeInternal
+)
+
+// apiError is the body of every error response
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WriteJSONError writes {"error":{"code":...,"message":...}} with the given status
+func WriteJSONError(w http.ResponseWriter, status int, code, message string) {
+	writeJSONError(w, status, code, message, nil)
+}
+
+// writeJSONError writes an error response with additional top-level fields.
+// The request ID set by the request ID middleware is echoed so support can
+// find the matching log lines.
+func writeJSONError(w http.ResponseWriter, status int, code, message string, extra map[string]interface{}) {
+	body := map[string]interface{}{
+		"error": apiError{Code: code, Message: message, RequestID: w.Header().Get(RequestIDHeader)},
+	}
+	for key, value := range extra {
+		body[key] = value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError answers err with the status and code errs.ToHTTP maps it to,
+// explained by message
+func writeError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, errs.ErrUnavailable) {
+		message = "Service temporarily unavailable, please retry shortly"
+	}
+	status, code := errs.ToHTTP(err)
+	WriteJSONError(w, status, code, message)
+}
+
+// writeDependencyError reports a failed database or Redis call. While the
+// dependency's circuit breaker is open, or Redis is marked down by its health
+// check, the caller gets a fast 503 to retry later; any other failure is a
+// 500 with message.
+func writeDependencyError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, errs.ErrUnavailable) {
+		writeError(w, err, message)
+		return
+	}
+	WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, message)
+}
@@ -0,0 +1,72 @@
+package errs
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Domain failures the storage layers report and handlers answer. Layers
+// return their own errors built on these with New, so the message says what
+// happened while errors.Is still finds the kind.
+var (
+	ErrSoldOut             = errors.New("sold out")
+	ErrInvalidCheckoutCode = errors.New("invalid checkout code")
+	ErrCheckoutUsed        = errors.New("checkout code already used")
+	ErrSaleEnded           = errors.New("sale ended")
+	ErrUserLimitReached    = errors.New("user limit reached")
+	ErrRateLimited         = errors.New("rate limited")
+	ErrUnavailable         = errors.New("dependency unavailable")
+)
+
+// Machine-readable error codes for the kinds above, sent in error responses
+const (
+	CodeSoldOut             = "SOLD_OUT"
+	CodeInvalidCheckoutCode = "INVALID_CHECKOUT_CODE"
+	CodeCheckoutUsed        = "CHECKOUT_ALREADY_USED"
+	CodeSaleEnded           = "SALE_ENDED"
+	CodeUserLimitReached    = "PURCHASE_LIMIT_REACHED"
+	CodeRateLimited         = "RATE_LIMITED"
+	CodeUnavailable         = "SERVICE_UNAVAILABLE"
+	CodeInternal            = "INTERNAL_ERROR"
+)
+
+// domainError reads as its own message and unwraps to its kind
+type domainError struct {
+	kind error
+	msg  string
+}
+
+func (e *domainError) Error() string {
+	return e.msg
+}
+
+func (e *domainError) Unwrap() error {
+	return e.kind
+}
+
+// New returns an error reading msg that errors.Is reports as kind
+func New(kind error, msg string) error {
+	return &domainError{kind: kind, msg: msg}
+}
+
+// ToHTTP returns the status and error code that answer err. Anything that
+// isn't one of the kinds above is a 500.
+func ToHTTP(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrSoldOut):
+		return http.StatusConflict, CodeSoldOut
+	case errors.Is(err, ErrInvalidCheckoutCode):
+		return http.StatusBadRequest, CodeInvalidCheckoutCode
+	case errors.Is(err, ErrCheckoutUsed):
+		return http.StatusConflict, CodeCheckoutUsed
+	case errors.Is(err, ErrSaleEnded):
+		return http.StatusGone, CodeSaleEnded
+	case errors.Is(err, ErrUserLimitReached):
+		return http.StatusForbidden, CodeUserLimitReached
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests, CodeRateLimited
+	case errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable, CodeUnavailable
+	}
+	return http.StatusInternalServerError, CodeInternal
+}
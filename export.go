@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/database"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/models"
+)
+
+// exportFlushRows is how many CSV rows are buffered before they are sent to
+// the client
+const exportFlushRows = 500
+
+// exportColumns is the header row of a purchase export
+var exportColumns = []string{"purchase_id", "user_id", "item_id", "item_name", "price", "timestamp"}
+
+// sendTracker notes whether anything has been written to the client yet,
+// after which an error can no longer be reported as JSON
+type sendTracker struct {
+	w    io.Writer
+	sent bool
+}
+
+func (t *sendTracker) Write(p []byte) (int, error) {
+	t.sent = true
+	return t.w.Write(p)
+}
+
+// parseUnixParam parses an optional Unix seconds query parameter, returning
+// the zero time when it is absent
+func parseUnixParam(r *http.Request, name string) (time.Time, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, true
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// formatCents renders an amount in cents as a decimal, e.g. 1999 as 19.99
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// csvCell keeps a value from being run as a formula when the file is opened
+// in a spreadsheet; user IDs come from clients
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// ExportPurchasesHandler serves GET /admin/sales/{saleID}/purchases.csv, every
+// purchase in a sale as CSV for reconciliation, oldest first. Optional from
+// and to query parameters (Unix seconds) restrict it to purchases made at or
+// after from and before to. Rows are streamed as they are read, so the size
+// of a sale doesn't matter; an error after the first rows were sent can only
+// cut the file short and is logged.
+func ExportPurchasesHandler(db *database.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		saleID, ok := saleIDFromPath(r.URL.Path, "/admin/sales/", "purchases.csv")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		from, okFrom := parseUnixParam(r, "from")
+		to, okTo := parseUnixParam(r, "to")
+		if !okFrom || !okTo {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "from and to must be Unix timestamps")
+			return
+		}
+		if !from.IsZero() && !to.IsZero() && !to.After(from) {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "to must be after from")
+			return
+		}
+
+		sale, err := db.GetSaleByID(saleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load sale", "sale_id", saleID, "error", err)
+			writeDependencyError(w, err, "Error exporting purchases")
+			return
+		}
+
+		if sale == nil {
+			WriteJSONError(w, http.StatusNotFound, ErrCodeNotFound, "Sale not found")
+			return
+		}
+
+		filename := fmt.Sprintf("purchases-%s.csv", sale.SaleID)
+		if !from.IsZero() || !to.IsZero() {
+			filename = fmt.Sprintf("purchases-%s-%d-%d.csv", sale.SaleID, from.Unix(), to.Unix())
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+		flusher := http.NewResponseController(w)
+		tracker := &sendTracker{w: w}
+		out := csv.NewWriter(tracker)
+		out.Write(exportColumns)
+
+		rows := 0
+		err = db.ExportPurchasesContext(r.Context(), sale.SaleID, from, to, func(p *models.Purchase) error {
+			out.Write([]string{
+				p.PurchaseID,
+				csvCell(p.UserID),
+				p.ItemID,
+				csvCell(p.ItemName),
+				formatCents(p.Price),
+				p.CreatedAt.UTC().Format(time.RFC3339),
+			})
+
+			rows++
+			if rows%exportFlushRows == 0 {
+				out.Flush()
+				flusher.Flush()
+			}
+			return out.Error()
+		})
+		if err != nil {
+			Logger(r.Context()).Error("Failed to export purchases", "sale_id", sale.SaleID, "rows", rows, "error", err)
+			if !tracker.sent {
+				w.Header().Del("Content-Disposition")
+				writeDependencyError(w, err, "Error exporting purchases")
+			}
+			return
+		}
+
+		out.Flush()
+		Logger(r.Context()).Info("Exported purchases", "sale_id", sale.SaleID, "rows", rows)
+	}
+}
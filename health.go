@@ -3,37 +3,269 @@ package handlers
 import (
     "encoding/json"
     "net/http"
+    "sync"
     "time"
 
+    "github.com/Hananjeda/Flash-Sale-Service/internal/breaker"
     "github.com/Hananjeda/Flash-Sale-Service/internal/database"
     "github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+    "github.com/Hananjeda/Flash-Sale-Service/internal/scheduler"
 )
 
-func HealthCheck(db *database.DB, redisClient *redis.Client) http.HandlerFunc {
+// Health statuses, from best to worst
+const (
+    HealthOK       = "OK"
+    HealthDegraded = "DEGRADED"
+    HealthError    = "ERROR"
+)
+
+// pingDependency times a dependency ping and classifies the result
+func pingDependency(ping func() error, threshold time.Duration) (string, float64) {
+    start := time.Now()
+    err := ping()
+    latency := time.Since(start)
+    latencyMs := float64(latency.Microseconds()) / 1000
+
+    switch {
+    case err != nil:
+        return HealthError, latencyMs
+    case latency > threshold:
+        return HealthDegraded, latencyMs
+    }
+    return HealthOK, latencyMs
+}
+
+// worstStatus returns the more severe of two health statuses
+func worstStatus(a, b string) string {
+    if a == HealthError || b == HealthError {
+        return HealthError
+    }
+    if a == HealthDegraded || b == HealthDegraded {
+        return HealthDegraded
+    }
+    return HealthOK
+}
+
+// poolStats is the database connection pool as reported in readiness checks
+type poolStats struct {
+    MaxOpen        int     `json:"max_open"`
+    Open           int     `json:"open"`
+    InUse          int     `json:"in_use"`
+    Idle           int     `json:"idle"`
+    WaitCount      int64   `json:"wait_count"`
+    WaitDurationMs float64 `json:"wait_duration_ms"`
+}
+
+// checkPool reports the pool's stats and whether it is saturated, i.e. every
+// connection is in use so new queries queue. WaitCount and WaitDurationMs are
+// totals since startup.
+func checkPool(db *database.DB) (poolStats, string) {
+    stats := db.Stats()
+    pool := poolStats{
+        MaxOpen:        stats.MaxOpenConnections,
+        Open:           stats.OpenConnections,
+        InUse:          stats.InUse,
+        Idle:           stats.Idle,
+        WaitCount:      stats.WaitCount,
+        WaitDurationMs: float64(stats.WaitDuration.Microseconds()) / 1000,
+    }
+
+    if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections {
+        return pool, HealthDegraded
+    }
+    return pool, HealthOK
+}
+
+// breakerHealth reports a circuit breaker's state and what it means for
+// health; anything but closed is degraded
+func breakerHealth(b *breaker.Breaker) (string, string) {
+    if b == nil {
+        return "", HealthOK
+    }
+
+    state := b.State()
+    if state == breaker.Closed {
+        return state.String(), HealthOK
+    }
+    return state.String(), HealthDegraded
+}
+
+// checkScheduler reports when the sale scheduler last finished a pass, in
+// Unix seconds, and whether it did so recently; a scheduler that stalled or
+// died leaves new sales uncreated, which is degraded
+func checkScheduler(saleScheduler *scheduler.Scheduler) (int64, string) {
+    if saleScheduler == nil {
+        return 0, HealthOK
+    }
+
+    last := saleScheduler.LastHeartbeat()
+    if last.IsZero() {
+        return 0, HealthDegraded
+    }
+    if clock().Sub(last) > scheduler.HeartbeatTimeout {
+        return last.Unix(), HealthDegraded
+    }
+    return last.Unix(), HealthOK
+}
+
+// checkActiveSale reports whether there is a running sale and every running
+// sale has its inventory loaded in Redis, i.e. whether purchases can actually
+// be served
+func checkActiveSale(db *database.DB, redisClient *redis.Client) string {
+    sales, err := db.GetActiveSales()
+    if err != nil || len(sales) == 0 {
+        return HealthError
+    }
+
+    for _, sale := range sales {
+        if _, err := redisClient.GetRemainingInventory(sale.SaleID); err != nil {
+            return HealthError
+        }
+    }
+    return HealthOK
+}
+
+// dependencyHealth is the part of a readiness check that reaches the database
+// and Redis, and so the part worth caching
+type dependencyHealth struct {
+    database        string
+    databaseLatency float64
+    redis           string
+    redisLatency    float64
+    activeSale      string
+    maintenance     bool
+    checkedAt       time.Time
+}
+
+// checkDependencies pings both dependencies and checks the active sale
+func checkDependencies(db *database.DB, redisClient *redis.Client, latencyThreshold time.Duration) dependencyHealth {
+    var deps dependencyHealth
+
+    // Ping both dependencies at once so one slow dependency doesn't
+    // delay the other's result
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        deps.database, deps.databaseLatency = pingDependency(db.Ping, latencyThreshold)
+    }()
+    go func() {
+        defer wg.Done()
+        deps.redis, deps.redisLatency = pingDependency(redisClient.Ping, latencyThreshold)
+    }()
+    wg.Wait()
+
+    deps.activeSale = HealthError
+    if deps.database != HealthError && deps.redis != HealthError {
+        deps.activeSale = checkActiveSale(db, redisClient)
+    }
+
+    // Maintenance pauses purchases but the instance still serves reads,
+    // so it doesn't affect the status
+    if deps.redis != HealthError {
+        if state, err := redisClient.GetMaintenance(); err == nil {
+            deps.maintenance = state.Enabled
+        }
+    }
+
+    deps.checkedAt = time.Now()
+    return deps
+}
+
+// dependencyCache shares one dependency check between every probe arriving
+// within ttl, so probe storms from many pods cost one round of pings. A
+// failure shows up at most ttl after it starts.
+type dependencyCache struct {
+    ttl   time.Duration
+    check func() dependencyHealth
+
+    mu   sync.Mutex
+    last dependencyHealth
+}
+
+// get returns the last check if it is younger than ttl and runs a new one
+// otherwise. Holding the lock while checking makes concurrent probes wait
+// for one check instead of each running their own.
+func (c *dependencyCache) get() dependencyHealth {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.ttl <= 0 || c.last.checkedAt.IsZero() || time.Since(c.last.checkedAt) >= c.ttl {
+        c.last = c.check()
+    }
+    return c.last
+}
+
+// LivenessHandler reports that the process is up. It never checks
+// dependencies so a brief outage elsewhere doesn't get the instance restarted.
+func LivenessHandler() http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "status":    HealthOK,
+            "timestamp": time.Now().Unix(),
+        })
+    }
+}
+
+// ReadinessHandler reports whether the instance can serve traffic: both
+// dependencies answer and an active sale is loaded. It returns 503 otherwise.
+// Dependency results are reused for cacheTTL, zero checking on every request;
+// pool, breaker and scheduler state is local and always current.
+func ReadinessHandler(db *database.DB, redisClient *redis.Client, saleScheduler *scheduler.Scheduler, latencyThreshold, cacheTTL time.Duration) http.HandlerFunc {
+    deps := &dependencyCache{
+        ttl: cacheTTL,
+        check: func() dependencyHealth {
+            return checkDependencies(db, redisClient, latencyThreshold)
+        },
+    }
+
     return func(w http.ResponseWriter, r *http.Request) {
         health := struct {
-            Status    string `json:"status"`
-            Timestamp int64  `json:"timestamp"`
-            Database  string `json:"database"`
-            Redis     string `json:"redis"`
+            Status          string    `json:"status"`
+            Timestamp       int64     `json:"timestamp"`
+            Database        string    `json:"database"`
+            DatabaseLatency float64   `json:"database_latency_ms"`
+            DatabaseBreaker string    `json:"database_breaker,omitempty"`
+            DatabasePool    poolStats `json:"database_pool"`
+            Redis           string    `json:"redis"`
+            RedisLatency    float64   `json:"redis_latency_ms"`
+            RedisBreaker    string    `json:"redis_breaker,omitempty"`
+            ActiveSale      string    `json:"active_sale"`
+            Maintenance     bool      `json:"maintenance"`
+            Scheduler       string    `json:"scheduler"`
+            SchedulerBeat   int64     `json:"scheduler_heartbeat,omitempty"`
+            CheckedAt       int64     `json:"checked_at"`
         }{
-            Status:    "OK",
             Timestamp: time.Now().Unix(),
-            Database:  "OK",
-            Redis:     "OK",
         }
 
-        if err := db.Ping(); err != nil {
-            health.Status = "ERROR"
-            health.Database = "ERROR"
-        }
+        dep := deps.get()
+        health.Database, health.DatabaseLatency = dep.database, dep.databaseLatency
+        health.Redis, health.RedisLatency = dep.redis, dep.redisLatency
+        health.ActiveSale = dep.activeSale
+        health.Maintenance = dep.maintenance
+        health.CheckedAt = dep.checkedAt.Unix()
 
-        if err := redisClient.Ping(); err != nil {
-            health.Status = "ERROR"
-            health.Redis = "ERROR"
-        }
+        health.Status = worstStatus(worstStatus(health.Database, health.Redis), health.ActiveSale)
+
+        var poolStatus string
+        health.DatabasePool, poolStatus = checkPool(db)
+        health.Status = worstStatus(health.Status, poolStatus)
+
+        var breakerStatus string
+        health.DatabaseBreaker, breakerStatus = breakerHealth(db.Breaker)
+        health.Status = worstStatus(health.Status, breakerStatus)
+        health.RedisBreaker, breakerStatus = breakerHealth(redisClient.Breaker)
+        health.Status = worstStatus(health.Status, breakerStatus)
+
+        health.SchedulerBeat, health.Scheduler = checkScheduler(saleScheduler)
+        health.Status = worstStatus(health.Status, health.Scheduler)
 
         w.Header().Set("Content-Type", "application/json")
+        if health.Status == HealthError {
+            w.WriteHeader(http.StatusServiceUnavailable)
+        }
         json.NewEncoder(w).Encode(health)
     }
 }
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+
+    "github.com/Hananjeda/Flash-Sale-Service/internal/config"
+    "github.com/Hananjeda/Flash-Sale-Service/internal/scheduler"
+)
+
+func TestCheckSchedulerDegradedOnceHeartbeatStale(t *testing.T) {
+    db, mock := newTestDB(t)
+    saleScheduler, err := scheduler.NewScheduler(db, nil, config.Scheduler{})
+    if err != nil {
+        t.Fatalf("NewScheduler: %v", err)
+    }
+
+    if _, status := checkScheduler(saleScheduler); status != HealthDegraded {
+        t.Errorf("before start: status = %s, want %s", status, HealthDegraded)
+    }
+
+    // Start beats once, then stops at the failing active sale lookup, so the
+    // heartbeat is never renewed
+    mock.ExpectQuery("FROM sales").WillReturnRows(sqlmock.NewRows(
+        []string{"sale_id", "start_time", "end_time", "total_items", "items_sold", "status", "checkout_ttl_seconds"}))
+    mock.ExpectQuery("FROM sales").WillReturnError(errors.New("connection refused"))
+    if err := saleScheduler.Start(context.Background()); err == nil {
+        t.Fatal("Start = nil, want the active sale lookup's error")
+    }
+    last := saleScheduler.LastHeartbeat()
+
+    tests := []struct {
+        name string
+        at   time.Time
+        want string
+    }{
+        {"just beaten", last, HealthOK},
+        {"at the timeout", last.Add(scheduler.HeartbeatTimeout), HealthOK},
+        {"past the timeout", last.Add(scheduler.HeartbeatTimeout + time.Second), HealthDegraded},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            setClock(t, tt.at)
+            beat, status := checkScheduler(saleScheduler)
+            if status != tt.want {
+                t.Errorf("status = %s, want %s", status, tt.want)
+            }
+            if beat != last.Unix() {
+                t.Errorf("heartbeat = %d, want %d", beat, last.Unix())
+            }
+        })
+    }
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+const (
+	// idempotencyTTL is how long a stored response is replayed for retries
+	idempotencyTTL = 24 * time.Hour
+
+	// idempotencyPendingTTL is how long a key stays claimed while its request
+	// runs. It outlasts the request timeout and the query timeout of the
+	// writes that may follow it, and frees the key of a request whose
+	// instance died with it soon after.
+	idempotencyPendingTTL = time.Minute
+
+	// maxIdempotencyKeyLength rejects keys that would bloat Redis
+	maxIdempotencyKeyLength = 255
+)
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	rr.status = code
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// withIdempotency makes next safe to retry when the client sends an
+// Idempotency-Key header. The first request with a key is processed and its
+// response stored; repeats get that response back verbatim. Reusing a key for
+// a different payload, as identified by fingerprint, is rejected with 422.
+func withIdempotency(redisClient *redis.Client, fingerprint func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeIdempotencyKeyInvalid, "Idempotency-Key is too long")
+			return
+		}
+
+		record, err := redisClient.BeginIdempotentRequest(r.Context(), key, fingerprint(r), idempotencyPendingTTL)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to claim idempotency key", "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error processing request")
+			return
+		}
+
+		switch record.State {
+		case redis.IdempotencyMismatch:
+			WriteJSONError(w, http.StatusUnprocessableEntity, ErrCodeIdempotencyKeyReused, "Idempotency-Key was already used with a different request")
+			return
+		case redis.IdempotencyInProgress:
+			WriteJSONError(w, http.StatusConflict, ErrCodeIdempotencyKeyInFlight, "A request with this Idempotency-Key is still being processed")
+			return
+		case redis.IdempotencyDone:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.Status)
+			w.Write(record.Body)
+			return
+		}
+
+		// A panic is no final answer either; the key is released before the
+		// panic goes on to the recovery middleware
+		defer func() {
+			if p := recover(); p != nil {
+				if err := redisClient.AbandonIdempotentRequest(context.WithoutCancel(r.Context()), key); err != nil {
+					Logger(r.Context()).Error("Failed to release idempotency key", "error", err)
+				}
+				panic(p)
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		// Server errors are not final; let the client retry them
+		if recorder.status >= http.StatusInternalServerError {
+			if err := redisClient.AbandonIdempotentRequest(context.WithoutCancel(r.Context()), key); err != nil {
+				Logger(r.Context()).Error("Failed to release idempotency key", "error", err)
+			}
+			return
+		}
+
+		if err := redisClient.CompleteIdempotentRequest(context.WithoutCancel(r.Context()), key, recorder.status, recorder.body.Bytes(), idempotencyTTL); err != nil {
+			Logger(r.Context()).Error("Failed to store idempotent response", "error", err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeyPendingTTLIsShort(t *testing.T) {
+	redisClient := newTestRedis(t)
+	var pendingTTL time.Duration
+	handler := withIdempotency(redisClient, func(*http.Request) string { return "fp" }, func(w http.ResponseWriter, r *http.Request) {
+		pendingTTL = redisClient.PTTL(context.Background(), "idempotency:key_1").Val()
+		w.WriteHeader(http.StatusOK)
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/purchase", nil)
+	r.Header.Set("Idempotency-Key", "key_1")
+	handler(httptest.NewRecorder(), r)
+
+	if pendingTTL <= 0 || pendingTTL > idempotencyPendingTTL {
+		t.Errorf("TTL while pending = %v, want at most %v", pendingTTL, idempotencyPendingTTL)
+	}
+	// The stored response is kept for replays
+	if ttl := redisClient.PTTL(context.Background(), "idempotency:key_1").Val(); ttl <= idempotencyPendingTTL {
+		t.Errorf("TTL once done = %v, want up to %v", ttl, idempotencyTTL)
+	}
+}
+
+func TestIdempotencyKeyReleasedOnPanic(t *testing.T) {
+	redisClient := newTestRedis(t)
+	calls := 0
+	handler := withIdempotency(redisClient, func(*http.Request) string { return "fp" }, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/purchase", nil)
+		r.Header.Set("Idempotency-Key", "key_1")
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec
+	}
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Fatalf("recovered %v, want the panic passed on", p)
+			}
+		}()
+		request()
+	}()
+
+	// The retry is processed rather than told the key is still in flight
+	if rec := request(); rec.Code != http.StatusOK || calls != 2 {
+		t.Errorf("retry after the panic: status = %d, calls = %d; want 200 and 2", rec.Code, calls)
+	}
+}
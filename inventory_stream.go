@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/database"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+const (
+	// inventoryPushInterval is the most often clients are sent a new count
+	inventoryPushInterval = time.Second
+
+	// streamHeartbeatInterval keeps idle connections open through proxies
+	streamHeartbeatInterval = 15 * time.Second
+)
+
+// inventoryUpdate is the payload of each inventory event
+type inventoryUpdate struct {
+	SaleID         string `json:"sale_id"`
+	ItemsRemaining int    `json:"items_remaining"`
+}
+
+// InventoryStream pushes the remaining inventory of each running sale to
+// connected Server-Sent Events clients. Purchases publish through Redis so every
+// instance hears about them; each instance reads the count at most once per
+// second however many purchases or clients there are.
+type InventoryStream struct {
+	db         *database.DB
+	redis      *redis.Client
+	maxStreams int
+
+	mu      sync.Mutex
+	clients map[chan []inventoryUpdate]struct{}
+	latest  map[string]int
+
+	// done closes when Run returns so open streams end on shutdown
+	done chan struct{}
+}
+
+// NewInventoryStream creates a stream allowing up to maxStreams clients
+func NewInventoryStream(db *database.DB, redisClient *redis.Client, maxStreams int) *InventoryStream {
+	return &InventoryStream{
+		db:         db,
+		redis:      redisClient,
+		maxStreams: maxStreams,
+		clients:    make(map[chan []inventoryUpdate]struct{}),
+		latest:     make(map[string]int),
+		done:       make(chan struct{}),
+	}
+}
+
+// Run listens for inventory changes and broadcasts them until ctx is cancelled
+func (s *InventoryStream) Run(ctx context.Context) {
+	defer close(s.done)
+
+	updates := s.redis.SubscribeInventoryUpdates(ctx)
+	ticker := time.NewTicker(inventoryPushInterval)
+	defer ticker.Stop()
+
+	dirty := true
+	for {
+		select {
+		case _, ok := <-updates:
+			if !ok {
+				return
+			}
+			dirty = true
+
+		case <-ticker.C:
+			if !dirty {
+				continue
+			}
+			dirty = false
+
+			counts, err := s.current()
+			if err != nil {
+				slog.Error("Failed to load inventory for stream", "error", err)
+				dirty = true
+				continue
+			}
+			s.broadcast(counts)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// current reads the remaining inventory of every running sale
+func (s *InventoryStream) current() ([]inventoryUpdate, error) {
+	sales, err := s.db.GetActiveSales()
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make([]inventoryUpdate, 0, len(sales))
+	for _, sale := range sales {
+		remaining, err := s.redis.GetRemainingInventory(sale.SaleID)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, inventoryUpdate{SaleID: sale.SaleID, ItemsRemaining: remaining})
+	}
+	return updates, nil
+}
+
+// broadcast sends every update whose count changed to every client. A slow
+// client only ever holds the newest count of each sale.
+func (s *InventoryStream) broadcast(updates []inventoryUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed []inventoryUpdate
+	for _, update := range updates {
+		if remaining, ok := s.latest[update.SaleID]; ok && remaining == update.ItemsRemaining {
+			continue
+		}
+		s.latest[update.SaleID] = update.ItemsRemaining
+		changed = append(changed, update)
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	for ch := range s.clients {
+		pending := changed
+		select {
+		case unsent := <-ch:
+			pending = mergeUpdates(unsent, changed)
+		default:
+		}
+		ch <- pending
+	}
+}
+
+// mergeUpdates combines a client's unsent updates with newer ones, keeping
+// the newest count of each sale
+func mergeUpdates(unsent, newer []inventoryUpdate) []inventoryUpdate {
+	merged := append([]inventoryUpdate(nil), newer...)
+	for _, old := range unsent {
+		superseded := false
+		for _, update := range newer {
+			if update.SaleID == old.SaleID {
+				superseded = true
+				break
+			}
+		}
+		if !superseded {
+			merged = append(merged, old)
+		}
+	}
+	return merged
+}
+
+func (s *InventoryStream) register() (chan []inventoryUpdate, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.clients) >= s.maxStreams {
+		return nil, false
+	}
+	ch := make(chan []inventoryUpdate, 1)
+	s.clients[ch] = struct{}{}
+	return ch, true
+}
+
+func (s *InventoryStream) unregister(ch chan []inventoryUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, ch)
+}
+
+// Handler serves GET /sales/active/stream as text/event-stream. Each event is
+// "event: inventory" with {"sale_id", "items_remaining"} of one sale as data.
+func (s *InventoryStream) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		ch, ok := s.register()
+		if !ok {
+			WriteJSONError(w, http.StatusServiceUnavailable, ErrCodeTooManyStreams, "Too many open inventory streams, poll /sales/active instead")
+			return
+		}
+		defer s.unregister(ch)
+
+		// Streams outlive the server's write timeout
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			Logger(r.Context()).Error("Failed to clear write deadline for inventory stream", "error", err)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		send := func(update inventoryUpdate) error {
+			data, err := json.Marshal(update)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: inventory\ndata: %s\n\n", data); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+
+		updates, err := s.current()
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load inventory for stream", "error", err)
+		}
+		for _, update := range updates {
+			if err := send(update); err != nil {
+				return
+			}
+		}
+		if len(updates) == 0 {
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case updates := <-ch:
+				for _, update := range updates {
+					if err := send(update); err != nil {
+						return
+					}
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
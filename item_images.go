@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// imageCheckInterval is how long the result of probing an image host is
+	// trusted before it is probed again
+	imageCheckInterval = 30 * time.Second
+
+	// imageCheckTimeout bounds each probe
+	imageCheckTimeout = 2 * time.Second
+)
+
+// ItemImages adds a fallback image to item responses, for the storefront to
+// swap in when an image fails to load. With health checks on, items on an
+// image host that doesn't answer are served the fallback as their image_url
+// outright. A nil *ItemImages leaves items as they are.
+type ItemImages struct {
+	fallback string
+	checker  *imageHostChecker
+}
+
+// NewItemImages serves fallback with every item, and with checkHosts also
+// probes image hosts in the background to substitute it for unreachable ones
+func NewItemImages(fallback string, checkHosts bool) *ItemImages {
+	images := &ItemImages{fallback: fallback}
+	if checkHosts {
+		images.checker = &imageHostChecker{
+			client: &http.Client{Timeout: imageCheckTimeout},
+			hosts:  make(map[string]*imageHostState),
+		}
+	}
+	return images
+}
+
+// resolve returns the image URL to serve for primary, and the fallback
+func (im *ItemImages) resolve(primary string) (string, string) {
+	if im == nil || im.fallback == "" {
+		return primary, ""
+	}
+	if im.checker != nil && !im.checker.reachable(primary) {
+		return im.fallback, im.fallback
+	}
+	return primary, im.fallback
+}
+
+// imageHostChecker remembers which image hosts answered their last probe.
+// Items are generated from one strategy, so there are only ever a handful
+// of hosts.
+type imageHostChecker struct {
+	client *http.Client
+
+	mu    sync.Mutex
+	hosts map[string]*imageHostState
+}
+
+type imageHostState struct {
+	down    bool
+	checked time.Time
+	probing bool
+}
+
+// reachable reports whether rawURL's host answered its last probe. It never
+// waits on the network: a host whose result is old is probed in the
+// background and keeps its last result, optimistically reachable, until the
+// probe finishes.
+func (c *imageHostChecker) reachable(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state, ok := c.hosts[u.Host]
+	if !ok {
+		state = &imageHostState{}
+		c.hosts[u.Host] = state
+	}
+	if !state.probing && time.Since(state.checked) >= imageCheckInterval {
+		state.probing = true
+		go c.probe(state, rawURL)
+	}
+	return !state.down
+}
+
+// probe sends a HEAD for rawURL and records whether its host answered.
+// Client errors such as 404 still mean the host is up.
+func (c *imageHostChecker) probe(state *imageHostState, rawURL string) {
+	ctx, cancel := context.WithTimeout(context.Background(), imageCheckTimeout)
+	defer cancel()
+
+	down := true
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, rawURL, nil)
+	if err == nil {
+		resp, err := c.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			down = resp.StatusCode >= 500
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state.down = down
+	state.checked = time.Now()
+	state.probing = false
+}
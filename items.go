@@ -0,0 +1,440 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/database"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/models"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+const (
+	defaultItemsLimit = 50
+	maxItemsLimit     = 200
+
+	// maxAvailabilityItems caps the item IDs in one availability check
+	maxAvailabilityItems = 100
+
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+
+	// maxSearchQueryLength bounds the search text; no item name is longer
+	maxSearchQueryLength = 100
+)
+
+// itemResponse is an item together with its live availability
+type itemResponse struct {
+	models.Item
+	FallbackImageURL string `json:"fallback_image_url,omitempty"`
+	Stock            int    `json:"stock"`
+	Available        bool   `json:"available"`
+}
+
+// newItemResponse builds the response for item, choosing its images through
+// images
+func newItemResponse(item models.Item, stock int, available bool, images *ItemImages) itemResponse {
+	resp := itemResponse{Item: item, Stock: stock, Available: available}
+	resp.ImageURL, resp.FallbackImageURL = images.resolve(item.ImageURL)
+	return resp
+}
+
+// parseNonNegativeInt parses an optional query parameter, returning def when
+// it is absent
+func parseNonNegativeInt(r *http.Request, name string, def int) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, true
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// stocksFromPurchases estimates remaining stock from the purchases table
+func stocksFromPurchases(db *database.DB, itemIDs []string) (map[string]int, error) {
+	purchased, err := db.CountPurchasesByItem(itemIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	stocks := make(map[string]int, len(itemIDs))
+	for _, itemID := range itemIDs {
+		stock := models.DefaultStockPerItem - purchased[itemID]
+		if stock < 0 {
+			stock = 0
+		}
+		stocks[itemID] = stock
+	}
+	return stocks, nil
+}
+
+// itemStocks reads the live stock of items. While Redis is down, stock is
+// derived from recorded purchases and reported stale; it misses units held by
+// open checkouts.
+func itemStocks(r *http.Request, db *database.DB, redisClient *redis.Client, itemIDs []string) (map[string]int, bool, error) {
+	stocks, err := redisClient.GetItemStocks(itemIDs)
+	if err == nil {
+		return stocks, false, nil
+	}
+
+	Logger(r.Context()).Error("Failed to load item stock, falling back to database", "error", err)
+	stocks, err = stocksFromPurchases(db, itemIDs)
+	if err != nil {
+		Logger(r.Context()).Error("Failed to count purchases by item", "error", err)
+		return nil, false, err
+	}
+	return stocks, true, nil
+}
+
+// itemsETag is the weak ETag of a page of a sale's items, built from the
+// sale's inventory version, which moves on with every change to its stock.
+// Item details don't change once a sale is generated.
+func itemsETag(saleID string, version int64) string {
+	return fmt.Sprintf(`W/"%s-%d"`, saleID, version)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using weak
+// comparison
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ListItemsHandler returns a page of items for a sale. The sale defaults to
+// the active one and can be chosen with ?sale_id=; ?category= narrows the
+// page to one category. Responses carry an ETag and a matching If-None-Match
+// gets 304 Not Modified until the sale's inventory changes. Item images are
+// chosen through images.
+func ListItemsHandler(db *database.DB, redisClient *redis.Client, images *ItemImages) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		limit, ok := parseNonNegativeInt(r, "limit", defaultItemsLimit)
+		if !ok {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid limit")
+			return
+		}
+		if limit == 0 {
+			limit = defaultItemsLimit
+		}
+		if limit > maxItemsLimit {
+			limit = maxItemsLimit
+		}
+
+		offset, ok := parseNonNegativeInt(r, "offset", 0)
+		if !ok {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid offset")
+			return
+		}
+
+		saleID := r.URL.Query().Get("sale_id")
+		if saleID == "" {
+			sale, err := db.GetActiveSale()
+			if err != nil {
+				Logger(r.Context()).Error("Failed to load active sale", "error", err)
+				WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error listing items")
+				return
+			}
+
+			if sale == nil {
+				WriteJSONError(w, http.StatusNotFound, ErrCodeNoActiveSale, "No active sale")
+				return
+			}
+			saleID = sale.SaleID
+		}
+
+		category := r.URL.Query().Get("category")
+
+		// The version is read before the stock so a stock change in between
+		// only ever makes the body newer than its ETag, never older
+		version, err := redisClient.GetInventoryVersion(saleID)
+		if err == nil {
+			etag := itemsETag(saleID, version)
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "no-cache")
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else if !errors.Is(err, redis.ErrSaleNotInitialized) {
+			Logger(r.Context()).Error("Failed to load inventory version, serving without ETag", "sale_id", saleID, "error", err)
+		}
+
+		total, err := db.CountItemsByCategory(saleID, category)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to count items", "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error listing items")
+			return
+		}
+
+		items, err := db.ListItemsByCategory(saleID, category, limit, offset)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to list items", "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error listing items")
+			return
+		}
+
+		itemIDs := make([]string, len(items))
+		for i, item := range items {
+			itemIDs[i] = item.ItemID
+		}
+
+		stocks, stale, err := itemStocks(r, db, redisClient, itemIDs)
+		if err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error listing items")
+			return
+		}
+
+		// Derived stock isn't what the ETag versions
+		if stale {
+			w.Header().Del("ETag")
+		}
+
+		results := make([]itemResponse, len(items))
+		for i, item := range items {
+			stock := stocks[item.ItemID]
+			results[i] = newItemResponse(item, stock, stock > 0, images)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"stale":   stale,
+			"sale_id": saleID,
+			"items":   results,
+			"total":   total,
+			"limit":   limit,
+			"offset":  offset,
+		})
+	}
+}
+
+// SearchItemsHandler serves GET /items/search?q=, finding items in a sale by
+// a case-insensitive match anywhere in their name, best match first, each
+// with its live availability. The sale defaults to the active one and can be
+// chosen with ?sale_id=. No matches is an empty list. Item images are chosen
+// through images.
+func SearchItemsHandler(db *database.DB, redisClient *redis.Client, images *ItemImages) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		if query == "" {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeMissingParameter, "Missing q")
+			return
+		}
+		if len(query) > maxSearchQueryLength {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter,
+				fmt.Sprintf("q must be at most %d characters", maxSearchQueryLength))
+			return
+		}
+
+		limit, ok := parseNonNegativeInt(r, "limit", defaultSearchLimit)
+		if !ok {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid limit")
+			return
+		}
+		if limit == 0 {
+			limit = defaultSearchLimit
+		}
+		if limit > maxSearchLimit {
+			limit = maxSearchLimit
+		}
+
+		saleID := r.URL.Query().Get("sale_id")
+		if saleID == "" {
+			sale, err := db.GetActiveSale()
+			if err != nil {
+				Logger(r.Context()).Error("Failed to load active sale", "error", err)
+				writeDependencyError(w, err, "Error searching items")
+				return
+			}
+
+			if sale == nil {
+				WriteJSONError(w, http.StatusNotFound, ErrCodeNoActiveSale, "No active sale")
+				return
+			}
+			saleID = sale.SaleID
+		}
+
+		items, err := db.SearchItems(saleID, query, limit)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to search items", "sale_id", saleID, "error", err)
+			writeDependencyError(w, err, "Error searching items")
+			return
+		}
+
+		itemIDs := make([]string, len(items))
+		for i, item := range items {
+			itemIDs[i] = item.ItemID
+		}
+
+		stocks, stale, err := itemStocks(r, db, redisClient, itemIDs)
+		if err != nil {
+			writeDependencyError(w, err, "Error searching items")
+			return
+		}
+
+		results := make([]itemResponse, len(items))
+		for i, item := range items {
+			stock := stocks[item.ItemID]
+			results[i] = newItemResponse(item, stock, stock > 0, images)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"stale":   stale,
+			"sale_id": saleID,
+			"query":   query,
+			"items":   results,
+			"limit":   limit,
+		})
+	}
+}
+
+// GetItemHandler serves GET /items/{itemID} with one item's details and live
+// stock, for deep links to a product page. sale_active tells the page whether
+// to offer a buy button; available is only set while the sale is running.
+// Item images are chosen through images.
+func GetItemHandler(db *database.DB, redisClient *redis.Client, images *ItemImages) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/items/"), "/")
+		if itemID == "" || strings.Contains(itemID, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		item, err := db.GetItemContext(r.Context(), itemID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load item", "item_id", itemID, "error", err)
+			writeDependencyError(w, err, "Error loading item")
+			return
+		}
+
+		if item == nil {
+			WriteJSONError(w, http.StatusNotFound, ErrCodeNotFound, "Item not found")
+			return
+		}
+
+		sale, err := db.GetActiveSaleByIDContext(r.Context(), item.SaleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load item's sale", "sale_id", item.SaleID, "error", err)
+			writeDependencyError(w, err, "Error loading item")
+			return
+		}
+		saleActive := sale != nil
+
+		// Falls back to recorded purchases like ListItemsHandler does
+		stale := false
+		stock, err := redisClient.GetItemStock(itemID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load item stock, falling back to database", "item_id", itemID, "error", err)
+			stocks, err := stocksFromPurchases(db, []string{itemID})
+			if err != nil {
+				Logger(r.Context()).Error("Failed to count purchases by item", "item_id", itemID, "error", err)
+				writeDependencyError(w, err, "Error loading item")
+				return
+			}
+			stock = stocks[itemID]
+			stale = true
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":     true,
+			"stale":       stale,
+			"sale_active": saleActive,
+			"item":        newItemResponse(*item, stock, saleActive && stock > 0, images),
+		})
+	}
+}
+
+// CheckAvailabilityHandler serves GET /items/availability?item_ids=a,b,c with
+// the current stock of each item, read from Redis in one MGET so storefronts
+// can poll it to grey out sold out items. The answer is advisory: stock can
+// change before a checkout, open checkouts are not subtracted, and unknown
+// items report no stock. Only the checkout decides whether an item can be
+// had.
+func CheckAvailabilityHandler(redisClient *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		var itemIDs []string
+		seen := make(map[string]bool)
+		for _, param := range r.URL.Query()["item_ids"] {
+			for _, itemID := range strings.Split(param, ",") {
+				itemID = strings.TrimSpace(itemID)
+				if itemID == "" || seen[itemID] {
+					continue
+				}
+				seen[itemID] = true
+				itemIDs = append(itemIDs, itemID)
+			}
+		}
+
+		if len(itemIDs) == 0 {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeMissingParameter, "Missing item_ids")
+			return
+		}
+
+		if len(itemIDs) > maxAvailabilityItems {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter,
+				fmt.Sprintf("At most %d item IDs can be checked at once", maxAvailabilityItems))
+			return
+		}
+
+		stocks, err := redisClient.GetItemStocks(itemIDs)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load item stock", "error", err)
+			writeDependencyError(w, err, "Error checking availability")
+			return
+		}
+
+		items := make([]map[string]interface{}, len(itemIDs))
+		for i, itemID := range itemIDs {
+			items[i] = map[string]interface{}{
+				"item_id":   itemID,
+				"stock":     stocks[itemID],
+				"available": stocks[itemID] > 0,
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"advisory": true,
+			"items":    items,
+		})
+	}
+}
@@ -3,139 +3,282 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"syscall"
-	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/breaker"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/config"
 	"github.com/Hananjeda/Flash-Sale-Service/internal/database"
 	"github.com/Hananjeda/Flash-Sale-Service/internal/handlers"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/metrics"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/middleware"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/notify"
 	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
 	"github.com/Hananjeda/Flash-Sale-Service/internal/scheduler"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/webhooks"
 )
 
-// Config holds application configuration
-type Config struct {
-	Port     int
-	Database database.Config
-	Redis    redis.Config
-}
-
-// getEnv returns environment variable value or default
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
-
-// getEnvInt returns environment variable as integer or default
-func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
-		}
-	}
-	return defaultValue
-}
-
-// loadConfig loads configuration from environment variables
-func loadConfig() Config {
-	return Config{
-		Port: getEnvInt("PORT", 8080),
-		Database: database.Config{
-			Host:     getEnv("DB_HOST", "localhost"),
-			Port:     getEnvInt("DB_PORT", 5432),
-			User:     getEnv("DB_USER", "postgres"),
-			Password: getEnv("DB_PASSWORD", "password"),
-			DBName:   getEnv("DB_NAME", "flashsale"),
-			SSLMode:  getEnv("DB_SSLMODE", "disable"),
-		},
-		Redis: redis.Config{
-			Addr:     getEnv("REDIS_ADDR", "localhost:6379"),
-			Password: getEnv("REDIS_PASSWORD", ""),
-			DB:       getEnvInt("REDIS_DB", 0),
-		},
-	}
-}
-
-// corsMiddleware adds CORS headers
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		
-		next.ServeHTTP(w, r)
-	})
-}
-
-// loggingMiddleware logs HTTP requests
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		
-		// Create a response writer wrapper to capture status code
-		wrapper := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		
-		next.ServeHTTP(wrapper, r)
-		
-		duration := time.Since(start)
-		log.Printf("%s %s %d %v", r.Method, r.URL.Path, wrapper.statusCode, duration)
-	})
-}
-
-// responseWriter wraps http.ResponseWriter to capture status code
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
-
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
-}
-
 func main() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
 	log.Println("Starting Flash Sale Service...")
 
 	// Load configuration
-	config := loadConfig()
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 	log.Printf("Configuration loaded: Port=%d, DB=%s:%d, Redis=%s", 
-		config.Port, config.Database.Host, config.Database.Port, config.Redis.Addr)
+		cfg.Server.Port, cfg.Database.Host, cfg.Database.Port, cfg.Redis.Addr)
 
 	// Initialize database
-	db, err := database.ConnectDB()
+	db, err := database.ConnectDB(cfg.Database)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 	defer db.Close()
 
+	// Checkout and purchase answer 503 while the breaker is open, and their
+	// queries give up after the query timeout
+	db.Breaker = breaker.New(cfg.DBBreaker.Threshold, cfg.DBBreaker.Cooldown)
+	db.QueryTimeout = cfg.DBQueryTimeout
+	db.QueryMetrics = cfg.DBQueryMetrics
+	db.SlowQueryThreshold = cfg.DBSlowQueryThreshold
+	db.ConfigurePool(cfg.DBPool)
+
 	// Initialize Redis
-	redisClient, err := redis.ConnectRedis()
+	redisClient, err := redis.ConnectRedis(cfg.Redis)
 	if err != nil {
 		log.Fatalf("Failed to connect to Redis: %v", err)
 	}
 	defer redisClient.Close()
 
+	// Reads fall back to the database while the breaker is open; purchases
+	// fail fast instead of waiting on timeouts
+	redisClient.EnableCircuitBreaker(breaker.New(cfg.RedisBreaker.Threshold, cfg.RedisBreaker.Cooldown))
+
 	// Initialize scheduler
-	scheduler.StartScheduler(db)
+	schedulerCtx, schedulerCancel := context.WithCancel(context.Background())
+	defer schedulerCancel()
+
+	// Requests get ErrRedisUnavailable at once while pings fail, and the
+	// client reconnects with backoff once Redis is back
+	redisClient.StartHealthCheck(schedulerCtx, cfg.RedisHealthInterval)
+
+	var events *webhooks.Dispatcher
+	if cfg.WebhookURL != "" {
+		events = webhooks.NewDispatcher(cfg.WebhookURL, cfg.WebhookSecret)
+		events.Start(schedulerCtx)
+	}
+
+	// Buyers are notified off the request path; without a URL nothing is sent
+	var notifier notify.Notifier = notify.Nop{}
+	if cfg.PurchaseNotifyURL != "" {
+		notifier = notify.NewHTTPNotifier(cfg.PurchaseNotifyURL)
+	}
+	notifications := notify.NewDispatcher(notifier)
+	notifications.Start(schedulerCtx)
+
+	saleScheduler, err := scheduler.NewScheduler(db, redisClient, cfg.Scheduler)
+	if err != nil {
+		log.Fatalf("Invalid scheduler configuration: %v", err)
+	}
+	saleScheduler.Events = events
+	if cfg.Scheduler.DryRun {
+		log.Printf("Scheduler dry run: sales are generated but not written")
+	}
+	go func() {
+		if err := saleScheduler.Start(schedulerCtx); err != nil && err != context.Canceled {
+			log.Printf("Scheduler exited: %v", err)
+		}
+	}()
+
+	// Report live inventory for every running sale on every scrape
+	metrics.RegisterItemsRemaining(func() map[string]float64 {
+		sales, err := db.GetActiveSales()
+		if err != nil {
+			return nil
+		}
+		remaining := make(map[string]float64, len(sales))
+		for _, sale := range sales {
+			count, err := redisClient.GetRemainingInventory(sale.SaleID)
+			if err != nil {
+				continue
+			}
+			remaining[sale.SaleID] = float64(count)
+		}
+		return remaining
+	})
 
 	// Setup HTTP routes
 	mux := http.NewServeMux()
 	
+	// Rate limits are per user once authenticated, per client IP otherwise
+	ipKey := middleware.KeyFunc(middleware.RemoteIPKey)
+	if len(cfg.TrustedProxies) > 0 {
+		ipKey, err = middleware.ForwardedIPKey(cfg.TrustedProxies)
+		if err != nil {
+			log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+		}
+	}
+	rateLimitKey := middleware.UserOrIPKey(ipKey)
+
+	// Buckets are kept in Redis so every instance enforces the same limit;
+	// RATE_LIMIT_STORE=memory limits each instance on its own instead
+	limiters := make(map[string]*middleware.RateLimiter)
+	rateLimit := func(route string) func(http.Handler) http.Handler {
+		limit := cfg.RateLimits[route]
+		if limit.Rate <= 0 {
+			return func(next http.Handler) http.Handler { return next }
+		}
+		if cfg.RateLimitStore == config.RateLimitStoreRedis {
+			limiter := middleware.NewRedisRateLimiter(redisClient, limit.Rate, limit.Burst)
+			return middleware.RateLimitMiddlewareFor(route, limiter, rateLimitKey)
+		}
+		limiter := middleware.NewRateLimiter(limit.Rate, limit.Burst)
+		limiter.StartCleanup(schedulerCtx, cfg.RateLimitIdle)
+		limiters[route] = limiter
+		return middleware.RateLimitMiddlewareFor(route, limiter, rateLimitKey)
+	}
+	limitCheckout := rateLimit("checkout")
+	limitPurchase := rateLimit("purchase")
+	limitSales := rateLimit("sales")
+	limitItems := rateLimit("items")
+
+	// In-memory limiters are only added above, so the scrapes can read the
+	// map freely
+	limiterStat := func(stat func(*middleware.RateLimiter) float64) func() map[string]float64 {
+		return func() map[string]float64 {
+			values := make(map[string]float64, len(limiters))
+			for route, limiter := range limiters {
+				values[route] = stat(limiter)
+			}
+			return values
+		}
+	}
+	metrics.RegisterRateLimiters(
+		limiterStat(func(l *middleware.RateLimiter) float64 {
+			keys, _ := l.Stats()
+			return float64(keys)
+		}),
+		limiterStat(func(l *middleware.RateLimiter) float64 {
+			_, saturation := l.Stats()
+			return saturation
+		}),
+	)
+
+	var itemImages *handlers.ItemImages
+	if cfg.FallbackImageURL != "" {
+		itemImages = handlers.NewItemImages(cfg.FallbackImageURL, cfg.ImageHealthChecks)
+	}
+
+	// Each route gets its own deadline; the inventory stream is long-lived
+	// and has none
+	timeout := func(route string) func(http.Handler) http.Handler {
+		return middleware.TimeoutMiddleware(cfg.RouteTimeouts[route])
+	}
+	limitTime := middleware.TimeoutMiddleware(cfg.RequestTimeout)
+	limitCheckoutTime := timeout("checkout")
+	limitPurchaseTime := timeout("purchase")
+	limitSalesTime := timeout("sales")
+	limitItemsTime := timeout("items")
+
+	// Listings are large enough to be worth gzipping; small responses such
+	// as rate limit rejections pass through as they are
+	compress := middleware.CompressionMiddleware(middleware.DefaultCompressionMinSize)
+
 	// API routes
-	mux.HandleFunc("/checkout", handlers.CheckoutHandler(db, redisClient))
-	mux.HandleFunc("/purchase", handlers.PurchaseHandler(db, redisClient))
-	mux.HandleFunc("/health", handlers.HealthCheck)
-	mux.HandleFunc("/stats", handlers.GetStats(db))
+	var checkoutHandler http.Handler = handlers.CheckoutHandler(db, redisClient, []byte(cfg.CheckoutSecret))
+	var cancelCheckoutHandler http.Handler = handlers.CancelCheckoutHandler(redisClient, []byte(cfg.CheckoutSecret))
+	var checkoutQueueHandler http.Handler = handlers.CheckoutQueueHandler(db, redisClient, []byte(cfg.CheckoutSecret))
+	purchaseWrites := handlers.NewPurchaseWrites(cfg.MaxPurchaseWrites, cfg.PurchaseWriteWait)
+	var purchaseSpikes *handlers.PurchaseSpikes
+	if cfg.PurchaseSpikes {
+		purchaseSpikes = handlers.NewPurchaseSpikes(redisClient, float64(cfg.PurchaseSpikeRate), cfg.PurchaseSpikeWindow, cfg.PurchaseSpikeDelay)
+		go purchaseSpikes.Run(schedulerCtx)
+		metrics.RegisterSalePurchaseRates(purchaseSpikes.Rates)
+	}
+	var purchaseHandler http.Handler = handlers.PurchaseHandler(db, redisClient, []byte(cfg.CheckoutSecret), events, notifications, purchaseWrites, purchaseSpikes)
+	var bulkPurchaseHandler http.Handler = handlers.BulkPurchaseHandler(db, redisClient, []byte(cfg.CheckoutSecret), events, notifications, purchaseWrites, purchaseSpikes)
+	var userReservationsHandler http.Handler = handlers.UserReservationsHandler(db, redisClient)
+	var queueHandler http.Handler
+	if cfg.QueueSecret != "" {
+		waitingRoom := handlers.NewWaitingRoom(redisClient, []byte(cfg.QueueSecret), cfg.QueueAdmitPerSecond)
+		purchaseHandler = waitingRoom.Require(handlers.PurchaseUser([]byte(cfg.CheckoutSecret)), purchaseHandler.ServeHTTP)
+		bulkPurchaseHandler = waitingRoom.Require(handlers.BulkPurchaseUser([]byte(cfg.CheckoutSecret)), bulkPurchaseHandler.ServeHTTP)
+		queueHandler = waitingRoom.QueueHandler()
+		mux.HandleFunc("/queue/status", waitingRoom.StatusHandler())
+	}
+	// The limits run after authentication so they can key on the user
+	checkoutHandler = limitCheckout(checkoutHandler)
+	cancelCheckoutHandler = limitCheckout(cancelCheckoutHandler)
+	checkoutQueueHandler = limitCheckout(checkoutQueueHandler)
+	purchaseHandler = limitPurchase(purchaseHandler)
+	bulkPurchaseHandler = limitPurchase(bulkPurchaseHandler)
+	if cfg.JWTSecret != "" {
+		requireAuth := middleware.AuthMiddleware(cfg.JWTSecret)
+		checkoutHandler = requireAuth(checkoutHandler)
+		cancelCheckoutHandler = requireAuth(cancelCheckoutHandler)
+		checkoutQueueHandler = requireAuth(checkoutQueueHandler)
+		purchaseHandler = requireAuth(purchaseHandler)
+		bulkPurchaseHandler = requireAuth(bulkPurchaseHandler)
+		userReservationsHandler = requireAuth(userReservationsHandler)
+		if queueHandler != nil {
+			queueHandler = requireAuth(queueHandler)
+		}
+	}
+	if queueHandler != nil {
+		mux.Handle("/queue", queueHandler)
+	}
+	// Maintenance turns buyers away before anything else runs; cancelling a
+	// checkout only gives stock back, so it stays open
+	pauseForMaintenance := middleware.MaintenanceMiddleware(redisClient)
+	checkoutHandler = pauseForMaintenance(checkoutHandler)
+	checkoutQueueHandler = pauseForMaintenance(checkoutQueueHandler)
+	purchaseHandler = pauseForMaintenance(purchaseHandler)
+	bulkPurchaseHandler = pauseForMaintenance(bulkPurchaseHandler)
+	mux.Handle("/checkout", limitCheckoutTime(checkoutHandler))
+	mux.Handle("/checkout/cancel", limitCheckoutTime(cancelCheckoutHandler))
+	mux.Handle("/checkout/queue", limitCheckoutTime(checkoutQueueHandler))
+	mux.Handle("/purchase", limitPurchaseTime(purchaseHandler))
+	mux.Handle("/purchase/bulk", limitPurchaseTime(bulkPurchaseHandler))
+	readiness := handlers.ReadinessHandler(db, redisClient, saleScheduler, cfg.HealthLatencyThreshold, cfg.HealthCacheTTL)
+	mux.HandleFunc("/health", readiness)
+	mux.HandleFunc("/health/live", handlers.LivenessHandler())
+	mux.HandleFunc("/health/ready", readiness)
+	mux.HandleFunc("/version", handlers.VersionHandler())
+	mux.Handle("/metrics", promhttp.Handler())
+	if cfg.AdminAPIKey != "" {
+		requireAdmin := middleware.AdminMiddleware(cfg.AdminAPIKey)
+		limitAdminTime := timeout("admin")
+		mux.Handle("/admin/sales", limitAdminTime(requireAdmin(handlers.AdminCreateSaleHandler(saleScheduler))))
+		mux.Handle("/admin/sales/", limitAdminTime(requireAdmin(handlers.AdminSaleResourceHandler(db, redisClient, events, purchaseSpikes))))
+		mux.Handle("/admin/items/", limitAdminTime(requireAdmin(handlers.AdminAdjustStockHandler(db, redisClient, events))))
+		mux.Handle("/admin/audit", limitAdminTime(requireAdmin(handlers.AdminAuditHandler(db))))
+		mux.Handle("/admin/maintenance", limitAdminTime(requireAdmin(handlers.AdminMaintenanceHandler(redisClient))))
+	}
+	mux.Handle("/stats", limitTime(handlers.StatsHandler(db, redisClient)))
+	mux.Handle("/sales/active", limitSalesTime(compress(limitSales(handlers.ActiveSaleHandler(db, redisClient, saleScheduler.Schedule)))))
+	inventoryStream := handlers.NewInventoryStream(db, redisClient, cfg.MaxInventoryStreams)
+	go inventoryStream.Run(schedulerCtx)
+	mux.HandleFunc("/sales/active/stream", inventoryStream.Handler())
+	mux.Handle("/sales/upcoming", limitSalesTime(compress(limitSales(handlers.UpcomingSalesHandler(db, saleScheduler.Schedule)))))
+	mux.Handle("/sales/", limitSalesTime(compress(limitSales(handlers.SaleResourceHandler(db, redisClient)))))
+	mux.Handle("/items", limitItemsTime(compress(limitItems(handlers.ListItemsHandler(db, redisClient, itemImages)))))
+	mux.Handle("/items/search", limitItemsTime(compress(limitItems(handlers.SearchItemsHandler(db, redisClient, itemImages)))))
+	mux.Handle("/items/availability", limitItemsTime(limitItems(handlers.CheckAvailabilityHandler(redisClient))))
+	// Held open on purpose, so it sets its own deadline instead of the route
+	// timeout
+	availabilityWatch := handlers.NewAvailabilityWatch(redisClient, cfg.MaxAvailabilityWaits, cfg.AvailabilityWaitHold)
+	go availabilityWatch.Run(schedulerCtx)
+	mux.Handle("/items/availability/wait", limitItems(availabilityWatch.WaitForAvailabilityChange()))
+	mux.Handle("/items/", limitItemsTime(compress(limitItems(handlers.GetItemHandler(db, redisClient, itemImages)))))
+	mux.Handle("/users/", limitTime(compress(handlers.UserResourceHandler(handlers.UserPurchasesHandler(db), userReservationsHandler))))
 	
 	// Root route
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -150,20 +293,22 @@ func main() {
 	})
 
 	// Apply middleware
-	finalHandler := corsMiddleware(loggingMiddleware(mux))
+	handler := middleware.BodyLimitMiddleware(int64(cfg.Server.MaxBodyBytes))(mux)
+	handler = middleware.CORSMiddleware(cfg.CORSAllowedOrigins)(handler)
+	finalHandler := middleware.RequestIDMiddleware(middleware.RecoveryMiddleware(handler))
 
 	// Create HTTP server
 	server := &http.Server{
-		Addr:         "0.0.0.0:" + strconv.Itoa(config.Port),
+		Addr:         "0.0.0.0:" + strconv.Itoa(cfg.Server.Port),
 		Handler:      finalHandler,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
 	}
 
 	// Start server in a goroutine
 	go func() {
-		log.Printf("Server starting on port %d", config.Port)
+		log.Printf("Server starting on port %d", cfg.Server.Port)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
 		}
@@ -175,9 +320,10 @@ func main() {
 	<-quit
 	
 	log.Println("Shutting down server...")
+	schedulerCancel()
 
 	// Graceful shutdown with timeout
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 	defer shutdownCancel()
 
 	if err := server.Shutdown(shutdownCtx); err != nil {
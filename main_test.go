@@ -0,0 +1,49 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestMainCreatesSalesOnlyThroughScheduler guards against a second sale
+// creation path growing back in main: sales are created by the scheduler,
+// through the database package, and main never talks SQL itself
+func TestMainCreatesSalesOnlyThroughScheduler(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", nil, 0)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	pkg, ok := pkgs["main"]
+	if !ok {
+		t.Fatal("package main not found")
+	}
+
+	for name, file := range pkg.Files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		for _, imp := range file.Imports {
+			if path, _ := strconv.Unquote(imp.Path.Value); path == "database/sql" {
+				t.Errorf("%s imports database/sql; go through the database package", name)
+			}
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncDecl:
+				if n.Recv == nil && strings.Contains(strings.ToLower(n.Name.Name), "sale") {
+					t.Errorf("%s declares %s; sales are created by the scheduler", fset.Position(n.Pos()), n.Name.Name)
+				}
+			case *ast.BasicLit:
+				if n.Kind == token.STRING && strings.Contains(strings.ToUpper(n.Value), "INSERT INTO") {
+					t.Errorf("%s writes SQL; go through the database package", fset.Position(n.Pos()))
+				}
+			}
+			return true
+		})
+	}
+}
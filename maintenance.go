@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/handlers"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+const (
+	// maintenanceCacheTTL is how long an instance trusts its last read of the
+	// maintenance switch, so purchases don't pay a Redis round-trip for it
+	maintenanceCacheTTL = time.Second
+
+	// maintenanceRetryAfter is the Retry-After sent while maintenance is on
+	maintenanceRetryAfter = 30 * time.Second
+
+	// defaultMaintenanceMessage is shown when maintenance was turned on
+	// without a message
+	defaultMaintenanceMessage = "Purchases are paused for maintenance, please retry shortly"
+)
+
+// MaintenanceMiddleware answers 503 MAINTENANCE while the maintenance switch
+// in Redis is on. It guards the checkout and purchase routes; reads keep
+// serving. Each instance sees a change within maintenanceCacheTTL. If the
+// switch can't be read the request goes ahead, since the handler will find
+// out about an unreachable Redis on its own.
+func MaintenanceMiddleware(redisClient *redis.Client) func(http.Handler) http.Handler {
+	var (
+		mu      sync.Mutex
+		cached  redis.Maintenance
+		checked time.Time
+	)
+	current := func() redis.Maintenance {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if time.Since(checked) < maintenanceCacheTTL {
+			return cached
+		}
+		// On error the last known state stands until the next check
+		if state, err := redisClient.GetMaintenance(); err == nil {
+			cached = state
+		}
+		checked = time.Now()
+		return cached
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			state := current()
+			if !state.Enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			message := state.Message
+			if message == "" {
+				message = defaultMaintenanceMessage
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter/time.Second)))
+			handlers.WriteJSONError(w, http.StatusServiceUnavailable, handlers.ErrCodeMaintenance, message)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/handlers"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+func TestMaintenanceTogglePausesPurchases(t *testing.T) {
+	redisClient := &redis.Client{Client: goredis.NewClient(&goredis.Options{Addr: miniredis.RunT(t).Addr()})}
+	defer redisClient.Close()
+
+	purchases := 0
+	purchase := MaintenanceMiddleware(redisClient)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		purchases++
+	}))
+	toggle := handlers.AdminMaintenanceHandler(redisClient)
+
+	setMaintenance := func(body string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		toggle(rec, httptest.NewRequest(http.MethodPost, "/admin/maintenance", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST /admin/maintenance %s: status = %d: %s", body, rec.Code, rec.Body)
+		}
+		// Wait out this instance's cached read of the switch
+		time.Sleep(maintenanceCacheTTL)
+	}
+	buy := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		purchase.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/purchase?code=c", nil))
+		return rec
+	}
+
+	if rec := buy(); rec.Code != http.StatusOK || purchases != 1 {
+		t.Fatalf("before maintenance: status = %d, purchases = %d; want 200 and 1", rec.Code, purchases)
+	}
+
+	setMaintenance(`{"enabled": true, "message": "Back at noon"}`)
+	rec := buy()
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("during maintenance: status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if purchases != 1 {
+		t.Errorf("during maintenance: purchase handler reached")
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("during maintenance: no Retry-After")
+	}
+	if !strings.Contains(rec.Body.String(), "Back at noon") {
+		t.Errorf("during maintenance: body %s lacks the message", rec.Body)
+	}
+
+	setMaintenance(`{"enabled": false}`)
+	if rec := buy(); rec.Code != http.StatusOK || purchases != 2 {
+		t.Errorf("after maintenance: status = %d, purchases = %d; want 200 and 2", rec.Code, purchases)
+	}
+}
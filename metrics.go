@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DefaultLatencyBuckets suit Redis and database calls, in seconds
+var DefaultLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Flash sale metrics, registered with the default Prometheus registry and
+// served by promhttp.Handler. Label values must come from a small fixed set;
+// never use user or item IDs.
+var (
+	PurchasesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "flashsale_purchases_total",
+		Help: "Completed purchases.",
+	})
+
+	PurchaseFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "flashsale_purchase_failures_total",
+		Help: "Rejected or failed purchases by reason.",
+	}, []string{"reason"})
+
+	CheckoutReservationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "flashsale_checkout_reservations_total",
+		Help: "Checkout reservations created.",
+	})
+
+	CheckoutReservationsExpiredTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "flashsale_checkout_reservations_expired_total",
+		Help: "Checkout reservations that expired without a purchase.",
+	})
+
+	CheckoutReservationsCancelledTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "flashsale_checkout_reservations_cancelled_total",
+		Help: "Checkout reservations released early by the user.",
+	})
+
+	RateLimitRejectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "flashsale_rate_limit_rejections_total",
+		Help: "Requests rejected by a rate limit.",
+	})
+
+	RateLimitRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "flashsale_rate_limit_requests_total",
+		Help: "Requests checked by a rate limit by route, result and key type.",
+	}, []string{"route", "result", "key_type"})
+
+	AuditWriteFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "flashsale_audit_write_failures_total",
+		Help: "Purchases completed without their audit entry.",
+	})
+
+	InventoryDecrementDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "flashsale_inventory_decrement_duration_seconds",
+		Help:    "Latency of the atomic inventory decrement in Redis.",
+		Buckets: DefaultLatencyBuckets,
+	})
+
+	DBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "flashsale_db_query_duration_seconds",
+		Help:    "Latency of database queries by query name.",
+		Buckets: DefaultLatencyBuckets,
+	}, []string{"query"})
+)
+
+// Purchase failure reasons
+const (
+	ReasonInvalidCode  = "invalid_code"
+	ReasonNoActiveSale = "no_active_sale"
+	ReasonLimitReached = "limit_reached"
+	ReasonSoldOut      = "sold_out"
+	ReasonError        = "error"
+	ReasonOverloaded   = "overloaded"
+)
+
+// Rate limit results
+const (
+	RateLimitAllowed  = "allowed"
+	RateLimitRejected = "rejected"
+)
+
+// ObserveSince records the seconds elapsed since start
+func ObserveSince(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+// CounterValue returns a counter's current value, for reporting it outside
+// /metrics
+func CounterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+// gaugeFuncVec reports values computed at scrape time, keyed by a single label
+type gaugeFuncVec struct {
+	desc *prometheus.Desc
+	fn   func() map[string]float64
+}
+
+// newGaugeFuncVec registers a gauge whose values come from fn on every scrape
+func newGaugeFuncVec(name, help, label string, fn func() map[string]float64) {
+	prometheus.MustRegister(&gaugeFuncVec{
+		desc: prometheus.NewDesc(name, help, []string{label}, nil),
+		fn:   fn,
+	})
+}
+
+func (g *gaugeFuncVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *gaugeFuncVec) Collect(ch chan<- prometheus.Metric) {
+	for labelValue, v := range g.fn() {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, v, labelValue)
+	}
+}
+
+// RegisterRateLimiters exposes how many client keys each in-memory rate
+// limiter tracks and how saturated its buckets are, keyed by route. Client
+// keys themselves are never labels.
+func RegisterRateLimiters(trackedKeys, saturation func() map[string]float64) {
+	newGaugeFuncVec("flashsale_rate_limit_tracked_keys",
+		"Client keys tracked by each in-memory rate limiter.", "route", trackedKeys)
+	newGaugeFuncVec("flashsale_rate_limit_saturation",
+		"Mean share of the burst spent across each in-memory rate limiter's buckets; 1 means every tracked client is throttled.", "route", saturation)
+}
+
+// RegisterSalePurchaseRates exposes the purchase rate of each sale being
+// bought from, as measured by spike detection. Sales drop out a minute after
+// their last purchase attempt, which keeps the label bounded.
+func RegisterSalePurchaseRates(fn func() map[string]float64) {
+	newGaugeFuncVec("flashsale_sale_purchase_rate",
+		"Purchases per second in each sale being bought from, over the spike detection window.", "sale_id", fn)
+}
+
+// RegisterItemsRemaining exposes the items left in each active sale. The sale
+// ID label stays bounded because only running sales are reported.
+func RegisterItemsRemaining(fn func() map[string]float64) {
+	newGaugeFuncVec("flashsale_sale_items_remaining",
+		"Items remaining in each active sale.", "sale_id", fn)
+}
@@ -0,0 +1,212 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// ItemsPerSale is the number of items generated for each hourly sale
+	ItemsPerSale = 10000
+
+	// SaleDuration is how long each sale runs unless the scheduler is
+	// configured otherwise; sales start on the hour, one window after another
+	SaleDuration = time.Hour
+
+	// MaxSaleDuration bounds how long any sale may run
+	MaxSaleDuration = 24 * time.Hour
+
+	// SalesPerWindow is how many sales run side by side in each window
+	SalesPerWindow = 1
+
+	// MaxSalesPerWindow bounds configurable concurrent sales
+	MaxSalesPerWindow = 10
+
+	// MaxItemsPerSale bounds configurable sale sizes so a typo can't generate
+	// millions of rows
+	MaxItemsPerSale = 100000
+
+	// DefaultStockPerItem is how many units of each item a sale holds; items
+	// are unique by default
+	DefaultStockPerItem = 1
+
+	// MaxItemsPerUserPerSale caps how many items a single user can buy in one sale
+	MaxItemsPerUserPerSale = 1
+
+	// CheckoutReservationTTL is how long a checkout holds an item before it
+	// becomes available to other buyers again, unless the sale sets its own
+	CheckoutReservationTTL = 60 * time.Second
+
+	// MinCheckoutTTL and MaxCheckoutTTL bound a sale's checkout TTL: long
+	// enough to complete payment, short enough that abandoned checkouts
+	// don't hide stock for most of the sale
+	MinCheckoutTTL = 10 * time.Second
+	MaxCheckoutTTL = 15 * time.Minute
+)
+
+// Sale statuses
+const (
+	SaleStatusScheduled = "scheduled"
+	SaleStatusActive    = "active"
+	SaleStatusSoldOut   = "sold_out"
+	SaleStatusCompleted = "completed"
+	SaleStatusCancelled = "cancelled"
+)
+
+// Sale represents a single flash sale window
+type Sale struct {
+	SaleID     string    `json:"sale_id"`
+	StartTime  time.Time `json:"start_time"`
+	EndTime    time.Time `json:"end_time"`
+	TotalItems int       `json:"total_items"`
+	ItemsSold  int       `json:"items_sold"`
+	Status     string    `json:"status"`
+
+	// CheckoutTTL is how long a checkout in this sale holds an item
+	CheckoutTTL time.Duration `json:"checkout_ttl"`
+
+	// PendingItems is how many items are still to be generated for a sale
+	// scheduled further ahead than the lead time; zero once they exist
+	PendingItems int `json:"-"`
+}
+
+// ReservationTTL returns how long a checkout in the sale holds an item. Sales
+// created before the TTL was stored per sale use CheckoutReservationTTL.
+func (s Sale) ReservationTTL() time.Duration {
+	if s.CheckoutTTL <= 0 {
+		return CheckoutReservationTTL
+	}
+	return s.CheckoutTTL
+}
+
+// Item represents a single item offered in a sale
+type Item struct {
+	ItemID   string `json:"item_id"`
+	SaleID   string `json:"sale_id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	ImageURL string `json:"image_url"`
+
+	// Tier is the item's rarity, one of Tiers, for storefronts to badge
+	Tier string `json:"tier"`
+
+	// Prices are in integer cents. DiscountPrice is what buyers pay in the
+	// sale; zero means the item sells at Price.
+	Price         int64 `json:"price_cents"`
+	DiscountPrice int64 `json:"discount_price_cents"`
+
+	// Queued marks a hot item whose checkouts are granted in arrival order
+	// through its reservation queue, instead of to whichever request lands
+	// on Redis first
+	Queued bool `json:"queued"`
+}
+
+// Item tiers, rarest first
+const (
+	TierLegendary = "legendary"
+	TierRare      = "rare"
+	TierCommon    = "common"
+)
+
+// Tiers lists every item tier, rarest first
+var Tiers = []string{TierLegendary, TierRare, TierCommon}
+
+// IsTier reports whether tier is one of Tiers
+func IsTier(tier string) bool {
+	for _, known := range Tiers {
+		if tier == known {
+			return true
+		}
+	}
+	return false
+}
+
+// TierShare is the percentage of a sale's generated items that get one tier
+type TierShare struct {
+	Tier    string
+	Percent int
+}
+
+// ValidateTierShares checks that shares name known tiers, each at most once,
+// with positive percentages adding up to 100. No shares at all is valid and
+// makes every item common.
+func ValidateTierShares(shares []TierShare) error {
+	if len(shares) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(shares))
+	total := 0
+	for _, share := range shares {
+		if !IsTier(share.Tier) {
+			return fmt.Errorf("unknown tier %q, expected one of %v", share.Tier, Tiers)
+		}
+		if seen[share.Tier] {
+			return fmt.Errorf("tier %q given more than once", share.Tier)
+		}
+		seen[share.Tier] = true
+
+		if share.Percent <= 0 {
+			return fmt.Errorf("tier %q must have a positive percentage, got %d", share.Tier, share.Percent)
+		}
+		total += share.Percent
+	}
+
+	if total != 100 {
+		return fmt.Errorf("tier percentages must add up to 100, got %d", total)
+	}
+	return nil
+}
+
+// SalePrice returns the price, in cents, a buyer pays for the item in its sale
+func (i Item) SalePrice() int64 {
+	if i.DiscountPrice > 0 {
+		return i.DiscountPrice
+	}
+	return i.Price
+}
+
+// CategoryCount is the number of items of one category in a sale
+type CategoryCount struct {
+	Category string `json:"category"`
+	Count    int    `json:"count"`
+}
+
+// Purchase records an item bought by a user
+type Purchase struct {
+	PurchaseID string    `json:"purchase_id"`
+	SaleID     string    `json:"sale_id"`
+	UserID     string    `json:"user_id"`
+	ItemID     string    `json:"item_id"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// Item details, populated when purchases are listed
+	ItemName string `json:"item_name,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+
+	// Price is what the buyer paid in cents, populated for exports
+	Price int64 `json:"price_cents,omitempty"`
+}
+
+// Audit actions
+const (
+	AuditActionPurchase        = "purchase"
+	AuditActionStockAdjustment = "stock_adjustment"
+)
+
+// AuditEntry records one inventory change, a purchase or an admin stock
+// adjustment, for dispute resolution. Adjustments have no purchase or
+// checkout code and carry the admin's name as UserID. Entries are only ever
+// inserted.
+type AuditEntry struct {
+	AuditID      int64     `json:"audit_id"`
+	Action       string    `json:"action"`
+	PurchaseID   string    `json:"purchase_id"`
+	SaleID       string    `json:"sale_id"`
+	UserID       string    `json:"user_id"`
+	ItemID       string    `json:"item_id"`
+	CheckoutCode string    `json:"checkout_code"`
+	StockBefore  int       `json:"stock_before"`
+	StockAfter   int       `json:"stock_after"`
+	CreatedAt    time.Time `json:"created_at"`
+}
@@ -0,0 +1,179 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultQueueSize is how many notifications may wait to be sent before
+	// new ones are dropped
+	DefaultQueueSize = 1000
+
+	// DefaultMaxAttempts bounds send attempts per notification
+	DefaultMaxAttempts = 3
+
+	// DefaultBaseBackoff is the wait before the first retry; it doubles on
+	// each further attempt
+	DefaultBaseBackoff = 500 * time.Millisecond
+
+	// sendWorkers is how many notifications are sent in parallel
+	sendWorkers = 4
+)
+
+// Notifier tells a user about a completed purchase, e.g. by email
+type Notifier interface {
+	NotifyPurchase(ctx context.Context, userID, itemID, purchaseID string) error
+}
+
+// Nop is a Notifier that sends nothing
+type Nop struct{}
+
+// NotifyPurchase does nothing
+func (Nop) NotifyPurchase(ctx context.Context, userID, itemID, purchaseID string) error {
+	return nil
+}
+
+// HTTPNotifier POSTs {"user_id", "item_id", "purchase_id"} to a URL, for a
+// separate service that owns the email templates and user addresses
+type HTTPNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPNotifier creates a notifier that POSTs to url
+func NewHTTPNotifier(url string) *HTTPNotifier {
+	return &HTTPNotifier{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// NotifyPurchase sends one purchase notification
+func (n *HTTPNotifier) NotifyPurchase(ctx context.Context, userID, itemID, purchaseID string) error {
+	body, err := json.Marshal(map[string]string{
+		"user_id":     userID,
+		"item_id":     itemID,
+		"purchase_id": purchaseID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build notification request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// purchaseNotification is one queued call to NotifyPurchase
+type purchaseNotification struct {
+	userID     string
+	itemID     string
+	purchaseID string
+}
+
+// Dispatcher sends purchase notifications through a Notifier in the
+// background. Purchase never blocks the caller; notifications are dropped
+// with a log line when the queue is full. A nil *Dispatcher discards every
+// notification.
+type Dispatcher struct {
+	notifier Notifier
+	queue    chan purchaseNotification
+
+	// MaxAttempts and BaseBackoff control retries; set them before Start
+	MaxAttempts int
+	BaseBackoff time.Duration
+
+	wg sync.WaitGroup
+}
+
+// NewDispatcher creates a dispatcher that sends through notifier
+func NewDispatcher(notifier Notifier) *Dispatcher {
+	return &Dispatcher{
+		notifier:    notifier,
+		queue:       make(chan purchaseNotification, DefaultQueueSize),
+		MaxAttempts: DefaultMaxAttempts,
+		BaseBackoff: DefaultBaseBackoff,
+	}
+}
+
+// Start runs the send workers until ctx is cancelled
+func (d *Dispatcher) Start(ctx context.Context) {
+	for i := 0; i < sendWorkers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for {
+				select {
+				case n := <-d.queue:
+					d.send(ctx, n)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Wait blocks until the workers have stopped
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// Purchase queues a notification that userID bought itemID
+func (d *Dispatcher) Purchase(userID, itemID, purchaseID string) {
+	if d == nil {
+		return
+	}
+
+	select {
+	case d.queue <- purchaseNotification{userID: userID, itemID: itemID, purchaseID: purchaseID}:
+	default:
+		slog.Warn("Notification queue full, dropping notification", "purchase_id", purchaseID)
+	}
+}
+
+// send delivers one notification, retrying with exponential backoff
+func (d *Dispatcher) send(ctx context.Context, n purchaseNotification) {
+	var err error
+	backoff := d.BaseBackoff
+	for attempt := 1; attempt <= d.MaxAttempts; attempt++ {
+		err = d.notifier.NotifyPurchase(ctx, n.userID, n.itemID, n.purchaseID)
+		if err == nil {
+			return
+		}
+
+		if attempt == d.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			slog.Warn("Shutting down before notifying purchase", "purchase_id", n.purchaseID, "attempts", attempt, "error", err)
+			return
+		}
+	}
+
+	slog.Error("Giving up on purchase notification", "purchase_id", n.purchaseID, "attempts", d.MaxAttempts, "error", err)
+}
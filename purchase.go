@@ -1,58 +1,323 @@
 package handlers
 
 import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
     "encoding/json"
+    "errors"
+    "fmt"
     "net/http"
+    "time"
+
     "github.com/Hananjeda/Flash-Sale-Service/internal/database"
+    "github.com/Hananjeda/Flash-Sale-Service/internal/errs"
+    "github.com/Hananjeda/Flash-Sale-Service/internal/metrics"
+    "github.com/Hananjeda/Flash-Sale-Service/internal/models"
+    "github.com/Hananjeda/Flash-Sale-Service/internal/notify"
     "github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+    "github.com/Hananjeda/Flash-Sale-Service/internal/webhooks"
 )
 
-func PurchaseHandler(db *sql.DB, redisClient *redis.Client) http.HandlerFunc {
+// clock tells the time purchases judge a sale's end by, and readiness the
+// scheduler's heartbeat
+var clock = time.Now
+
+// PurchaseHandler completes a purchase for a checkout code. Codes are verified
+// against codeSecret before anything touches Redis, so forged or expired codes
+// are cheap to reject. Requests may carry an Idempotency-Key header so client
+// retries never buy twice. Completed purchases are reported to events, and
+// the buyer is told through notifier once the response no longer waits on it.
+// Writing the purchase waits its turn in writes, and while spikes reports the
+// sale spiking the purchase is held before it may take stock.
+func PurchaseHandler(db *database.DB, redisClient *redis.Client, codeSecret []byte, events *webhooks.Dispatcher, notifier *notify.Dispatcher, writes *PurchaseWrites, spikes *PurchaseSpikes) http.HandlerFunc {
+    checkoutCode := func(r *http.Request) string {
+        return r.URL.Query().Get("code")
+    }
+    next := withIdempotency(redisClient, checkoutCode, purchase(db, redisClient, events, notifier, writes, spikes))
+
     return func(w http.ResponseWriter, r *http.Request) {
-        checkoutCode := r.URL.Query().Get("code")
+        code := checkoutCode(r)
+
+        if code == "" {
+            metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonInvalidCode).Inc()
+            WriteJSONError(w, http.StatusBadRequest, ErrCodeMissingCheckoutCode, "Missing checkout code")
+            return
+        }
+
+        // Malformed codes are explained; well-formed ones that don't verify
+        // are not, so forging a code gets no hints
+        var invalid *validationError
+        if err := validateCheckoutCode(code); errors.As(err, &invalid) {
+            metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonInvalidCode).Inc()
+            writeJSONError(w, http.StatusBadRequest, ErrCodeInvalidCheckoutCode, "Malformed checkout code",
+                map[string]interface{}{"problems": invalid.Problems})
+            return
+        }
 
-        if checkoutCode == "" {
-            http.Error(w, "Missing checkout code", http.StatusBadRequest)
+        if _, err := parseCheckoutCode(codeSecret, code); err != nil {
+            metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonInvalidCode).Inc()
+            writeError(w, errs.ErrInvalidCheckoutCode, "Invalid or expired checkout code")
             return
         }
 
+        next(w, r)
+    }
+}
+
+func purchase(db *database.DB, redisClient *redis.Client, events *webhooks.Dispatcher, notifier *notify.Dispatcher, writes *PurchaseWrites, spikes *PurchaseSpikes) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        checkoutCode := r.URL.Query().Get("code")
+
         // Retrieve checkout session from Redis
-        userID, itemID, err := redis.GetCheckoutSession(redisClient, checkoutCode)
+        userID, itemID, err := redis.GetCheckoutSession(r.Context(), redisClient, checkoutCode)
+        if errors.Is(err, redis.ErrCheckoutUsed) {
+            metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonInvalidCode).Inc()
+            writeError(w, errs.ErrCheckoutUsed, "Checkout code has already been used")
+            return
+        }
+
         if err != nil {
-            http.Error(w, "Invalid or expired checkout code", http.StatusBadRequest)
+            metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonInvalidCode).Inc()
+            writeError(w, errs.ErrInvalidCheckoutCode, "Invalid or expired checkout code")
+            return
+        }
+
+        // The caller must be the user who made the checkout
+        if authUserID, ok := UserFromContext(r.Context()); ok && authUserID != userID {
+            metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonInvalidCode).Inc()
+            WriteJSONError(w, http.StatusForbidden, ErrCodeForbidden, "Checkout code belongs to another user")
+            return
+        }
+
+        item, err := db.GetItemContext(r.Context(), itemID)
+        if err != nil {
+            Logger(r.Context()).Error("Failed to load item", "item_id", itemID, "error", err)
+            metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonError).Inc()
+            writeDependencyError(w, err, "Error processing purchase")
+            return
+        }
+
+        if item == nil {
+            metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonInvalidCode).Inc()
+            writeError(w, errs.ErrInvalidCheckoutCode, "Invalid or expired checkout code")
+            return
+        }
+
+        // The purchase counts against the item's own sale, which may be one
+        // of several running at once. A code left over from a sale that has
+        // since ended must not touch its stale inventory keys.
+        sale, err := db.GetActiveSaleByIDContext(r.Context(), item.SaleID)
+        if err != nil {
+            Logger(r.Context()).Error("Failed to load item's sale", "sale_id", item.SaleID, "error", err)
+            metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonError).Inc()
+            writeDependencyError(w, err, "Error processing purchase")
+            return
+        }
+
+        // The sale may have ended between checkout and now; the database
+        // and this instance may also disagree on the time by a little
+        if sale == nil || !clock().Before(sale.EndTime) {
+            releaseEndedCheckout(r.Context(), redisClient, checkoutCode, userID)
+            metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonNoActiveSale).Inc()
+            writeError(w, errs.ErrSaleEnded, "The sale this item belongs to is no longer active")
+            return
+        }
+
+        // Cheap early rejection for repeat buyers; the decrement below is
+        // still the authoritative check
+        if models.MaxItemsPerUserPerSale == 1 {
+            purchased, err := redisClient.HasUserPurchased(r.Context(), sale.SaleID, userID)
+            if err != nil {
+                metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonError).Inc()
+                writeDependencyError(w, err, "Error processing purchase")
+                return
+            }
+
+            if purchased {
+                metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonLimitReached).Inc()
+                writeError(w, errs.ErrUserLimitReached, "User has already purchased an item in this sale")
+                return
+            }
+        }
+
+        // The client gave up or the deadline answered for us
+        if !spikes.admit(r.Context(), sale.SaleID) {
             return
         }
 
-        // Perform atomic inventory decrement
-        decremented, err := redis.DecrementInventory(redisClient, itemID)
+        // Once sent, the decrement may take stock whether or not the client is
+        // still waiting, so it and the commands after it outlive the request
+        ctx := context.WithoutCancel(r.Context())
+
+        // Perform atomic inventory decrement together with the user limit check
+        stockBefore, err := redis.DecrementInventory(ctx, redisClient, sale.SaleID, userID, itemID, checkoutCode, models.MaxItemsPerUserPerSale)
         if err != nil {
-            http.Error(w, "Error processing purchase", http.StatusInternalServerError)
+            reason, message := purchaseFailure(err)
+            metrics.PurchaseFailuresTotal.WithLabelValues(reason).Inc()
+            writeError(w, err, message)
             return
         }
 
-        if !decremented {
-            http.Error(w, "Item sold out", http.StatusConflict)
+        // The stock is taken first so buyers still race on Redis alone; one
+        // that can't be written in time gives it back
+        if !writes.acquire() {
+            rejectPurchaseWrite(w, r, redisClient, sale.SaleID, userID, []string{itemID}, []string{checkoutCode})
             return
         }
+        defer writes.release()
+
+        if err := redisClient.PublishInventoryUpdate(ctx, sale.SaleID); err != nil {
+            Logger(r.Context()).Error("Failed to publish inventory update", "error", err)
+        }
 
         // Record the purchase in the database
-        purchaseID, err := recordPurchase(db, userID, itemID)
+        // Inventory is already taken, so the record is written even if the
+        // client has gone away; only the query timeout can stop it. A record
+        // that can't be written gives the inventory back.
+        record, err := recordPurchase(ctx, db, sale.SaleID, userID, itemID)
+        if err != nil {
+            restorePurchase(r.Context(), redisClient, sale.SaleID, userID, []string{itemID}, []string{checkoutCode})
+        }
+
+        if errors.Is(err, database.ErrDuplicatePurchase) {
+            metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonLimitReached).Inc()
+            writeError(w, errs.ErrUserLimitReached, "User has already purchased an item in this sale")
+            return
+        }
+
         if err != nil {
-            http.Error(w, "Error recording purchase", http.StatusInternalServerError)
+            Logger(r.Context()).Error("Failed to record purchase", "user_id", userID, "error", err)
+            metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonError).Inc()
+            writeDependencyError(w, err, "Error recording purchase")
             return
         }
 
+        // Only a written purchase may end the sale
+        markSoldOutIfExhausted(ctx, db, redisClient, events, sale)
+
+        purchaseID := record.PurchaseID
+        recordAudit(r.Context(), db, []*models.AuditEntry{newAuditEntry(record, checkoutCode, stockBefore)})
+
+        metrics.PurchasesTotal.Inc()
+        if err := redisClient.RecordPurchases(ctx, sale.SaleID, 1); err != nil {
+            Logger(r.Context()).Error("Failed to record purchase rate", "error", err)
+        }
+        events.Emit(webhooks.EventPurchaseCompleted, map[string]interface{}{
+            "purchase_id": purchaseID,
+            "sale_id":     sale.SaleID,
+            "user_id":     userID,
+            "item_id":     itemID,
+            "price_cents": item.SalePrice(),
+        })
+        notifier.Purchase(userID, itemID, purchaseID)
+
+        // The item was loaded before the purchase, so confirming what was
+        // bought costs the client no second call
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(map[string]interface{}{
             "success":     true,
             "purchase_id": purchaseID,
+            "sale_id":     sale.SaleID,
+            "item": map[string]interface{}{
+                "item_id":   item.ItemID,
+                "name":      item.Name,
+                "category":  item.Category,
+                "image_url": item.ImageURL,
+            },
+            "price_cents": item.SalePrice(),
             "message":     "Purchase completed successfully",
         })
     }
 }
 
-func recordPurchase(db *sql.DB, userID, itemID string) (string, error) {
-    // Implementation for recording the purchase in the database
-    // This is a placeholder and should be implemented with actual logic
-    return "purchase_a1b2c3d4e5f6g7h8", nil
+// purchaseFailure gives the failure reason and the buyer's explanation for a
+// decrement that took nothing. The sale or checkout may have changed since it
+// was looked up: a sale that ended has already released the reservation, and
+// a used code means a parallel request with it bought the item first.
+func purchaseFailure(err error) (string, string) {
+    switch {
+    case errors.Is(err, errs.ErrSoldOut):
+        return metrics.ReasonSoldOut, "Item sold out"
+    case errors.Is(err, errs.ErrUserLimitReached):
+        return metrics.ReasonLimitReached, "User has already purchased an item in this sale"
+    case errors.Is(err, redis.ErrSaleCancelled):
+        return metrics.ReasonNoActiveSale, "The sale this item belongs to has been cancelled"
+    case errors.Is(err, errs.ErrSaleEnded):
+        return metrics.ReasonNoActiveSale, "The sale this item belongs to has ended"
+    case errors.Is(err, errs.ErrCheckoutUsed):
+        return metrics.ReasonInvalidCode, "Checkout code has already been used"
+    case errors.Is(err, errs.ErrInvalidCheckoutCode):
+        return metrics.ReasonInvalidCode, "Invalid or expired checkout code"
+    }
+    return metrics.ReasonError, "Error processing purchase"
+}
+
+// releaseEndedCheckout frees the reservation of a checkout whose sale is no
+// longer running, rather than leave it to expire. Failures are logged only;
+// the reservation still expires on its own.
+func releaseEndedCheckout(ctx context.Context, redisClient *redis.Client, code, userID string) {
+    err := redisClient.CancelCheckout(ctx, code, userID)
+    if err != nil && !errors.Is(err, redis.ErrCheckoutNotFound) {
+        Logger(ctx).Error("Failed to release checkout of ended sale", "error", err)
+    }
+}
+
+// markSoldOutIfExhausted flips the sale to sold out once every item is gone.
+// The status update only succeeds while the sale is still active, so exactly
+// one request performs the transition. Failures are logged and never fail the
+// purchase; the sale still ends on schedule.
+func markSoldOutIfExhausted(ctx context.Context, db *database.DB, redisClient *redis.Client, events *webhooks.Dispatcher, sale *models.Sale) {
+    sold, err := redisClient.GetItemsSold(ctx, sale.SaleID)
+    if err != nil {
+        Logger(ctx).Error("Failed to get sold count", "sale_id", sale.SaleID, "error", err)
+        return
+    }
+
+    if sold < sale.TotalItems {
+        return
+    }
+
+    updated, err := db.UpdateSaleStatus(sale.SaleID, models.SaleStatusActive, models.SaleStatusSoldOut)
+    if err != nil {
+        Logger(ctx).Error("Failed to mark sale sold out", "sale_id", sale.SaleID, "error", err)
+        return
+    }
+    if updated {
+        Logger(ctx).Info("Sale sold out", "sale_id", sale.SaleID, "items_sold", sold)
+        events.Emit(webhooks.EventSaleSoldOut, map[string]interface{}{
+            "sale_id":    sale.SaleID,
+            "items_sold": sold,
+        })
+    }
+}
+
+// generatePurchaseID generates a unique purchase ID
+func generatePurchaseID() (string, error) {
+    bytes := make([]byte, 8)
+    if _, err := rand.Read(bytes); err != nil {
+        return "", err
+    }
+    return fmt.Sprintf("purchase_%s", hex.EncodeToString(bytes)), nil
+}
+
+func recordPurchase(ctx context.Context, db *database.DB, saleID, userID, itemID string) (*models.Purchase, error) {
+    purchaseID, err := generatePurchaseID()
+    if err != nil {
+        return nil, fmt.Errorf("failed to generate purchase ID: %w", err)
+    }
+
+    purchase := &models.Purchase{
+        PurchaseID: purchaseID,
+        SaleID:     saleID,
+        UserID:     userID,
+        ItemID:     itemID,
+        CreatedAt:  time.Now().UTC(),
+    }
+
+    if err := db.CreatePurchaseContext(ctx, purchase); err != nil {
+        return nil, err
+    }
+
+    return purchase, nil
 }
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+const (
+	// purchaseSpikeCheckInterval is how often the purchase rates of the
+	// sales being bought from are read again
+	purchaseSpikeCheckInterval = time.Second
+
+	// purchaseSpikeForget is how long a sale nobody tried to buy from on this
+	// instance keeps being watched
+	purchaseSpikeForget = time.Minute
+)
+
+// watchedSale is a sale purchases were attempted in lately, with its last
+// measured rate
+type watchedSale struct {
+	rate     float64
+	spiking  bool
+	lastSeen time.Time
+}
+
+// PurchaseSpikes watches the purchase rate of each sale being bought from and,
+// while it runs above the threshold, holds every purchase in the sale for a
+// random admission delay before it may take stock. Scripts firing the moment
+// an item appears then lose their head start over people, who were going to
+// take longer anyway. The rate is shared by every instance through Redis; the
+// delay costs nothing while the rate is normal. A nil *PurchaseSpikes never
+// delays.
+type PurchaseSpikes struct {
+	redis     *redis.Client
+	threshold float64
+	window    time.Duration
+	maxDelay  time.Duration
+
+	mu    sync.Mutex
+	sales map[string]*watchedSale
+}
+
+// NewPurchaseSpikes treats more than threshold purchases per second in a
+// sale, measured over window, as a spike, and delays its purchases by up to
+// maxDelay while it lasts
+func NewPurchaseSpikes(redisClient *redis.Client, threshold float64, window, maxDelay time.Duration) *PurchaseSpikes {
+	return &PurchaseSpikes{
+		redis:     redisClient,
+		threshold: threshold,
+		window:    window,
+		maxDelay:  maxDelay,
+		sales:     make(map[string]*watchedSale),
+	}
+}
+
+// Run measures the watched sales' rates until ctx is cancelled
+func (ps *PurchaseSpikes) Run(ctx context.Context) {
+	ticker := time.NewTicker(purchaseSpikeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ps.check(); err != nil {
+				slog.Error("Failed to measure sale purchase rates", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check reads the rate of every watched sale, dropping those nobody tried to
+// buy from lately. A sale's spike is logged once when it starts and once when
+// it ends.
+func (ps *PurchaseSpikes) check() error {
+	ps.mu.Lock()
+	var saleIDs []string
+	for saleID, sale := range ps.sales {
+		if time.Since(sale.lastSeen) > purchaseSpikeForget {
+			delete(ps.sales, saleID)
+			continue
+		}
+		saleIDs = append(saleIDs, saleID)
+	}
+	ps.mu.Unlock()
+
+	if len(saleIDs) == 0 {
+		return nil
+	}
+
+	rates, err := ps.redis.SalePurchaseRates(saleIDs, ps.window)
+	if err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for saleID, rate := range rates {
+		sale, ok := ps.sales[saleID]
+		if !ok {
+			continue
+		}
+		spiking := rate > ps.threshold
+		if spiking && !sale.spiking {
+			slog.Warn("Purchase spike detected, delaying purchases", "sale_id", saleID,
+				"purchases_per_second", rate, "threshold", ps.threshold)
+		} else if !spiking && sale.spiking {
+			slog.Info("Purchase spike over", "sale_id", saleID, "purchases_per_second", rate)
+		}
+		sale.rate = rate
+		sale.spiking = spiking
+	}
+	return nil
+}
+
+// admit notes a purchase attempt in saleID and, while the sale is spiking,
+// holds it for a random delay up to the maximum. It reports false if ctx
+// ended first, in which case the purchase must not go ahead.
+func (ps *PurchaseSpikes) admit(ctx context.Context, saleID string) bool {
+	if ps == nil {
+		return true
+	}
+
+	ps.mu.Lock()
+	sale, ok := ps.sales[saleID]
+	if !ok {
+		sale = &watchedSale{}
+		ps.sales[saleID] = sale
+	}
+	sale.lastSeen = time.Now()
+	spiking := sale.spiking
+	ps.mu.Unlock()
+
+	if !spiking || ps.maxDelay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(time.Duration(mathrand.Int63n(int64(ps.maxDelay) + 1)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Rate returns saleID's current purchases per second and whether that counts
+// as a spike, read straight from Redis so it holds for sales this instance
+// isn't watching
+func (ps *PurchaseSpikes) Rate(saleID string) (float64, bool, error) {
+	rates, err := ps.redis.SalePurchaseRates([]string{saleID}, ps.window)
+	if err != nil {
+		return 0, false, err
+	}
+	return rates[saleID], rates[saleID] > ps.threshold, nil
+}
+
+// Rates returns the last measured purchase rate of each watched sale, for
+// metrics
+func (ps *PurchaseSpikes) Rates() map[string]float64 {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	rates := make(map[string]float64, len(ps.sales))
+	for saleID, sale := range ps.sales {
+		rates[saleID] = sale.rate
+	}
+	return rates
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+    "context"
+    "database/sql/driver"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/alicebob/miniredis/v2"
+    goredis "github.com/go-redis/redis/v8"
+    "github.com/lib/pq"
+
+    "github.com/Hananjeda/Flash-Sale-Service/internal/database"
+    "github.com/Hananjeda/Flash-Sale-Service/internal/errs"
+    "github.com/Hananjeda/Flash-Sale-Service/internal/models"
+    "github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+var testCodeSecret = []byte("test-checkout-secret")
+
+// newTestRedis returns a client on a fresh in-memory Redis
+func newTestRedis(t *testing.T) *redis.Client {
+    t.Helper()
+    mr := miniredis.RunT(t)
+    c := &redis.Client{Client: goredis.NewClient(&goredis.Options{Addr: mr.Addr()})}
+    t.Cleanup(func() { c.Close() })
+    return c
+}
+
+// seedTestSale loads a sale running from a minute ago until endTime whose
+// items each have stock
+func seedTestSale(t *testing.T, c *redis.Client, saleID string, endTime time.Time, stock int, itemIDs ...string) {
+    t.Helper()
+    items := make([]models.Item, len(itemIDs))
+    for i, itemID := range itemIDs {
+        items[i] = models.Item{ItemID: itemID, SaleID: saleID}
+    }
+    if err := c.InitializeSale(saleID, time.Now().Add(-time.Minute), endTime, items, stock); err != nil {
+        t.Fatalf("InitializeSale: %v", err)
+    }
+}
+
+// reserveTestCheckout checks out itemID for userID and returns the code
+func reserveTestCheckout(t *testing.T, c *redis.Client, saleID, userID, itemID string) string {
+    t.Helper()
+    expiresAt := time.Now().Add(5 * time.Minute)
+    code, err := generateCheckoutCode(testCodeSecret, userID, itemID, expiresAt)
+    if err != nil {
+        t.Fatalf("generateCheckoutCode: %v", err)
+    }
+    reserved, err := c.ReserveItem(context.Background(), code, saleID, userID, itemID, expiresAt)
+    if err != nil || !reserved {
+        t.Fatalf("ReserveItem = %v, %v; want reserved", reserved, err)
+    }
+    return code
+}
+
+// newTestDB returns a database whose queries are answered by the returned mock
+func newTestDB(t *testing.T) (*database.DB, sqlmock.Sqlmock) {
+    t.Helper()
+    sqlDB, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("sqlmock.New: %v", err)
+    }
+    t.Cleanup(func() { sqlDB.Close() })
+    return &database.DB{DB: sqlDB}, mock
+}
+
+// expectItem answers the next item lookup with itemID in saleID
+func expectItem(mock sqlmock.Sqlmock, itemID, saleID string) {
+    mock.ExpectQuery("FROM items").WithArgs(itemID).WillReturnRows(sqlmock.NewRows(
+        []string{"item_id", "sale_id", "name", "category", "image_url", "tier", "price_cents", "discount_price_cents", "queued"}).
+        AddRow(itemID, saleID, "Item", "general", "", models.TierCommon, 1000, 500, false))
+}
+
+// expectActiveSale answers the next active sale lookup with a running sale of
+// totalItems units ending at endTime
+func expectActiveSale(mock sqlmock.Sqlmock, saleID string, endTime time.Time, totalItems int) {
+    mock.ExpectQuery("FROM sales").WithArgs(models.SaleStatusActive, models.SaleStatusSoldOut, saleID).
+        WillReturnRows(sqlmock.NewRows(
+            []string{"sale_id", "start_time", "end_time", "total_items", "items_sold", "status", "checkout_ttl_seconds"}).
+            AddRow(saleID, endTime.Add(-time.Hour), endTime, totalItems, 0, models.SaleStatusActive, driver.Value(int64(300))))
+}
+
+// setClock makes purchases see the time as at until the test ends
+func setClock(t *testing.T, at time.Time) {
+    t.Helper()
+    clock = func() time.Time { return at }
+    t.Cleanup(func() { clock = time.Now })
+}
+
+func testItemStock(t *testing.T, c *redis.Client, itemID string) int {
+    t.Helper()
+    stock, err := c.GetItemStock(itemID)
+    if err != nil {
+        t.Fatalf("GetItemStock: %v", err)
+    }
+    return stock
+}
+
+// errorCode returns the code of a JSON error response
+func errorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+    t.Helper()
+    var body struct {
+        Error apiError `json:"error"`
+    }
+    if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+        t.Fatalf("decode error body: %v", err)
+    }
+    return body.Error.Code
+}
+
+func TestPurchaseReplayedCodeConflicts(t *testing.T) {
+    redisClient := newTestRedis(t)
+    seedTestSale(t, redisClient, "sale_1", time.Now().Add(time.Hour), 5, "item_1")
+    code := reserveTestCheckout(t, redisClient, "sale_1", "user_1", "item_1")
+
+    // The first purchase with the code takes its unit
+    if _, err := redis.DecrementInventory(context.Background(), redisClient, "sale_1", "user_1", "item_1", code, 1); err != nil {
+        t.Fatalf("DecrementInventory: %v", err)
+    }
+
+    handler := PurchaseHandler(nil, redisClient, testCodeSecret, nil, nil, nil, nil)
+    rec := httptest.NewRecorder()
+    handler(rec, httptest.NewRequest(http.MethodPost, "/purchase?code="+url.QueryEscape(code), nil))
+
+    if rec.Code != http.StatusConflict {
+        t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+    }
+    if code := errorCode(t, rec); code != ErrCodeCheckoutUsed {
+        t.Errorf("error code = %q, want %q", code, ErrCodeCheckoutUsed)
+    }
+    if stock := testItemStock(t, redisClient, "item_1"); stock != 4 {
+        t.Errorf("stock after replay = %d, want 4", stock)
+    }
+}
+
+func TestPurchaseAfterSaleEndReleasesReservation(t *testing.T) {
+    redisClient := newTestRedis(t)
+    endTime := time.Now().Add(time.Hour)
+    seedTestSale(t, redisClient, "sale_1", endTime, 1, "item_1")
+    code := reserveTestCheckout(t, redisClient, "sale_1", "user_1", "item_1")
+
+    db, mock := newTestDB(t)
+    expectItem(mock, "item_1", "sale_1")
+    expectActiveSale(mock, "sale_1", endTime, 10)
+
+    // The database still lists the sale, but this instance's clock is past
+    // its end
+    setClock(t, endTime.Add(time.Second))
+
+    handler := PurchaseHandler(db, redisClient, testCodeSecret, nil, nil, nil, nil)
+    rec := httptest.NewRecorder()
+    handler(rec, httptest.NewRequest(http.MethodPost, "/purchase?code="+url.QueryEscape(code), nil))
+
+    if rec.Code != http.StatusGone {
+        t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusGone, rec.Body)
+    }
+    if code := errorCode(t, rec); code != ErrCodeSaleEnded {
+        t.Errorf("error code = %q, want %q", code, ErrCodeSaleEnded)
+    }
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Error(err)
+    }
+
+    if _, _, err := redis.GetCheckoutSession(context.Background(), redisClient, code); !errors.Is(err, redis.ErrCheckoutNotFound) {
+        t.Errorf("checkout session after 410: error = %v, want ErrCheckoutNotFound", err)
+    }
+    if stock := testItemStock(t, redisClient, "item_1"); stock != 1 {
+        t.Errorf("stock = %d, want 1", stock)
+    }
+
+    // The only unit is free for someone else again
+    reserveTestCheckout(t, redisClient, "sale_1", "user_2", "item_1")
+}
+
+func TestPurchaseOfLastItemMarksSaleSoldOut(t *testing.T) {
+    redisClient := newTestRedis(t)
+    endTime := time.Now().Add(time.Hour)
+    seedTestSale(t, redisClient, "sale_1", endTime, 1, "item_1", "item_2")
+    codes := []string{
+        reserveTestCheckout(t, redisClient, "sale_1", "user_1", "item_1"),
+        reserveTestCheckout(t, redisClient, "sale_1", "user_2", "item_2"),
+    }
+
+    db, mock := newTestDB(t)
+    handler := PurchaseHandler(db, redisClient, testCodeSecret, nil, nil, nil, nil)
+    for i, itemID := range []string{"item_1", "item_2"} {
+        expectItem(mock, itemID, "sale_1")
+        expectActiveSale(mock, "sale_1", endTime, 2)
+        mock.ExpectExec("INSERT INTO purchases").WillReturnResult(sqlmock.NewResult(0, 1))
+        // Only the purchase that takes the last unit ends the sale
+        if i == 1 {
+            mock.ExpectExec("UPDATE sales SET status").
+                WithArgs(models.SaleStatusSoldOut, "sale_1", models.SaleStatusActive).
+                WillReturnResult(sqlmock.NewResult(0, 1))
+        }
+        mock.ExpectExec("INSERT INTO audit").WillReturnResult(sqlmock.NewResult(0, 1))
+
+        rec := httptest.NewRecorder()
+        handler(rec, httptest.NewRequest(http.MethodPost, "/purchase?code="+url.QueryEscape(codes[i]), nil))
+        if rec.Code != http.StatusOK {
+            t.Fatalf("purchase of %s: status = %d, want %d: %s", itemID, rec.Code, http.StatusOK, rec.Body)
+        }
+        if err := mock.ExpectationsWereMet(); err != nil {
+            t.Fatalf("after purchase of %s: %v", itemID, err)
+        }
+    }
+}
+
+func TestPurchaseDuplicateInDatabaseAnswersLikeUserLimit(t *testing.T) {
+    redisClient := newTestRedis(t)
+    endTime := time.Now().Add(time.Hour)
+    seedTestSale(t, redisClient, "sale_1", endTime, 5, "item_1")
+    code := reserveTestCheckout(t, redisClient, "sale_1", "user_1", "item_1")
+
+    // Redis let the purchase through, but the database already has one for
+    // the buyer
+    db, mock := newTestDB(t)
+    expectItem(mock, "item_1", "sale_1")
+    expectActiveSale(mock, "sale_1", endTime, 5)
+    mock.ExpectExec("INSERT INTO purchases").WillReturnError(&pq.Error{Code: "23505"})
+
+    handler := PurchaseHandler(db, redisClient, testCodeSecret, nil, nil, nil, nil)
+    rec := httptest.NewRecorder()
+    handler(rec, httptest.NewRequest(http.MethodPost, "/purchase?code="+url.QueryEscape(code), nil))
+
+    wantStatus, wantCode := errs.ToHTTP(errs.ErrUserLimitReached)
+    if rec.Code != wantStatus {
+        t.Fatalf("status = %d, want %d: %s", rec.Code, wantStatus, rec.Body)
+    }
+    if code := errorCode(t, rec); code != wantCode {
+        t.Errorf("error code = %q, want %q", code, wantCode)
+    }
+    if stock := testItemStock(t, redisClient, "item_1"); stock != 5 {
+        t.Errorf("stock after the rejected purchase = %d, want 5", stock)
+    }
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/metrics"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+// purchaseWritesRetryAfter is the Retry-After sent when a purchase couldn't
+// get a turn to be written
+const purchaseWritesRetryAfter = time.Second
+
+// PurchaseWrites caps how many purchases are written to the database at once,
+// so a rush of buyers queues here instead of on the connection pool that
+// every other query needs too. A purchase that doesn't get a turn within the
+// wait is turned away. A nil *PurchaseWrites doesn't limit.
+type PurchaseWrites struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+// NewPurchaseWrites allows max purchase writes at a time, each waiting at
+// most wait for its turn
+func NewPurchaseWrites(max int, wait time.Duration) *PurchaseWrites {
+	return &PurchaseWrites{slots: make(chan struct{}, max), wait: wait}
+}
+
+// acquire takes a turn, reporting false if none came free within the wait.
+// The turn must be given back with release.
+func (pw *PurchaseWrites) acquire() bool {
+	if pw == nil {
+		return true
+	}
+
+	select {
+	case pw.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if pw.wait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(pw.wait)
+	defer timer.Stop()
+
+	select {
+	case pw.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (pw *PurchaseWrites) release() {
+	if pw != nil {
+		<-pw.slots
+	}
+}
+
+// restorePurchase undoes the decrement of a purchase that was never written,
+// so its items aren't lost and the buyer's count in the sale doesn't hold a
+// purchase they never got. If that fails too the items stay taken, and the log
+// line is what reconciliation has to go on.
+func restorePurchase(ctx context.Context, redisClient *redis.Client, saleID, userID string, itemIDs, codes []string) {
+	// The stock is given back however the request ended
+	ctx = context.WithoutCancel(ctx)
+	if err := redisClient.RestoreInventory(ctx, saleID, userID, itemIDs, codes); err != nil {
+		Logger(ctx).Error("Failed to restore inventory of unwritten purchase",
+			"sale_id", saleID, "user_id", userID, "item_ids", itemIDs, "error", err)
+		return
+	}
+	if err := redisClient.PublishInventoryUpdate(ctx, saleID); err != nil {
+		Logger(ctx).Error("Failed to publish inventory update", "error", err)
+	}
+}
+
+// rejectPurchaseWrite answers a purchase whose inventory was taken but that
+// never got a turn to be written, giving the inventory back first
+func rejectPurchaseWrite(w http.ResponseWriter, r *http.Request, redisClient *redis.Client, saleID, userID string, itemIDs, codes []string) {
+	restorePurchase(r.Context(), redisClient, saleID, userID, itemIDs, codes)
+
+	Logger(r.Context()).Info("Purchase turned away, too many purchase writes in flight",
+		"sale_id", saleID, "user_id", userID)
+	metrics.PurchaseFailuresTotal.WithLabelValues(metrics.ReasonOverloaded).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(purchaseWritesRetryAfter/time.Second)))
+	WriteJSONError(w, http.StatusServiceUnavailable, ErrCodeServiceUnavailable,
+		"Too many purchases in progress; the item was released, please check out again")
+}
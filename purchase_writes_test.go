@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPurchaseWritesCapsInFlight(t *testing.T) {
+	const limit = 3
+	writes := NewPurchaseWrites(limit, 5*time.Millisecond)
+
+	var (
+		wg       sync.WaitGroup
+		inFlight atomic.Int32
+		peak     atomic.Int32
+		admitted atomic.Int32
+		rejected atomic.Int32
+		hold     = make(chan struct{})
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !writes.acquire() {
+				rejected.Add(1)
+				return
+			}
+			defer writes.release()
+
+			admitted.Add(1)
+			n := inFlight.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			<-hold
+			inFlight.Add(-1)
+		}()
+	}
+
+	// Everyone past the cap gives up within the wait while the first turns
+	// are still held
+	deadline := time.Now().Add(time.Second)
+	for admitted.Load()+rejected.Load() < 20 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(hold)
+	wg.Wait()
+
+	if got := peak.Load(); got != limit {
+		t.Errorf("peak writes in flight = %d, want %d", got, limit)
+	}
+	if got := admitted.Load(); got != limit {
+		t.Errorf("admitted = %d, want %d", got, limit)
+	}
+	if got := rejected.Load(); got != 20-limit {
+		t.Errorf("rejected = %d, want %d", got, 20-limit)
+	}
+	if !writes.acquire() {
+		t.Error("acquire after the burst drained = false, want true")
+	}
+}
+
+func TestPurchaseWritesRejectedBurstRestoresInventory(t *testing.T) {
+	const buyers = 5
+	redisClient := newTestRedis(t)
+	seedTestSale(t, redisClient, "sale_1", time.Now().Add(time.Hour), 1, itemIDsFor(buyers)...)
+
+	db, mock := newTestDB(t)
+	mock.MatchExpectationsInOrder(false)
+	codes := make([]string, buyers)
+	for i := range codes {
+		itemID := fmt.Sprintf("item_%d", i)
+		codes[i] = reserveTestCheckout(t, redisClient, "sale_1", fmt.Sprintf("user_%d", i), itemID)
+		expectItem(mock, itemID, "sale_1")
+		expectActiveSale(mock, "sale_1", time.Now().Add(time.Hour), buyers)
+	}
+
+	// The only write turn is taken and never comes free during the burst
+	writes := NewPurchaseWrites(1, 10*time.Millisecond)
+	if !writes.acquire() {
+		t.Fatal("acquire the only turn = false")
+	}
+
+	handler := PurchaseHandler(db, redisClient, testCodeSecret, nil, nil, writes, nil)
+	statuses := make([]int, buyers)
+	var wg sync.WaitGroup
+	for i, code := range codes {
+		wg.Add(1)
+		go func(i int, code string) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodPost, "/purchase?code="+url.QueryEscape(code), nil))
+			statuses[i] = rec.Code
+		}(i, code)
+	}
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != http.StatusServiceUnavailable {
+			t.Errorf("buyer %d status = %d, want %d", i, status, http.StatusServiceUnavailable)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < buyers; i++ {
+		itemID := fmt.Sprintf("item_%d", i)
+		if stock := testItemStock(t, redisClient, itemID); stock != 1 {
+			t.Errorf("%s stock after rejected write = %d, want 1", itemID, stock)
+		}
+		purchased, err := redisClient.HasUserPurchased(context.Background(), "sale_1", fmt.Sprintf("user_%d", i))
+		if err != nil {
+			t.Fatalf("HasUserPurchased: %v", err)
+		}
+		if purchased {
+			t.Errorf("user_%d still counted as a buyer", i)
+		}
+	}
+	sold, err := redisClient.GetItemsSold(context.Background(), "sale_1")
+	if err != nil {
+		t.Fatalf("GetItemsSold: %v", err)
+	}
+	if sold != 0 {
+		t.Errorf("items sold = %d, want 0", sold)
+	}
+}
+
+func itemIDsFor(n int) []string {
+	itemIDs := make([]string, n)
+	for i := range itemIDs {
+		itemIDs[i] = fmt.Sprintf("item_%d", i)
+	}
+	return itemIDs
+}
@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+// queueTokenTTL is how long a waiting room token stays valid after issue
+const queueTokenTTL = time.Hour
+
+var errInvalidQueueToken = errors.New("invalid queue token")
+
+// queueToken is the signed payload handed to a user joining the waiting room
+type queueToken struct {
+	ID       string
+	Position int64
+	IssuedAt time.Time
+	UserID   string
+}
+
+// WaitingRoom paces entry into the purchase flow. Users join a queue and
+// receive a signed token for themselves; purchases are only accepted once the
+// queue has admitted the token's position, and each token buys once.
+type WaitingRoom struct {
+	redis          *redis.Client
+	secret         []byte
+	admitPerSecond int
+}
+
+// NewWaitingRoom creates a waiting room admitting admitPerSecond users per
+// second. The secret signs tokens and must be shared by every instance.
+func NewWaitingRoom(redisClient *redis.Client, secret []byte, admitPerSecond int) *WaitingRoom {
+	return &WaitingRoom{
+		redis:          redisClient,
+		secret:         secret,
+		admitPerSecond: admitPerSecond,
+	}
+}
+
+func (wr *WaitingRoom) sign(payload string) string {
+	mac := hmac.New(sha256.New, wr.secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// issue creates the token string for userID's queue position. The user ID is
+// hex encoded, so whatever it contains can't be mistaken for a separator.
+func (wr *WaitingRoom) issue(position int64, userID string) (string, error) {
+	id, err := generateNonce()
+	if err != nil {
+		return "", err
+	}
+	payload := fmt.Sprintf("%s.%d.%d.%s", id, position, time.Now().Unix(), hex.EncodeToString([]byte(userID)))
+	return payload + "." + wr.sign(payload), nil
+}
+
+// parse verifies a token's signature and age
+func (wr *WaitingRoom) parse(token string) (*queueToken, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return nil, errInvalidQueueToken
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(wr.sign(payload))) {
+		return nil, errInvalidQueueToken
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 4 {
+		return nil, errInvalidQueueToken
+	}
+	position, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errInvalidQueueToken
+	}
+	issued, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, errInvalidQueueToken
+	}
+
+	userID, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return nil, errInvalidQueueToken
+	}
+
+	t := &queueToken{ID: parts[0], Position: position, IssuedAt: time.Unix(issued, 0), UserID: string(userID)}
+	if time.Since(t.IssuedAt) > queueTokenTTL {
+		return nil, errInvalidQueueToken
+	}
+	return t, nil
+}
+
+// QueueHandler adds the caller to the waiting room and returns their token,
+// which only buys for them
+func (wr *WaitingRoom) QueueHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		if !parseFormBody(w, r) {
+			return
+		}
+
+		// Prefer the authenticated user; user_id is only trusted without auth
+		userID, ok := UserFromContext(r.Context())
+		if !ok {
+			userID = r.FormValue("user_id")
+		}
+		if userID == "" {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeMissingParameter, "Missing user_id")
+			return
+		}
+
+		position, err := wr.redis.JoinQueue(r.Context())
+		if err != nil {
+			Logger(r.Context()).Error("Failed to join queue", "error", err)
+			writeDependencyError(w, err, "Error joining queue")
+			return
+		}
+
+		token, err := wr.issue(position, userID)
+		if err != nil {
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error joining queue")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"token":    token,
+			"position": position,
+		})
+	}
+}
+
+// StatusHandler reports a token's place in the queue and estimated wait
+func (wr *WaitingRoom) StatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := wr.parse(r.URL.Query().Get("token"))
+		if err != nil {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeQueueTokenInvalid, "Invalid or expired queue token")
+			return
+		}
+
+		head, err := wr.redis.QueueHead(r.Context(), wr.admitPerSecond)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to get queue head", "error", err)
+			writeDependencyError(w, err, "Error loading queue status")
+			return
+		}
+
+		ahead := t.Position - head
+		if ahead < 0 {
+			ahead = 0
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":                true,
+			"admitted":               ahead == 0,
+			"position":               t.Position,
+			"users_ahead":            ahead,
+			"estimated_wait_seconds": (ahead + int64(wr.admitPerSecond) - 1) / int64(wr.admitPerSecond),
+		})
+	}
+}
+
+// Require rejects requests that don't carry an admitted, unused queue token in
+// the X-Queue-Token header, issued to the user userOf finds the request is
+// for. The token is spent on use so it can't be replayed; a retry with the
+// same Idempotency-Key may present it again so the original response can be
+// replayed. A purchase that fails on our side, with a 5xx or a panic, gives
+// the token back for the retry.
+func (wr *WaitingRoom) Require(userOf func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Queue-Token")
+		if token == "" {
+			WriteJSONError(w, http.StatusForbidden, ErrCodeQueueTokenRequired, "A queue token is required")
+			return
+		}
+
+		t, err := wr.parse(token)
+		if err != nil {
+			WriteJSONError(w, http.StatusForbidden, ErrCodeQueueTokenInvalid, "Invalid or expired queue token")
+			return
+		}
+
+		// Checked before the token is spent, so presenting someone else's
+		// token can't use it up
+		if userID := userOf(r); userID == "" || userID != t.UserID {
+			WriteJSONError(w, http.StatusForbidden, ErrCodeQueueTokenInvalid, "Queue token was issued to another user")
+			return
+		}
+
+		head, err := wr.redis.QueueHead(r.Context(), wr.admitPerSecond)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to get queue head", "error", err)
+			writeDependencyError(w, err, "Error checking queue token")
+			return
+		}
+
+		if t.Position > head {
+			WriteJSONError(w, http.StatusForbidden, ErrCodeNotAdmitted, "Queue token has not been admitted yet")
+			return
+		}
+
+		requestKey := r.Header.Get("Idempotency-Key")
+		consumed, err := wr.redis.ConsumeQueueToken(r.Context(), t.ID, requestKey, queueTokenTTL)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to consume queue token", "error", err)
+			writeDependencyError(w, err, "Error checking queue token")
+			return
+		}
+
+		if !consumed {
+			WriteJSONError(w, http.StatusForbidden, ErrCodeQueueTokenUsed, "Queue token has already been used")
+			return
+		}
+
+		release := func() {
+			if err := wr.redis.ReleaseQueueToken(context.WithoutCancel(r.Context()), t.ID, requestKey); err != nil {
+				Logger(r.Context()).Error("Failed to release queue token", "error", err)
+			}
+		}
+		defer func() {
+			if p := recover(); p != nil {
+				release()
+				panic(p)
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		// Like an idempotency key, a token is only spent on a final answer
+		if recorder.status >= http.StatusInternalServerError {
+			release()
+		}
+	}
+}
+
+// PurchaseUser returns the user a /purchase request is for: the one its
+// signed checkout code was issued to, or "" for a code that doesn't verify
+// against codeSecret
+func PurchaseUser(codeSecret []byte) func(*http.Request) string {
+	return func(r *http.Request) string {
+		claims, err := parseCheckoutCode(codeSecret, r.URL.Query().Get("code"))
+		if err != nil {
+			return ""
+		}
+		return claims.UserID
+	}
+}
+
+// BulkPurchaseUser returns the user a /purchase/bulk request is for: the one
+// its first checkout code was issued to, since a bundle of several users'
+// codes is rejected anyway. The body is put back for the handler to read,
+// along with any error reading it.
+func BulkPurchaseUser(codeSecret []byte) func(*http.Request) string {
+	return func(r *http.Request) string {
+		body, err := io.ReadAll(r.Body)
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil {
+			return ""
+		}
+
+		var req struct {
+			CheckoutCodes []string `json:"checkout_codes"`
+		}
+		if json.Unmarshal(body, &req) != nil || len(req.CheckoutCodes) == 0 {
+			return ""
+		}
+		claims, err := parseCheckoutCode(codeSecret, req.CheckoutCodes[0])
+		if err != nil {
+			return ""
+		}
+		return claims.UserID
+	}
+}
+
+// readCloser reads from a Reader and closes the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestWaitingRoom returns a waiting room and an admitted token in it for
+// userID
+func newTestWaitingRoom(t *testing.T, userID string) (*WaitingRoom, string) {
+	t.Helper()
+	wr := NewWaitingRoom(newTestRedis(t), []byte("test-queue-secret"), 1000)
+	position, err := wr.redis.JoinQueue(context.Background())
+	if err != nil {
+		t.Fatalf("JoinQueue: %v", err)
+	}
+	// Admitted straight away rather than a pace later
+	if err := wr.redis.HSet(context.Background(), "queue:head", "head", position).Err(); err != nil {
+		t.Fatalf("HSet queue head: %v", err)
+	}
+	token, err := wr.issue(position, userID)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	return wr, token
+}
+
+// queuedPurchase makes a purchase for userID with the given queue token
+func queuedPurchase(handler http.HandlerFunc, token, userID string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/purchase?user="+userID, nil)
+	r.Header.Set("X-Queue-Token", token)
+	rec := httptest.NewRecorder()
+	handler(rec, r)
+	return rec
+}
+
+func requestUser(r *http.Request) string {
+	return r.URL.Query().Get("user")
+}
+
+func TestWaitingRoomTokenOnlyBuysForItsUser(t *testing.T) {
+	wr, token := newTestWaitingRoom(t, "user_1")
+	calls := 0
+	handler := wr.Require(requestUser, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	})
+
+	rec := queuedPurchase(handler, token, "user_2")
+	if rec.Code != http.StatusForbidden || calls != 0 {
+		t.Fatalf("another user's purchase: status = %d, calls = %d; want %d and 0", rec.Code, calls, http.StatusForbidden)
+	}
+	if code := errorCode(t, rec); code != ErrCodeQueueTokenInvalid {
+		t.Errorf("another user's purchase: error code = %q, want %q", code, ErrCodeQueueTokenInvalid)
+	}
+
+	// Presenting it for someone else didn't use it up
+	if rec := queuedPurchase(handler, token, "user_1"); rec.Code != http.StatusOK || calls != 1 {
+		t.Fatalf("own purchase: status = %d, calls = %d; want 200 and 1", rec.Code, calls)
+	}
+	if rec := queuedPurchase(handler, token, "user_1"); rec.Code != http.StatusForbidden || calls != 1 {
+		t.Errorf("second purchase: status = %d, calls = %d; want %d and 1", rec.Code, calls, http.StatusForbidden)
+	}
+}
+
+func TestWaitingRoomTokenReleasedOnServerError(t *testing.T) {
+	wr, token := newTestWaitingRoom(t, "user_1")
+	statuses := []int{http.StatusServiceUnavailable, http.StatusConflict, http.StatusOK}
+	calls := 0
+	handler := wr.Require(requestUser, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[calls])
+		calls++
+	})
+
+	// A 503 leaves the token for the retry; the 409 that follows is final
+	for i, want := range statuses[:2] {
+		if rec := queuedPurchase(handler, token, "user_1"); rec.Code != want {
+			t.Fatalf("attempt %d: status = %d, want %d", i+1, rec.Code, want)
+		}
+	}
+	if rec := queuedPurchase(handler, token, "user_1"); rec.Code != http.StatusForbidden || calls != 2 {
+		t.Errorf("after a final answer: status = %d, calls = %d; want %d and 2", rec.Code, calls, http.StatusForbidden)
+	}
+}
+
+func TestBulkPurchaseUserLeavesBodyForHandler(t *testing.T) {
+	code, err := generateCheckoutCode(testCodeSecret, "user_1", "item_1", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("generateCheckoutCode: %v", err)
+	}
+	body := `{"checkout_codes": ["` + code + `"]}`
+	r := httptest.NewRequest(http.MethodPost, "/purchase/bulk", strings.NewReader(body))
+
+	if user := BulkPurchaseUser(testCodeSecret)(r); user != "user_1" {
+		t.Errorf("user = %q, want user_1", user)
+	}
+	if rest, err := io.ReadAll(r.Body); err != nil || string(rest) != body {
+		t.Errorf("body left = %q, %v; want it whole", rest, err)
+	}
+}
@@ -1,25 +1,60 @@
 package middleware
 
 import (
+    "context"
+    "fmt"
+    "math"
+    "net"
     "net/http"
+    "strconv"
+    "strings"
     "sync"
     "time"
+
+    "github.com/Hananjeda/Flash-Sale-Service/internal/errs"
+    "github.com/Hananjeda/Flash-Sale-Service/internal/handlers"
+    "github.com/Hananjeda/Flash-Sale-Service/internal/metrics"
 )
 
+// Limiter decides whether a request identified by key may proceed
+type Limiter interface {
+    Allow(key string) bool
+}
+
+// RetryAfterLimiter is a Limiter that can also tell a throttled client how
+// long to wait. RateLimitMiddleware sets Retry-After for limiters that
+// implement it.
+type RetryAfterLimiter interface {
+    Limiter
+    RetryAfter(key string) time.Duration
+}
+
+// RateLimiter is an in-memory token bucket per key. Buckets refill
+// continuously at rate tokens per second, so fractional tokens carry over
+// between requests and low rates still refill.
 type RateLimiter struct {
-    rate  int
-    burst int
-    mutex sync.Mutex
-    tokens map[string]int
+    rate       int
+    burst      int
+    mutex      sync.Mutex
+    tokens     map[string]float64
     lastRefill map[string]time.Time
+
+    // now is the limiter's clock, replaced in tests
+    now func() time.Time
 }
 
+// tokenEpsilon absorbs the rounding error of adding up many small refills,
+// which would otherwise leave a bucket polled often a hair short of a whole
+// token and throttle it below its rate
+const tokenEpsilon = 1e-9
+
 func NewRateLimiter(rate, burst int) *RateLimiter {
     return &RateLimiter{
-        rate:  rate,
-        burst: burst,
-        tokens: make(map[string]int),
+        rate:       rate,
+        burst:      burst,
+        tokens:     make(map[string]float64),
         lastRefill: make(map[string]time.Time),
+        now:        time.Now,
     }
 }
 
@@ -27,40 +62,236 @@ func (rl *RateLimiter) Allow(key string) bool {
     rl.mutex.Lock()
     defer rl.mutex.Unlock()
 
-    now := time.Now()
+    now := rl.now()
+    tokens := float64(rl.burst)
+    if lastRefill, exists := rl.lastRefill[key]; exists {
+        elapsed := now.Sub(lastRefill).Seconds()
+        tokens = math.Min(rl.tokens[key]+elapsed*float64(rl.rate), float64(rl.burst))
+    }
+    rl.lastRefill[key] = now
+
+    if tokens < 1-tokenEpsilon {
+        rl.tokens[key] = tokens
+        return false
+    }
+    rl.tokens[key] = tokens - 1
+    return true
+}
+
+// RetryAfter returns how long until key's bucket holds a whole token again,
+// or zero if a request would be allowed now
+func (rl *RateLimiter) RetryAfter(key string) time.Duration {
+    rl.mutex.Lock()
+    defer rl.mutex.Unlock()
+
     lastRefill, exists := rl.lastRefill[key]
-    if !exists {
-        rl.tokens[key] = rl.burst
-        rl.lastRefill[key] = now
-        return true
+    if !exists || rl.rate <= 0 {
+        return 0
+    }
+
+    elapsed := rl.now().Sub(lastRefill).Seconds()
+    tokens := math.Min(rl.tokens[key]+elapsed*float64(rl.rate), float64(rl.burst))
+    if tokens >= 1-tokenEpsilon {
+        return 0
+    }
+    return time.Duration((1 - tokens) / float64(rl.rate) * float64(time.Second))
+}
+
+// Stats returns how many keys the limiter is tracking and their saturation:
+// the mean share of the burst spent across their buckets as of now, from 0
+// when every bucket is full to 1 when every client is throttled
+func (rl *RateLimiter) Stats() (int, float64) {
+    rl.mutex.Lock()
+    defer rl.mutex.Unlock()
+
+    if len(rl.lastRefill) == 0 || rl.burst <= 0 {
+        return len(rl.lastRefill), 0
+    }
+
+    now := rl.now()
+    spent := 0.0
+    for key, lastRefill := range rl.lastRefill {
+        tokens := math.Min(rl.tokens[key]+now.Sub(lastRefill).Seconds()*float64(rl.rate), float64(rl.burst))
+        spent += 1 - tokens/float64(rl.burst)
+    }
+    return len(rl.lastRefill), spent / float64(len(rl.lastRefill))
+}
+
+// StartCleanup periodically drops keys that have not been seen for maxIdle so
+// the limiter doesn't grow without bound. It stops when ctx is cancelled.
+func (rl *RateLimiter) StartCleanup(ctx context.Context, maxIdle time.Duration) {
+    go func() {
+        ticker := time.NewTicker(maxIdle)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case now := <-ticker.C:
+                rl.sweep(now.Add(-maxIdle))
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+}
+
+// sweep removes every key last refilled before cutoff and returns how many went
+func (rl *RateLimiter) sweep(cutoff time.Time) int {
+    rl.mutex.Lock()
+    defer rl.mutex.Unlock()
+
+    removed := 0
+    for key, lastRefill := range rl.lastRefill {
+        if lastRefill.Before(cutoff) {
+            delete(rl.lastRefill, key)
+            delete(rl.tokens, key)
+            removed++
+        }
+    }
+    return removed
+}
+
+// KeyFunc picks the rate limit bucket for a request
+type KeyFunc func(*http.Request) string
+
+// RemoteIPKey keys requests on the connecting IP address, ignoring the port
+func RemoteIPKey(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// ForwardedIPKey returns a KeyFunc that resolves the client IP behind the given
+// trusted proxies (IPs or CIDRs). X-Forwarded-For is only honoured when the
+// connection comes from a trusted proxy, and it is walked from the right past
+// trusted hops so a client can't choose its own key by prepending addresses.
+func ForwardedIPKey(trustedProxies []string) (KeyFunc, error) {
+    var trusted []*net.IPNet
+    for _, proxy := range trustedProxies {
+        if !strings.Contains(proxy, "/") {
+            if strings.Contains(proxy, ":") {
+                proxy += "/128"
+            } else {
+                proxy += "/32"
+            }
+        }
+        _, network, err := net.ParseCIDR(proxy)
+        if err != nil {
+            return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+        }
+        trusted = append(trusted, network)
+    }
+
+    isTrusted := func(addr string) bool {
+        ip := net.ParseIP(strings.TrimSpace(addr))
+        if ip == nil {
+            return false
+        }
+        for _, network := range trusted {
+            if network.Contains(ip) {
+                return true
+            }
+        }
+        return false
     }
 
-    tokensToAdd := int(now.Sub(lastRefill).Seconds()) * rl.rate
-    if tokensToAdd > 0 {
-        rl.tokens[key] = min(rl.tokens[key]+tokensToAdd, rl.burst)
-        rl.lastRefill[key] = now
+    return func(r *http.Request) string {
+        remote := RemoteIPKey(r)
+        if !isTrusted(remote) {
+            return remote
+        }
+
+        hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+        client := remote
+        for i := len(hops) - 1; i >= 0; i-- {
+            hop := strings.TrimSpace(hops[i])
+            if hop == "" || net.ParseIP(hop) == nil {
+                break
+            }
+            client = hop
+            if !isTrusted(hop) {
+                break
+            }
+        }
+        return client
+    }, nil
+}
+
+// UserOrIPKey keys authenticated requests on the user ID and falls back to
+// ipKey otherwise. It must run after AuthMiddleware to see the user.
+func UserOrIPKey(ipKey KeyFunc) KeyFunc {
+    return func(r *http.Request) string {
+        if userID, ok := handlers.UserFromContext(r.Context()); ok {
+            return "user:" + userID
+        }
+        return "ip:" + ipKey(r)
     }
+}
 
-    if rl.tokens[key] > 0 {
-        rl.tokens[key]--
-        return true
+// RateLimitMiddleware limits requests per client IP
+func RateLimitMiddleware(next http.Handler, limiter Limiter) http.Handler {
+    return RateLimitMiddlewareWithKey(next, limiter, RemoteIPKey)
+}
+
+// RateLimitMiddlewareFor returns middleware limiting one route with its own
+// limiter, so each route can have its own rate and burst. Keys are prefixed
+// with route so limiters sharing a store, like RedisRateLimiter, keep
+// separate buckets per route.
+func RateLimitMiddlewareFor(route string, limiter Limiter, keyFunc KeyFunc) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return limitRequests(next, limiter, keyFunc, route)
     }
-    return false
 }
 
-func min(a, b int) int {
-    if a < b {
-        return a
+// RateLimitMiddlewareWithKey limits requests per bucket chosen by keyFunc
+func RateLimitMiddlewareWithKey(next http.Handler, limiter Limiter, keyFunc KeyFunc) http.Handler {
+    return limitRequests(next, limiter, keyFunc, "")
+}
+
+// rateLimitKeyType is the kind of client a key from UserOrIPKey stands for,
+// the only part of it fit to be a metric label
+func rateLimitKeyType(key string) string {
+    if strings.HasPrefix(key, "user:") {
+        return "user"
     }
-    return b
+    return "ip"
 }
 
-func RateLimitMiddleware(next http.Handler, limiter *RateLimiter) http.Handler {
+// limitRequests limits requests per bucket chosen by keyFunc, inside route
+// when it is set, and counts every decision by route, result and key type.
+// Requests limited without a route are counted under "default".
+func limitRequests(next http.Handler, limiter Limiter, keyFunc KeyFunc, route string) http.Handler {
+    label := route
+    if label == "" {
+        label = "default"
+    }
+
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        if !limiter.Allow(r.RemoteAddr) {
-            http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+        clientKey := keyFunc(r)
+        key := clientKey
+        if route != "" {
+            key = route + ":" + clientKey
+        }
+
+        if !limiter.Allow(key) {
+            metrics.RateLimitRejectionsTotal.Inc()
+            metrics.RateLimitRequestsTotal.WithLabelValues(label, metrics.RateLimitRejected, rateLimitKeyType(clientKey)).Inc()
+            if ral, ok := limiter.(RetryAfterLimiter); ok {
+                // Retry-After is whole seconds; round up so clients that
+                // honour it are never throttled again on arrival
+                seconds := int(math.Ceil(ral.RetryAfter(key).Seconds()))
+                if seconds < 1 {
+                    seconds = 1
+                }
+                w.Header().Set("Retry-After", strconv.Itoa(seconds))
+            }
+            status, code := errs.ToHTTP(errs.ErrRateLimited)
+            handlers.WriteJSONError(w, status, code, "Rate limit exceeded")
             return
         }
+        metrics.RateLimitRequestsTotal.WithLabelValues(label, metrics.RateLimitAllowed, rateLimitKeyType(clientKey)).Inc()
         next.ServeHTTP(w, r)
     })
 }
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+
+	goredis "github.com/go-redis/redis/v8"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+// tokenBucketScript refills and spends a token bucket stored in a hash. Time
+// comes from the Redis server so every instance sees the same clock.
+//
+// KEYS[1] bucket
+// ARGV[1] rate (tokens per second), ARGV[2] burst, ARGV[3] key ttl (ms)
+var tokenBucketScript = goredis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return allowed
+`)
+
+// RedisRateLimiter is a token bucket limiter whose state is shared by every
+// instance through Redis
+type RedisRateLimiter struct {
+	client *redis.Client
+	rate   int
+	burst  int
+	ttlMs  int64
+}
+
+// NewRedisRateLimiter creates a distributed limiter allowing rate requests per
+// second with bursts of up to burst requests per key
+func NewRedisRateLimiter(client *redis.Client, rate, burst int) *RedisRateLimiter {
+	// Keep idle buckets just long enough to refill completely; after that a
+	// fresh bucket is equivalent and the key can go
+	refill := math.Ceil(float64(burst) / float64(rate))
+	return &RedisRateLimiter{
+		client: client,
+		rate:   rate,
+		burst:  burst,
+		ttlMs:  int64(refill+1) * 1000,
+	}
+}
+
+// Allow reports whether the request identified by key may proceed. If Redis
+// is unavailable the request is allowed so an outage doesn't take the API down.
+func (rl *RedisRateLimiter) Allow(key string) bool {
+	allowed, err := tokenBucketScript.Run(context.Background(), rl.client.Client,
+		[]string{fmt.Sprintf("ratelimit:%s", key)},
+		rl.rate, rl.burst, rl.ttlMs,
+	).Int()
+	if err != nil {
+		log.Printf("Warning: rate limiter unavailable, allowing request: %v", err)
+		return true
+	}
+	return allowed == 1
+}
@@ -0,0 +1,159 @@
+package middleware
+
+import (
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/Hananjeda/Flash-Sale-Service/internal/handlers"
+)
+
+// fakeClock is a clock that only moves when told to
+type fakeClock struct {
+    at time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+    return c.at
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+    c.at = c.at.Add(d)
+}
+
+// newTestRateLimiter returns a limiter on a fake clock
+func newTestRateLimiter(rate, burst int) (*RateLimiter, *fakeClock) {
+    clock := &fakeClock{at: time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)}
+    rl := NewRateLimiter(rate, burst)
+    rl.now = clock.now
+    return rl, clock
+}
+
+func TestRateLimiterSweepDropsIdleKeys(t *testing.T) {
+    const maxIdle = 10 * time.Minute
+    rl, clock := newTestRateLimiter(10, 10)
+
+    for i := 0; i < 5000; i++ {
+        rl.Allow(fmt.Sprintf("ip:10.0.%d.%d", i/256, i%256))
+    }
+    if keys, _ := rl.Stats(); keys != 5000 {
+        t.Fatalf("tracked keys = %d, want 5000", keys)
+    }
+
+    // A few clients keep coming back; everyone else goes idle
+    clock.advance(maxIdle + time.Second)
+    for i := 0; i < 10; i++ {
+        rl.Allow(fmt.Sprintf("ip:10.0.0.%d", i))
+    }
+
+    if removed := rl.sweep(clock.now().Add(-maxIdle)); removed != 4990 {
+        t.Errorf("sweep removed %d keys, want 4990", removed)
+    }
+    if len(rl.tokens) != 10 || len(rl.lastRefill) != 10 {
+        t.Errorf("maps hold %d tokens and %d refills after sweep, want 10 each", len(rl.tokens), len(rl.lastRefill))
+    }
+}
+
+func TestRateLimiterSteadyStateMatchesRate(t *testing.T) {
+    tests := []struct {
+        name        string
+        rate, burst int
+        every       time.Duration
+    }{
+        {"1/s polled every 900ms", 1, 2, 900 * time.Millisecond},
+        {"1/s polled every 100ms", 1, 1, 100 * time.Millisecond},
+        {"1/s with burst polled every 100ms", 1, 5, 100 * time.Millisecond},
+        {"10/s polled every 90ms", 10, 10, 90 * time.Millisecond},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rl, clock := newTestRateLimiter(tt.rate, tt.burst)
+
+            // Spend the burst first, so only the refill is measured
+            for rl.Allow("client") {
+            }
+
+            const window = 100 * time.Second
+            allowed := 0
+            for elapsed := time.Duration(0); elapsed < window; elapsed += tt.every {
+                clock.advance(tt.every)
+                if rl.Allow("client") {
+                    allowed++
+                }
+            }
+
+            want := int(window.Seconds()) * tt.rate
+            if allowed < want-1 || allowed > want {
+                t.Errorf("allowed %d requests over %v, want %d", allowed, window, want)
+            }
+        })
+    }
+}
+
+// newKeyRequest returns a request arriving from remote with the given
+// X-Forwarded-For header, if any
+func newKeyRequest(remote, forwardedFor string) *http.Request {
+    r := httptest.NewRequest(http.MethodGet, "/", nil)
+    r.RemoteAddr = remote
+    if forwardedFor != "" {
+        r.Header.Set("X-Forwarded-For", forwardedFor)
+    }
+    return r
+}
+
+func TestUserOrIPKey(t *testing.T) {
+    tests := []struct {
+        name   string
+        userID string
+        want   string
+    }{
+        {"authenticated user", "user_1", "user:user_1"},
+        {"anonymous falls back to the IP", "", "ip:203.0.113.7"},
+    }
+    key := UserOrIPKey(RemoteIPKey)
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := newKeyRequest("203.0.113.7:41000", "")
+            if tt.userID != "" {
+                r = r.WithContext(handlers.ContextWithUser(r.Context(), tt.userID))
+            }
+            if got := key(r); got != tt.want {
+                t.Errorf("key = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestForwardedIPKey(t *testing.T) {
+    key, err := ForwardedIPKey([]string{"10.0.0.1", "192.168.0.0/16"})
+    if err != nil {
+        t.Fatalf("ForwardedIPKey: %v", err)
+    }
+    tests := []struct {
+        name         string
+        remote       string
+        forwardedFor string
+        want         string
+    }{
+        {"untrusted remote ignores the header", "203.0.113.7:41000", "198.51.100.1", "203.0.113.7"},
+        {"trusted proxy without a header", "10.0.0.1:41000", "", "10.0.0.1"},
+        {"trusted proxy takes the rightmost untrusted hop", "10.0.0.1:41000", "198.51.100.1, 192.168.1.5", "198.51.100.1"},
+        {"spoofed leftmost entry is passed over", "10.0.0.1:41000", "1.2.3.4, 198.51.100.1, 192.168.1.5", "198.51.100.1"},
+        {"malformed hop stops the walk", "10.0.0.1:41000", "198.51.100.1, not-an-ip, 192.168.1.5", "192.168.1.5"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := key(newKeyRequest(tt.remote, tt.forwardedFor)); got != tt.want {
+                t.Errorf("key = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestForwardedIPKeyRejectsInvalidProxy(t *testing.T) {
+    if _, err := ForwardedIPKey([]string{"not-a-proxy"}); err == nil {
+        t.Error("ForwardedIPKey accepted an invalid trusted proxy")
+    }
+}
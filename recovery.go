@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/handlers"
+)
+
+// RecoveryMiddleware turns a panic in a downstream handler into a 500 JSON
+// error instead of a crashed server. The panic value and stack are logged
+// with the request ID; the client only sees a generic message. Panics with
+// http.ErrAbortHandler are passed on so net/http can abort the response as
+// intended.
+func RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if err, ok := recovered.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(recovered)
+			}
+
+			handlers.Logger(r.Context()).Error("Recovered from panic",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(recovered),
+				"stack", string(debug.Stack()),
+			)
+			handlers.WriteJSONError(w, http.StatusInternalServerError, handlers.ErrCodeInternal, "Internal server error")
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,1859 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"flash-sale-service/internal/breaker"
+	"flash-sale-service/internal/errs"
+	"flash-sale-service/internal/metrics"
+	"flash-sale-service/internal/models"
+)
+
+// ctx is the context of the commands that don't take one of their own.
+// Commands on the checkout, purchase, idempotency and queue paths take the
+// request's context instead, so they stop with it.
+var ctx = context.Background()
+
+// saleKeyGrace keeps a sale's keys around for a while after it ends so late
+// reads and reconciliation still see its final state
+const saleKeyGrace = time.Hour
+
+var (
+	// ErrCheckoutNotFound is returned when a checkout code is unknown or expired
+	ErrCheckoutNotFound = errs.New(errs.ErrInvalidCheckoutCode, "checkout session not found")
+
+	// ErrSaleNotInitialized is returned when a sale has no inventory in Redis
+	ErrSaleNotInitialized = errors.New("sale inventory not initialized")
+
+	// ErrUserLimitReached is returned when a user already bought their share of a sale
+	ErrUserLimitReached = errs.New(errs.ErrUserLimitReached, "user purchase limit exceeded")
+
+	// ErrCheckoutUsed is returned when a checkout code already completed a
+	// purchase
+	ErrCheckoutUsed = errs.New(errs.ErrCheckoutUsed, "checkout code already used")
+
+	// ErrCheckoutNotOwned is returned when a user acts on another user's checkout
+	ErrCheckoutNotOwned = errors.New("checkout session belongs to another user")
+
+	// ErrSaleCancelled is returned when purchasing from a cancelled sale
+	ErrSaleCancelled = errs.New(errs.ErrSaleEnded, "sale has been cancelled")
+
+	// ErrSaleEnded is returned when purchasing from a sale past its end time
+	ErrSaleEnded = errs.New(errs.ErrSaleEnded, "sale has ended")
+
+	// ErrSoldOut is returned when purchasing an item with no stock left
+	ErrSoldOut = errs.New(errs.ErrSoldOut, "item sold out")
+
+	// ErrNegativeStock is returned when a stock adjustment would leave an
+	// item with less than nothing
+	ErrNegativeStock = errors.New("stock cannot go below zero")
+
+	// ErrNotQueued is returned when a user asks about their place in an
+	// item's reservation queue without holding one, or after it lapsed
+	ErrNotQueued = errors.New("not in the item's reservation queue")
+
+	// ErrRedisUnavailable is returned without touching the network while the
+	// health check has Redis marked down
+	ErrRedisUnavailable = errs.New(errs.ErrUnavailable, "redis unavailable")
+)
+
+// transientReplies are the prefixes of Redis error replies that pass on their
+// own, sent while a server loads its data or a failover is under way
+var transientReplies = []string{"LOADING", "READONLY", "MASTERDOWN", "TRYAGAIN", "CLUSTERDOWN", "BUSY "}
+
+// IsTransient reports whether err may pass if the command is tried again:
+// Redis is marked unavailable, the connection failed or timed out, or the
+// server is loading or failing over. Script and type errors are permanent.
+func IsTransient(err error) bool {
+	if errors.Is(err, ErrRedisUnavailable) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var replyErr redis.Error
+	if errors.As(err, &replyErr) {
+		for _, prefix := range transientReplies {
+			if strings.HasPrefix(replyErr.Error(), prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Config holds the Redis connection settings
+type Config struct {
+	Addr     string
+	Password string
+	DB       int
+}
+
+// ConnectRedis connects to the Redis server described by cfg and checks that
+// it answers
+func ConnectRedis(cfg Config) (*Client, error) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("failed to reach redis at %s: %w", cfg.Addr, err)
+	}
+
+	return &Client{Client: rdb}, nil
+}
+
+// DefaultPipelineBatchSize is how many commands are sent per pipeline when
+// seeding a sale
+const DefaultPipelineBatchSize = 1000
+
+// Client wraps the go-redis client with flash sale specific operations
+type Client struct {
+	*redis.Client
+
+	// PipelineBatchSize caps the commands per pipeline round-trip during bulk
+	// writes; zero uses DefaultPipelineBatchSize
+	PipelineBatchSize int
+
+	// Breaker, when set with EnableCircuitBreaker, fails commands fast while
+	// Redis is unreachable
+	Breaker *breaker.Breaker
+
+	// unavailable is set by the health check while Redis can't be reached
+	unavailable atomic.Bool
+}
+
+// EnableCircuitBreaker routes every command through b. Commands return
+// breaker.ErrOpen without touching the network while it is open.
+func (c *Client) EnableCircuitBreaker(b *breaker.Breaker) {
+	c.Breaker = b
+	c.AddHook(breakerHook{b})
+}
+
+// breakerHook feeds command outcomes to a circuit breaker
+type breakerHook struct {
+	breaker *breaker.Breaker
+}
+
+// connectivityError reports whether err means Redis could not be reached, as
+// opposed to a miss or an error reply the server sent back
+func connectivityError(err error) error {
+	var replyErr redis.Error
+	if err == nil || err == redis.Nil || errors.As(err, &replyErr) {
+		return nil
+	}
+	return err
+}
+
+func (h breakerHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, h.breaker.Allow()
+}
+
+func (h breakerHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.record(cmd.Err())
+	return nil
+}
+
+// record feeds err to the breaker. A command turned away by the health check
+// never reached Redis, and one whose caller gave up says nothing about it,
+// so their slot is handed back instead of counted.
+func (h breakerHook) record(err error) {
+	switch {
+	case err == breaker.ErrOpen:
+	case errors.Is(err, ErrRedisUnavailable), errors.Is(err, context.Canceled):
+		h.breaker.Abandon()
+	default:
+		h.breaker.Record(connectivityError(err))
+	}
+}
+
+func (h breakerHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, h.breaker.Allow()
+}
+
+func (h breakerHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if err = cmd.Err(); err != nil {
+			break
+		}
+	}
+	h.record(err)
+	return nil
+}
+
+// Reconnect backoff bounds for the health check while Redis is down
+const (
+	reconnectMinBackoff = 100 * time.Millisecond
+	reconnectMaxBackoff = 10 * time.Second
+)
+
+// Healthy reports whether the last health check reached Redis
+func (c *Client) Healthy() bool {
+	return !c.unavailable.Load()
+}
+
+// StartHealthCheck pings Redis every interval until ctx is done. When a ping
+// fails the client is marked unhealthy and every command except PING returns
+// ErrRedisUnavailable at once, rather than each request waiting on a dial
+// timeout. Pings then retry with exponential backoff from
+// reconnectMinBackoff to reconnectMaxBackoff; go-redis redials its pool on
+// the next command, so the first ping that gets through marks the client
+// healthy again.
+func (c *Client) StartHealthCheck(ctx context.Context, interval time.Duration) {
+	c.AddHook(healthHook{c})
+
+	go func() {
+		backoff := reconnectMinBackoff
+		for {
+			wait := interval
+			if !c.Healthy() {
+				wait = backoff
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			err := c.Client.Ping(pingCtx).Err()
+			cancel()
+
+			switch {
+			case err != nil && c.Healthy():
+				c.unavailable.Store(true)
+				slog.Error("Redis unreachable, failing commands until it recovers", "error", err)
+			case err != nil:
+				backoff *= 2
+				if backoff > reconnectMaxBackoff {
+					backoff = reconnectMaxBackoff
+				}
+			case !c.Healthy():
+				c.unavailable.Store(false)
+				backoff = reconnectMinBackoff
+				slog.Info("Redis reachable again")
+			}
+		}
+	}()
+}
+
+// healthHook turns commands away while the health check has Redis marked
+// down. PING is let through so the health check and readiness probe see the
+// real state.
+type healthHook struct {
+	client *Client
+}
+
+func (h healthHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if cmd.Name() != "ping" && !h.client.Healthy() {
+		return ctx, ErrRedisUnavailable
+	}
+	return ctx, nil
+}
+
+func (h healthHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h healthHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if !h.client.Healthy() {
+		return ctx, ErrRedisUnavailable
+	}
+	return ctx, nil
+}
+
+func (h healthHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// Ping checks connectivity to Redis
+func (c *Client) Ping() error {
+	return c.Client.Ping(ctx).Err()
+}
+
+// Key helpers
+func itemStockKey(itemID string) string {
+	return fmt.Sprintf("item:%s:stock", itemID)
+}
+
+func itemReservationsKey(itemID string) string {
+	return fmt.Sprintf("item:%s:reservations", itemID)
+}
+
+func saleKey(saleID string) string {
+	return fmt.Sprintf("sale:%s", saleID)
+}
+
+func saleSoldKey(saleID string) string {
+	return fmt.Sprintf("sale:%s:sold", saleID)
+}
+
+func saleInventoryKey(saleID string) string {
+	return fmt.Sprintf("sale:%s:inventory", saleID)
+}
+
+// saleVersionKey counts the changes to a sale's item stock. Every script that
+// moves stock, either way, increments it while it exists, so unlike the sold
+// count it never repeats a value for two different states of the stock.
+// Reservations don't change stock, so checkouts opening, lapsing or being
+// cancelled leave it alone.
+func saleVersionKey(saleID string) string {
+	return fmt.Sprintf("sale:%s:version", saleID)
+}
+
+func saleBuyersKey(saleID string) string {
+	return fmt.Sprintf("sale:%s:buyers", saleID)
+}
+
+func saleUserCountKey(saleID, userID string) string {
+	return fmt.Sprintf("sale:%s:user:%s:count", saleID, userID)
+}
+
+func lockKey(name string) string {
+	return fmt.Sprintf("lock:%s", name)
+}
+
+func idempotencyKey(key string) string {
+	return fmt.Sprintf("idempotency:%s", key)
+}
+
+const (
+	queueHeadKey = "queue:head"
+	queueTailKey = "queue:tail"
+)
+
+func queueTokenUsedKey(tokenID string) string {
+	return fmt.Sprintf("queue:used:%s", tokenID)
+}
+
+// inventoryChannel carries the IDs of sales whose inventory just changed
+const inventoryChannel = "inventory:updates"
+
+func checkoutKey(code string) string {
+	return fmt.Sprintf("checkout:%s", code)
+}
+
+// checkoutUsedTTL is how long a purchased checkout code is remembered, longer
+// than any code stays valid; after that its own expiry rejects it
+const checkoutUsedTTL = models.MaxCheckoutTTL
+
+func checkoutUsedKey(code string) string {
+	return fmt.Sprintf("checkout:used:%s", code)
+}
+
+// activeCheckoutsKey is a sorted set of every open checkout code scored by its
+// expiry, so the number of live reservations can be read without a scan
+const activeCheckoutsKey = "checkouts:active"
+
+// userCheckoutsKey is a sorted set of a user's open checkout codes scored by
+// their expiry, so a user's reservations can be listed without a scan
+func userCheckoutsKey(userID string) string {
+	return fmt.Sprintf("checkouts:user:%s", userID)
+}
+
+// Purchases are counted in purchaseBucket wide buckets, kept for as long as
+// the longest window RecentPurchases is asked about
+const (
+	purchaseBucket    = 10 * time.Second
+	purchaseBucketTTL = time.Hour + purchaseBucket
+)
+
+func purchaseBucketKey(bucket int64) string {
+	return fmt.Sprintf("stats:purchases:%d", bucket)
+}
+
+// MaxSalePurchaseWindow is the longest window SalePurchaseRates measures
+// over. Each sale's purchases are counted in one second buckets kept that
+// long, plus the bucket the window is sliding out of.
+const MaxSalePurchaseWindow = time.Minute
+
+const salePurchaseBucketTTL = MaxSalePurchaseWindow + 2*time.Second
+
+func salePurchaseBucketKey(saleID string, second int64) string {
+	return fmt.Sprintf("stats:sale:%s:purchases:%d", saleID, second)
+}
+
+// reserveScript holds one unit of an item for a checkout. Reservations live in
+// a sorted set scored by their expiry so lapsed holds are pruned before the
+// remaining stock is compared, which keeps two checkouts from both claiming
+// the last unit.
+//
+// KEYS[1] item stock, KEYS[2] item reservations, KEYS[3] checkout session,
+// KEYS[4] active checkouts, KEYS[5] user checkouts
+// ARGV[1] now (ms), ARGV[2] expires at (ms), ARGV[3] ttl (ms), ARGV[4] code,
+// ARGV[5] user ID, ARGV[6] item ID, ARGV[7] sale ID
+var reserveScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+local stock = tonumber(redis.call('GET', KEYS[1]) or '0')
+if redis.call('ZCARD', KEYS[2]) >= stock then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[4])
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+redis.call('HSET', KEYS[3], 'user_id', ARGV[5], 'item_id', ARGV[6], 'sale_id', ARGV[7], 'expires_at', ARGV[2])
+redis.call('PEXPIRE', KEYS[3], ARGV[3])
+redis.call('ZADD', KEYS[4], ARGV[2], ARGV[4])
+redis.call('ZADD', KEYS[5], ARGV[2], ARGV[4])
+if redis.call('PTTL', KEYS[5]) < tonumber(ARGV[3]) then
+	redis.call('PEXPIRE', KEYS[5], ARGV[3])
+end
+return 1
+`)
+
+// ReserveItem places a soft hold on an item under the given checkout code
+// until expiresAt. It returns false when the item is already reserved or sold
+// out. Inventory is only decremented once the checkout is purchased.
+func (c *Client) ReserveItem(ctx context.Context, code, saleID, userID, itemID string, expiresAt time.Time) (bool, error) {
+	now := time.Now()
+	ttl := expiresAt.Sub(now)
+
+	reserved, err := reserveScript.Run(ctx, c.Client,
+		[]string{itemStockKey(itemID), itemReservationsKey(itemID), checkoutKey(code), activeCheckoutsKey, userCheckoutsKey(userID)},
+		now.UnixMilli(), expiresAt.UnixMilli(), ttl.Milliseconds(), code, userID, itemID, saleID,
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to reserve item %s: %w", itemID, err)
+	}
+
+	return reserved == 1, nil
+}
+
+// A hot item's reservation queue is a sorted set of the waiting users scored
+// by arrival number, with a second set scoring the same users by when their
+// place lapses unless they ask after it again. Both go, with the arrival
+// counter, once the queue has been idle for itemQueueTTL.
+const itemQueueTTL = time.Hour
+
+func itemQueueKey(itemID string) string {
+	return fmt.Sprintf("item:%s:queue", itemID)
+}
+
+func itemQueueLeasesKey(itemID string) string {
+	return fmt.Sprintf("item:%s:queue:leases", itemID)
+}
+
+func itemQueueSeqKey(itemID string) string {
+	return fmt.Sprintf("item:%s:queue:seq", itemID)
+}
+
+// claimQueuedScript asks for a user's reservation from a hot item's queue,
+// adding them at the back first when join is set. Users whose place lapsed
+// are dropped before anything else, so whoever is left moves up. The user is
+// reserved the item, exactly as reserveScript would, only once fewer users
+// are ahead of them than there are free units; otherwise their place is
+// renewed and the number ahead returned. A sold out item empties the user's
+// place.
+//
+// KEYS[1] queue, KEYS[2] queue leases, KEYS[3] queue arrivals, KEYS[4] item
+// stock, KEYS[5] item reservations, KEYS[6] checkout session, KEYS[7] active
+// checkouts, KEYS[8] user checkouts
+// ARGV[1] now (ms), ARGV[2] expires at (ms), ARGV[3] ttl (ms), ARGV[4] code,
+// ARGV[5] user ID, ARGV[6] item ID, ARGV[7] sale ID, ARGV[8] lease until (ms),
+// ARGV[9] queue ttl (ms), ARGV[10] join ("1" or "0")
+//
+// Returns {1, 0} reserved, {0, ahead} waiting, {-1, 0} not queued or
+// {-2, 0} sold out
+var claimQueuedScript = redis.NewScript(`
+local lapsed = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, 1000)
+if #lapsed > 0 then
+	redis.call('ZREM', KEYS[1], unpack(lapsed))
+	redis.call('ZREM', KEYS[2], unpack(lapsed))
+end
+
+local rank = redis.call('ZRANK', KEYS[1], ARGV[5])
+if not rank then
+	if ARGV[10] ~= '1' then
+		return {-1, 0}
+	end
+	redis.call('ZADD', KEYS[1], redis.call('INCR', KEYS[3]), ARGV[5])
+	rank = redis.call('ZRANK', KEYS[1], ARGV[5])
+end
+redis.call('ZADD', KEYS[2], ARGV[8], ARGV[5])
+for i = 1, 3 do
+	redis.call('PEXPIRE', KEYS[i], ARGV[9])
+end
+
+redis.call('ZREMRANGEBYSCORE', KEYS[5], '-inf', ARGV[1])
+local stock = tonumber(redis.call('GET', KEYS[4]) or '0')
+if stock <= 0 then
+	redis.call('ZREM', KEYS[1], ARGV[5])
+	redis.call('ZREM', KEYS[2], ARGV[5])
+	return {-2, 0}
+end
+if rank >= stock - redis.call('ZCARD', KEYS[5]) then
+	return {0, rank}
+end
+
+redis.call('ZADD', KEYS[5], ARGV[2], ARGV[4])
+redis.call('PEXPIRE', KEYS[5], ARGV[3])
+redis.call('HSET', KEYS[6], 'user_id', ARGV[5], 'item_id', ARGV[6], 'sale_id', ARGV[7], 'expires_at', ARGV[2])
+redis.call('PEXPIRE', KEYS[6], ARGV[3])
+redis.call('ZADD', KEYS[7], ARGV[2], ARGV[4])
+redis.call('ZADD', KEYS[8], ARGV[2], ARGV[4])
+if redis.call('PTTL', KEYS[8]) < tonumber(ARGV[3]) then
+	redis.call('PEXPIRE', KEYS[8], ARGV[3])
+end
+redis.call('ZREM', KEYS[1], ARGV[5])
+redis.call('ZREM', KEYS[2], ARGV[5])
+return {1, 0}
+`)
+
+// ClaimQueuedItem asks for userID's reservation of a hot item from its queue,
+// joining at the back first if join is set. When the user's turn has come and
+// a unit is free, the item is reserved under code until expiresAt, as
+// ReserveItem does, and the user leaves the queue. Otherwise it returns false
+// with how many users are ahead, and the user keeps their place until
+// leaseUntil; asking again renews it. It returns ErrNotQueued for a user
+// without a place when join isn't set, and ErrSoldOut once the item has no
+// stock left.
+func (c *Client) ClaimQueuedItem(ctx context.Context, code, saleID, userID, itemID string, expiresAt, leaseUntil time.Time, join bool) (bool, int, error) {
+	now := time.Now()
+	ttl := expiresAt.Sub(now)
+	joinArg := "0"
+	if join {
+		joinArg = "1"
+	}
+
+	result, err := claimQueuedScript.Run(ctx, c.Client,
+		[]string{
+			itemQueueKey(itemID), itemQueueLeasesKey(itemID), itemQueueSeqKey(itemID),
+			itemStockKey(itemID), itemReservationsKey(itemID), checkoutKey(code), activeCheckoutsKey, userCheckoutsKey(userID),
+		},
+		now.UnixMilli(), expiresAt.UnixMilli(), ttl.Milliseconds(), code, userID, itemID, saleID,
+		leaseUntil.UnixMilli(), itemQueueTTL.Milliseconds(), joinArg,
+	).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to claim queued item %s: %w", itemID, err)
+	}
+
+	switch result[0] {
+	case 1:
+		return true, 0, nil
+	case -1:
+		return false, 0, ErrNotQueued
+	case -2:
+		return false, 0, ErrSoldOut
+	}
+	return false, int(result[1]), nil
+}
+
+// LeaveItemQueue gives up userID's place in a hot item's queue. Leaving a
+// queue the user isn't in does nothing.
+func (c *Client) LeaveItemQueue(ctx context.Context, userID, itemID string) error {
+	_, err := c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, itemQueueKey(itemID), userID)
+		pipe.ZRem(ctx, itemQueueLeasesKey(itemID), userID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to leave queue for item %s: %w", itemID, err)
+	}
+	return nil
+}
+
+// GetCheckoutSession returns the user and item held by a checkout code
+func GetCheckoutSession(ctx context.Context, c *Client, code string) (string, string, error) {
+	session, err := c.HGetAll(ctx, checkoutKey(code)).Result()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get checkout session: %w", err)
+	}
+
+	if len(session) == 0 {
+		used, err := c.Exists(ctx, checkoutUsedKey(code)).Result()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get checkout session: %w", err)
+		}
+		if used > 0 {
+			return "", "", ErrCheckoutUsed
+		}
+		return "", "", ErrCheckoutNotFound
+	}
+
+	if expiresAt, err := strconv.ParseInt(session["expires_at"], 10, 64); err == nil && time.Now().UnixMilli() >= expiresAt {
+		return "", "", ErrCheckoutNotFound
+	}
+
+	return session["user_id"], session["item_id"], nil
+}
+
+// cancelScript releases a checkout's reservation and ends the session in one
+// step. Purchases delete the session in the same step that takes the stock, so
+// a cancel racing a purchase either finds the session and wins or finds it
+// gone.
+//
+// KEYS[1] checkout session, KEYS[2] item reservations, KEYS[3] active checkouts,
+// KEYS[4] user checkouts
+// ARGV[1] checkout code, ARGV[2] user ID
+//
+// Returns 1 when cancelled, 0 when the session is gone and -1 when it belongs
+// to another user.
+var cancelScript = redis.NewScript(`
+local owner = redis.call('HGET', KEYS[1], 'user_id')
+if not owner then
+	return 0
+end
+if owner ~= ARGV[2] then
+	return -1
+end
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('ZREM', KEYS[4], ARGV[1])
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// CancelCheckout releases the reservation held by a user's checkout code so
+// the item can be reserved again straight away. It returns ErrCheckoutNotFound
+// when the code is unknown, expired or already purchased and
+// ErrCheckoutNotOwned when it belongs to someone else.
+func (c *Client) CancelCheckout(ctx context.Context, code, userID string) error {
+	_, itemID, err := GetCheckoutSession(ctx, c, code)
+	if err != nil {
+		return err
+	}
+
+	result, err := cancelScript.Run(ctx, c.Client,
+		[]string{checkoutKey(code), itemReservationsKey(itemID), activeCheckoutsKey, userCheckoutsKey(userID)},
+		code, userID,
+	).Int()
+	if err != nil {
+		return fmt.Errorf("failed to cancel checkout for item %s: %w", itemID, err)
+	}
+
+	switch result {
+	case -1:
+		return ErrCheckoutNotOwned
+	case 0:
+		return ErrCheckoutNotFound
+	}
+	return nil
+}
+
+// CleanupExpiredCheckouts releases every reservation whose checkout has
+// expired and returns how many it released. Reservations hold stock without
+// taking it, so releasing one just stops it counting against its item. A
+// purchase removes its reservation in the same step that takes the stock, so a
+// checkout that was bought is never released a second time.
+func (c *Client) CleanupExpiredCheckouts() (int, error) {
+	batchSize := c.PipelineBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultPipelineBatchSize
+	}
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	if err := c.ZRemRangeByScore(ctx, activeCheckoutsKey, "-inf", now).Err(); err != nil {
+		return 0, fmt.Errorf("failed to prune active checkouts: %w", err)
+	}
+
+	released := 0
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(ctx, cursor, itemReservationsKey("*"), int64(batchSize)).Result()
+		if err != nil {
+			return released, fmt.Errorf("failed to scan reservations: %w", err)
+		}
+
+		if len(keys) > 0 {
+			cmds := make([]*redis.IntCmd, len(keys))
+			_, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i, key := range keys {
+					cmds[i] = pipe.ZRemRangeByScore(ctx, key, "-inf", now)
+				}
+				return nil
+			})
+			if err != nil {
+				return released, fmt.Errorf("failed to release expired reservations: %w", err)
+			}
+			for _, cmd := range cmds {
+				released += int(cmd.Val())
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return released, nil
+		}
+	}
+}
+
+// ReleaseAllReservations releases every open checkout in a sale straight
+// away instead of leaving them to expire, and returns how many it released.
+// Each is released the way a cancel would, so a checkout that expires or is
+// purchased meanwhile is simply skipped and never counted twice. Codes
+// reserved while it runs may be missed.
+func (c *Client) ReleaseAllReservations(saleID string) (int, error) {
+	batchSize := c.PipelineBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultPipelineBatchSize
+	}
+
+	released := 0
+	var cursor uint64
+	for {
+		entries, next, err := c.ZScan(ctx, activeCheckoutsKey, cursor, "", int64(batchSize)).Result()
+		if err != nil {
+			return released, fmt.Errorf("failed to scan active checkouts: %w", err)
+		}
+
+		// ZSCAN returns members and scores alternately
+		codes := make([]string, 0, len(entries)/2)
+		for i := 0; i < len(entries); i += 2 {
+			codes = append(codes, entries[i])
+		}
+
+		sessions := make([]*redis.SliceCmd, len(codes))
+		_, err = c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, code := range codes {
+				sessions[i] = pipe.HMGet(ctx, checkoutKey(code), "sale_id", "user_id", "item_id")
+			}
+			return nil
+		})
+		if err != nil {
+			return released, fmt.Errorf("failed to load checkout sessions: %w", err)
+		}
+
+		var results []*redis.Cmd
+		_, err = c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, code := range codes {
+				fields := sessions[i].Val()
+				if len(fields) != 3 || fields[0] != saleID {
+					continue
+				}
+				userID, _ := fields[1].(string)
+				itemID, _ := fields[2].(string)
+				results = append(results, cancelScript.Eval(ctx, pipe,
+					[]string{checkoutKey(code), itemReservationsKey(itemID), activeCheckoutsKey, userCheckoutsKey(userID)},
+					code, userID,
+				))
+			}
+			return nil
+		})
+		if err != nil {
+			return released, fmt.Errorf("failed to release reservations for sale %s: %w", saleID, err)
+		}
+		for _, result := range results {
+			if n, _ := result.Int(); n == 1 {
+				released++
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return released, nil
+		}
+	}
+}
+
+// UserCheckout is an open checkout held by a user
+type UserCheckout struct {
+	Code      string
+	SaleID    string
+	ItemID    string
+	ExpiresAt time.Time
+}
+
+// GetUserCheckouts returns the user's open checkouts, soonest to expire
+// first. Checkouts that were purchased or cancelled leave the index in the
+// same step that ends them; expired ones are pruned here, and any whose
+// session has gone anyway are dropped.
+func (c *Client) GetUserCheckouts(userID string) ([]UserCheckout, error) {
+	key := userCheckoutsKey(userID)
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	if err := c.ZRemRangeByScore(ctx, key, "-inf", now).Err(); err != nil {
+		return nil, fmt.Errorf("failed to prune checkouts for user %s: %w", userID, err)
+	}
+
+	codes, err := c.ZRangeWithScores(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkouts for user %s: %w", userID, err)
+	}
+	if len(codes) == 0 {
+		return []UserCheckout{}, nil
+	}
+
+	cmds := make([]*redis.StringStringMapCmd, len(codes))
+	_, err = c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, code := range codes {
+			cmds[i] = pipe.HGetAll(ctx, checkoutKey(code.Member.(string)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load checkouts for user %s: %w", userID, err)
+	}
+
+	checkouts := make([]UserCheckout, 0, len(codes))
+	for i, code := range codes {
+		session := cmds[i].Val()
+		if len(session) == 0 || session["user_id"] != userID {
+			continue
+		}
+		checkouts = append(checkouts, UserCheckout{
+			Code:      code.Member.(string),
+			SaleID:    session["sale_id"],
+			ItemID:    session["item_id"],
+			ExpiresAt: time.UnixMilli(int64(code.Score)),
+		})
+	}
+	return checkouts, nil
+}
+
+// HasUserPurchased reports whether the user has bought anything in the sale
+func (c *Client) HasUserPurchased(ctx context.Context, saleID, userID string) (bool, error) {
+	purchased, err := c.SIsMember(ctx, saleBuyersKey(saleID), userID).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check buyers for sale %s: %w", saleID, err)
+	}
+	return purchased, nil
+}
+
+// decrementScript enforces the per-user limit and takes one unit of stock in
+// a single step, so parallel requests from the same user cannot both pass the
+// limit check before either is recorded. The checkout session is consumed in
+// the same step so it can't be cancelled or purchased again, and the code is
+// remembered as used so a replay is told so instead of treated as expired.
+// Redis runs each
+// script to completion before the next command, and stock is only decremented
+// after the script itself has read it as positive, so however many buyers race
+// for an item's last unit exactly one gets it and stock never goes below zero.
+//
+// KEYS[1] item stock, KEYS[2] item reservations, KEYS[3] sale buyers,
+// KEYS[4] user purchase count, KEYS[5] sale inventory, KEYS[6] sale sold count,
+// KEYS[7] checkout session, KEYS[8] sale, KEYS[9] active checkouts,
+// KEYS[10] checkout used marker, KEYS[11] user checkouts, KEYS[12] sale
+// inventory version
+// ARGV[1] user ID, ARGV[2] checkout code, ARGV[3] max items per user,
+// ARGV[4] current Unix time, ARGV[5] used marker TTL in seconds
+//
+// Returns the item's stock before the decrement, 0 when sold out, or a
+// negative rejection.
+var decrementScript = redis.NewScript(`
+if redis.call('HGET', KEYS[8], 'cancelled') then
+	return -3
+end
+local ends = tonumber(redis.call('HGET', KEYS[8], 'end_time') or '0')
+if ends > 0 and tonumber(ARGV[4]) >= ends then
+	if redis.call('EXISTS', KEYS[7]) == 1 then
+		redis.call('ZREM', KEYS[2], ARGV[2])
+		redis.call('ZREM', KEYS[9], ARGV[2])
+		redis.call('ZREM', KEYS[11], ARGV[2])
+		redis.call('DEL', KEYS[7])
+	end
+	return -4
+end
+if redis.call('EXISTS', KEYS[7]) == 0 then
+	if redis.call('EXISTS', KEYS[10]) == 1 then
+		return -5
+	end
+	return -2
+end
+local count = tonumber(redis.call('GET', KEYS[4]) or '0')
+if count >= tonumber(ARGV[3]) then
+	return -1
+end
+local stock = tonumber(redis.call('GET', KEYS[1]) or '0')
+if stock <= 0 then
+	return 0
+end
+redis.call('DECR', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[2])
+redis.call('ZREM', KEYS[9], ARGV[2])
+redis.call('ZREM', KEYS[11], ARGV[2])
+redis.call('DEL', KEYS[7])
+redis.call('SET', KEYS[10], 1, 'EX', ARGV[5])
+redis.call('INCR', KEYS[4])
+redis.call('SADD', KEYS[3], ARGV[1])
+if redis.call('EXISTS', KEYS[5]) == 1 then
+	redis.call('DECR', KEYS[5])
+end
+redis.call('INCR', KEYS[6])
+if redis.call('EXISTS', KEYS[12]) == 1 then
+	redis.call('INCR', KEYS[12])
+end
+return stock
+`)
+
+// DecrementInventory atomically takes one unit of an item for a user and
+// releases the checkout reservation that was holding it. It returns the
+// item's stock before the decrement, for the audit trail, or ErrSoldOut when
+// the item has none left, ErrUserLimitReached when the user is at the cap,
+// ErrCheckoutUsed when the code already completed a purchase,
+// ErrCheckoutNotFound when the checkout was cancelled or has expired and
+// ErrSaleCancelled when the sale was. Past the sale's end time it takes
+// nothing, releases the reservation and returns ErrSaleEnded.
+func DecrementInventory(ctx context.Context, c *Client, saleID, userID, itemID, code string, maxPerUser int) (int, error) {
+	defer metrics.ObserveSince(metrics.InventoryDecrementDuration, time.Now())
+
+	result, err := decrementScript.Run(ctx, c.Client,
+		[]string{itemStockKey(itemID), itemReservationsKey(itemID), saleBuyersKey(saleID), saleUserCountKey(saleID, userID), saleInventoryKey(saleID), saleSoldKey(saleID), checkoutKey(code), saleKey(saleID), activeCheckoutsKey, checkoutUsedKey(code), userCheckoutsKey(userID), saleVersionKey(saleID)},
+		userID, code, maxPerUser, time.Now().Unix(), int(checkoutUsedTTL/time.Second),
+	).Int()
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrement inventory for item %s: %w", itemID, err)
+	}
+
+	switch result {
+	case 0:
+		return 0, ErrSoldOut
+	case -5:
+		return 0, ErrCheckoutUsed
+	case -4:
+		return 0, ErrSaleEnded
+	case -3:
+		return 0, ErrSaleCancelled
+	case -2:
+		return 0, ErrCheckoutNotFound
+	case -1:
+		return 0, ErrUserLimitReached
+	}
+	return result, nil
+}
+
+// bulkDecrementScript takes one unit of each item in a bundle for a user, or
+// nothing at all. The per-user limit applies to the whole bundle. As with
+// decrementScript, each code is remembered as used so a replayed bundle is
+// told so instead of treated as expired.
+//
+// KEYS[1] sale buyers, KEYS[2] user purchase count, KEYS[3] sale inventory,
+// KEYS[4] sale sold count, KEYS[5] sale, then item stock, item reservations,
+// checkout session and checkout used marker for each item, then active
+// checkouts, user checkouts and sale inventory version
+// ARGV[1] user ID, ARGV[2] max items per user, ARGV[3] used marker TTL in
+// seconds, then the checkout code for each item
+//
+// Returns the overall result (1 taken, 0 some item sold out, -1 limit reached,
+// -2 some checkout gone, -3 sale cancelled, -5 some checkout already used)
+// followed by each item's stock before the decrement, 0 for items that had
+// none.
+var bulkDecrementScript = redis.NewScript(`
+if redis.call('HGET', KEYS[5], 'cancelled') then
+	return {-3}
+end
+local n = #ARGV - 3
+for i = 1, n do
+	if redis.call('EXISTS', KEYS[4 + 4 * i]) == 0 then
+		if redis.call('EXISTS', KEYS[5 + 4 * i]) == 1 then
+			return {-5}
+		end
+		return {-2}
+	end
+end
+local count = tonumber(redis.call('GET', KEYS[2]) or '0')
+if count + n > tonumber(ARGV[2]) then
+	return {-1}
+end
+local result = {1}
+for i = 1, n do
+	local stock = tonumber(redis.call('GET', KEYS[2 + 4 * i]) or '0')
+	if stock <= 0 then
+		result[1] = 0
+		result[i + 1] = 0
+	else
+		result[i + 1] = stock
+	end
+end
+if result[1] == 0 then
+	return result
+end
+for i = 1, n do
+	redis.call('DECR', KEYS[2 + 4 * i])
+	redis.call('ZREM', KEYS[3 + 4 * i], ARGV[3 + i])
+	redis.call('ZREM', KEYS[#KEYS - 2], ARGV[3 + i])
+	redis.call('ZREM', KEYS[#KEYS - 1], ARGV[3 + i])
+	redis.call('DEL', KEYS[4 + 4 * i])
+	redis.call('SET', KEYS[5 + 4 * i], 1, 'EX', ARGV[3])
+end
+redis.call('INCRBY', KEYS[2], n)
+redis.call('SADD', KEYS[1], ARGV[1])
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	redis.call('DECRBY', KEYS[3], n)
+end
+redis.call('INCRBY', KEYS[4], n)
+if redis.call('EXISTS', KEYS[#KEYS]) == 1 then
+	redis.call('INCR', KEYS[#KEYS])
+end
+return result
+`)
+
+// DecrementInventoryBulk atomically takes one unit of every item for a user
+// and releases the checkout reservations holding them, or takes nothing. It
+// reports whether the bundle was taken along with each item's stock before
+// the decrement, 0 for items that had none, and
+// returns ErrUserLimitReached when the bundle would put the user over the cap,
+// ErrCheckoutUsed when any code already completed a purchase,
+// ErrCheckoutNotFound when any checkout was cancelled or has expired and
+// ErrSaleCancelled when the sale was.
+// itemIDs must not repeat and codes[i] must be the checkout for itemIDs[i].
+func (c *Client) DecrementInventoryBulk(ctx context.Context, saleID, userID string, itemIDs, codes []string, maxPerUser int) (bool, []int, error) {
+	defer metrics.ObserveSince(metrics.InventoryDecrementDuration, time.Now())
+
+	keys := []string{saleBuyersKey(saleID), saleUserCountKey(saleID, userID), saleInventoryKey(saleID), saleSoldKey(saleID), saleKey(saleID)}
+	args := []interface{}{userID, maxPerUser, int(checkoutUsedTTL / time.Second)}
+	for i, itemID := range itemIDs {
+		keys = append(keys, itemStockKey(itemID), itemReservationsKey(itemID), checkoutKey(codes[i]), checkoutUsedKey(codes[i]))
+		args = append(args, codes[i])
+	}
+	keys = append(keys, activeCheckoutsKey, userCheckoutsKey(userID), saleVersionKey(saleID))
+
+	result, err := bulkDecrementScript.Run(ctx, c.Client, keys, args...).Int64Slice()
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to decrement inventory for sale %s: %w", saleID, err)
+	}
+
+	switch result[0] {
+	case -5:
+		return false, nil, ErrCheckoutUsed
+	case -3:
+		return false, nil, ErrSaleCancelled
+	case -2:
+		return false, nil, ErrCheckoutNotFound
+	case -1:
+		return false, nil, ErrUserLimitReached
+	}
+
+	stocks := make([]int, len(itemIDs))
+	for i := range stocks {
+		stocks[i] = int(result[i+1])
+	}
+	return result[0] == 1, stocks, nil
+}
+
+// restoreScript gives back what a decrement took for a user, one unit of each
+// item. The checkout sessions the decrement consumed stay gone.
+//
+// KEYS[1] sale buyers, KEYS[2] user purchase count, KEYS[3] sale inventory,
+// KEYS[4] sale sold count, then item stock and checkout used marker for each
+// item, then sale inventory version
+// ARGV[1] user ID
+var restoreScript = redis.NewScript(`
+local n = (#KEYS - 5) / 2
+for i = 1, n do
+	redis.call('INCR', KEYS[3 + 2 * i])
+	redis.call('DEL', KEYS[4 + 2 * i])
+end
+if redis.call('DECRBY', KEYS[2], n) <= 0 then
+	redis.call('DEL', KEYS[2])
+	redis.call('SREM', KEYS[1], ARGV[1])
+end
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	redis.call('INCRBY', KEYS[3], n)
+end
+redis.call('DECRBY', KEYS[4], n)
+if redis.call('EXISTS', KEYS[#KEYS]) == 1 then
+	redis.call('INCR', KEYS[#KEYS])
+end
+return n
+`)
+
+// RestoreInventory undoes a DecrementInventory or DecrementInventoryBulk whose
+// purchase was never written: the items go back in stock and the user's
+// count goes down again, so they can check out anew. codes[i] must be the
+// checkout that took itemIDs[i].
+func (c *Client) RestoreInventory(ctx context.Context, saleID, userID string, itemIDs, codes []string) error {
+	keys := []string{saleBuyersKey(saleID), saleUserCountKey(saleID, userID), saleInventoryKey(saleID), saleSoldKey(saleID)}
+	for i, itemID := range itemIDs {
+		keys = append(keys, itemStockKey(itemID), checkoutUsedKey(codes[i]))
+	}
+	keys = append(keys, saleVersionKey(saleID))
+
+	if err := restoreScript.Run(ctx, c.Client, keys, userID).Err(); err != nil {
+		return fmt.Errorf("failed to restore inventory for sale %s: %w", saleID, err)
+	}
+	return nil
+}
+
+// GetRemainingInventory returns the live number of items left in a sale
+func (c *Client) GetRemainingInventory(saleID string) (int, error) {
+	remaining, err := c.Get(ctx, saleInventoryKey(saleID)).Int()
+	if err == redis.Nil {
+		return 0, ErrSaleNotInitialized
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get inventory for sale %s: %w", saleID, err)
+	}
+	return remaining, nil
+}
+
+// GetItemStocks returns the remaining stock for each of the given items in a
+// single round-trip
+func (c *Client) GetItemStocks(itemIDs []string) (map[string]int, error) {
+	stocks := make(map[string]int, len(itemIDs))
+	if len(itemIDs) == 0 {
+		return stocks, nil
+	}
+
+	keys := make([]string, len(itemIDs))
+	for i, itemID := range itemIDs {
+		keys[i] = itemStockKey(itemID)
+	}
+
+	values, err := c.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get item stock: %w", err)
+	}
+
+	for i, value := range values {
+		stock := 0
+		if str, ok := value.(string); ok {
+			if n, err := strconv.Atoi(str); err == nil {
+				stock = n
+			}
+		}
+		stocks[itemIDs[i]] = stock
+	}
+	return stocks, nil
+}
+
+// AcquireLock takes a distributed lock for ttl. It returns a token that must be
+// passed to ReleaseLock, or an empty token if someone else holds the lock.
+func (c *Client) AcquireLock(name string, ttl time.Duration) (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate lock token: %w", err)
+	}
+	token := hex.EncodeToString(bytes)
+
+	acquired, err := c.SetNX(ctx, lockKey(name), token, ttl).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to acquire lock %s: %w", name, err)
+	}
+	if !acquired {
+		return "", nil
+	}
+	return token, nil
+}
+
+// releaseLockScript deletes a lock, or a used queue token, only if it is
+// still held with our token
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// ReleaseLock releases a lock previously taken with AcquireLock
+func (c *Client) ReleaseLock(name, token string) error {
+	if err := releaseLockScript.Run(ctx, c.Client, []string{lockKey(name)}, token).Err(); err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", name, err)
+	}
+	return nil
+}
+
+// InitializeSale seeds Redis with a sale's metadata and the stock of each of
+// its items. Writes are pipelined so a large sale takes a handful of
+// round-trips; the sale-level keys go last so the sale only looks initialized
+// once every item has stock. Only keys that don't exist yet are written, so
+// running it again for a sale, such as when sale creation is retried, fills
+// in whatever the earlier attempt missed without resetting stock or counters
+// that purchases have already moved.
+func (c *Client) InitializeSale(saleID string, startTime, endTime time.Time, items []models.Item, stockPerItem int) error {
+	expiry := time.Until(endTime.Add(saleKeyGrace))
+
+	// The live inventory is only written if missing, and then has to count
+	// the stock that is actually left rather than the stock it started with
+	inventory := 0
+
+	batchSize := c.PipelineBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultPipelineBatchSize
+	}
+
+	for start := 0; start < len(items); start += batchSize {
+		end := start + batchSize
+		if end > len(items) {
+			end = len(items)
+		}
+
+		set := make([]*redis.BoolCmd, 0, end-start)
+		_, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, item := range items[start:end] {
+				set = append(set, pipe.SetNX(ctx, itemStockKey(item.ItemID), stockPerItem, expiry))
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set stock for items %d-%d: %w", start, end, err)
+		}
+
+		var existing []string
+		for i, cmd := range set {
+			if cmd.Val() {
+				inventory += stockPerItem
+			} else {
+				existing = append(existing, itemStockKey(items[start+i].ItemID))
+			}
+		}
+		if len(existing) == 0 {
+			continue
+		}
+
+		stocks, err := c.MGet(ctx, existing...).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read existing stock for items %d-%d: %w", start, end, err)
+		}
+		for _, value := range stocks {
+			if s, ok := value.(string); ok {
+				stock, _ := strconv.Atoi(s)
+				inventory += stock
+			}
+		}
+	}
+
+	_, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(ctx, saleKey(saleID), "start_time", startTime.Unix())
+		pipe.HSetNX(ctx, saleKey(saleID), "end_time", endTime.Unix())
+		pipe.Expire(ctx, saleKey(saleID), expiry)
+		pipe.SetNX(ctx, saleSoldKey(saleID), 0, expiry)
+		pipe.SetNX(ctx, saleInventoryKey(saleID), inventory, expiry)
+		pipe.SetNX(ctx, saleVersionKey(saleID), 0, expiry)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize sale %s: %w", saleID, err)
+	}
+
+	return nil
+}
+
+// MarkSaleCancelled flags a sale as cancelled so every later purchase against
+// it fails with ErrSaleCancelled. Purchases already past the decrement are
+// unaffected. The flag lives as long as the sale's other keys.
+func (c *Client) MarkSaleCancelled(saleID string, endTime time.Time) error {
+	_, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, saleKey(saleID), "cancelled", 1)
+		pipe.Expire(ctx, saleKey(saleID), time.Until(endTime.Add(saleKeyGrace)))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark sale %s cancelled: %w", saleID, err)
+	}
+	return nil
+}
+
+// FlushSaleInventory deletes a sale's inventory keys: the stock and
+// reservations of each item and the sale's counters, version and buyers. The sale
+// itself, along with its cancelled flag, is kept.
+func (c *Client) FlushSaleInventory(saleID string, itemIDs []string) error {
+	batchSize := c.PipelineBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultPipelineBatchSize
+	}
+
+	for start := 0; start < len(itemIDs); start += batchSize {
+		end := start + batchSize
+		if end > len(itemIDs) {
+			end = len(itemIDs)
+		}
+
+		keys := make([]string, 0, 2*(end-start))
+		for _, itemID := range itemIDs[start:end] {
+			keys = append(keys, itemStockKey(itemID), itemReservationsKey(itemID))
+		}
+		if err := c.Del(ctx, keys...).Err(); err != nil {
+			return fmt.Errorf("failed to flush stock for items %d-%d: %w", start, end, err)
+		}
+	}
+
+	if err := c.Del(ctx, saleInventoryKey(saleID), saleSoldKey(saleID), saleBuyersKey(saleID), saleVersionKey(saleID)).Err(); err != nil {
+		return fmt.Errorf("failed to flush inventory for sale %s: %w", saleID, err)
+	}
+	return nil
+}
+
+// SaleState is the database's record of a sale's purchases, which
+// RehydrateSale rebuilds the sale's Redis keys from
+type SaleState struct {
+	// ItemIDs lists every item in the sale
+	ItemIDs []string
+
+	// PurchasedByItem and PurchasesByUser count purchases per item and per
+	// buyer
+	PurchasedByItem map[string]int
+	PurchasesByUser map[string]int
+}
+
+// RehydrateSale rebuilds a sale's inventory in Redis after the keys were lost,
+// e.g. to a Redis restart. Each item gets its original stock less what was
+// bought, buyers are restored so the per-user limit still holds, and the sale
+// counters start from soldCount. Only missing keys are written, so it is safe
+// to run while the sale is live; anything Redis still has is left alone. It
+// returns how many items had their stock restored.
+func (c *Client) RehydrateSale(sale *models.Sale, soldCount int, state SaleState) (int, error) {
+	if len(state.ItemIDs) == 0 {
+		return 0, fmt.Errorf("sale %s has no items to rehydrate", sale.SaleID)
+	}
+	stockPerItem := sale.TotalItems / len(state.ItemIDs)
+	expiry := time.Until(sale.EndTime.Add(saleKeyGrace))
+
+	batchSize := c.PipelineBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultPipelineBatchSize
+	}
+
+	restored := 0
+	for start := 0; start < len(state.ItemIDs); start += batchSize {
+		end := start + batchSize
+		if end > len(state.ItemIDs) {
+			end = len(state.ItemIDs)
+		}
+
+		cmds := make([]*redis.BoolCmd, 0, end-start)
+		_, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, itemID := range state.ItemIDs[start:end] {
+				stock := stockPerItem - state.PurchasedByItem[itemID]
+				if stock < 0 {
+					stock = 0
+				}
+				cmds = append(cmds, pipe.SetNX(ctx, itemStockKey(itemID), stock, expiry))
+			}
+			return nil
+		})
+		if err != nil {
+			return restored, fmt.Errorf("failed to restore stock for items %d-%d: %w", start, end, err)
+		}
+		for _, cmd := range cmds {
+			if cmd.Val() {
+				restored++
+			}
+		}
+	}
+
+	_, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for userID, count := range state.PurchasesByUser {
+			pipe.SAdd(ctx, saleBuyersKey(sale.SaleID), userID)
+			pipe.SetNX(ctx, saleUserCountKey(sale.SaleID, userID), count, expiry)
+		}
+		pipe.Expire(ctx, saleBuyersKey(sale.SaleID), expiry)
+
+		// HSETNX keeps a cancelled flag, and anything else already there
+		pipe.HSetNX(ctx, saleKey(sale.SaleID), "start_time", sale.StartTime.Unix())
+		pipe.HSetNX(ctx, saleKey(sale.SaleID), "end_time", sale.EndTime.Unix())
+		pipe.Expire(ctx, saleKey(sale.SaleID), expiry)
+		pipe.SetNX(ctx, saleSoldKey(sale.SaleID), soldCount, expiry)
+		pipe.SetNX(ctx, saleInventoryKey(sale.SaleID), sale.TotalItems-soldCount, expiry)
+		// The count of changes was lost with the keys; starting from the
+		// clock puts it past every version handed out before
+		pipe.SetNX(ctx, saleVersionKey(sale.SaleID), time.Now().UnixMilli(), expiry)
+		return nil
+	})
+	if err != nil {
+		return restored, fmt.Errorf("failed to restore sale %s: %w", sale.SaleID, err)
+	}
+
+	return restored, nil
+}
+
+// GetItemStock returns the remaining stock of a single item
+func (c *Client) GetItemStock(itemID string) (int, error) {
+	stock, err := c.Get(ctx, itemStockKey(itemID)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get stock for item %s: %w", itemID, err)
+	}
+	return stock, nil
+}
+
+// adjustStockScript changes an item's stock and its sale's remaining
+// inventory together, so the two never disagree. INCRBY keeps the stock key's
+// expiry.
+//
+// KEYS[1] item stock, KEYS[2] sale inventory, KEYS[3] sale inventory version
+// ARGV[1] "set" or "delta", ARGV[2] the new stock or the change to it
+//
+// Returns the stock before and after, {-1} when the item has no stock and
+// {-2} when the change would take it below zero.
+var adjustStockScript = redis.NewScript(`
+local before = redis.call('GET', KEYS[1])
+if not before then
+	return {-1}
+end
+before = tonumber(before)
+local after = tonumber(ARGV[2])
+if ARGV[1] == 'delta' then
+	after = before + after
+end
+if after < 0 then
+	return {-2}
+end
+if after == before then
+	return {before, after}
+end
+redis.call('INCRBY', KEYS[1], after - before)
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	redis.call('INCRBY', KEYS[2], after - before)
+end
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	redis.call('INCR', KEYS[3])
+end
+return {before, after}
+`)
+
+// adjustStock runs adjustStockScript and returns the stock before and after
+func (c *Client) adjustStock(saleID, itemID, mode string, value int) (int, int, error) {
+	result, err := adjustStockScript.Run(ctx, c.Client,
+		[]string{itemStockKey(itemID), saleInventoryKey(saleID), saleVersionKey(saleID)},
+		mode, value,
+	).Int64Slice()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to adjust stock for item %s: %w", itemID, err)
+	}
+
+	switch result[0] {
+	case -2:
+		return 0, 0, ErrNegativeStock
+	case -1:
+		return 0, 0, ErrSaleNotInitialized
+	}
+	return int(result[0]), int(result[1]), nil
+}
+
+// AdjustItemStock adds delta, which may be negative, to an item's stock and
+// its sale's remaining inventory and returns the new stock. It returns
+// ErrNegativeStock when that would go below zero and ErrSaleNotInitialized
+// when the item has no stock in Redis. Open checkouts keep their holds; a
+// hold that no longer fits is refused at purchase as sold out.
+func (c *Client) AdjustItemStock(saleID, itemID string, delta int) (int, error) {
+	_, after, err := c.adjustStock(saleID, itemID, "delta", delta)
+	return after, err
+}
+
+// SetItemStock replaces an item's stock, moving its sale's remaining
+// inventory by the difference, and returns the stock it replaced. Errors are
+// as for AdjustItemStock.
+func (c *Client) SetItemStock(saleID, itemID string, stock int) (int, error) {
+	before, _, err := c.adjustStock(saleID, itemID, "set", stock)
+	return before, err
+}
+
+// GetItemsSold returns how many units of a sale have been purchased
+func (c *Client) GetItemsSold(ctx context.Context, saleID string) (int, error) {
+	sold, err := c.Get(ctx, saleSoldKey(saleID)).Int()
+	if err == redis.Nil {
+		return 0, ErrSaleNotInitialized
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get sold count for sale %s: %w", saleID, err)
+	}
+	return sold, nil
+}
+
+// GetInventoryVersion returns the version of a sale's item stock, which
+// changes whenever any of it does
+func (c *Client) GetInventoryVersion(saleID string) (int64, error) {
+	version, err := c.Get(ctx, saleVersionKey(saleID)).Int64()
+	if err == redis.Nil {
+		return 0, ErrSaleNotInitialized
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get inventory version for sale %s: %w", saleID, err)
+	}
+	return version, nil
+}
+
+// ActiveCheckouts returns how many checkouts across every sale still hold an
+// item
+func (c *Client) ActiveCheckouts() (int, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	count, err := c.ZCount(ctx, activeCheckoutsKey, "("+now, "+inf").Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count active checkouts: %w", err)
+	}
+	return int(count), nil
+}
+
+// RecordPurchases adds n completed purchases in saleID to the counters behind
+// RecentPurchases and SalePurchaseRates
+func (c *Client) RecordPurchases(ctx context.Context, saleID string, n int) error {
+	now := time.Now().Unix()
+	key := purchaseBucketKey(now / int64(purchaseBucket/time.Second))
+	saleKey := salePurchaseBucketKey(saleID, now)
+	_, err := c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.IncrBy(ctx, key, int64(n))
+		pipe.Expire(ctx, key, purchaseBucketTTL)
+		pipe.IncrBy(ctx, saleKey, int64(n))
+		pipe.Expire(ctx, saleKey, salePurchaseBucketTTL)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record purchases: %w", err)
+	}
+	return nil
+}
+
+// RecentPurchases returns how many purchases were recorded within each of
+// windows, to the nearest ten seconds. Windows longer than an hour are cut
+// to an hour.
+func (c *Client) RecentPurchases(windows ...time.Duration) ([]int, error) {
+	bucketSeconds := int64(purchaseBucket / time.Second)
+	current := time.Now().Unix() / bucketSeconds
+
+	longest := 0
+	buckets := make([]int, len(windows))
+	for i, window := range windows {
+		if window > purchaseBucketTTL-purchaseBucket {
+			window = purchaseBucketTTL - purchaseBucket
+		}
+		buckets[i] = int(window / purchaseBucket)
+		if buckets[i] > longest {
+			longest = buckets[i]
+		}
+	}
+
+	// Newest bucket first, so a window's count is a prefix sum
+	keys := make([]string, longest)
+	for i := range keys {
+		keys[i] = purchaseBucketKey(current - int64(i))
+	}
+
+	counts := make([]int, len(windows))
+	if longest == 0 {
+		return counts, nil
+	}
+
+	values, err := c.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get recent purchases: %w", err)
+	}
+
+	sum := 0
+	sums := make([]int, len(values)+1)
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			n, _ := strconv.Atoi(s)
+			sum += n
+		}
+		sums[i+1] = sum
+	}
+	for i, n := range buckets {
+		counts[i] = sums[n]
+	}
+	return counts, nil
+}
+
+// SalePurchaseRates returns each sale's purchases per second over the
+// sliding window, cut to MaxSalePurchaseWindow. The second the window is
+// sliding out of counts for the part of it still inside, so the rate moves
+// smoothly instead of jumping at each bucket boundary. Every sale is read in
+// one round-trip.
+func (c *Client) SalePurchaseRates(saleIDs []string, window time.Duration) (map[string]float64, error) {
+	rates := make(map[string]float64, len(saleIDs))
+	if window > MaxSalePurchaseWindow {
+		window = MaxSalePurchaseWindow
+	}
+	seconds := int64(window / time.Second)
+	if len(saleIDs) == 0 || seconds < 1 {
+		return rates, nil
+	}
+
+	now := time.Now()
+	current := now.Unix()
+	// Newest bucket first; the last one per sale is the oldest, partly
+	// outside the window
+	keys := make([]string, 0, len(saleIDs)*int(seconds+1))
+	for _, saleID := range saleIDs {
+		for i := int64(0); i <= seconds; i++ {
+			keys = append(keys, salePurchaseBucketKey(saleID, current-i))
+		}
+	}
+
+	values, err := c.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sale purchase rates: %w", err)
+	}
+
+	elapsed := float64(now.UnixNano()%int64(time.Second)) / float64(time.Second)
+	for i, saleID := range saleIDs {
+		sum := 0.0
+		for j := int64(0); j <= seconds; j++ {
+			s, ok := values[i*int(seconds+1)+int(j)].(string)
+			if !ok {
+				continue
+			}
+			n, _ := strconv.Atoi(s)
+			if j == seconds {
+				sum += float64(n) * (1 - elapsed)
+			} else {
+				sum += float64(n)
+			}
+		}
+		rates[saleID] = sum / float64(seconds)
+	}
+	return rates, nil
+}
+
+// PublishInventoryUpdate tells every instance that a sale's inventory changed
+func (c *Client) PublishInventoryUpdate(ctx context.Context, saleID string) error {
+	if err := c.Publish(ctx, inventoryChannel, saleID).Err(); err != nil {
+		return fmt.Errorf("failed to publish inventory update for sale %s: %w", saleID, err)
+	}
+	return nil
+}
+
+// SubscribeInventoryUpdates delivers the sale IDs passed to
+// PublishInventoryUpdate until subCtx is cancelled, then closes the channel
+func (c *Client) SubscribeInventoryUpdates(subCtx context.Context) <-chan string {
+	pubsub := c.Subscribe(subCtx, inventoryChannel)
+	updates := make(chan string, 1)
+
+	go func() {
+		defer close(updates)
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				select {
+				case updates <- msg.Payload:
+				default:
+					// The receiver only needs to know something changed
+				}
+			case <-subCtx.Done():
+				return
+			}
+		}
+	}()
+
+	return updates
+}
+
+// Idempotency record states
+const (
+	IdempotencyNew        = "new"
+	IdempotencyInProgress = "pending"
+	IdempotencyMismatch   = "mismatch"
+	IdempotencyDone       = "done"
+)
+
+// IdempotencyRecord is the stored outcome of a request made with an
+// Idempotency-Key
+type IdempotencyRecord struct {
+	State  string
+	Status int
+	Body   []byte
+}
+
+// beginIdempotencyScript claims an idempotency key for a new request or
+// reports what is already stored under it
+//
+// KEYS[1] idempotency record
+// ARGV[1] request fingerprint, ARGV[2] ttl (ms)
+var beginIdempotencyScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	redis.call('HSET', KEYS[1], 'fingerprint', ARGV[1], 'state', 'pending')
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return {'new'}
+end
+local rec = redis.call('HMGET', KEYS[1], 'fingerprint', 'state', 'status', 'body')
+if rec[1] ~= ARGV[1] then
+	return {'mismatch'}
+end
+if rec[2] ~= 'done' then
+	return {'pending'}
+end
+return {'done', rec[3], rec[4]}
+`)
+
+// BeginIdempotentRequest atomically claims key for a request with the given
+// fingerprint, for ttl while the request is pending. Only the caller that
+// gets IdempotencyNew should process the request; later callers get the
+// stored response or a conflict state.
+func (c *Client) BeginIdempotentRequest(ctx context.Context, key, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error) {
+	result, err := beginIdempotencyScript.Run(ctx, c.Client,
+		[]string{idempotencyKey(key)}, fingerprint, ttl.Milliseconds(),
+	).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+
+	record := &IdempotencyRecord{State: fmt.Sprint(result[0])}
+	if record.State == IdempotencyDone && len(result) == 3 {
+		record.Status, _ = strconv.Atoi(fmt.Sprint(result[1]))
+		record.Body = []byte(fmt.Sprint(result[2]))
+	}
+	return record, nil
+}
+
+// completeIdempotencyScript stores the response of a pending claim and keeps
+// it for the replay ttl. A claim that already lapsed is left alone, since a
+// retry may have claimed the key again since.
+//
+// KEYS[1] idempotency record
+// ARGV[1] status, ARGV[2] body, ARGV[3] ttl (ms)
+var completeIdempotencyScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'state') ~= 'pending' then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'state', 'done', 'status', ARGV[1], 'body', ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+// CompleteIdempotentRequest stores the response for a claimed key so retries
+// can replay it, and extends the claim's short pending TTL to ttl
+func (c *Client) CompleteIdempotentRequest(ctx context.Context, key string, status int, body []byte, ttl time.Duration) error {
+	err := completeIdempotencyScript.Run(ctx, c.Client,
+		[]string{idempotencyKey(key)}, status, body, ttl.Milliseconds(),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to store idempotent response: %w", err)
+	}
+	return nil
+}
+
+// AbandonIdempotentRequest releases a claimed key without storing a response,
+// letting the client retry
+func (c *Client) AbandonIdempotentRequest(ctx context.Context, key string) error {
+	if err := c.Del(ctx, idempotencyKey(key)).Err(); err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// JoinQueue appends a user to the waiting room and returns their position
+func (c *Client) JoinQueue(ctx context.Context) (int64, error) {
+	position, err := c.Incr(ctx, queueTailKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to join queue: %w", err)
+	}
+	return position, nil
+}
+
+// queueHeadScript advances the admitted position by the time elapsed since it
+// last moved, so admission is paced without a background worker and every
+// instance agrees on it. The head never passes the tail, which stops an idle
+// queue from banking admissions for a later rush.
+//
+// KEYS[1] queue head, KEYS[2] queue tail
+// ARGV[1] admissions per second
+var queueHeadScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local head = tonumber(redis.call('HGET', KEYS[1], 'head') or '0')
+local ts = tonumber(redis.call('HGET', KEYS[1], 'ts') or tostring(now))
+local tail = tonumber(redis.call('GET', KEYS[2]) or '0')
+
+local admit = math.floor((now - ts) * rate / 1000)
+if admit > 0 then
+	if head + admit >= tail then
+		head = tail
+		ts = now
+	else
+		head = head + admit
+		ts = ts + math.floor(admit * 1000 / rate)
+	end
+end
+
+redis.call('HSET', KEYS[1], 'head', head, 'ts', ts)
+return head
+`)
+
+// QueueHead returns the highest queue position admitted so far
+func (c *Client) QueueHead(ctx context.Context, admitPerSecond int) (int64, error) {
+	head, err := queueHeadScript.Run(ctx, c.Client, []string{queueHeadKey, queueTailKey}, admitPerSecond).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get queue head: %w", err)
+	}
+	return head, nil
+}
+
+// ConsumeQueueToken marks a queue token as used by the request identified by
+// requestKey. It returns false if the token was already used, unless it was
+// used by the same non-empty requestKey.
+func (c *Client) ConsumeQueueToken(ctx context.Context, tokenID, requestKey string, ttl time.Duration) (bool, error) {
+	consumed, err := c.SetNX(ctx, queueTokenUsedKey(tokenID), requestKey, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to consume queue token: %w", err)
+	}
+	if consumed || requestKey == "" {
+		return consumed, nil
+	}
+
+	owner, err := c.Get(ctx, queueTokenUsedKey(tokenID)).Result()
+	if err != nil && err != redis.Nil {
+		return false, fmt.Errorf("failed to check queue token: %w", err)
+	}
+	return owner == requestKey, nil
+}
+
+// ReleaseQueueToken gives back a queue token used by the request identified
+// by requestKey, whose purchase failed on our side, so it can be used again.
+// A token since used by another request is left alone.
+func (c *Client) ReleaseQueueToken(ctx context.Context, tokenID, requestKey string) error {
+	if err := releaseLockScript.Run(ctx, c.Client, []string{queueTokenUsedKey(tokenID)}, requestKey).Err(); err != nil {
+		return fmt.Errorf("failed to release queue token: %w", err)
+	}
+	return nil
+}
+
+// maintenanceKey holds the cluster-wide maintenance switch while it is on
+const maintenanceKey = "maintenance"
+
+// Maintenance is the state of the maintenance switch that pauses checkout
+// and purchase on every instance
+type Maintenance struct {
+	Enabled bool
+	Message string
+	Since   time.Time
+}
+
+// SetMaintenance turns maintenance on with message shown to buyers, or off.
+// The switch has no expiry; it stays on until turned off.
+func (c *Client) SetMaintenance(enabled bool, message string) error {
+	var err error
+	if enabled {
+		err = c.HSet(ctx, maintenanceKey, "message", message, "since", time.Now().Unix()).Err()
+	} else {
+		err = c.Del(ctx, maintenanceKey).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set maintenance mode: %w", err)
+	}
+	return nil
+}
+
+// GetMaintenance returns the current state of the maintenance switch
+func (c *Client) GetMaintenance() (Maintenance, error) {
+	fields, err := c.HGetAll(ctx, maintenanceKey).Result()
+	if err != nil {
+		return Maintenance{}, fmt.Errorf("failed to get maintenance mode: %w", err)
+	}
+	if len(fields) == 0 {
+		return Maintenance{}, nil
+	}
+
+	state := Maintenance{Enabled: true, Message: fields["message"]}
+	if since, err := strconv.ParseInt(fields["since"], 10, 64); err == nil {
+		state.Since = time.Unix(since, 0)
+	}
+	return state, nil
+}
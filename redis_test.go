@@ -0,0 +1,469 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"flash-sale-service/internal/breaker"
+	"flash-sale-service/internal/models"
+)
+
+// newTestClient returns a client on a fresh in-memory Redis
+func newTestClient(t *testing.T) (*Client, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	c := &Client{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	t.Cleanup(func() { c.Close() })
+	return c, mr
+}
+
+// initTestSale seeds a running sale whose items each have stock
+func initTestSale(t *testing.T, c *Client, saleID string, stock int, itemIDs ...string) {
+	t.Helper()
+	items := make([]models.Item, len(itemIDs))
+	for i, itemID := range itemIDs {
+		items[i] = models.Item{ItemID: itemID, SaleID: saleID}
+	}
+	now := time.Now()
+	if err := c.InitializeSale(saleID, now.Add(-time.Minute), now.Add(time.Hour), items, stock); err != nil {
+		t.Fatalf("InitializeSale: %v", err)
+	}
+}
+
+// openCheckout writes a checkout session directly, bypassing the stock check
+// ReserveItem makes, so more buyers can race for an item than it has units
+func openCheckout(t *testing.T, c *Client, code, saleID, userID, itemID string) {
+	t.Helper()
+	err := c.HSet(ctx, checkoutKey(code), "user_id", userID, "item_id", itemID, "sale_id", saleID).Err()
+	if err != nil {
+		t.Fatalf("HSet checkout: %v", err)
+	}
+}
+
+func itemStock(t *testing.T, c *Client, itemID string) int {
+	t.Helper()
+	stock, err := c.Get(ctx, itemStockKey(itemID)).Int()
+	if err != nil {
+		t.Fatalf("Get stock: %v", err)
+	}
+	return stock
+}
+
+func TestDecrementInventoryLastUnitGoesToExactlyOneBuyer(t *testing.T) {
+	c, _ := newTestClient(t)
+	initTestSale(t, c, "sale_1", 1, "item_1")
+
+	const buyers = 50
+	for i := 0; i < buyers; i++ {
+		openCheckout(t, c, fmt.Sprintf("code_%d", i), "sale_1", fmt.Sprintf("user_%d", i), "item_1")
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		won      int
+		soldOut  int
+		failures []error
+	)
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := DecrementInventory(ctx, c, "sale_1", fmt.Sprintf("user_%d", i), "item_1", fmt.Sprintf("code_%d", i), 1)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				won++
+			case errors.Is(err, ErrSoldOut):
+				soldOut++
+			default:
+				failures = append(failures, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(failures) > 0 {
+		t.Fatalf("unexpected errors: %v", failures)
+	}
+	if won != 1 {
+		t.Errorf("decrements that took stock = %d, want 1", won)
+	}
+	if soldOut != buyers-1 {
+		t.Errorf("sold out rejections = %d, want %d", soldOut, buyers-1)
+	}
+	if stock := itemStock(t, c, "item_1"); stock != 0 {
+		t.Errorf("final stock = %d, want 0", stock)
+	}
+}
+
+func TestDecrementInventoryRejectsReplayedCode(t *testing.T) {
+	c, _ := newTestClient(t)
+	initTestSale(t, c, "sale_1", 5, "item_1")
+	openCheckout(t, c, "code_1", "sale_1", "user_1", "item_1")
+
+	if _, err := DecrementInventory(ctx, c, "sale_1", "user_1", "item_1", "code_1", 2); err != nil {
+		t.Fatalf("first DecrementInventory: %v", err)
+	}
+
+	_, err := DecrementInventory(ctx, c, "sale_1", "user_1", "item_1", "code_1", 2)
+	if !errors.Is(err, ErrCheckoutUsed) {
+		t.Fatalf("replayed DecrementInventory error = %v, want ErrCheckoutUsed", err)
+	}
+	if stock := itemStock(t, c, "item_1"); stock != 4 {
+		t.Errorf("stock after replay = %d, want 4", stock)
+	}
+}
+
+func TestDecrementInventoryBulkRejectsReplayedCodes(t *testing.T) {
+	c, _ := newTestClient(t)
+	initTestSale(t, c, "sale_1", 5, "item_1", "item_2")
+	openCheckout(t, c, "code_1", "sale_1", "user_1", "item_1")
+	openCheckout(t, c, "code_2", "sale_1", "user_1", "item_2")
+
+	itemIDs, codes := []string{"item_1", "item_2"}, []string{"code_1", "code_2"}
+	taken, _, err := c.DecrementInventoryBulk(ctx, "sale_1", "user_1", itemIDs, codes, 4)
+	if err != nil || !taken {
+		t.Fatalf("first DecrementInventoryBulk = %v, %v; want taken", taken, err)
+	}
+
+	_, _, err = c.DecrementInventoryBulk(ctx, "sale_1", "user_1", itemIDs, codes, 4)
+	if !errors.Is(err, ErrCheckoutUsed) {
+		t.Fatalf("replayed DecrementInventoryBulk error = %v, want ErrCheckoutUsed", err)
+	}
+	for _, itemID := range itemIDs {
+		if stock := itemStock(t, c, itemID); stock != 4 {
+			t.Errorf("%s stock after replay = %d, want 4", itemID, stock)
+		}
+	}
+}
+
+func TestInitializeSaleTwiceKeepsSoldStock(t *testing.T) {
+	c, _ := newTestClient(t)
+	initTestSale(t, c, "sale_1", 5, "item_1", "item_2")
+	openCheckout(t, c, "code_1", "sale_1", "user_1", "item_1")
+	if _, err := DecrementInventory(ctx, c, "sale_1", "user_1", "item_1", "code_1", 1); err != nil {
+		t.Fatalf("DecrementInventory: %v", err)
+	}
+
+	// A retried or repeated initialization must not hand the sold unit out
+	// again
+	initTestSale(t, c, "sale_1", 5, "item_1", "item_2")
+
+	if stock := itemStock(t, c, "item_1"); stock != 4 {
+		t.Errorf("item_1 stock = %d, want 4", stock)
+	}
+	if stock := itemStock(t, c, "item_2"); stock != 5 {
+		t.Errorf("item_2 stock = %d, want 5", stock)
+	}
+	remaining, err := c.GetRemainingInventory("sale_1")
+	if err != nil {
+		t.Fatalf("GetRemainingInventory: %v", err)
+	}
+	if remaining != 9 {
+		t.Errorf("remaining inventory = %d, want 9", remaining)
+	}
+	sold, err := c.GetItemsSold(ctx, "sale_1")
+	if err != nil {
+		t.Fatalf("GetItemsSold: %v", err)
+	}
+	if sold != 1 {
+		t.Errorf("items sold = %d, want 1", sold)
+	}
+	purchased, err := c.HasUserPurchased(ctx, "sale_1", "user_1")
+	if err != nil {
+		t.Fatalf("HasUserPurchased: %v", err)
+	}
+	if !purchased {
+		t.Error("user_1 no longer counted as a buyer")
+	}
+}
+
+func TestReleaseAllReservationsReleasesEverySaleCheckout(t *testing.T) {
+	// Every checkout fits in one scan batch: miniredis pages ZSCAN by offset,
+	// so members released mid-scan would shift later ones past the cursor,
+	// which Redis itself never does
+	c, _ := newTestClient(t)
+	initTestSale(t, c, "sale_1", 5, "item_1", "item_2")
+	initTestSale(t, c, "sale_2", 5, "item_3")
+
+	expiresAt := time.Now().Add(5 * time.Minute)
+	var codes []string
+	for i := 0; i < 7; i++ {
+		code := fmt.Sprintf("code_%d", i)
+		itemID := []string{"item_1", "item_2"}[i%2]
+		reserved, err := c.ReserveItem(ctx, code, "sale_1", fmt.Sprintf("user_%d", i), itemID, expiresAt)
+		if err != nil || !reserved {
+			t.Fatalf("ReserveItem %s = %v, %v; want reserved", code, reserved, err)
+		}
+		codes = append(codes, code)
+	}
+	reserved, err := c.ReserveItem(ctx, "other", "sale_2", "user_0", "item_3", expiresAt)
+	if err != nil || !reserved {
+		t.Fatalf("ReserveItem in sale_2 = %v, %v; want reserved", reserved, err)
+	}
+
+	released, err := c.ReleaseAllReservations("sale_1")
+	if err != nil {
+		t.Fatalf("ReleaseAllReservations: %v", err)
+	}
+	if released != len(codes) {
+		t.Errorf("released = %d, want %d", released, len(codes))
+	}
+
+	for _, code := range codes {
+		if _, _, err := GetCheckoutSession(ctx, c, code); !errors.Is(err, ErrCheckoutNotFound) {
+			t.Errorf("%s after release: error = %v, want ErrCheckoutNotFound", code, err)
+		}
+	}
+	if _, _, err := GetCheckoutSession(ctx, c, "other"); err != nil {
+		t.Errorf("checkout in another sale: %v", err)
+	}
+	if active, err := c.ActiveCheckouts(); err != nil || active != 1 {
+		t.Errorf("ActiveCheckouts = %d, %v; want 1", active, err)
+	}
+
+	// Nothing is left to release
+	if again, err := c.ReleaseAllReservations("sale_1"); err != nil || again != 0 {
+		t.Errorf("second ReleaseAllReservations = %d, %v; want 0", again, err)
+	}
+}
+
+func TestCleanupExpiredCheckoutsRestoresStock(t *testing.T) {
+	c, _ := newTestClient(t)
+	initTestSale(t, c, "sale_1", 1, "item_1", "item_2")
+
+	expiresAt := time.Now().Add(20 * time.Millisecond)
+	for _, itemID := range []string{"item_1", "item_2"} {
+		if reserved, err := c.ReserveItem(ctx, "code_"+itemID, "sale_1", "user_1", itemID, expiresAt); err != nil || !reserved {
+			t.Fatalf("ReserveItem %s = %v, %v; want reserved", itemID, reserved, err)
+		}
+	}
+	// While held, the only unit of item_1 can't be checked out again
+	if reserved, err := c.ReserveItem(ctx, "code_held", "sale_1", "user_2", "item_1", time.Now().Add(time.Minute)); err != nil || reserved {
+		t.Fatalf("ReserveItem of a held unit = %v, %v; want not reserved", reserved, err)
+	}
+	// item_2 is bought before its checkout runs out
+	if _, err := DecrementInventory(ctx, c, "sale_1", "user_1", "item_2", "code_item_2", 2); err != nil {
+		t.Fatalf("DecrementInventory: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	released, err := c.CleanupExpiredCheckouts()
+	if err != nil {
+		t.Fatalf("CleanupExpiredCheckouts: %v", err)
+	}
+	// The bought checkout isn't released a second time
+	if released != 1 {
+		t.Errorf("released = %d, want 1", released)
+	}
+	if stock := itemStock(t, c, "item_1"); stock != 1 {
+		t.Errorf("item_1 stock = %d, want 1", stock)
+	}
+	if stock := itemStock(t, c, "item_2"); stock != 0 {
+		t.Errorf("item_2 stock = %d, want 0", stock)
+	}
+
+	if reserved, err := c.ReserveItem(ctx, "code_next", "sale_1", "user_2", "item_1", time.Now().Add(time.Minute)); err != nil || !reserved {
+		t.Errorf("ReserveItem after cleanup = %v, %v; want the released unit reserved", reserved, err)
+	}
+	if reserved, err := c.ReserveItem(ctx, "code_sold", "sale_1", "user_2", "item_2", time.Now().Add(time.Minute)); err == nil && reserved {
+		t.Error("ReserveItem of the bought unit succeeded")
+	}
+
+	if again, err := c.CleanupExpiredCheckouts(); err != nil || again != 0 {
+		t.Errorf("second CleanupExpiredCheckouts = %d, %v; want 0", again, err)
+	}
+}
+
+// waitHealthy waits for the client's health to become want
+func waitHealthy(t *testing.T, c *Client, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Healthy() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Healthy = %v after 2s, want %v", !want, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheckFailsFastWhileDownAndRecovers(t *testing.T) {
+	c, mr := newTestClient(t)
+	initTestSale(t, c, "sale_1", 5, "item_1")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.StartHealthCheck(ctx, 10*time.Millisecond)
+
+	mr.Close()
+	waitHealthy(t, c, false)
+	if _, err := c.GetItemStock("item_1"); !errors.Is(err, ErrRedisUnavailable) {
+		t.Fatalf("GetItemStock while down: error = %v, want ErrRedisUnavailable", err)
+	}
+	if !IsTransient(ErrRedisUnavailable) {
+		t.Error("ErrRedisUnavailable is not transient")
+	}
+
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("restart Redis: %v", err)
+	}
+	waitHealthy(t, c, true)
+	if stock, err := c.GetItemStock("item_1"); err != nil || stock != 5 {
+		t.Errorf("GetItemStock after recovery = %d, %v; want 5", stock, err)
+	}
+}
+
+// roundTripCounter counts the network round-trips a client makes: one per
+// command, one per pipeline
+type roundTripCounter struct {
+	count int
+}
+
+func (r *roundTripCounter) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	r.count++
+	return ctx, nil
+}
+
+func (r *roundTripCounter) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (r *roundTripCounter) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	r.count++
+	return ctx, nil
+}
+
+func (r *roundTripCounter) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func BenchmarkInitializeSale(b *testing.B) {
+	const count = 10000
+	mr := miniredis.RunT(b)
+	items := make([]models.Item, count)
+	for i := range items {
+		items[i] = models.Item{ItemID: fmt.Sprintf("item_%d", i), SaleID: "sale_1"}
+	}
+	now := time.Now()
+
+	for _, batchSize := range []int{1, 100, DefaultPipelineBatchSize} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			c := &Client{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()}), PipelineBatchSize: batchSize}
+			defer c.Close()
+			counter := &roundTripCounter{}
+			c.AddHook(counter)
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				mr.FlushAll()
+				b.StartTimer()
+
+				if err := c.InitializeSale("sale_1", now, now.Add(time.Hour), items, 1); err != nil {
+					b.Fatalf("InitializeSale: %v", err)
+				}
+			}
+			b.ReportMetric(float64(counter.count)/float64(b.N), "round-trips/op")
+		})
+	}
+}
+
+func TestInventoryVersionNeverRepeats(t *testing.T) {
+	c, _ := newTestClient(t)
+	initTestSale(t, c, "sale_1", 5, "item_1", "item_2")
+
+	seen := make(map[int64]bool)
+	version := func(step string) {
+		t.Helper()
+		v, err := c.GetInventoryVersion("sale_1")
+		if err != nil {
+			t.Fatalf("GetInventoryVersion after %s: %v", step, err)
+		}
+		if seen[v] {
+			t.Errorf("version %d after %s was handed out before", v, step)
+		}
+		seen[v] = true
+	}
+	version("initialization")
+
+	openCheckout(t, c, "code_1", "sale_1", "user_1", "item_1")
+	if _, err := DecrementInventory(ctx, c, "sale_1", "user_1", "item_1", "code_1", 3); err != nil {
+		t.Fatalf("DecrementInventory: %v", err)
+	}
+	version("decrement")
+
+	// The sold count goes back to where it was; the version must not
+	if err := c.RestoreInventory(ctx, "sale_1", "user_1", []string{"item_1"}, []string{"code_1"}); err != nil {
+		t.Fatalf("RestoreInventory: %v", err)
+	}
+	version("restore")
+
+	openCheckout(t, c, "code_2", "sale_1", "user_1", "item_1")
+	openCheckout(t, c, "code_3", "sale_1", "user_1", "item_2")
+	if taken, _, err := c.DecrementInventoryBulk(ctx, "sale_1", "user_1", []string{"item_1", "item_2"}, []string{"code_2", "code_3"}, 3); err != nil || !taken {
+		t.Fatalf("DecrementInventoryBulk = %v, %v; want taken", taken, err)
+	}
+	version("bulk decrement")
+
+	if stock := itemStock(t, c, "item_2"); stock != 4 {
+		t.Errorf("item_2 stock = %d, want 4", stock)
+	}
+}
+
+func TestAdjustItemStockMovesInventoryVersion(t *testing.T) {
+	c, _ := newTestClient(t)
+	initTestSale(t, c, "sale_1", 5, "item_1")
+
+	before, err := c.GetInventoryVersion("sale_1")
+	if err != nil {
+		t.Fatalf("GetInventoryVersion: %v", err)
+	}
+	if _, err := c.SetItemStock("sale_1", "item_1", 0); err != nil {
+		t.Fatalf("SetItemStock: %v", err)
+	}
+	after, err := c.GetInventoryVersion("sale_1")
+	if err != nil {
+		t.Fatalf("GetInventoryVersion: %v", err)
+	}
+	if after == before {
+		t.Errorf("version after pulling the item = %d, want it moved on from %d", after, before)
+	}
+
+	// Setting the stock it already has changes nothing
+	if _, err := c.SetItemStock("sale_1", "item_1", 0); err != nil {
+		t.Fatalf("SetItemStock: %v", err)
+	}
+	if again, _ := c.GetInventoryVersion("sale_1"); again != after {
+		t.Errorf("version after a no-op = %d, want %d", again, after)
+	}
+}
+
+func TestCancelledRequestStopsCommandWithoutTrippingBreaker(t *testing.T) {
+	c, _ := newTestClient(t)
+	initTestSale(t, c, "sale_1", 5, "item_1")
+	b := breaker.New(1, time.Hour)
+	c.EnableCircuitBreaker(b)
+
+	// The client has gone away before the command is sent
+	reqCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	reserved, err := c.ReserveItem(reqCtx, "code_1", "sale_1", "user_1", "item_1", time.Now().Add(time.Minute))
+	if !errors.Is(err, context.Canceled) || reserved {
+		t.Fatalf("ReserveItem with a cancelled context = %v, %v; want context.Canceled", reserved, err)
+	}
+	if state := b.State(); state != breaker.Closed {
+		t.Errorf("breaker state = %v, want closed", state)
+	}
+	if _, _, err := GetCheckoutSession(ctx, c, "code_1"); !errors.Is(err, ErrCheckoutNotFound) {
+		t.Errorf("GetCheckoutSession = %v, want ErrCheckoutNotFound", err)
+	}
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/handlers"
+)
+
+// maxRequestIDLength bounds client-supplied request IDs before they reach logs
+const maxRequestIDLength = 128
+
+// statusRecorder captures the response status for the request log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer to flush
+// streams
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// validRequestID accepts printable, header-safe IDs of a sane length
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// generateRequestID generates a random request ID
+func generateRequestID() string {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// RequestIDMiddleware gives every request an ID, reusing a valid incoming
+// X-Request-ID, echoes it in the response and stores it in the context for
+// handlers.Logger. Each request is logged once it completes.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(handlers.RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = generateRequestID()
+		}
+		w.Header().Set(handlers.RequestIDHeader, requestID)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		ctx := handlers.ContextWithRequestID(r.Context(), requestID)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		handlers.Logger(ctx).Info("Request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
@@ -0,0 +1,379 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/database"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/models"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/scheduler"
+)
+
+// ActiveSaleHandler returns the sales that are currently running along with
+// the live number of items each still has available. "sale" is the most
+// recently started of them, kept for clients that predate concurrent sales.
+func ActiveSaleHandler(db *database.DB, redisClient *redis.Client, schedule scheduler.Schedule) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		sales, err := db.GetActiveSales()
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load active sales", "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading active sale")
+			return
+		}
+
+		if len(sales) == 0 {
+			nextStart := schedule.NextBoundary(time.Now())
+			writeJSONError(w, http.StatusNotFound, ErrCodeNoActiveSale,
+				fmt.Sprintf("No active sale, the next sale starts at %s", nextStart.Format(time.RFC3339)),
+				map[string]interface{}{"next_sale_start": nextStart.Unix()})
+			return
+		}
+
+		// Redis is authoritative for inventory; the items_sold column lags
+		// behind, so it is only served, flagged stale, while Redis is down
+		stale := false
+		results := make([]map[string]interface{}, len(sales))
+		for i, sale := range sales {
+			remaining, err := redisClient.GetRemainingInventory(sale.SaleID)
+			if err != nil {
+				Logger(r.Context()).Error("Failed to load inventory, falling back to database", "sale_id", sale.SaleID, "error", err)
+				remaining = sale.TotalItems - sale.ItemsSold
+				if remaining < 0 {
+					remaining = 0
+				}
+				stale = true
+			}
+
+			results[i] = map[string]interface{}{
+				"sale_id":              sale.SaleID,
+				"start_time":           sale.StartTime.Unix(),
+				"end_time":             sale.EndTime.Unix(),
+				"total_items":          sale.TotalItems,
+				"items_remaining":      remaining,
+				"status":               sale.Status,
+				"checkout_ttl_seconds": int(sale.ReservationTTL() / time.Second),
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"stale":   stale,
+			"sale":    results[0],
+			"sales":   results,
+		})
+	}
+}
+
+const (
+	defaultUpcomingSalesLimit = 10
+	maxUpcomingSalesLimit     = 50
+)
+
+// UpcomingSalesHandler returns sales that have not started yet, soonest first.
+// Sales are only created on the schedule's boundaries, so next_sale_start is
+// always included even before the next sale's row exists.
+func UpcomingSalesHandler(db *database.DB, schedule scheduler.Schedule) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		limit, ok := parseNonNegativeInt(r, "limit", defaultUpcomingSalesLimit)
+		if !ok {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid limit")
+			return
+		}
+		if limit == 0 {
+			limit = defaultUpcomingSalesLimit
+		}
+		if limit > maxUpcomingSalesLimit {
+			limit = maxUpcomingSalesLimit
+		}
+
+		sales, err := db.GetUpcomingSales(limit)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load upcoming sales", "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading upcoming sales")
+			return
+		}
+
+		nextStart := schedule.NextBoundary(time.Now())
+		if len(sales) > 0 && sales[0].StartTime.Before(nextStart) {
+			nextStart = sales[0].StartTime
+		}
+
+		results := make([]map[string]interface{}, len(sales))
+		for i, sale := range sales {
+			results[i] = map[string]interface{}{
+				"sale_id":     sale.SaleID,
+				"start_time":  sale.StartTime.Unix(),
+				"end_time":    sale.EndTime.Unix(),
+				"total_items": sale.TotalItems,
+				"status":      sale.Status,
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":         true,
+			"sales":           results,
+			"next_sale_start": nextStart.Unix(),
+		})
+	}
+}
+
+// SaleDetailHandler serves GET /sales/{saleID} with the sale and its sell
+// through stats. The live remaining count comes from Redis while the sale is
+// running and from the items_sold column otherwise.
+func SaleDetailHandler(db *database.DB, redisClient *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		saleID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sales/"), "/")
+		if saleID == "" || strings.Contains(saleID, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		sale, err := db.GetSaleByID(saleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load sale", "sale_id", saleID, "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading sale")
+			return
+		}
+
+		if sale == nil {
+			WriteJSONError(w, http.StatusNotFound, ErrCodeNotFound, "Sale not found")
+			return
+		}
+
+		now := time.Now()
+		live := (sale.Status == models.SaleStatusActive || sale.Status == models.SaleStatusSoldOut) &&
+			!now.Before(sale.StartTime) && now.Before(sale.EndTime)
+
+		remaining := sale.TotalItems - sale.ItemsSold
+		if live {
+			remaining, err = redisClient.GetRemainingInventory(sale.SaleID)
+			if err != nil {
+				Logger(r.Context()).Error("Failed to load inventory", "sale_id", sale.SaleID, "error", err)
+				WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading sale")
+				return
+			}
+		}
+		if remaining < 0 {
+			remaining = 0
+		}
+		sold := sale.TotalItems - remaining
+
+		sellThrough := 0.0
+		if sale.TotalItems > 0 {
+			sellThrough = float64(sold) * 100 / float64(sale.TotalItems)
+		}
+
+		stats := map[string]interface{}{
+			"items_sold":           sold,
+			"items_remaining":      remaining,
+			"sell_through_percent": sellThrough,
+		}
+
+		// The last purchase of a sold out sale is when it sold out
+		if remaining == 0 && sale.TotalItems > 0 {
+			soldOutAt, err := db.GetLastPurchaseTime(sale.SaleID)
+			if err != nil {
+				Logger(r.Context()).Error("Failed to load sellout time", "sale_id", sale.SaleID, "error", err)
+				WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading sale")
+				return
+			}
+			if !soldOutAt.IsZero() {
+				stats["sold_out_at"] = soldOutAt.Unix()
+				stats["time_to_sellout_seconds"] = int64(soldOutAt.Sub(sale.StartTime).Seconds())
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"sale": map[string]interface{}{
+				"sale_id":     sale.SaleID,
+				"start_time":  sale.StartTime.Unix(),
+				"end_time":    sale.EndTime.Unix(),
+				"total_items": sale.TotalItems,
+				"status":      sale.Status,
+			},
+			"stats": stats,
+		})
+	}
+}
+
+// topCategoriesLimit is how many best selling categories results report
+const topCategoriesLimit = 5
+
+// SaleResultsHandler serves GET /sales/{saleID}/results, the post-sale report
+// built from recorded purchases: units sold, time to sellout, a per-minute
+// histogram of purchases and the best selling categories. Results are only
+// final once the sale has ended, so earlier requests get 400.
+func SaleResultsHandler(db *database.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		saleID, ok := saleIDFromPath(r.URL.Path, "/sales/", "results")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		sale, err := db.GetSaleByID(saleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load sale", "sale_id", saleID, "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading sale results")
+			return
+		}
+
+		if sale == nil {
+			WriteJSONError(w, http.StatusNotFound, ErrCodeNotFound, "Sale not found")
+			return
+		}
+
+		if sale.Status != models.SaleStatusCompleted && time.Now().Before(sale.EndTime) {
+			WriteJSONError(w, http.StatusBadRequest, ErrCodeSaleNotFinished, "Results are only available once the sale has ended")
+			return
+		}
+
+		perMinute, err := db.GetPurchasesPerMinute(sale.SaleID, sale.StartTime)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to count purchases per minute", "sale_id", sale.SaleID, "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading sale results")
+			return
+		}
+
+		// One bucket per minute of the sale, zeros included, so charts don't
+		// have to fill gaps
+		histogram := make([]int, int(sale.EndTime.Sub(sale.StartTime)/time.Minute))
+		sold := 0
+		for minute, count := range perMinute {
+			sold += count
+			if minute >= 0 && minute < len(histogram) {
+				histogram[minute] += count
+			}
+		}
+
+		categories, err := db.GetTopCategoriesSold(sale.SaleID, topCategoriesLimit)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load top categories", "sale_id", sale.SaleID, "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading sale results")
+			return
+		}
+
+		sellThrough := 0.0
+		if sale.TotalItems > 0 {
+			sellThrough = float64(sold) * 100 / float64(sale.TotalItems)
+		}
+
+		results := map[string]interface{}{
+			"items_sold":           sold,
+			"sell_through_percent": sellThrough,
+			"sales_per_minute":     histogram,
+			"top_categories":       categories,
+		}
+
+		if sale.TotalItems > 0 && sold >= sale.TotalItems {
+			soldOutAt, err := db.GetLastPurchaseTime(sale.SaleID)
+			if err != nil {
+				Logger(r.Context()).Error("Failed to load sellout time", "sale_id", sale.SaleID, "error", err)
+				WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading sale results")
+				return
+			}
+			results["sold_out_at"] = soldOutAt.Unix()
+			results["time_to_sellout_seconds"] = int64(soldOutAt.Sub(sale.StartTime).Seconds())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"sale": map[string]interface{}{
+				"sale_id":     sale.SaleID,
+				"start_time":  sale.StartTime.Unix(),
+				"end_time":    sale.EndTime.Unix(),
+				"total_items": sale.TotalItems,
+				"status":      sale.Status,
+			},
+			"results": results,
+		})
+	}
+}
+
+// SaleResourceHandler routes /sales/{saleID} and its sub-resources
+func SaleResourceHandler(db *database.DB, redisClient *redis.Client) http.HandlerFunc {
+	detail := SaleDetailHandler(db, redisClient)
+	categories := SaleCategoriesHandler(db)
+	results := SaleResultsHandler(db)
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		switch {
+		case strings.HasSuffix(path, "/categories"):
+			categories(w, r)
+		case strings.HasSuffix(path, "/results"):
+			results(w, r)
+		default:
+			detail(w, r)
+		}
+	}
+}
+
+// saleIDFromPath extracts the sale ID from paths shaped like
+// {prefix}{saleID}/{action}
+func saleIDFromPath(path, prefix, action string) (string, bool) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, prefix), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != action {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// SaleCategoriesHandler serves GET /sales/{saleID}/categories with the
+// distinct item categories in the sale and how many items each has
+func SaleCategoriesHandler(db *database.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		saleID, ok := saleIDFromPath(r.URL.Path, "/sales/", "categories")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		categories, err := db.GetCategoryCounts(saleID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load categories", "sale_id", saleID, "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading categories")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"sale_id":    saleID,
+			"categories": categories,
+		})
+	}
+}
@@ -3,29 +3,238 @@ package scheduler
 import (
 	"context"
 	"crypto/rand"
-	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/big"
+	mathrand "math/rand"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"flash-sale-service/internal/config"
 	"flash-sale-service/internal/database"
+	"flash-sale-service/internal/metrics"
 	"flash-sale-service/internal/models"
 	redisClient "flash-sale-service/internal/redis"
+	"flash-sale-service/internal/webhooks"
 )
 
+// Schedule is the cadence of scheduled sales: back-to-back windows of
+// Duration whose boundaries fall on multiples of Duration, counted from the
+// zero time, shifted by Offset. Any Duration that divides a day lines up
+// with UTC midnight. Windows are worked out in UTC, so every instance agrees
+// on them whatever its local zone, and a DST change neither stretches nor
+// shortens one.
+type Schedule struct {
+	Duration time.Duration
+	Offset   time.Duration
+}
+
+// WindowStart returns the start of the window t falls in, in UTC
+func (sc Schedule) WindowStart(t time.Time) time.Time {
+	return t.UTC().Add(-sc.Offset).Truncate(sc.Duration).Add(sc.Offset)
+}
+
+// NextBoundary returns the start of the first window after now
+func (sc Schedule) NextBoundary(now time.Time) time.Time {
+	return sc.WindowStart(now).Add(sc.Duration)
+}
+
 type Scheduler struct {
 	db    *database.DB
 	redis *redisClient.Client
+
+	// Schedule is when scheduled sales start and how long they run
+	Schedule Schedule
+
+	// ItemsPerSale is how many items each new sale is generated with
+	ItemsPerSale int
+
+	// SalesPerWindow is how many sales are generated to run side by side in
+	// each window
+	SalesPerWindow int
+
+	// StockPerItem is how many units of each generated item are for sale
+	StockPerItem int
+
+	// CheckoutTTL is how long a checkout in each new sale holds an item
+	CheckoutTTL time.Duration
+
+	// Items generates the contents of each new sale
+	Items *ItemGenerator
+
+	// Images decides the image URL of each generated item
+	Images ImageURLStrategy
+
+	// UniqueItemNames redraws generated names that repeat within a sale
+	UniqueItemNames bool
+
+	// ItemTiers is the share of generated items in each rarity tier; empty
+	// makes every item common
+	ItemTiers []models.TierShare
+
+	// QueuedTiers lists the tiers whose generated items are hot: checked out
+	// in arrival order through a reservation queue. Empty queues none.
+	QueuedTiers []string
+
+	// GenerationWorkers is how many goroutines generate a sale's items
+	GenerationWorkers int
+
+	// Events receives sale lifecycle events; nil disables them
+	Events *webhooks.Dispatcher
+
+	// LeadTime is how long before its start each sale is generated, so the
+	// work doesn't compete with buyers at the start of the window. Must be
+	// under the sale duration.
+	LeadTime time.Duration
+
+	// CleanupInterval is how often expired checkouts are released, sold counts
+	// reconciled and ended sales completed. Must be under the sale duration.
+	CleanupInterval time.Duration
+
+	// CleanupJitter moves each cleanup pass a random amount up to this either
+	// side of CleanupInterval, so instances started together drift apart
+	// instead of hitting Redis at once. Must be under CleanupInterval.
+	CleanupJitter time.Duration
+
+	// GenerationJitter delays each window's sale generation by a random
+	// amount up to this past LeadTime before the start, spreading the
+	// instances racing for the generation lock. Must be under LeadTime.
+	GenerationJitter time.Duration
+
+	// DryRun makes sale creation generate everything as usual but log the
+	// writes instead of sending them to the database and Redis, and emit no
+	// events. It is for benchmarking generation: activation and cleanup are
+	// skipped, and Start only reads the database to look for a running sale.
+	DryRun bool
+
+	dryRunOnce  sync.Once
+	dryRunStore *dryRunStore
+
+	// lastBeat is when the loop last finished a pass, in Unix nanoseconds
+	lastBeat atomic.Int64
 }
 
-// NewScheduler creates a new scheduler instance
-func NewScheduler(db *database.DB, redis *redisClient.Client) *Scheduler {
-	return &Scheduler{
-		db:    db,
-		redis: redis,
+// beat records that the loop finished a pass
+func (s *Scheduler) beat() {
+	s.lastBeat.Store(time.Now().UnixNano())
+}
+
+// LastHeartbeat returns when the scheduler loop last finished a pass, or the
+// zero time if it never started
+func (s *Scheduler) LastHeartbeat() time.Time {
+	nanos := s.lastBeat.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// store returns where sale creation reads and writes, honouring DryRun
+func (s *Scheduler) store() saleStore {
+	if !s.DryRun {
+		return liveStore{db: s.db, redis: s.redis}
+	}
+	s.dryRunOnce.Do(func() { s.dryRunStore = newDryRunStore() })
+	return s.dryRunStore
+}
+
+// NewScheduler creates a new scheduler instance from cfg. Zero values in cfg
+// use the config package defaults.
+func NewScheduler(db *database.DB, redis *redisClient.Client, cfg config.Scheduler) (*Scheduler, error) {
+	if cfg.ItemsPerSale == 0 {
+		cfg.ItemsPerSale = models.ItemsPerSale
+	}
+	if cfg.ItemsPerSale < 0 || cfg.ItemsPerSale > models.MaxItemsPerSale {
+		return nil, fmt.Errorf("items per sale must be between 1 and %d, got %d", models.MaxItemsPerSale, cfg.ItemsPerSale)
+	}
+	if cfg.SalesPerWindow == 0 {
+		cfg.SalesPerWindow = models.SalesPerWindow
+	}
+	if cfg.SalesPerWindow < 0 || cfg.SalesPerWindow > models.MaxSalesPerWindow {
+		return nil, fmt.Errorf("sales per window must be between 1 and %d, got %d", models.MaxSalesPerWindow, cfg.SalesPerWindow)
+	}
+	if cfg.SaleDuration == 0 {
+		cfg.SaleDuration = models.SaleDuration
+	}
+	if cfg.SaleDuration < 0 || cfg.SaleDuration > models.MaxSaleDuration {
+		return nil, fmt.Errorf("sale duration must be between 0 and %s, got %s", models.MaxSaleDuration, cfg.SaleDuration)
+	}
+	if cfg.SaleOffset < 0 || cfg.SaleOffset >= cfg.SaleDuration {
+		return nil, fmt.Errorf("sale offset must be under the sale duration %s, got %s", cfg.SaleDuration, cfg.SaleOffset)
+	}
+	if cfg.LeadTime < 0 || cfg.LeadTime >= cfg.SaleDuration {
+		return nil, fmt.Errorf("lead time must be under the sale duration %s, got %s", cfg.SaleDuration, cfg.LeadTime)
+	}
+	if cfg.CleanupInterval == 0 {
+		cfg.CleanupInterval = config.DefaultCleanupInterval
+	}
+	if cfg.CleanupInterval < 0 || cfg.CleanupInterval >= cfg.SaleDuration {
+		return nil, fmt.Errorf("cleanup interval must be under the sale duration %s, got %s", cfg.SaleDuration, cfg.CleanupInterval)
+	}
+	if cfg.CleanupJitter < 0 || cfg.CleanupJitter >= cfg.CleanupInterval {
+		return nil, fmt.Errorf("cleanup jitter must be under the cleanup interval %s, got %s", cfg.CleanupInterval, cfg.CleanupJitter)
+	}
+	if cfg.GenerationJitter < 0 || (cfg.GenerationJitter > 0 && cfg.GenerationJitter >= cfg.LeadTime) {
+		return nil, fmt.Errorf("generation jitter must be under the lead time %s, got %s", cfg.LeadTime, cfg.GenerationJitter)
+	}
+	if cfg.CheckoutTTL == 0 {
+		cfg.CheckoutTTL = models.CheckoutReservationTTL
 	}
+	if cfg.CheckoutTTL < models.MinCheckoutTTL || cfg.CheckoutTTL > models.MaxCheckoutTTL {
+		return nil, fmt.Errorf("checkout TTL must be between %s and %s, got %s", models.MinCheckoutTTL, models.MaxCheckoutTTL, cfg.CheckoutTTL)
+	}
+
+	if cfg.GenerationWorkers == 0 {
+		cfg.GenerationWorkers = runtime.GOMAXPROCS(0)
+	}
+	if cfg.GenerationWorkers < 0 {
+		return nil, fmt.Errorf("generation workers must not be negative, got %d", cfg.GenerationWorkers)
+	}
+
+	if err := models.ValidateTierShares(cfg.ItemTiers); err != nil {
+		return nil, fmt.Errorf("item tiers: %w", err)
+	}
+	for _, tier := range cfg.QueuedTiers {
+		if !models.IsTier(tier) {
+			return nil, fmt.Errorf("queued tiers: unknown tier %q, expected one of %v", tier, models.Tiers)
+		}
+	}
+
+	var images ImageURLStrategy = PicsumImages{}
+	if cfg.ImageURLTemplate != "" {
+		if !strings.Contains(cfg.ImageURLTemplate, ItemIDPlaceholder) {
+			return nil, fmt.Errorf("image URL template must contain %s, got %q", ItemIDPlaceholder, cfg.ImageURLTemplate)
+		}
+		images = TemplateImages{Template: cfg.ImageURLTemplate}
+	}
+
+	return &Scheduler{
+		db:                db,
+		redis:             redis,
+		Schedule:          Schedule{Duration: cfg.SaleDuration, Offset: cfg.SaleOffset},
+		ItemsPerSale:      cfg.ItemsPerSale,
+		SalesPerWindow:    cfg.SalesPerWindow,
+		StockPerItem:      models.DefaultStockPerItem,
+		CheckoutTTL:       cfg.CheckoutTTL,
+		Items:             NewItemGenerator(),
+		Images:            images,
+		UniqueItemNames:   cfg.UniqueItemNames,
+		ItemTiers:         cfg.ItemTiers,
+		QueuedTiers:       cfg.QueuedTiers,
+		GenerationWorkers: cfg.GenerationWorkers,
+		LeadTime:          cfg.LeadTime,
+		CleanupInterval:   cfg.CleanupInterval,
+		CleanupJitter:     cfg.CleanupJitter,
+		GenerationJitter:  cfg.GenerationJitter,
+		DryRun:            cfg.DryRun,
+	}, nil
 }
 
 // generateSaleID generates a unique sale ID
@@ -38,10 +247,44 @@ func generateSaleID() (string, error) {
 	return fmt.Sprintf("sale_%d_%s", timestamp, hex.EncodeToString(bytes)), nil
 }
 
-// generateItemID generates a unique item ID
-func generateItemID() (string, error) {
+// ItemGenerator produces the random parts of generated items. The zero value
+// and NewItemGenerator draw from crypto/rand; NewSeededItemGenerator makes the
+// output reproducible. A seeded generator is not safe for concurrent use.
+type ItemGenerator struct {
+	rng *mathrand.Rand
+}
+
+// NewItemGenerator returns a generator backed by crypto/rand, which is safe
+// for concurrent use
+func NewItemGenerator() *ItemGenerator {
+	return &ItemGenerator{}
+}
+
+// NewSeededItemGenerator returns a generator that draws IDs and names from
+// src, so the same source always yields the same items
+func NewSeededItemGenerator(src mathrand.Source) *ItemGenerator {
+	return &ItemGenerator{rng: mathrand.New(src)}
+}
+
+// intn returns a random index in [0, n)
+func (g *ItemGenerator) intn(n int) (int, error) {
+	if g.rng != nil {
+		return g.rng.Intn(n), nil
+	}
+
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
+
+// ItemID generates a unique item ID
+func (g *ItemGenerator) ItemID() (string, error) {
 	bytes := make([]byte, 8)
-	if _, err := rand.Read(bytes); err != nil {
+	if g.rng != nil {
+		g.rng.Read(bytes)
+	} else if _, err := rand.Read(bytes); err != nil {
 		return "", err
 	}
 	return fmt.Sprintf("item_%s", hex.EncodeToString(bytes)), nil
@@ -61,6 +304,31 @@ var itemNameTemplates = []string{
 	"Master %s Series",
 }
 
+// Name templates of the rarer tiers, so a legendary item reads as one; common
+// items use itemNameTemplates
+var (
+	rareNameTemplates = []string{
+		"Rare %s Edition",
+		"Collector's %s",
+		"Numbered %s Series",
+		"Vault %s Release",
+	}
+
+	legendaryNameTemplates = []string{
+		"Legendary %s",
+		"Mythic %s Edition",
+		"Founders' %s Masterpiece",
+		"One of a Kind %s",
+	}
+)
+
+// tierNameTemplates maps each tier to its name templates
+var tierNameTemplates = map[string][]string{
+	models.TierCommon:    itemNameTemplates,
+	models.TierRare:      rareNameTemplates,
+	models.TierLegendary: legendaryNameTemplates,
+}
+
 var itemCategories = []string{
 	"Smartphone", "Laptop", "Headphones", "Watch", "Camera", "Tablet", "Speaker", "Gaming Console",
 	"Fitness Tracker", "Smart TV", "Keyboard", "Mouse", "Monitor", "Printer", "Router", "Drone",
@@ -78,37 +346,91 @@ var colorVariants = []string{
 	"Forest Green", "Sunset Orange", "Deep Purple", "Coral", "Mint", "Lavender", "Crimson",
 }
 
-// generateItemName generates a random item name
-func generateItemName() (string, error) {
-	// Select random template
-	templateIndex, err := rand.Int(rand.Reader, big.NewInt(int64(len(itemNameTemplates))))
+// Tier draws an item's rarity tier from shares, which must be valid; with no
+// shares every item is common
+func (g *ItemGenerator) Tier(shares []models.TierShare) (string, error) {
+	if len(shares) == 0 {
+		return models.TierCommon, nil
+	}
+
+	n, err := g.intn(100)
 	if err != nil {
 		return "", err
 	}
-	template := itemNameTemplates[templateIndex.Int64()]
+	for _, share := range shares {
+		if n < share.Percent {
+			return share.Tier, nil
+		}
+		n -= share.Percent
+	}
+	return shares[len(shares)-1].Tier, nil
+}
+
+// ItemName generates a random item name from the templates of tier and
+// returns it with the item's category
+func (g *ItemGenerator) ItemName(tier string) (string, string, error) {
+	templates, ok := tierNameTemplates[tier]
+	if !ok {
+		templates = itemNameTemplates
+	}
+
+	// Select random template
+	templateIndex, err := g.intn(len(templates))
+	if err != nil {
+		return "", "", err
+	}
+	template := templates[templateIndex]
 
 	// Select random category
-	categoryIndex, err := rand.Int(rand.Reader, big.NewInt(int64(len(itemCategories))))
+	categoryIndex, err := g.intn(len(itemCategories))
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	category := itemCategories[categoryIndex.Int64()]
+	category := itemCategories[categoryIndex]
 
 	// Select random color
-	colorIndex, err := rand.Int(rand.Reader, big.NewInt(int64(len(colorVariants))))
+	colorIndex, err := g.intn(len(colorVariants))
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	color := colorVariants[colorIndex.Int64()]
+	color := colorVariants[colorIndex]
 
 	// Combine category and color
 	categoryWithColor := fmt.Sprintf("%s %s", color, category)
 
-	return fmt.Sprintf(template, categoryWithColor), nil
+	return fmt.Sprintf(template, categoryWithColor), category, nil
+}
+
+// Price generates a list price, in cents, between $10 and $999 ending in .99,
+// and a sale price 10-70% below it
+func (g *ItemGenerator) Price() (int64, int64, error) {
+	dollars, err := g.intn(990)
+	if err != nil {
+		return 0, 0, err
+	}
+	price := int64(dollars+10)*100 - 1
+
+	discountPercent, err := g.intn(61)
+	if err != nil {
+		return 0, 0, err
+	}
+	discountPrice := price * int64(100-(discountPercent+10)) / 100
+
+	return price, discountPrice, nil
 }
 
-// generateImageURL generates a placeholder image URL
-func generateImageURL(itemID string) string {
+// ImageURLStrategy decides the image URL of each generated item. ImageURL
+// may be called from several goroutines at once.
+type ImageURLStrategy interface {
+	ImageURL(itemID string) string
+}
+
+// PicsumImages points items at placeholder images from picsum.photos. The
+// image is seeded from the item ID, so an item always gets the same one.
+type PicsumImages struct{}
+
+// ImageURL generates a placeholder image URL
+func (PicsumImages) ImageURL(itemID string) string {
 	// Use a placeholder image service with item-specific parameters
 	width := 400
 	height := 400
@@ -122,110 +444,771 @@ func generateImageURL(itemID string) string {
 	return fmt.Sprintf("https://picsum.photos/seed/%d/%d/%d", seed, width, height)
 }
 
-// generateItems generates the specified number of items for a sale
-func (s *Scheduler) generateItems(saleID string, count int) ([]models.Item, error) {
-	items := make([]models.Item, count)
-	
-	for i := 0; i < count; i++ {
-		itemID, err := generateItemID()
+// ItemIDPlaceholder marks where a TemplateImages template takes the item ID
+const ItemIDPlaceholder = "{itemID}"
+
+// TemplateImages builds image URLs from a template such as
+// https://cdn.example.com/items/{itemID}.jpg, for images served from a CDN
+type TemplateImages struct {
+	Template string
+}
+
+// ImageURL substitutes the escaped item ID into the template
+func (t TemplateImages) ImageURL(itemID string) string {
+	return strings.ReplaceAll(t.Template, ItemIDPlaceholder, url.PathEscape(itemID))
+}
+
+// maxNameAttempts bounds how often a colliding item name is redrawn before
+// it is made unique with a numeric suffix
+const maxNameAttempts = 10
+
+// uniqueItemName draws names of tier from gen until one isn't in seen. Past
+// maxNameAttempts collisions the last draw is numbered instead; generated
+// names never end in "#n", so a numbered name can't clash with another one.
+// seen counts how often each drawn name has been handed out.
+func uniqueItemName(gen *ItemGenerator, tier string, seen map[string]int) (string, string, error) {
+	var name, category string
+	for attempt := 0; attempt < maxNameAttempts; attempt++ {
+		var err error
+		name, category, err = gen.ItemName(tier)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate item ID: %w", err)
+			return "", "", err
+		}
+		if seen[name] == 0 {
+			seen[name] = 1
+			return name, category, nil
 		}
+	}
+
+	seen[name]++
+	return fmt.Sprintf("%s #%d", name, seen[name]), category, nil
+}
+
+// generateItem generates one item of a sale, in a tier drawn from tiers
+func generateItem(gen *ItemGenerator, images ImageURLStrategy, tiers []models.TierShare, saleID string) (models.Item, error) {
+	itemID, err := gen.ItemID()
+	if err != nil {
+		return models.Item{}, fmt.Errorf("failed to generate item ID: %w", err)
+	}
+
+	tier, err := gen.Tier(tiers)
+	if err != nil {
+		return models.Item{}, fmt.Errorf("failed to generate item tier: %w", err)
+	}
+
+	itemName, category, err := gen.ItemName(tier)
+	if err != nil {
+		return models.Item{}, fmt.Errorf("failed to generate item name: %w", err)
+	}
 
-		itemName, err := generateItemName()
+	price, discountPrice, err := gen.Price()
+	if err != nil {
+		return models.Item{}, fmt.Errorf("failed to generate item price: %w", err)
+	}
+
+	imageURL := images.ImageURL(itemID)
+
+	return models.Item{
+		ItemID:        itemID,
+		SaleID:        saleID,
+		Name:          itemName,
+		Category:      category,
+		ImageURL:      imageURL,
+		Tier:          tier,
+		Price:         price,
+		DiscountPrice: discountPrice,
+	}, nil
+}
+
+// minItemsPerWorker keeps each generation worker busy enough to be worth
+// starting
+const minItemsPerWorker = 1000
+
+// fillItems generates every entry of items. Large batches are split into
+// contiguous chunks generated by up to workers goroutines; a seeded
+// generator always runs alone, since it is not safe for concurrent use and
+// its output must stay reproducible.
+func fillItems(gen *ItemGenerator, images ImageURLStrategy, tiers []models.TierShare, saleID string, items []models.Item, workers int) error {
+	if gen.rng != nil {
+		workers = 1
+	}
+	if limit := len(items) / minItemsPerWorker; workers > limit {
+		workers = limit
+	}
+
+	fill := func(part []models.Item) error {
+		for i := range part {
+			item, err := generateItem(gen, images, tiers, saleID)
+			if err != nil {
+				return err
+			}
+			part[i] = item
+		}
+		return nil
+	}
+
+	if workers <= 1 {
+		return fill(items)
+	}
+
+	chunk := (len(items) + workers - 1) / workers
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		part := items[w*chunk : min((w+1)*chunk, len(items))]
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs[w] = fill(part)
+		}(w)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// dedupeItemNames redraws the name of every item whose name an earlier item
+// already has, keeping its tier
+func dedupeItemNames(gen *ItemGenerator, items []models.Item) error {
+	seen := make(map[string]int, len(items))
+	for i := range items {
+		if seen[items[i].Name] == 0 {
+			seen[items[i].Name] = 1
+			continue
+		}
+
+		name, category, err := uniqueItemName(gen, items[i].Tier, seen)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate item name: %w", err)
+			return fmt.Errorf("failed to generate item name: %w", err)
 		}
+		items[i].Name = name
+		items[i].Category = category
+	}
+	return nil
+}
 
-		imageURL := generateImageURL(itemID)
+// generateItems generates the specified number of items for a sale, using up
+// to workers goroutines, with tiers drawn from tiers. With uniqueNames set no
+// two items share a name.
+func generateItems(gen *ItemGenerator, images ImageURLStrategy, tiers []models.TierShare, saleID string, count int, uniqueNames bool, workers int) ([]models.Item, error) {
+	items := make([]models.Item, count)
+	if err := fillItems(gen, images, tiers, saleID, items, workers); err != nil {
+		return nil, err
+	}
 
-		items[i] = models.Item{
-			ItemID:   itemID,
-			SaleID:   saleID,
-			Name:     itemName,
-			ImageURL: imageURL,
+	if uniqueNames {
+		if err := dedupeItemNames(gen, items); err != nil {
+			return nil, err
 		}
 	}
 
 	return items, nil
 }
 
-// createNewSale creates a new flash sale with items
-func (s *Scheduler) createNewSale() error {
-	log.Println("Creating new flash sale...")
+// markQueuedItems flags the items in QueuedTiers as hot, so they are checked
+// out through their reservation queue
+func (s *Scheduler) markQueuedItems(items []models.Item) {
+	if len(s.QueuedTiers) == 0 {
+		return
+	}
+	for i := range items {
+		for _, tier := range s.QueuedTiers {
+			if items[i].Tier == tier {
+				items[i].Queued = true
+			}
+		}
+	}
+}
 
-	// Generate sale ID
-	saleID, err := generateSaleID()
+// saleLockTTL bounds how long one instance may hold the sale creation lock
+const saleLockTTL = 2 * time.Minute
+
+// jittered returns d moved a random amount up to spread either side of it,
+// i.e. a duration in [d-spread, d+spread]
+func jittered(d, spread time.Duration) time.Duration {
+	if spread <= 0 {
+		return d
+	}
+	return d - spread + time.Duration(mathrand.Int63n(int64(2*spread)+1))
+}
+
+// generationAt returns when the sale starting at start is generated: LeadTime
+// before it, delayed by up to GenerationJitter
+func (s *Scheduler) generationAt(start time.Time) time.Time {
+	at := start.Add(-s.LeadTime)
+	if s.GenerationJitter > 0 {
+		at = at.Add(time.Duration(mathrand.Int63n(int64(s.GenerationJitter) + 1)))
+	}
+	return at
+}
+
+// scheduledSaleCheckInterval is how often sales scheduled for an arbitrary
+// time are checked for items to generate and for having started
+const scheduledSaleCheckInterval = 5 * time.Second
+
+const (
+	// HeartbeatTimeout is how long the scheduler loop may go without a pass
+	// before it is reported stalled. The loop passes at least every
+	// scheduledSaleCheckInterval, and even a sale creation that exhausts its
+	// retries finishes well inside it.
+	HeartbeatTimeout = 3 * time.Minute
+
+	// schedulerRestartDelay is the pause before a crashed loop is restarted,
+	// so a pass that panics every time doesn't spin
+	schedulerRestartDelay = 5 * time.Second
+)
+
+const (
+	// saleStepAttempts bounds the tries of each database or Redis write while
+	// creating a sale
+	saleStepAttempts = 4
+
+	// saleStepBackoff is the wait before the first retry of a step; it
+	// doubles on each further attempt, keeping all retries well inside
+	// saleLockTTL
+	saleStepBackoff = 500 * time.Millisecond
+)
+
+// isTransient reports whether a database or Redis error may pass on its own
+func isTransient(err error) bool {
+	return database.IsTransient(err) || redisClient.IsTransient(err)
+}
+
+// retryStep runs one step of sale creation, retrying transient failures with
+// exponential backoff. A permanent failure is returned at once.
+func retryStep(step string, fn func() error) error {
+	backoff := saleStepBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransient(err) || attempt == saleStepAttempts {
+			return err
+		}
+
+		slog.Warn("Sale creation step failed, retrying", "step", step, "attempt", attempt, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// createNewSale creates the flash sales starting at startTime, with their
+// items, in the given status, topping the window up to SalesPerWindow sales
+func (s *Scheduler) createNewSale(startTime time.Time, status string) error {
+	slog.Info("Creating flash sales", "start_time", startTime, "sales", s.SalesPerWindow, "dry_run", s.DryRun)
+	started := time.Now()
+	store := s.store()
+
+	// Only one instance creates the sales for a given window
+	lockName := fmt.Sprintf("sale:create:%d", startTime.Unix())
+	token, err := store.AcquireLock(lockName, saleLockTTL)
+	if err != nil {
+		return fmt.Errorf("failed to acquire sale creation lock: %w", err)
+	}
+	if token == "" {
+		slog.Info("Another instance is creating the sale, skipping", "start_time", startTime)
+		return nil
+	}
+	defer func() {
+		if err := store.ReleaseLock(lockName, token); err != nil {
+			slog.Error("Failed to release sale creation lock", "error", err)
+		}
+	}()
+
+	existing, err := store.CountSalesForStart(startTime)
 	if err != nil {
-		return fmt.Errorf("failed to generate sale ID: %w", err)
+		return fmt.Errorf("failed to check for existing sale: %w", err)
+	}
+	if existing >= s.SalesPerWindow {
+		slog.Info("Sale already exists, skipping", "start_time", startTime)
+		return nil
+	}
+
+	// A sale an admin scheduled into the window takes its place
+	endTime := startTime.Add(s.Schedule.Duration)
+	if existing == 0 {
+		overlaps, err := store.SaleOverlaps(startTime, endTime)
+		if err != nil {
+			return fmt.Errorf("failed to check for overlapping sales: %w", err)
+		}
+		if overlaps {
+			slog.Info("Window overlaps a scheduled sale, skipping", "start_time", startTime)
+			return nil
+		}
+	}
+
+	for i := existing; i < s.SalesPerWindow; i++ {
+		if _, err := s.createSale(store, startTime, endTime, s.ItemsPerSale, s.CheckoutTTL, status); err != nil {
+			slog.Error("Sale creation failed, window is short of sales", "start_time", startTime,
+				"created", i-existing, "wanted", s.SalesPerWindow-existing, "error", err)
+			if !s.DryRun {
+				s.Events.Emit(webhooks.EventSaleCreationFailed, map[string]interface{}{
+					"start_time": startTime.Unix(),
+					"end_time":   endTime.Unix(),
+					"error":      err.Error(),
+				})
+			}
+			return err
+		}
 	}
 
-	// Calculate sale times
+	slog.Info("Created flash sales", "start_time", startTime, "sales", s.SalesPerWindow-existing,
+		"duration", time.Since(started), "dry_run", s.DryRun)
+	return nil
+}
+
+// Errors returned by CreateSale
+var (
+	// ErrInvalidSaleOptions wraps every rejection of the requested options
+	ErrInvalidSaleOptions = errors.New("invalid sale options")
+
+	// ErrSaleOverlaps means the requested window overlaps a sale that is
+	// scheduled or running
+	ErrSaleOverlaps = errors.New("sale overlaps an existing sale")
+
+	// ErrSaleCreationBusy means another sale is being created for the same
+	// window right now
+	ErrSaleCreationBusy = errors.New("another sale is being created for this window")
+)
+
+// SaleOptions overrides the defaults of a sale created with CreateSale. Zero
+// fields keep the default.
+type SaleOptions struct {
+	// StartTime defaults to now
+	StartTime time.Time
+
+	// EndTime defaults to StartTime plus the scheduled sale duration
+	EndTime time.Time
+
+	// ItemsPerSale defaults to the scheduler's ItemsPerSale
+	ItemsPerSale int
+
+	// CheckoutTTL defaults to the scheduler's CheckoutTTL
+	CheckoutTTL time.Duration
+}
+
+// CreateSale creates a sale on demand, outside the schedule, for
+// testing, incident recovery or a sale planned for a particular time. A sale
+// starting now or earlier is created active; a later one is created
+// scheduled and activated within a few seconds of its start. A sale starting
+// further ahead than LeadTime is only recorded, and its items are generated
+// LeadTime before its start like those of scheduled windows. It fails with
+// ErrSaleOverlaps rather than run alongside a sale that is scheduled or
+// running in the same window.
+func (s *Scheduler) CreateSale(opts SaleOptions) (*models.Sale, error) {
 	now := time.Now()
-	startTime := now.Truncate(time.Hour)
-	endTime := startTime.Add(time.Hour)
+	if opts.StartTime.IsZero() {
+		opts.StartTime = now
+	}
+	if opts.EndTime.IsZero() {
+		opts.EndTime = opts.StartTime.Add(s.Schedule.Duration)
+	}
+	if opts.ItemsPerSale == 0 {
+		opts.ItemsPerSale = s.ItemsPerSale
+	}
+	if opts.CheckoutTTL == 0 {
+		opts.CheckoutTTL = s.CheckoutTTL
+	}
+
+	if !opts.EndTime.After(opts.StartTime) || !opts.EndTime.After(now) {
+		return nil, fmt.Errorf("%w: end time must be after the start time and in the future", ErrInvalidSaleOptions)
+	}
+	if opts.EndTime.Sub(opts.StartTime) > models.MaxSaleDuration {
+		return nil, fmt.Errorf("%w: sale must not run longer than %s", ErrInvalidSaleOptions, models.MaxSaleDuration)
+	}
+	if opts.ItemsPerSale < 0 || opts.ItemsPerSale > models.MaxItemsPerSale {
+		return nil, fmt.Errorf("%w: items per sale must be between 1 and %d, got %d", ErrInvalidSaleOptions, models.MaxItemsPerSale, opts.ItemsPerSale)
+	}
+	if opts.CheckoutTTL < models.MinCheckoutTTL || opts.CheckoutTTL > models.MaxCheckoutTTL {
+		return nil, fmt.Errorf("%w: checkout TTL must be between %s and %s, got %s", ErrInvalidSaleOptions, models.MinCheckoutTTL, models.MaxCheckoutTTL, opts.CheckoutTTL)
+	}
+
+	// Shares the scheduler's lock so the two never create the same window
+	store := s.store()
+	lockName := fmt.Sprintf("sale:create:%d", s.Schedule.WindowStart(opts.StartTime).Unix())
+	token, err := store.AcquireLock(lockName, saleLockTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire sale creation lock: %w", err)
+	}
+	if token == "" {
+		return nil, ErrSaleCreationBusy
+	}
+	defer func() {
+		if err := store.ReleaseLock(lockName, token); err != nil {
+			slog.Error("Failed to release sale creation lock", "error", err)
+		}
+	}()
+
+	overlaps, err := store.SaleOverlaps(opts.StartTime, opts.EndTime)
+	if err != nil {
+		return nil, err
+	}
+	if overlaps {
+		return nil, ErrSaleOverlaps
+	}
+
+	if opts.StartTime.Sub(now) > s.LeadTime {
+		return s.schedulePendingSale(store, opts)
+	}
+
+	status := models.SaleStatusScheduled
+	if !opts.StartTime.After(now) {
+		status = models.SaleStatusActive
+	}
+	return s.createSale(store, opts.StartTime, opts.EndTime, opts.ItemsPerSale, opts.CheckoutTTL, status)
+}
+
+// schedulePendingSale records a scheduled sale without its items, which
+// generatePendingSales creates once the sale is within LeadTime of its start
+func (s *Scheduler) schedulePendingSale(store saleStore, opts SaleOptions) (*models.Sale, error) {
+	saleID, err := generateSaleID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate sale ID: %w", err)
+	}
 
-	// Create sale record
 	sale := &models.Sale{
-		SaleID:     saleID,
-		StartTime:  startTime,
-		EndTime:    endTime,
-		TotalItems: models.ItemsPerSale,
-		ItemsSold:  0,
-		Status:     models.SaleStatusActive,
+		SaleID:       saleID,
+		StartTime:    opts.StartTime.UTC(),
+		EndTime:      opts.EndTime.UTC(),
+		TotalItems:   opts.ItemsPerSale * s.StockPerItem,
+		Status:       models.SaleStatusScheduled,
+		CheckoutTTL:  opts.CheckoutTTL,
+		PendingItems: opts.ItemsPerSale,
+	}
+	if err := retryStep("create_sale", func() error { return store.CreateSale(sale) }); err != nil {
+		return nil, fmt.Errorf("failed to create sale in database: %w", err)
+	}
+
+	slog.Info("Scheduled sale", "sale_id", saleID, "start_time", sale.StartTime, "items", opts.ItemsPerSale)
+	if !s.DryRun {
+		s.Events.Emit(webhooks.EventSaleCreated, saleEventData(sale))
+	}
+	return sale, nil
+}
+
+// generatePendingSales creates the items of scheduled sales that are now
+// within LeadTime of their start, and loads them into Redis, through store
+// like sale creation
+func (s *Scheduler) generatePendingSales() error {
+	store := s.store()
+	sales, err := store.GetSalesAwaitingItems(time.Now().Add(s.LeadTime))
+	if err != nil {
+		return fmt.Errorf("failed to load sales awaiting items: %w", err)
+	}
+
+	for _, sale := range sales {
+		if err := s.generateSaleItems(store, sale); err != nil {
+			slog.Error("Failed to generate items of scheduled sale", "sale_id", sale.SaleID, "error", err)
+		}
+	}
+	return nil
+}
+
+// generateSaleItems creates a pending sale's items and loads the sale into
+// Redis. Items are inserted in one transaction, so a sale either has all of
+// them or none; if an earlier attempt inserted them but failed to load Redis,
+// the items are reused, and loading Redis only fills in what is missing.
+// Only one instance works on a sale at a time.
+func (s *Scheduler) generateSaleItems(store saleStore, sale models.Sale) error {
+	lockName := fmt.Sprintf("sale:generate:%s", sale.SaleID)
+	token, err := store.AcquireLock(lockName, saleLockTTL)
+	if err != nil {
+		return fmt.Errorf("failed to acquire sale generation lock: %w", err)
+	}
+	if token == "" {
+		return nil
+	}
+	defer func() {
+		if err := store.ReleaseLock(lockName, token); err != nil {
+			slog.Error("Failed to release sale generation lock", "error", err)
+		}
+	}()
+
+	var items []models.Item
+	itemIDs, err := store.GetItemIDs(sale.SaleID)
+	if err != nil {
+		return fmt.Errorf("failed to check for existing items: %w", err)
+	}
+	if len(itemIDs) == 0 {
+		items, err = generateItems(s.Items, s.Images, s.ItemTiers, sale.SaleID, sale.PendingItems, s.UniqueItemNames, s.GenerationWorkers)
+		if err != nil {
+			return fmt.Errorf("failed to generate items: %w", err)
+		}
+		s.markQueuedItems(items)
+		if err := retryStep("create_items", func() error { return store.CreateItems(items) }); err != nil {
+			return fmt.Errorf("failed to create items in database: %w", err)
+		}
+	} else {
+		items = make([]models.Item, len(itemIDs))
+		for i, itemID := range itemIDs {
+			items[i] = models.Item{ItemID: itemID, SaleID: sale.SaleID}
+		}
+	}
+
+	stockPerItem := sale.TotalItems / sale.PendingItems
+	if err := retryStep("initialize_sale", func() error {
+		return store.InitializeSale(sale.SaleID, sale.StartTime, sale.EndTime, items, stockPerItem)
+	}); err != nil {
+		return fmt.Errorf("failed to initialize sale in Redis: %w", err)
 	}
 
+	if err := store.ClearPendingItems(sale.SaleID); err != nil {
+		return err
+	}
+	slog.Info("Generated items of scheduled sale", "sale_id", sale.SaleID, "items", len(items), "start_time", sale.StartTime)
+	return nil
+}
+
+// createSale creates one flash sale of itemCount items running from startTime
+// to endTime, whose checkouts hold items for checkoutTTL, in store and loads
+// it into Redis. The caller holds the sale creation lock. Each write is
+// retried through transient failures; if one still fails, whatever was
+// written to the database is deleted again so the window never counts a
+// sale that was never loaded into Redis.
+func (s *Scheduler) createSale(store saleStore, startTime, endTime time.Time, itemCount int, checkoutTTL time.Duration, status string) (sale *models.Sale, err error) {
+	// Generate sale ID
+	saleID, err := generateSaleID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate sale ID: %w", err)
+	}
+
+	// Create sale record
+	sale = &models.Sale{
+		SaleID:      saleID,
+		StartTime:   startTime.UTC(),
+		EndTime:     endTime.UTC(),
+		TotalItems:  itemCount * s.StockPerItem,
+		ItemsSold:   0,
+		Status:      status,
+		CheckoutTTL: checkoutTTL,
+	}
+
+	// From here on a failure may leave rows behind, even from an insert that
+	// reported an error after committing. Stock keys already set in Redis
+	// expire with the sale and are unreachable without the sale key.
+	defer func() {
+		if err == nil {
+			return
+		}
+		sale = nil
+		if rollbackErr := retryStep("delete_sale", func() error { return store.DeleteSale(saleID) }); rollbackErr != nil {
+			slog.Error("Failed to roll back partially created sale, cancel it by hand",
+				"sale_id", saleID, "error", rollbackErr)
+		}
+	}()
+
 	// Save sale to database
-	if err := s.db.CreateSale(sale); err != nil {
-		return fmt.Errorf("failed to create sale in database: %w", err)
+	if err := retryStep("create_sale", func() error { return store.CreateSale(sale) }); err != nil {
+		return nil, fmt.Errorf("failed to create sale in database: %w", err)
 	}
 
 	// Generate items
-	items, err := s.generateItems(saleID, models.ItemsPerSale)
+	generateStart := time.Now()
+	items, err := generateItems(s.Items, s.Images, s.ItemTiers, saleID, itemCount, s.UniqueItemNames, s.GenerationWorkers)
 	if err != nil {
-		return fmt.Errorf("failed to generate items: %w", err)
+		return nil, fmt.Errorf("failed to generate items: %w", err)
 	}
+	s.markQueuedItems(items)
+	generation := time.Since(generateStart)
 
 	// Save items to database
-	if err := s.db.CreateItems(items); err != nil {
-		return fmt.Errorf("failed to create items in database: %w", err)
+	if err := retryStep("create_items", func() error { return store.CreateItems(items) }); err != nil {
+		return nil, fmt.Errorf("failed to create items in database: %w", err)
 	}
 
 	// Initialize sale in Redis
-	if err := s.redis.InitializeSale(saleID, startTime, endTime); err != nil {
-		return fmt.Errorf("failed to initialize sale in Redis: %w", err)
+	if err := retryStep("initialize_sale", func() error {
+		return store.InitializeSale(saleID, startTime, endTime, items, s.StockPerItem)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to initialize sale in Redis: %w", err)
+	}
+
+	slog.Info("Created sale", "sale_id", saleID, "status", status, "items", len(items), "generation", generation)
+	if s.DryRun {
+		return sale, nil
+	}
+	s.Events.Emit(webhooks.EventSaleCreated, saleEventData(sale))
+	if status == models.SaleStatusActive {
+		s.Events.Emit(webhooks.EventSaleStarted, saleEventData(sale))
+	}
+	return sale, nil
+}
+
+// saleEventData is the payload of sale lifecycle webhook events
+func saleEventData(sale *models.Sale) map[string]interface{} {
+	return map[string]interface{}{
+		"sale_id":     sale.SaleID,
+		"start_time":  sale.StartTime.Unix(),
+		"end_time":    sale.EndTime.Unix(),
+		"total_items": sale.TotalItems,
+	}
+}
+
+// activateDueSales marks scheduled sales whose start time has arrived as
+// active. Each transition only succeeds once across instances.
+func (s *Scheduler) activateDueSales() error {
+	// Nothing a dry run created is there to activate
+	if s.DryRun {
+		return nil
+	}
+
+	sales, err := s.db.GetDueScheduledSales(time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to load due sales: %w", err)
+	}
+
+	for _, sale := range sales {
+		activated, err := s.db.UpdateSaleStatus(sale.SaleID, models.SaleStatusScheduled, models.SaleStatusActive)
+		if err != nil {
+			return err
+		}
+		if activated {
+			slog.Info("Sale started, marked active", "sale_id", sale.SaleID, "start_time", sale.StartTime)
+			s.Events.Emit(webhooks.EventSaleStarted, saleEventData(&sale))
+		}
 	}
 
-	log.Printf("Successfully created sale %s with %d items", saleID, len(items))
 	return nil
 }
 
-// cleanupExpiredSales marks expired sales as completed
+// cleanupExpiredSales releases the reservations of expired checkout sessions
+// so their items can be checked out again
 func (s *Scheduler) cleanupExpiredSales() error {
-	// This would typically update sales that have passed their end time
-	// For now, we'll implement a simple cleanup of expired checkout sessions
 	count, err := s.redis.CleanupExpiredCheckouts()
 	if err != nil {
 		return fmt.Errorf("failed to cleanup expired checkouts: %w", err)
 	}
 
+	metrics.CheckoutReservationsExpiredTotal.Add(float64(count))
 	if count > 0 {
-		log.Printf("Cleaned up %d expired checkout sessions", count)
+		slog.Info("Released expired checkout reservations", "count", count)
 	}
 
 	return nil
 }
 
-// waitUntilNextHour waits until the next hour boundary
-func waitUntilNextHour() time.Duration {
-	now := time.Now()
-	nextHour := now.Truncate(time.Hour).Add(time.Hour)
-	return nextHour.Sub(now)
+// completeExpiredSales marks active and sold out sales whose end time has passed as
+// completed, recording their final sold count from Redis first, and then
+// releases the checkouts still open in them. Sales another instance already
+// completed are skipped, so running it repeatedly is safe.
+func (s *Scheduler) completeExpiredSales() error {
+	sales, err := s.db.GetExpiredActiveSales(time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to load expired sales: %w", err)
+	}
+
+	for _, sale := range sales {
+		if sold, err := s.redis.GetItemsSold(context.Background(), sale.SaleID); err != nil {
+			slog.Error("Failed to get final sold count", "sale_id", sale.SaleID, "error", err)
+		} else if sold != sale.ItemsSold {
+			err := s.db.UpdateItemsSold(sale.SaleID, sale.ItemsSold, sold)
+			if err != nil && !errors.Is(err, database.ErrStaleItemsSold) {
+				slog.Error("Failed to record final sold count", "sale_id", sale.SaleID, "error", err)
+			}
+		}
+
+		completed, err := s.db.UpdateSaleStatus(sale.SaleID, sale.Status, models.SaleStatusCompleted)
+		if err != nil {
+			return err
+		}
+		if completed {
+			slog.Info("Sale ended, marked completed", "sale_id", sale.SaleID, "end_time", sale.EndTime)
+			s.Events.Emit(webhooks.EventSaleCompleted, saleEventData(&sale))
+
+			// Nothing can be bought any more; the holds would only expire
+			if released, err := s.redis.ReleaseAllReservations(sale.SaleID); err != nil {
+				slog.Error("Failed to release reservations of completed sale", "sale_id", sale.SaleID, "error", err)
+			} else if released > 0 {
+				slog.Info("Released reservations of completed sale", "sale_id", sale.SaleID, "count", released)
+			}
+		}
+	}
+
+	return nil
 }
 
-// Start starts the scheduler
+// reconcileInventory copies the authoritative sold count of each running sale
+// from Redis into the sales table. A sale that can't be reconciled is logged
+// and skipped; sales missing from Redis are expected after a wipe, and any
+// other failures are returned together once every sale has been tried.
+func (s *Scheduler) reconcileInventory() error {
+	sales, err := s.db.GetActiveSales()
+	if err != nil {
+		return fmt.Errorf("failed to load active sales: %w", err)
+	}
+
+	// One sale that can't be reconciled must not hold up the others
+	var errs []error
+	for _, sale := range sales {
+		sold, err := s.redis.GetItemsSold(context.Background(), sale.SaleID)
+		if errors.Is(err, redisClient.ErrSaleNotInitialized) {
+			slog.Warn("Sale missing from Redis, skipping reconciliation", "sale_id", sale.SaleID)
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to get sold count, skipping reconciliation", "sale_id", sale.SaleID, "error", err)
+			errs = append(errs, fmt.Errorf("failed to get sold count for sale %s: %w", sale.SaleID, err))
+			continue
+		}
+
+		if sold == sale.ItemsSold {
+			continue
+		}
+
+		// Another writer changed the count since it was read; the next pass
+		// reconciles from there
+		err = s.db.UpdateItemsSold(sale.SaleID, sale.ItemsSold, sold)
+		if errors.Is(err, database.ErrStaleItemsSold) {
+			slog.Info("Items sold changed concurrently, skipping", "sale_id", sale.SaleID, "sold", sold)
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to record items sold", "sale_id", sale.SaleID, "sold", sold, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+
+		slog.Info("Reconciled items sold", "sale_id", sale.SaleID, "from", sale.ItemsSold, "to", sold, "delta", sold-sale.ItemsSold)
+	}
+	return errors.Join(errs...)
+}
+
+// runCleanup is the periodic maintenance pass: it releases expired checkouts,
+// reconciles sold counts and completes ended sales. Failures are logged and
+// left for the next pass.
+func (s *Scheduler) runCleanup() {
+	// A dry run leaves the live sales to the instances running them
+	if s.DryRun {
+		return
+	}
+
+	// Also a fallback for a missed activation
+	if err := s.activateDueSales(); err != nil {
+		slog.Error("Failed to activate sales", "error", err)
+	}
+
+	if err := s.cleanupExpiredSales(); err != nil {
+		slog.Error("Failed to cleanup expired sales", "error", err)
+		// Continue running even if cleanup fails
+	}
+
+	if err := s.reconcileInventory(); err != nil {
+		slog.Error("Failed to reconcile inventory", "error", err)
+	}
+
+	if err := s.completeExpiredSales(); err != nil {
+		slog.Error("Failed to complete expired sales", "error", err)
+	}
+}
+
+// Start starts the scheduler and runs it until ctx is cancelled. The
+// heartbeat starts with it, so a scheduler whose startup fails is reported
+// stalled once HeartbeatTimeout passes.
 func (s *Scheduler) Start(ctx context.Context) error {
-	log.Println("Starting flash sale scheduler...")
+	slog.Info("Starting flash sale scheduler")
+	s.beat()
+
+	// Pick up sales another instance prepared while this one was down
+	if err := s.activateDueSales(); err != nil {
+		return fmt.Errorf("failed to activate due sales: %w", err)
+	}
 
 	// Create initial sale if none exists
 	activeSale, err := s.db.GetActiveSale()
@@ -234,87 +1217,102 @@ func (s *Scheduler) Start(ctx context.Context) error {
 	}
 
 	if activeSale == nil {
-		log.Println("No active sale found, creating initial sale...")
-		if err := s.createNewSale(); err != nil {
+		slog.Info("No active sale found, creating initial sale")
+		if err := s.createNewSale(s.Schedule.WindowStart(time.Now()), models.SaleStatusActive); err != nil {
 			return fmt.Errorf("failed to create initial sale: %w", err)
 		}
 	} else {
-		log.Printf("Found active sale: %s", activeSale.SaleID)
+		slog.Info("Found active sale", "sale_id", activeSale.SaleID)
 	}
 
-	// Wait until the next hour boundary for the first scheduled sale
-	waitDuration := waitUntilNextHour()
-	log.Printf("Waiting %v until next scheduled sale creation", waitDuration)
+	// A panicking pass restarts the loop rather than silently ending sale
+	// creation on this instance
+	for {
+		err := s.loop(ctx)
+		if ctx.Err() != nil {
+			slog.Info("Scheduler stopped")
+			return ctx.Err()
+		}
 
-	select {
-	case <-time.After(waitDuration):
-		// Continue to main loop
-	case <-ctx.Done():
-		log.Println("Scheduler stopped before first scheduled sale")
-		return ctx.Err()
+		slog.Error("Scheduler loop crashed, restarting", "error", err, "delay", schedulerRestartDelay)
+		select {
+		case <-time.After(schedulerRestartDelay):
+		case <-ctx.Done():
+			slog.Info("Scheduler stopped")
+			return ctx.Err()
+		}
 	}
+}
 
-	// Main scheduler loop - create new sale every hour
-	ticker := time.NewTicker(time.Hour)
-	defer ticker.Stop()
+// loop runs sale creation, activation and cleanup until ctx is cancelled,
+// beating the heartbeat after every pass. A panic is recovered and returned
+// as an error.
+func (s *Scheduler) loop(ctx context.Context) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("Scheduler loop panicked", "panic", p, "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	s.beat()
 
-	// Cleanup ticker - run every 15 minutes
-	cleanupTicker := time.NewTicker(15 * time.Minute)
-	defer cleanupTicker.Stop()
+	// Each window the next sale is generated LeadTime early as scheduled, then
+	// activated at its start. prepared tracks which of the two the timer is
+	// waiting for.
+	nextStart := s.Schedule.NextBoundary(time.Now())
+	prepared := false
+	timer := time.NewTimer(time.Until(s.generationAt(nextStart)))
+	defer timer.Stop()
+	slog.Info("Waiting for next sale", "start_time", nextStart, "lead_time", s.LeadTime)
+
+	// Checkouts left over from before a restart are released now rather than
+	// one interval in. The timer runs beside the sale timer, so cleanup keeps
+	// its schedule however far off the next sale is; each wait is jittered
+	// anew, so instances started together spread out over the first passes.
+	s.runCleanup()
+	cleanupTimer := time.NewTimer(jittered(s.CleanupInterval, s.CleanupJitter))
+	defer cleanupTimer.Stop()
+
+	// Sales scheduled through the admin API start at any time, not just on
+	// a window boundary
+	scheduledTicker := time.NewTicker(scheduledSaleCheckInterval)
+	defer scheduledTicker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			if err := s.createNewSale(); err != nil {
-				log.Printf("Failed to create new sale: %v", err)
-				// Continue running even if one sale creation fails
+		case <-timer.C:
+			if !prepared {
+				if err := s.createNewSale(nextStart, models.SaleStatusScheduled); err != nil {
+					slog.Error("Failed to create new sale", "error", err)
+					// Continue running even if one sale creation fails
+				}
+				prepared = true
+				timer.Reset(time.Until(nextStart))
+				break
 			}
 
-		case <-cleanupTicker.C:
-			if err := s.cleanupExpiredSales(); err != nil {
-				log.Printf("Failed to cleanup expired sales: %v", err)
-				// Continue running even if cleanup fails
+			if err := s.activateDueSales(); err != nil {
+				slog.Error("Failed to activate sales", "error", err)
+			}
+			nextStart = s.Schedule.NextBoundary(time.Now())
+			prepared = false
+			timer.Reset(time.Until(s.generationAt(nextStart)))
+
+		case <-cleanupTimer.C:
+			s.runCleanup()
+			cleanupTimer.Reset(jittered(s.CleanupInterval, s.CleanupJitter))
+
+		case <-scheduledTicker.C:
+			if err := s.generatePendingSales(); err != nil {
+				slog.Error("Failed to generate scheduled sales", "error", err)
+			}
+			if err := s.activateDueSales(); err != nil {
+				slog.Error("Failed to activate sales", "error", err)
 			}
 
 		case <-ctx.Done():
-			log.Println("Scheduler stopped")
 			return ctx.Err()
 		}
+		s.beat()
 	}
 }
-
-func StartScheduler(db *sql.DB) {
-    ticker := time.NewTicker(1 * time.Hour)
-    go func() {
-        for {
-            <-ticker.C
-            createNewSale(db)
-        }
-    }()
-}
-
-func createNewSale(db *sql.DB) {
-    startTime := time.Now().Truncate(time.Hour)
-    endTime := startTime.Add(1 * time.Hour)
-
-    _, err := db.Exec(`
-        INSERT INTO sales (start_time, end_time, total_items)
-        VALUES ($1, $2, $3)
-    `, startTime, endTime, 10000)
-
-    if err != nil {
-        log.Printf("Error creating new sale: %v", err)
-        return
-    }
-
-    log.Printf("New sale created from %v to %v", startTime, endTime)
-
-    // Generate 10,000 items for this sale
-    generateItems(db, startTime)
-}
-
-func generateItems(db *sql.DB, saleStartTime time.Time) {
-    // Implementation for generating 10,000 unique items
-    // This is a placeholder and should be implemented with actual logic
-    log.Println("Generating 10,000 items for the new sale")
-}
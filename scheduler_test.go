@@ -0,0 +1,643 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	mathrand "math/rand"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"flash-sale-service/internal/config"
+	"flash-sale-service/internal/database"
+	"flash-sale-service/internal/metrics"
+	"flash-sale-service/internal/models"
+	redisClient "flash-sale-service/internal/redis"
+)
+
+func TestScheduleWindowsAcrossDSTChanges(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	// The instance's own zone must not matter either
+	local := time.Local
+	time.Local = newYork
+	t.Cleanup(func() { time.Local = local })
+
+	schedule := Schedule{Duration: time.Hour}
+	for _, day := range []struct {
+		name string
+		from time.Time
+	}{
+		{"spring forward", time.Date(2024, time.March, 10, 0, 0, 0, 0, newYork)},
+		{"fall back", time.Date(2024, time.November, 3, 0, 0, 0, 0, newYork)},
+	} {
+		t.Run(day.name, func(t *testing.T) {
+			start := schedule.WindowStart(day.from)
+			if start.Location() != time.UTC {
+				t.Fatalf("WindowStart location = %v, want UTC", start.Location())
+			}
+			if !start.Equal(day.from) {
+				t.Fatalf("WindowStart(%v) = %v, want the same instant", day.from, start)
+			}
+
+			// Walk every minute of the six hours around the change: each
+			// falls in the window that started on the hour before it, and
+			// the windows follow each other exactly an hour apart
+			for i := 0; i < 6; i++ {
+				end := schedule.NextBoundary(start)
+				if end.Location() != time.UTC || !end.Equal(end.Truncate(time.Hour)) {
+					t.Errorf("boundary %v is not on a UTC hour", end)
+				}
+				if got := end.Sub(start); got != time.Hour {
+					t.Errorf("window from %v runs %v, want 1h", start, got)
+				}
+				for at := start; at.Before(end); at = at.Add(time.Minute) {
+					if got := schedule.WindowStart(at.In(newYork)); !got.Equal(start) {
+						t.Fatalf("WindowStart(%v) = %v, want %v", at.In(newYork), got, start)
+					}
+				}
+				start = end
+			}
+		})
+	}
+}
+
+func TestScheduleNextBoundary(t *testing.T) {
+	at := func(hour, min, sec int) time.Time {
+		return time.Date(2024, time.June, 1, hour, min, sec, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		now      time.Time
+		want     time.Time
+	}{
+		{"hourly mid-window", Schedule{Duration: time.Hour}, at(10, 17, 42), at(11, 0, 0)},
+		{"hourly on a boundary", Schedule{Duration: time.Hour}, at(10, 0, 0), at(11, 0, 0)},
+		{"hourly just before a boundary", Schedule{Duration: time.Hour}, at(10, 59, 59), at(11, 0, 0)},
+		{"30 minutes first half", Schedule{Duration: 30 * time.Minute}, at(10, 5, 0), at(10, 30, 0)},
+		{"30 minutes second half", Schedule{Duration: 30 * time.Minute}, at(10, 45, 0), at(11, 0, 0)},
+		{"30 minutes on a boundary", Schedule{Duration: 30 * time.Minute}, at(10, 30, 0), at(11, 0, 0)},
+		{"2 hours on an odd hour", Schedule{Duration: 2 * time.Hour}, at(11, 10, 0), at(12, 0, 0)},
+		{"2 hours on an even hour", Schedule{Duration: 2 * time.Hour}, at(12, 0, 0), at(14, 0, 0)},
+		{"2 hours across midnight", Schedule{Duration: 2 * time.Hour}, at(23, 30, 0), at(24, 0, 0)},
+		{"hourly at quarter past", Schedule{Duration: time.Hour, Offset: 15 * time.Minute}, at(10, 10, 0), at(10, 15, 0)},
+		{"hourly at quarter past, after it", Schedule{Duration: time.Hour, Offset: 15 * time.Minute}, at(10, 20, 0), at(11, 15, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.schedule.NextBoundary(tt.now)
+			if !got.Equal(tt.want) {
+				t.Errorf("NextBoundary(%v) = %v, want %v", tt.now, got, tt.want)
+			}
+			if start := tt.schedule.WindowStart(tt.now); !start.Add(tt.schedule.Duration).Equal(got) {
+				t.Errorf("WindowStart(%v) = %v, want one window before %v", tt.now, start, got)
+			}
+		})
+	}
+}
+
+func TestNewSchedulerValidatesCadence(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Scheduler
+		wantErr string
+	}{
+		{"hourly default", config.Scheduler{}, ""},
+		{"30 minutes", config.Scheduler{SaleDuration: 30 * time.Minute, CleanupInterval: 5 * time.Minute}, ""},
+		{"negative duration", config.Scheduler{SaleDuration: -time.Hour}, "sale duration"},
+		{"cleanup as long as the sale", config.Scheduler{SaleDuration: 30 * time.Minute, CleanupInterval: 30 * time.Minute}, "cleanup interval"},
+		{"offset past the duration", config.Scheduler{SaleDuration: 30 * time.Minute, CleanupInterval: time.Minute, SaleOffset: time.Hour}, "sale offset"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewScheduler(nil, nil, tt.cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("NewScheduler: %v", err)
+				}
+				if s.Schedule.Duration <= 0 {
+					t.Errorf("Schedule.Duration = %v, want positive", s.Schedule.Duration)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewScheduler error = %v, want one about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGenerateItemsTierProportions(t *testing.T) {
+	shares := []models.TierShare{
+		{Tier: models.TierLegendary, Percent: 5},
+		{Tier: models.TierRare, Percent: 20},
+		{Tier: models.TierCommon, Percent: 75},
+	}
+	if err := models.ValidateTierShares(shares); err != nil {
+		t.Fatalf("ValidateTierShares: %v", err)
+	}
+
+	const count = 20000
+	gen := NewSeededItemGenerator(mathrand.NewSource(42))
+	items, err := generateItems(gen, PicsumImages{}, shares, "sale_1", count, false, 1)
+	if err != nil {
+		t.Fatalf("generateItems: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, item := range items {
+		counts[item.Tier]++
+	}
+	// A percentage point either way is several standard deviations at this
+	// batch size
+	for _, share := range shares {
+		got := 100 * float64(counts[share.Tier]) / count
+		if math.Abs(got-float64(share.Percent)) > 1 {
+			t.Errorf("%s items = %.2f%%, want %d%% within 1 point", share.Tier, got, share.Percent)
+		}
+	}
+	if len(counts) != len(shares) {
+		t.Errorf("tiers generated = %v, want only %d tiers", counts, len(shares))
+	}
+}
+
+// currentTime matches a query argument that is the time the query was made
+type currentTime struct{}
+
+func (currentTime) Match(v driver.Value) bool {
+	at, ok := v.(time.Time)
+	return ok && time.Since(at).Abs() < time.Second
+}
+
+// queriedAt matches the current time query argument of a due sales query,
+// made on the due side of start or before it. The mock can't run the SQL, so
+// it returns the rows the database would for that side, and this checks the
+// scheduler asked at the time the rows are for.
+type queriedAt struct {
+	start time.Time
+	due   bool
+}
+
+func (q queriedAt) Match(v driver.Value) bool {
+	at, ok := v.(time.Time)
+	return ok && currentTime{}.Match(at) && !at.Before(q.start) == q.due
+}
+
+func TestActivateDueSalesAtStartTime(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer sqlDB.Close()
+	s, err := NewScheduler(&database.DB{DB: sqlDB}, nil, config.Scheduler{})
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+
+	dueColumns := []string{"sale_id", "start_time", "end_time", "total_items", "items_sold", "status", "checkout_ttl_seconds"}
+	dueQuery := regexp.QuoteMeta("WHERE status = $1 AND start_time <= $2 AND end_time > $2")
+	start := time.Now().UTC().Add(100 * time.Millisecond)
+
+	// Before its start the sale isn't due, and nothing is activated
+	mock.ExpectQuery(dueQuery).WithArgs(models.SaleStatusScheduled, queriedAt{start, false}).
+		WillReturnRows(sqlmock.NewRows(dueColumns))
+	if err := s.activateDueSales(); err != nil {
+		t.Fatalf("activateDueSales before the start: %v", err)
+	}
+
+	// From its start it is due and made active, once
+	time.Sleep(time.Until(start))
+	for _, activated := range []int64{1, 0} {
+		mock.ExpectQuery(dueQuery).WithArgs(models.SaleStatusScheduled, queriedAt{start, true}).
+			WillReturnRows(sqlmock.NewRows(dueColumns).
+				AddRow("sale_1", start, start.Add(time.Hour), 100, 0, models.SaleStatusScheduled, 300))
+		mock.ExpectExec("UPDATE sales SET status").
+			WithArgs(models.SaleStatusActive, "sale_1", models.SaleStatusScheduled).
+			WillReturnResult(sqlmock.NewResult(0, activated))
+		if err := s.activateDueSales(); err != nil {
+			t.Fatalf("activateDueSales at the start: %v", err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoopRecoversPanickingPass(t *testing.T) {
+	// Without a database the first cleanup pass panics
+	s, err := NewScheduler(nil, nil, config.Scheduler{})
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+
+	err = s.loop(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "panic") {
+		t.Fatalf("loop error = %v, want the recovered panic", err)
+	}
+	if beat := s.LastHeartbeat(); time.Since(beat) > time.Second {
+		t.Errorf("LastHeartbeat = %v, want the loop's start", beat)
+	}
+}
+
+func TestJitteredStaysWithinSpread(t *testing.T) {
+	tests := []struct {
+		name      string
+		d, spread time.Duration
+	}{
+		{"no jitter", 15 * time.Minute, 0},
+		{"documented example", 900 * time.Second, 60 * time.Second},
+		{"one nanosecond", time.Second, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			low, high := tt.d, tt.d
+			for i := 0; i < 10000; i++ {
+				got := jittered(tt.d, tt.spread)
+				if got < tt.d-tt.spread || got > tt.d+tt.spread {
+					t.Fatalf("jittered(%v, %v) = %v, want within [%v, %v]", tt.d, tt.spread, got, tt.d-tt.spread, tt.d+tt.spread)
+				}
+				low, high = min(low, got), max(high, got)
+			}
+			// The draws actually spread over the range rather than sticking
+			// to the interval
+			if tt.spread >= time.Second && (tt.d-low < tt.spread/2 || high-tt.d < tt.spread/2) {
+				t.Errorf("draws spanned [%v, %v], want most of [%v, %v]", low, high, tt.d-tt.spread, tt.d+tt.spread)
+			}
+		})
+	}
+}
+
+func TestGenerationAtStaysWithinJitter(t *testing.T) {
+	s, err := NewScheduler(nil, nil, config.Scheduler{LeadTime: 5 * time.Minute, GenerationJitter: time.Minute})
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+
+	start := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	earliest, latest := start.Add(-5*time.Minute), start.Add(-4*time.Minute)
+	for i := 0; i < 10000; i++ {
+		if at := s.generationAt(start); at.Before(earliest) || at.After(latest) {
+			t.Fatalf("generationAt = %v, want within [%v, %v]", at, earliest, latest)
+		}
+	}
+}
+
+func TestStartCleansUpBeforeFirstBoundary(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer sqlDB.Close()
+	rdb := &redisClient.Client{Client: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})}
+	defer rdb.Close()
+
+	// Neither the next window nor the periodic pass is anywhere near
+	s, err := NewScheduler(&database.DB{DB: sqlDB}, rdb, config.Scheduler{CleanupInterval: 50 * time.Minute})
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+	s.Schedule = Schedule{Duration: 24 * time.Hour}
+
+	// A checkout left over from before the restart, already expired
+	now := time.Now()
+	items := []models.Item{{ItemID: "item_1", SaleID: "sale_1"}}
+	if err := rdb.InitializeSale("sale_1", now.Add(-time.Minute), now.Add(time.Hour), items, 1); err != nil {
+		t.Fatalf("InitializeSale: %v", err)
+	}
+	if reserved, err := rdb.ReserveItem(context.Background(), "code_1", "sale_1", "user_1", "item_1", now.Add(20*time.Millisecond)); err != nil || !reserved {
+		t.Fatalf("ReserveItem = %v, %v; want reserved", reserved, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	saleColumns := []string{"sale_id", "start_time", "end_time", "total_items", "items_sold", "status", "checkout_ttl_seconds"}
+	mock.ExpectQuery("FROM sales").WillReturnRows(sqlmock.NewRows(saleColumns))
+	mock.ExpectQuery("FROM sales").WillReturnRows(sqlmock.NewRows(saleColumns).
+		AddRow("sale_1", now.Add(-time.Minute), now.Add(time.Hour), 1, 0, models.SaleStatusActive, 300))
+	// The cleanup pass: activation, then reconciliation and completion
+	mock.ExpectQuery("FROM sales").WillReturnRows(sqlmock.NewRows(saleColumns))
+	mock.ExpectQuery("FROM sales").WillReturnRows(sqlmock.NewRows(saleColumns))
+	mock.ExpectQuery("FROM sales").WillReturnRows(sqlmock.NewRows(saleColumns))
+
+	expiredBefore := metrics.CounterValue(metrics.CheckoutReservationsExpiredTotal)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Start(ctx) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for mock.ExpectationsWereMet() != nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Start = %v, want context.Canceled", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("first cleanup pass didn't run: %v", err)
+	}
+	if released := metrics.CounterValue(metrics.CheckoutReservationsExpiredTotal) - expiredBefore; released != 1 {
+		t.Errorf("expired reservations released = %v, want 1", released)
+	}
+}
+
+func TestConcurrentCreateNewSaleCreatesOneSale(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer sqlDB.Close()
+	mr := miniredis.RunT(t)
+	rdb := &redisClient.Client{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	defer rdb.Close()
+
+	// Two instances sharing the database and Redis
+	cfg := config.Scheduler{ItemsPerSale: 10, SalesPerWindow: 1}
+	winner, err := NewScheduler(&database.DB{DB: sqlDB}, rdb, cfg)
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+	loser, err := NewScheduler(&database.DB{DB: sqlDB}, rdb, cfg)
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+
+	// Ahead of now, for the Redis keys to expire after it
+	start := time.Now().UTC().Add(time.Hour).Truncate(time.Minute)
+	lock := saleLockKey(start)
+
+	// The winner's existing-sale check is slow enough to hold the lock while
+	// the loser tries it; the loser touches the database not at all
+	mock.ExpectQuery("SELECT COUNT").WithArgs(start).WillDelayFor(200 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("INSERT INTO sales").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO items").WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectCommit()
+	// Once the lock is free again the existing sale stops a later run
+	mock.ExpectQuery("SELECT COUNT").WithArgs(start).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	done := make(chan error, 1)
+	go func() { done <- winner.createNewSale(start, models.SaleStatusActive) }()
+	for deadline := time.Now().Add(time.Second); !mr.Exists(lock); {
+		if time.Now().After(deadline) {
+			t.Fatal("winner never took the sale creation lock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := loser.createNewSale(start, models.SaleStatusActive); err != nil {
+		t.Fatalf("loser createNewSale: %v", err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("winner finished (%v) before the loser tried the lock", err)
+	default:
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("winner createNewSale: %v", err)
+	}
+	if mr.Exists(lock) {
+		t.Error("sale creation lock still held after the run")
+	}
+
+	if err := loser.createNewSale(start, models.SaleStatusActive); err != nil {
+		t.Fatalf("createNewSale after the race: %v", err)
+	}
+	// Exactly one INSERT INTO sales was expected, and any other statement
+	// fails the mock
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// saleLockKey is the Redis key of the sale creation lock for a window
+func saleLockKey(start time.Time) string {
+	return fmt.Sprintf("lock:sale:create:%d", start.Unix())
+}
+
+func TestCompleteExpiredSalesCompletesOnce(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer sqlDB.Close()
+	rdb := &redisClient.Client{Client: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})}
+	defer rdb.Close()
+	s, err := NewScheduler(&database.DB{DB: sqlDB}, rdb, config.Scheduler{})
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+
+	now := time.Now()
+	items := []models.Item{{ItemID: "item_1", SaleID: "sale_1"}}
+	if err := rdb.InitializeSale("sale_1", now.Add(-time.Hour), now.Add(time.Hour), items, 1); err != nil {
+		t.Fatalf("InitializeSale: %v", err)
+	}
+
+	saleColumns := []string{"sale_id", "start_time", "end_time", "total_items", "items_sold", "status", "checkout_ttl_seconds"}
+	expired := func() *sqlmock.Rows {
+		return sqlmock.NewRows(saleColumns).
+			AddRow("sale_1", now.Add(-time.Hour), now.Add(-time.Minute), 1, 0, models.SaleStatusActive, 300)
+	}
+
+	// The first pass completes the sale; a pass that read it before then,
+	// as another instance's would, finds it already moved on
+	for _, completed := range []int64{1, 0} {
+		mock.ExpectQuery("FROM sales").WithArgs(models.SaleStatusScheduled, models.SaleStatusActive, models.SaleStatusSoldOut, currentTime{}).
+			WillReturnRows(expired())
+		mock.ExpectExec("UPDATE sales SET status").
+			WithArgs(models.SaleStatusCompleted, "sale_1", models.SaleStatusActive).
+			WillReturnResult(sqlmock.NewResult(0, completed))
+		if err := s.completeExpiredSales(); err != nil {
+			t.Fatalf("completeExpiredSales: %v", err)
+		}
+	}
+
+	// Once completed the sale is no longer expired and active
+	mock.ExpectQuery("FROM sales").WillReturnRows(sqlmock.NewRows(saleColumns))
+	if err := s.completeExpiredSales(); err != nil {
+		t.Fatalf("completeExpiredSales after completion: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGenerateItemsUniqueNames(t *testing.T) {
+	const count = 10000
+	for _, unique := range []bool{false, true} {
+		gen := NewSeededItemGenerator(mathrand.NewSource(7))
+		items, err := generateItems(gen, PicsumImages{}, nil, "sale_1", count, unique, 1)
+		if err != nil {
+			t.Fatalf("generateItems: %v", err)
+		}
+		if len(items) != count {
+			t.Fatalf("generated %d items, want %d", len(items), count)
+		}
+
+		names := make(map[string]bool, count)
+		duplicates := 0
+		for _, item := range items {
+			if names[item.Name] {
+				duplicates++
+			}
+			names[item.Name] = true
+		}
+		switch {
+		case unique && duplicates > 0:
+			t.Errorf("with unique names: %d duplicate names", duplicates)
+		case !unique && duplicates == 0:
+			// Otherwise the batch is too small to show dedup doing anything
+			t.Errorf("without unique names: no duplicate names in %d items", count)
+		}
+	}
+}
+
+func BenchmarkGenerateItems(b *testing.B) {
+	const count = 50000
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			gen := NewItemGenerator()
+			for i := 0; i < b.N; i++ {
+				if _, err := generateItems(gen, PicsumImages{}, nil, "sale_1", count, false, workers); err != nil {
+					b.Fatalf("generateItems: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCreateNewSaleDryRun(b *testing.B) {
+	s, err := NewScheduler(nil, nil, config.Scheduler{ItemsPerSale: 10000, DryRun: true})
+	if err != nil {
+		b.Fatalf("NewScheduler: %v", err)
+	}
+	// Every write is logged in a dry run; only the generation is measured
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	start := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// A window of its own each time, or the first sale stops the rest
+		window := start.Add(time.Duration(i) * s.Schedule.Duration)
+		if err := s.createNewSale(window, models.SaleStatusScheduled); err != nil {
+			b.Fatalf("createNewSale: %v", err)
+		}
+	}
+}
+
+func TestDryRunSkipsActivationAndCleanup(t *testing.T) {
+	// Without a database any pass that reached it would panic
+	s, err := NewScheduler(nil, nil, config.Scheduler{DryRun: true})
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+	if err := s.activateDueSales(); err != nil {
+		t.Errorf("activateDueSales: %v", err)
+	}
+	s.runCleanup()
+}
+
+func TestReconcileInventorySkipsFailingSales(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer sqlDB.Close()
+	rdb := &redisClient.Client{Client: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})}
+	defer rdb.Close()
+	s, err := NewScheduler(&database.DB{DB: sqlDB}, rdb, config.Scheduler{})
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+
+	// sale_1 was lost from Redis; sale_2 and sale_3 each sold a unit
+	now := time.Now()
+	for _, saleID := range []string{"sale_2", "sale_3"} {
+		itemID := "item_" + saleID
+		items := []models.Item{{ItemID: itemID, SaleID: saleID}}
+		if err := rdb.InitializeSale(saleID, now.Add(-time.Minute), now.Add(time.Hour), items, 5); err != nil {
+			t.Fatalf("InitializeSale: %v", err)
+		}
+		if err := rdb.HSet(context.Background(), "checkout:code_"+saleID, "user_id", "user_1", "item_id", itemID, "sale_id", saleID).Err(); err != nil {
+			t.Fatalf("HSet checkout: %v", err)
+		}
+		if _, err := redisClient.DecrementInventory(context.Background(), rdb, saleID, "user_1", itemID, "code_"+saleID, 1); err != nil {
+			t.Fatalf("DecrementInventory: %v", err)
+		}
+	}
+
+	rows := sqlmock.NewRows([]string{"sale_id", "start_time", "end_time", "total_items", "items_sold", "status", "checkout_ttl_seconds"})
+	for _, saleID := range []string{"sale_1", "sale_2", "sale_3"} {
+		rows.AddRow(saleID, now.Add(-time.Minute), now.Add(time.Hour), 5, 0, models.SaleStatusActive, 300)
+	}
+	mock.ExpectQuery("FROM sales").WillReturnRows(rows)
+	mock.ExpectExec("UPDATE sales SET items_sold").WithArgs(1, "sale_2", 0).WillReturnError(errors.New("connection reset"))
+	mock.ExpectExec("UPDATE sales SET items_sold").WithArgs(1, "sale_3", 0).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = s.reconcileInventory()
+	if err == nil || !strings.Contains(err.Error(), "sale_2") {
+		t.Errorf("reconcileInventory = %v, want sale_2's failure", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("later sales weren't reconciled: %v", err)
+	}
+}
+
+func TestSaleGeneratedLeadTimeAheadIsScheduled(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer sqlDB.Close()
+	rdb := &redisClient.Client{Client: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})}
+	defer rdb.Close()
+	s, err := NewScheduler(&database.DB{DB: sqlDB}, rdb, config.Scheduler{ItemsPerSale: 10, LeadTime: 10 * time.Minute})
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+
+	start := time.Now().UTC().Add(10 * time.Minute).Truncate(time.Second)
+	if at := s.generationAt(start); !at.Equal(start.Add(-10 * time.Minute)) {
+		t.Fatalf("generationAt = %v, want LeadTime before the start %v", at, start)
+	}
+
+	// Generated at that point, the sale is recorded scheduled and only the
+	// activation at its start makes it active
+	mock.ExpectQuery("SELECT COUNT").WithArgs(start).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("INSERT INTO sales").
+		WithArgs(sqlmock.AnyArg(), start, start.Add(s.Schedule.Duration), sqlmock.AnyArg(), 0,
+			models.SaleStatusScheduled, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO items").WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectCommit()
+
+	if err := s.createNewSale(start, models.SaleStatusScheduled); err != nil {
+		t.Fatalf("createNewSale: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,98 @@
+-- Flash Sale Service schema
+
+CREATE TABLE IF NOT EXISTS sales (
+    sale_id     VARCHAR(64) PRIMARY KEY,
+    start_time  TIMESTAMPTZ NOT NULL,
+    end_time    TIMESTAMPTZ NOT NULL,
+    total_items INTEGER NOT NULL,
+    items_sold  INTEGER NOT NULL DEFAULT 0,
+    status      VARCHAR(32) NOT NULL,
+    -- How long a checkout in the sale holds an item
+    checkout_ttl_seconds INTEGER NOT NULL DEFAULT 60,
+    -- Items still to be generated for a sale scheduled ahead of its lead time
+    pending_items INTEGER NOT NULL DEFAULT 0,
+    -- Audit trail of sales voided by an admin
+    cancelled_by VARCHAR(128),
+    cancelled_at TIMESTAMPTZ
+);
+
+ALTER TABLE sales ADD COLUMN IF NOT EXISTS cancelled_by VARCHAR(128);
+ALTER TABLE sales ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMPTZ;
+ALTER TABLE sales ADD COLUMN IF NOT EXISTS checkout_ttl_seconds INTEGER NOT NULL DEFAULT 60;
+ALTER TABLE sales ADD COLUMN IF NOT EXISTS pending_items INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_sales_status_time ON sales (status, start_time, end_time);
+
+CREATE TABLE IF NOT EXISTS items (
+    item_id   VARCHAR(64) PRIMARY KEY,
+    sale_id   VARCHAR(64) NOT NULL REFERENCES sales (sale_id),
+    name      TEXT NOT NULL,
+    category  VARCHAR(64) NOT NULL DEFAULT '',
+    image_url TEXT NOT NULL,
+    -- Rarity tier: legendary, rare or common
+    tier      VARCHAR(16) NOT NULL DEFAULT 'common',
+    -- Prices are in cents; a zero discount price sells at price_cents
+    price_cents          BIGINT NOT NULL DEFAULT 0,
+    discount_price_cents BIGINT NOT NULL DEFAULT 0,
+    -- Hot items are checked out in arrival order through a queue
+    queued    BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+-- Brings databases created before these columns existed up to date
+ALTER TABLE items ADD COLUMN IF NOT EXISTS category VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE items ADD COLUMN IF NOT EXISTS price_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE items ADD COLUMN IF NOT EXISTS discount_price_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE items ADD COLUMN IF NOT EXISTS tier VARCHAR(16) NOT NULL DEFAULT 'common';
+ALTER TABLE items ADD COLUMN IF NOT EXISTS queued BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_items_sale ON items (sale_id, item_id);
+CREATE INDEX IF NOT EXISTS idx_items_sale_category ON items (sale_id, category, item_id);
+
+-- Backs item search, a case-insensitive substring match on name; a trigram
+-- index serves ILIKE '%...%' where a b-tree can't
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS idx_items_name_trgm ON items USING gin (name gin_trgm_ops);
+
+CREATE TABLE IF NOT EXISTS purchases (
+    purchase_id VARCHAR(64) PRIMARY KEY,
+    sale_id     VARCHAR(64) NOT NULL REFERENCES sales (sale_id),
+    user_id     VARCHAR(128) NOT NULL,
+    item_id     VARCHAR(64) NOT NULL REFERENCES items (item_id),
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    -- Backs the one-item-per-user rule enforced in Redis
+    CONSTRAINT purchases_sale_user_unique UNIQUE (sale_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_purchases_user ON purchases (user_id, created_at DESC);
+-- Backs per-sale aggregates such as the results report and sellout time
+CREATE INDEX IF NOT EXISTS idx_purchases_sale_created ON purchases (sale_id, created_at);
+
+-- Append-only trail of every inventory change, purchases and admin stock
+-- adjustments, for dispute resolution
+CREATE TABLE IF NOT EXISTS audit (
+    audit_id      BIGSERIAL PRIMARY KEY,
+    purchase_id   VARCHAR(64) NOT NULL,
+    sale_id       VARCHAR(64) NOT NULL,
+    user_id       VARCHAR(128) NOT NULL,
+    item_id       VARCHAR(64) NOT NULL,
+    checkout_code TEXT NOT NULL,
+    stock_before  INTEGER NOT NULL,
+    stock_after   INTEGER NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE audit ADD COLUMN IF NOT EXISTS action VARCHAR(32) NOT NULL DEFAULT 'purchase';
+
+CREATE INDEX IF NOT EXISTS idx_audit_user ON audit (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_audit_item ON audit (item_id, created_at DESC);
+
+-- Audit entries can't be changed or removed once written
+CREATE OR REPLACE FUNCTION audit_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit entries are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_immutable ON audit;
+CREATE TRIGGER audit_immutable BEFORE UPDATE OR DELETE ON audit
+    FOR EACH ROW EXECUTE FUNCTION audit_immutable();
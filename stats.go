@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/database"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/metrics"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+// statsCacheTTL is how long a /stats response is served to every caller
+// before it is rebuilt, so dashboards polling in parallel cost one build per
+// second between them
+const statsCacheTTL = time.Second
+
+// StatsHandler serves GET /stats, a system-wide view of the running sales for
+// operations dashboards: each active sale with its live inventory, the
+// purchases of the last minute and hour, the open checkouts and this
+// instance's rate limit rejections. Live numbers come from Redis counters;
+// the only database read is the indexed active sales query.
+func StatsHandler(db *database.DB, redisClient *redis.Client) http.HandlerFunc {
+	var (
+		mu      sync.Mutex
+		body    []byte
+		expires time.Time
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		// Holding the lock while building makes concurrent callers wait for
+		// one build instead of each running their own
+		mu.Lock()
+		defer mu.Unlock()
+
+		if time.Now().After(expires) {
+			stats, err := buildStats(r, db, redisClient)
+			if err != nil {
+				Logger(r.Context()).Error("Failed to build stats", "error", err)
+				writeDependencyError(w, err, "Error loading stats")
+				return
+			}
+			body = stats
+			expires = time.Now().Add(statsCacheTTL)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// buildStats gathers the /stats response and encodes it
+func buildStats(r *http.Request, db *database.DB, redisClient *redis.Client) ([]byte, error) {
+	sales, err := db.GetActiveSalesContext(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	itemsRemaining := 0
+	activeSales := make([]map[string]interface{}, len(sales))
+	for i, sale := range sales {
+		remaining, err := redisClient.GetRemainingInventory(sale.SaleID)
+		if errors.Is(err, redis.ErrSaleNotInitialized) {
+			remaining = sale.TotalItems - sale.ItemsSold
+		} else if err != nil {
+			return nil, err
+		}
+		itemsRemaining += remaining
+
+		activeSales[i] = map[string]interface{}{
+			"sale_id":         sale.SaleID,
+			"status":          sale.Status,
+			"start_time":      sale.StartTime.Unix(),
+			"end_time":        sale.EndTime.Unix(),
+			"total_items":     sale.TotalItems,
+			"items_remaining": remaining,
+		}
+	}
+
+	purchases, err := redisClient.RecentPurchases(time.Minute, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	checkouts, err := redisClient.ActiveCheckouts()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"success":      true,
+		"generated_at": time.Now().Unix(),
+		"sales":        activeSales,
+		"stats": map[string]interface{}{
+			"active_sales":          len(sales),
+			"items_remaining":       itemsRemaining,
+			"purchases_last_minute": purchases[0],
+			"purchases_last_hour":   purchases[1],
+			"active_checkouts":      checkouts,
+			"rate_limit_rejections": int64(metrics.CounterValue(metrics.RateLimitRejectionsTotal)),
+		},
+	})
+}
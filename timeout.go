@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/handlers"
+)
+
+// timeoutWriteGrace is how long past the handler deadline the connection
+// stays writable, so the timeout response itself can still be sent
+const timeoutWriteGrace = time.Second
+
+// timeoutWriter buffers a response until the handler finishes, so nothing
+// reaches the client if the deadline passes first. A handler that flushes
+// switches it to streaming: what was buffered is sent and later writes go
+// straight through until the deadline.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mu          sync.Mutex
+	buf         bytes.Buffer
+	status      int
+	wroteHeader bool
+	timedOut    bool
+	streaming   bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.status = code
+	tw.wroteHeader = true
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.status = http.StatusOK
+		tw.wroteHeader = true
+	}
+	if tw.streaming {
+		return tw.w.Write(p)
+	}
+	return tw.buf.Write(p)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if !tw.streaming {
+		tw.writeBufferedLocked()
+		tw.streaming = true
+	}
+	http.NewResponseController(tw.w).Flush()
+}
+
+// writeBufferedLocked sends the buffered headers and body to the client
+func (tw *timeoutWriter) writeBufferedLocked() {
+	for key, values := range tw.header {
+		tw.w.Header()[key] = values
+	}
+	if !tw.wroteHeader {
+		tw.status = http.StatusOK
+		tw.wroteHeader = true
+	}
+	tw.w.WriteHeader(tw.status)
+	tw.w.Write(tw.buf.Bytes())
+	tw.buf.Reset()
+}
+
+// TimeoutMiddleware gives each request d to finish. The handler's context is
+// cancelled at the deadline, so database queries and Redis commands made with
+// the request context abort with it, and the client gets 503 REQUEST_TIMEOUT
+// instead of waiting on a stuck dependency. Responses are buffered until the
+// handler returns or flushes; once a handler has flushed, a timeout can only
+// cut the response short. Long-lived streams such as SSE must not use it. The
+// connection's write deadline is moved to match d, which lets a route run
+// longer than the server's WriteTimeout.
+func TimeoutMiddleware(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			// Not every ResponseWriter supports deadlines; the server's own
+			// WriteTimeout then stands
+			http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d + timeoutWriteGrace))
+
+			tw := &timeoutWriter{w: w, header: w.Header().Clone()}
+			done := make(chan struct{})
+			panicked := make(chan interface{}, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+					}
+				}()
+				next.ServeHTTP(tw, r.WithContext(ctx))
+				close(done)
+			}()
+
+			select {
+			case p := <-panicked:
+				// Re-raised on the serving goroutine so RecoveryMiddleware
+				// still sees it
+				panic(p)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				if !tw.streaming {
+					tw.writeBufferedLocked()
+				}
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+
+				// A client that went away gets nothing, and a response
+				// already streaming can only be cut short
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) && !tw.streaming {
+					handlers.Logger(r.Context()).Error("Request timed out", "method", r.Method, "path", r.URL.Path, "timeout", d)
+					handlers.WriteJSONError(w, http.StatusServiceUnavailable, handlers.ErrCodeRequestTimeout, "Request took too long, please retry")
+				}
+			}
+		})
+	}
+}
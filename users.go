@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Hananjeda/Flash-Sale-Service/internal/database"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/models"
+	"github.com/Hananjeda/Flash-Sale-Service/internal/redis"
+)
+
+// UserResourceHandler routes /users/{userID}/purchases and
+// /users/{userID}/reservations
+func UserResourceHandler(purchases, reservations http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/reservations") {
+			reservations.ServeHTTP(w, r)
+			return
+		}
+		purchases.ServeHTTP(w, r)
+	}
+}
+
+// UserPurchasesHandler serves GET /users/{userID}/purchases, newest first,
+// with optional ?sale_id= filtering
+func UserPurchasesHandler(db *database.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/users/"), "/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] != "purchases" {
+			http.NotFound(w, r)
+			return
+		}
+		userID := parts[0]
+
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		purchases, err := db.GetPurchasesByUser(userID, r.URL.Query().Get("sale_id"))
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load purchases", "user_id", userID, "error", err)
+			WriteJSONError(w, http.StatusInternalServerError, ErrCodeInternal, "Error loading purchases")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"user_id":   userID,
+			"purchases": purchases,
+		})
+	}
+}
+
+// UserReservationsHandler serves GET /users/{userID}/reservations, the user's
+// checkouts that still hold an item, soonest to expire first, each with the
+// item and how long is left on it. When requests are authenticated a user
+// can only list their own.
+func UserReservationsHandler(db *database.DB, redisClient *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/users/"), "/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] != "reservations" {
+			http.NotFound(w, r)
+			return
+		}
+		userID := parts[0]
+
+		if r.Method != http.MethodGet {
+			WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		if authUserID, ok := UserFromContext(r.Context()); ok && authUserID != userID {
+			WriteJSONError(w, http.StatusForbidden, ErrCodeForbidden, "Reservations can only be listed for the authenticated user")
+			return
+		}
+
+		checkouts, err := redisClient.GetUserCheckouts(userID)
+		if err != nil {
+			Logger(r.Context()).Error("Failed to load reservations", "user_id", userID, "error", err)
+			writeDependencyError(w, err, "Error loading reservations")
+			return
+		}
+
+		now := time.Now()
+		reservations := make([]map[string]interface{}, 0, len(checkouts))
+		items := make(map[string]*models.Item, len(checkouts))
+		for _, checkout := range checkouts {
+			item, seen := items[checkout.ItemID]
+			if !seen {
+				item, err = db.GetItemContext(r.Context(), checkout.ItemID)
+				if err != nil {
+					Logger(r.Context()).Error("Failed to load item", "item_id", checkout.ItemID, "error", err)
+					writeDependencyError(w, err, "Error loading reservations")
+					return
+				}
+				items[checkout.ItemID] = item
+			}
+
+			// The item went with its sale, so the checkout can't be bought
+			if item == nil {
+				continue
+			}
+
+			reservations = append(reservations, map[string]interface{}{
+				"checkout_code": checkout.Code,
+				"sale_id":       checkout.SaleID,
+				"item":          item,
+				"expires_at":    checkout.ExpiresAt.Unix(),
+				"ttl_seconds":   int(checkout.ExpiresAt.Sub(now).Round(time.Second) / time.Second),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":      true,
+			"user_id":      userID,
+			"reservations": reservations,
+		})
+	}
+}
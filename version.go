@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// Build information, stamped at build time with
+//
+//	-ldflags "-X github.com/Hananjeda/Flash-Sale-Service/internal/handlers.Version=v1.2.3 ..."
+//
+// Each is "dev" in a build that doesn't set it.
+var (
+	Version   = "dev"
+	Commit    = "dev"
+	BuildTime = "dev"
+)
+
+// VersionHandler reports which build is running. Like liveness it never
+// touches a dependency, so it answers 200 even during an outage.
+func VersionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version":    Version,
+			"commit":     Commit,
+			"build_time": BuildTime,
+			"go_version": runtime.Version(),
+		})
+	}
+}
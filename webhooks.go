@@ -0,0 +1,196 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventSaleCreated        = "sale.created"
+	EventSaleCreationFailed = "sale.creation_failed"
+	EventSaleStarted        = "sale.started"
+	EventSaleSoldOut        = "sale.sold_out"
+	EventSaleCompleted      = "sale.completed"
+	EventSaleCancelled      = "sale.cancelled"
+	EventPurchaseCompleted  = "purchase.completed"
+)
+
+const (
+	// DefaultQueueSize is how many events may wait for delivery before new
+	// ones are dropped
+	DefaultQueueSize = 1000
+
+	// DefaultMaxAttempts bounds delivery attempts per event
+	DefaultMaxAttempts = 5
+
+	// DefaultBaseBackoff is the wait before the first retry; it doubles on
+	// each further attempt
+	DefaultBaseBackoff = 500 * time.Millisecond
+
+	// deliveryWorkers is how many events are delivered in parallel, so one
+	// event stuck in retries doesn't hold up the rest
+	deliveryWorkers = 4
+
+	// SignatureHeader carries the hex HMAC-SHA256 of the request body
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+// Event is the JSON body POSTed to the webhook URL
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Timestamp int64       `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Dispatcher delivers events to a webhook URL in the background. Emit never
+// blocks the caller; events are dropped with a log line when the queue is
+// full. A nil *Dispatcher discards every event, so callers don't need to check
+// whether webhooks are configured.
+type Dispatcher struct {
+	url    string
+	secret []byte
+	client *http.Client
+	queue  chan Event
+
+	// MaxAttempts and BaseBackoff control retries; set them before Start
+	MaxAttempts int
+	BaseBackoff time.Duration
+
+	wg sync.WaitGroup
+}
+
+// NewDispatcher creates a dispatcher that signs each body with secret
+func NewDispatcher(url, secret string) *Dispatcher {
+	return &Dispatcher{
+		url:         url,
+		secret:      []byte(secret),
+		client:      &http.Client{Timeout: 5 * time.Second},
+		queue:       make(chan Event, DefaultQueueSize),
+		MaxAttempts: DefaultMaxAttempts,
+		BaseBackoff: DefaultBaseBackoff,
+	}
+}
+
+// Start runs the delivery workers until ctx is cancelled
+func (d *Dispatcher) Start(ctx context.Context) {
+	for i := 0; i < deliveryWorkers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for {
+				select {
+				case event := <-d.queue:
+					d.deliver(ctx, event)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Wait blocks until the workers have stopped
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// Emit queues an event for delivery
+func (d *Dispatcher) Emit(eventType string, data interface{}) {
+	if d == nil {
+		return
+	}
+
+	id, err := generateEventID()
+	if err != nil {
+		log.Printf("Failed to generate webhook event ID: %v", err)
+		return
+	}
+
+	event := Event{ID: id, Type: eventType, Timestamp: time.Now().Unix(), Data: data}
+	select {
+	case d.queue <- event:
+	default:
+		log.Printf("Webhook queue full, dropping %s event %s", eventType, id)
+	}
+}
+
+// deliver POSTs one event, retrying with exponential backoff
+func (d *Dispatcher) deliver(ctx context.Context, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode webhook event %s: %v", event.ID, err)
+		return
+	}
+	signature := Sign(d.secret, body)
+
+	backoff := d.BaseBackoff
+	for attempt := 1; attempt <= d.MaxAttempts; attempt++ {
+		err = d.post(ctx, body, signature)
+		if err == nil {
+			return
+		}
+
+		if attempt == d.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			log.Printf("Shutting down before delivering webhook event %s: %v", event.ID, err)
+			return
+		}
+	}
+
+	log.Printf("Giving up on webhook event %s (%s) after %d attempts: %v", event.ID, event.Type, d.MaxAttempts, err)
+}
+
+func (d *Dispatcher) post(ctx context.Context, body []byte, signature string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send webhook: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the value of SignatureHeader for body. Receivers recompute it
+// with the shared secret and compare in constant time.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// generateEventID generates a unique event ID receivers can deduplicate on
+func generateEventID() (string, error) {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("evt_%s", hex.EncodeToString(bytes)), nil
+}